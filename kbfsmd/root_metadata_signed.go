@@ -294,3 +294,118 @@ func DecodeRootMetadataSigned(
 	}
 	return &rmds, nil
 }
+
+// RootMetadataHeader holds the fields of an encoded
+// RootMetadataSigned that are needed to order and check revisions,
+// without the potentially large serialized private metadata.
+type RootMetadataHeader struct {
+	Revision Revision
+	PrevRoot ID
+	BID      BranchID
+	Flags    MetadataFlags
+	WFlags   WriterFlags
+}
+
+// MergedStatus returns the unmerged state of the header.
+func (h RootMetadataHeader) MergedStatus() MergeStatus {
+	if h.WFlags&MetadataFlagUnmerged != 0 {
+		return Unmerged
+	}
+	return Merged
+}
+
+// IsFinal returns true if the header is for a finalized revision.
+func (h RootMetadataHeader) IsFinal() bool {
+	return h.Flags&MetadataFlagFinal != 0
+}
+
+// MakeRootMetadataHeader returns the header fields of the already
+// decoded `md`.
+func MakeRootMetadataHeader(md RootMetadata) RootMetadataHeader {
+	switch md := md.(type) {
+	case *RootMetadataV2:
+		return RootMetadataHeader{
+			Revision: md.Revision,
+			PrevRoot: md.PrevRoot,
+			BID:      md.BID(),
+			Flags:    md.Flags,
+			WFlags:   md.WFlags,
+		}
+	case *RootMetadataV3:
+		return RootMetadataHeader{
+			Revision: md.Revision,
+			PrevRoot: md.PrevRoot,
+			BID:      md.BID(),
+			Flags:    md.Flags,
+			WFlags:   md.WriterMetadata.WFlags,
+		}
+	default:
+		panic(fmt.Sprintf("Unexpected root metadata type %T", md))
+	}
+}
+
+// rootMetadataV2Header mirrors the header fields of RootMetadataV2,
+// which embeds its writer metadata.
+type rootMetadataV2Header struct {
+	BID      BranchID
+	WFlags   WriterFlags
+	Flags    MetadataFlags
+	Revision Revision
+	PrevRoot ID
+}
+
+// rootMetadataV3Header mirrors the header fields of RootMetadataV3.
+type rootMetadataV3Header struct {
+	WriterMetadata struct {
+		BID    BranchID
+		WFlags WriterFlags
+	} `codec:"wmd"`
+	Flags    MetadataFlags
+	Revision Revision
+	PrevRoot ID
+}
+
+// DecodeRootMetadataSignedHeader is like DecodeRootMetadataSigned,
+// but only decodes the header fields, without materializing any of
+// the other fields.  Note that the codec still copies byte fields
+// while skipping over them, so for metadata dominated by its
+// serialized private metadata this isn't much cheaper than a full
+// decode; callers that keep their own copy of each header, like
+// MakeRootMetadataHeader makes, avoid decoding altogether.
+func DecodeRootMetadataSignedHeader(
+	codec kbfscodec.Codec, tlf tlf.ID, ver, max MetadataVer, buf []byte) (
+	RootMetadataHeader, error) {
+	// Check the version the same way a full decode would.
+	if _, err := makeMutableRootMetadataForDecode(
+		codec, tlf, ver, max, buf); err != nil {
+		return RootMetadataHeader{}, err
+	}
+	if ver < SegregatedKeyBundlesVer {
+		var rmds struct {
+			MD rootMetadataV2Header
+		}
+		if err := codec.Decode(buf, &rmds); err != nil {
+			return RootMetadataHeader{}, err
+		}
+		return RootMetadataHeader{
+			Revision: rmds.MD.Revision,
+			PrevRoot: rmds.MD.PrevRoot,
+			BID:      rmds.MD.BID,
+			Flags:    rmds.MD.Flags,
+			WFlags:   rmds.MD.WFlags,
+		}, nil
+	}
+	var rmds struct {
+		MD rootMetadataV3Header
+	}
+	if err := codec.Decode(buf, &rmds); err != nil {
+		return RootMetadataHeader{}, err
+	}
+	return RootMetadataHeader{
+		Revision: rmds.MD.Revision,
+		PrevRoot: rmds.MD.PrevRoot,
+		BID:      rmds.MD.WriterMetadata.BID,
+		Flags:    rmds.MD.Flags,
+		WFlags:   rmds.MD.WriterMetadata.WFlags,
+	}, nil
+}
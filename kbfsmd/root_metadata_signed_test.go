@@ -77,3 +77,98 @@ func TestRootMetadataSigned(t *testing.T) {
 	}
 	runTestsOverMetadataVers(t, "testRootMetadataSigned", tests)
 }
+
+func makeRootMetadataSignedForHeaderTest(t require.TestingT, ver MetadataVer,
+	privateDataSize int) (codec kbfscodec.Codec, rmds *RootMetadataSigned) {
+	tlfID := tlf.FakeID(1, tlf.Private)
+
+	uid := keybase1.MakeTestUID(1)
+	bh, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	brmd, err := MakeInitialRootMetadata(ver, tlfID, bh)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	codec = kbfscodec.NewMsgpack()
+	signer := kbfscrypto.SigningKeySigner{
+		Key: kbfscrypto.MakeFakeSigningKeyOrBust("key"),
+	}
+
+	FakeInitialRekey(brmd, bh, kbfscrypto.TLFPublicKey{})
+
+	brmd.SetLastModifyingWriter(uid)
+	brmd.SetLastModifyingUser(uid)
+	brmd.SetRevision(10)
+	brmd.SetPrevRoot(FakeID(1))
+	brmd.SetUnmerged()
+	brmd.SetBranchID(FakeBranchID(1))
+	brmd.SetSerializedPrivateMetadata(make([]byte, privateDataSize))
+	err = brmd.SignWriterMetadataInternally(ctx, codec, signer)
+	require.NoError(t, err)
+
+	rmds, err = SignRootMetadata(ctx, codec, signer, signer, brmd)
+	require.NoError(t, err)
+	return codec, rmds
+}
+
+func testRootMetadataSignedDecodeHeader(t *testing.T, ver MetadataVer) {
+	codec, rmds := makeRootMetadataSignedForHeaderTest(t, ver, 1024)
+	buf, err := EncodeRootMetadataSigned(codec, rmds)
+	require.NoError(t, err)
+
+	header, err := DecodeRootMetadataSignedHeader(
+		codec, rmds.MD.TlfID(), ver, ver, buf)
+	require.NoError(t, err)
+	require.Equal(t, Revision(10), header.Revision)
+	require.Equal(t, FakeID(1), header.PrevRoot)
+	require.Equal(t, FakeBranchID(1), header.BID)
+	require.Equal(t, Unmerged, header.MergedStatus())
+	require.False(t, header.IsFinal())
+	require.Equal(t, MakeRootMetadataHeader(rmds.MD), header)
+
+	_, err = DecodeRootMetadataSignedHeader(
+		codec, rmds.MD.TlfID(), ver, ver-1, buf)
+	require.IsType(t, NewMetadataVersionError{}, err)
+}
+
+func TestRootMetadataSignedHeader(t *testing.T) {
+	tests := []func(*testing.T, MetadataVer){
+		testRootMetadataSignedDecodeHeader,
+	}
+	runTestsOverMetadataVers(t, "testRootMetadataSignedHeader", tests)
+}
+
+func benchmarkRootMetadataSignedDecode(
+	b *testing.B, ver MetadataVer, headerOnly bool) {
+	const privateDataSize = 10 * 1024 * 1024
+	codec, rmds := makeRootMetadataSignedForHeaderTest(b, ver, privateDataSize)
+	buf, err := EncodeRootMetadataSigned(codec, rmds)
+	require.NoError(b, err)
+	tlfID := rmds.MD.TlfID()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if headerOnly {
+			_, err = DecodeRootMetadataSignedHeader(codec, tlfID, ver, ver, buf)
+		} else {
+			_, err = DecodeRootMetadataSigned(codec, tlfID, ver, ver, buf)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRootMetadataSignedDecodeHeader(b *testing.B) {
+	runBenchmarkOverMetadataVers(b, func(b *testing.B, ver MetadataVer) {
+		benchmarkRootMetadataSignedDecode(b, ver, true)
+	})
+}
+
+func BenchmarkRootMetadataSignedDecodeFull(b *testing.B) {
+	runBenchmarkOverMetadataVers(b, func(b *testing.B, ver MetadataVer) {
+		benchmarkRootMetadataSignedDecode(b, ver, false)
+	})
+}
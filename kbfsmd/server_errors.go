@@ -60,6 +60,12 @@ const (
 	// should ask service to create an implicit team for the give handle, and
 	// use the i-team backed TLF.
 	StatusCodeServerErrorClassicTLFDoesNotExist = 2814
+	// StatusCodeServerErrorTooManyUnmergedRevisions is the error code
+	// returned by a MD write operation to indicate that the client's
+	// unmerged branch has grown past the server's limit, and the
+	// client should resolve its conflicts before writing more
+	// unmerged revisions.
+	StatusCodeServerErrorTooManyUnmergedRevisions = 2815
 )
 
 // ServerError is a generic server-side error.
@@ -383,6 +389,34 @@ func (e ServerErrorClassicTLFDoesNotExist) ToStatus() (s keybase1.Status) {
 	return
 }
 
+// ServerErrorTooManyUnmergedRevisions is the error type for
+// StatusCodeServerErrorTooManyUnmergedRevisions.
+type ServerErrorTooManyUnmergedRevisions struct {
+	Count uint64
+	Limit uint64
+}
+
+// Error implements the Error interface for
+// ServerErrorTooManyUnmergedRevisions.
+func (e ServerErrorTooManyUnmergedRevisions) Error() string {
+	return fmt.Sprintf("Too many unmerged revisions. Count: %d, limit: %d",
+		e.Count, e.Limit)
+}
+
+// ToStatus implements the ExportableError interface for
+// ServerErrorTooManyUnmergedRevisions.
+func (e ServerErrorTooManyUnmergedRevisions) ToStatus() (
+	s keybase1.Status) {
+	s.Code = StatusCodeServerErrorTooManyUnmergedRevisions
+	s.Name = "TOO_MANY_UNMERGED_REVISIONS"
+	s.Desc = e.Error()
+	s.Fields = []keybase1.StringKVPair{
+		{Key: "Limit", Value: strconv.FormatUint(e.Limit, 10)},
+		{Key: "Count", Value: strconv.FormatUint(e.Count, 10)},
+	}
+	return
+}
+
 // ServerErrorUnwrapper is an implementation of rpc.ErrorUnwrapper
 // for errors coming from the MDServer.
 type ServerErrorUnwrapper struct{}
@@ -483,6 +517,18 @@ func (eu ServerErrorUnwrapper) UnwrapError(arg interface{}) (appError error, dis
 	case StatusCodeServerErrorClassicTLFDoesNotExist:
 		appError = ServerErrorClassicTLFDoesNotExist{}
 		break
+	case StatusCodeServerErrorTooManyUnmergedRevisions:
+		err := ServerErrorTooManyUnmergedRevisions{}
+		for _, f := range s.Fields {
+			switch f.Key {
+			case "Limit":
+				err.Limit, _ = strconv.ParseUint(f.Value, 10, 64)
+			case "Count":
+				err.Count, _ = strconv.ParseUint(f.Value, 10, 64)
+			}
+		}
+		appError = err
+		break
 	default:
 		ase := libkb.AppStatusError{
 			Code:   s.Code,
@@ -6,6 +6,7 @@ package kbfssync
 
 import (
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -66,6 +67,23 @@ func (rwg *RepeatedWaitGroup) Wait(ctx context.Context) error {
 	}
 }
 
+// WaitWithTimeout works like Wait, except instead of a context it
+// takes a duration, and returns `context.DeadlineExceeded` if the
+// task count hasn't gone to 0 by the time it elapses.
+func (rwg *RepeatedWaitGroup) WaitWithTimeout(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return rwg.Wait(ctx)
+}
+
+// OutstandingCount returns the number of tasks that have begun but
+// not yet completed, without blocking.
+func (rwg *RepeatedWaitGroup) OutstandingCount() int {
+	rwg.lock.Lock()
+	defer rwg.lock.Unlock()
+	return rwg.num
+}
+
 // WaitUnlessPaused works like Wait, except it can return early if the
 // wait group is paused.  It returns whether it was paused with
 // outstanding work still left in the group.
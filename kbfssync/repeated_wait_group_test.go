@@ -7,6 +7,7 @@ package kbfssync
 import (
 	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -70,3 +71,43 @@ func TestRepeatedWaitGroupMultiWait(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestRepeatedWaitGroupOutstandingCount(t *testing.T) {
+	var rwg RepeatedWaitGroup
+	if n := rwg.OutstandingCount(); n != 0 {
+		t.Fatalf("Unexpected initial count: %d", n)
+	}
+	rwg.Add(3)
+	if n := rwg.OutstandingCount(); n != 3 {
+		t.Fatalf("Unexpected count after add: %d", n)
+	}
+	rwg.Done()
+	if n := rwg.OutstandingCount(); n != 2 {
+		t.Fatalf("Unexpected count after done: %d", n)
+	}
+	rwg.Add(-2)
+	if n := rwg.OutstandingCount(); n != 0 {
+		t.Fatalf("Unexpected final count: %d", n)
+	}
+}
+
+func TestRepeatedWaitGroupWaitWithTimeout(t *testing.T) {
+	var rwg RepeatedWaitGroup
+	// Nothing outstanding, so this shouldn't wait at all.
+	err := rwg.WaitWithTimeout(0)
+	if err != nil {
+		t.Fatalf("Error on idle wait: %v", err)
+	}
+
+	rwg.Add(1)
+	err = rwg.WaitWithTimeout(10 * time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error on timed-out wait: %v", err)
+	}
+
+	go rwg.Done()
+	err = rwg.WaitWithTimeout(10 * time.Second)
+	if err != nil {
+		t.Fatalf("Error on wait: %v", err)
+	}
+}
@@ -21,6 +21,13 @@ type blockContainer struct {
 	prefetchStatus PrefetchStatus
 }
 
+// pinnedBlock is a block protected from eviction by `count`
+// outstanding calls to BlockCacheStandard.Pin.
+type pinnedBlock struct {
+	blockContainer
+	count int
+}
+
 type idCacheKey struct {
 	tlf           tlf.ID
 	plaintextHash kbfshash.RawDefaultHash
@@ -32,6 +39,7 @@ type idCacheKey struct {
 // content-addressable).
 type BlockCacheStandard struct {
 	cleanBytesCapacity uint64
+	transientCapacity  int
 
 	ids *lru.Cache
 
@@ -42,6 +50,14 @@ type BlockCacheStandard struct {
 
 	bytesLock       sync.Mutex
 	cleanTotalBytes uint64
+
+	// pinned holds the blocks that must stay readable even if the
+	// transient cache evicts them.  Each pinned block counts toward
+	// cleanTotalBytes on its own, even while a copy is still in the
+	// transient or permanent cache, so pins can't be used to grow the
+	// cache past its capacity unnoticed.
+	pinLock sync.Mutex
+	pinned  map[kbfsblock.ID]*pinnedBlock
 }
 
 // NewBlockCacheStandard constructs a new BlockCacheStandard instance
@@ -54,7 +70,9 @@ func NewBlockCacheStandard(transientCapacity int,
 	cleanBytesCapacity uint64) *BlockCacheStandard {
 	b := &BlockCacheStandard{
 		cleanBytesCapacity: cleanBytesCapacity,
+		transientCapacity:  transientCapacity,
 		cleanPermanent:     make(map[kbfsblock.ID]Block),
+		pinned:             make(map[kbfsblock.ID]*pinnedBlock),
 	}
 
 	if transientCapacity > 0 {
@@ -75,6 +93,21 @@ func NewBlockCacheStandard(transientCapacity int,
 
 // GetWithPrefetch implements the BlockCache interface for BlockCacheStandard.
 func (b *BlockCacheStandard) GetWithPrefetch(ptr BlockPointer) (
+	Block, PrefetchStatus, BlockCacheLifetime, error) {
+	block, prefetchStatus, lifetime, err := b.getUnpinned(ptr)
+	if err == nil {
+		return block, prefetchStatus, lifetime, nil
+	}
+
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+	if pb, ok := b.pinned[ptr.ID]; ok {
+		return pb.block, pb.prefetchStatus, TransientEntry, nil
+	}
+	return nil, NoPrefetch, NoCacheEntry, err
+}
+
+func (b *BlockCacheStandard) getUnpinned(ptr BlockPointer) (
 	Block, PrefetchStatus, BlockCacheLifetime, error) {
 	if b.cleanTransient != nil {
 		if tmp, ok := b.cleanTransient.Get(ptr.ID); ok {
@@ -108,6 +141,64 @@ func (b *BlockCacheStandard) Get(ptr BlockPointer) (Block, error) {
 	return block, err
 }
 
+// Pin implements the BlockCache interface for BlockCacheStandard.
+func (b *BlockCacheStandard) Pin(ptr BlockPointer) bool {
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+	if pb, ok := b.pinned[ptr.ID]; ok {
+		pb.count++
+		return true
+	}
+
+	block, prefetchStatus, _, err := b.getUnpinned(ptr)
+	if err != nil {
+		return false
+	}
+	b.pinned[ptr.ID] = &pinnedBlock{
+		blockContainer{block, prefetchStatus}, 1}
+	size := uint64(getCachedBlockSize(block))
+	b.bytesLock.Lock()
+	defer b.bytesLock.Unlock()
+	b.cleanTotalBytes += size
+	return true
+}
+
+// Unpin implements the BlockCache interface for BlockCacheStandard.
+func (b *BlockCacheStandard) Unpin(ptr BlockPointer) {
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+	pb, ok := b.pinned[ptr.ID]
+	if !ok {
+		return
+	}
+	pb.count--
+	if pb.count <= 0 {
+		delete(b.pinned, ptr.ID)
+		b.subtractBlockBytes(pb.block)
+	}
+}
+
+// dropPinned forgets any pins for the given block ID, regardless of
+// how many are outstanding, and releases the bytes they were holding.
+// Later calls to Unpin for this ID are no-ops.
+func (b *BlockCacheStandard) dropPinned(id kbfsblock.ID) {
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+	pb, ok := b.pinned[id]
+	if !ok {
+		return
+	}
+	delete(b.pinned, id)
+	b.subtractBlockBytes(pb.block)
+}
+
+// numPinned returns the number of distinct blocks that are pinned.
+func (b *BlockCacheStandard) numPinned() int {
+	b.pinLock.Lock()
+	defer b.pinLock.Unlock()
+	return len(b.pinned)
+}
+
 func getCachedBlockSize(block Block) uint32 {
 	// Get the size of the block.  For direct file blocks, use the
 	// length of the plaintext contents.  For everything else, just
@@ -168,6 +259,37 @@ func (b *BlockCacheStandard) CheckForKnownPtr(tlf tlf.ID, block *FileBlock) (
 	return ptr, nil
 }
 
+// CheckForKnownPtrs implements the BlockCache interface for
+// BlockCacheStandard.
+func (b *BlockCacheStandard) CheckForKnownPtrs(
+	tlf tlf.ID, blocks []*FileBlock) (map[*FileBlock]BlockPointer, error) {
+	for _, block := range blocks {
+		if block.IsInd {
+			return nil, NotDirectFileBlockError{}
+		}
+	}
+
+	ptrs := make(map[*FileBlock]BlockPointer)
+	if b.ids == nil {
+		return ptrs, nil
+	}
+
+	for _, block := range blocks {
+		key := idCacheKey{tlf, block.GetHash()}
+		tmp, ok := b.ids.Get(key)
+		if !ok {
+			continue
+		}
+
+		ptr, ok := tmp.(BlockPointer)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected cached id: %v", tmp)
+		}
+		ptrs[block] = ptr
+	}
+	return ptrs, nil
+}
+
 // SetCleanBytesCapacity implements the BlockCache interface for
 // BlockCacheStandard.
 func (b *BlockCacheStandard) SetCleanBytesCapacity(capacity uint64) {
@@ -180,6 +302,19 @@ func (b *BlockCacheStandard) GetCleanBytesCapacity() (capacity uint64) {
 	return atomic.LoadUint64(&b.cleanBytesCapacity)
 }
 
+// HasRoomForTransient implements the BlockCache interface for
+// BlockCacheStandard.
+func (b *BlockCacheStandard) HasRoomForTransient(block Block) bool {
+	if b.cleanTransient == nil ||
+		b.cleanTransient.Len() >= b.transientCapacity {
+		return false
+	}
+	size := uint64(getCachedBlockSize(block))
+	b.bytesLock.Lock()
+	defer b.bytesLock.Unlock()
+	return b.cleanTotalBytes+size <= b.GetCleanBytesCapacity()
+}
+
 func (b *BlockCacheStandard) makeRoomForSize(size uint64, lifetime BlockCacheLifetime) bool {
 	if b.cleanTransient == nil {
 		return false
@@ -336,6 +471,10 @@ func (b *BlockCacheStandard) Put(
 // DeletePermanent implements the BlockCache interface for
 // BlockCacheStandard.
 func (b *BlockCacheStandard) DeletePermanent(id kbfsblock.ID) error {
+	// Drop the pins before taking `cleanLock`, since `Pin` reads the
+	// permanent cache while holding `pinLock`.
+	b.dropPinned(id)
+
 	b.cleanLock.Lock()
 	defer b.cleanLock.Unlock()
 	block, ok := b.cleanPermanent[id]
@@ -349,6 +488,7 @@ func (b *BlockCacheStandard) DeletePermanent(id kbfsblock.ID) error {
 // DeleteTransient implements the BlockCache interface for BlockCacheStandard.
 func (b *BlockCacheStandard) DeleteTransient(
 	ptr BlockPointer, tlf tlf.ID) error {
+	b.dropPinned(ptr.ID)
 	if b.cleanTransient == nil {
 		return nil
 	}
@@ -378,3 +378,95 @@ func TestBlockCacheDoublePut(t *testing.T) {
 	testBcachePutWithBlock(t, id2, cache, TransientEntry, block)
 	require.Equal(t, bytes, cache.cleanTotalBytes)
 }
+
+func TestBlockCacheCheckPtrsBatch(t *testing.T) {
+	ctx := context.Background()
+	config := blockCacheTestInit(t, 100, 1<<30)
+	defer CheckConfigAndShutdown(ctx, t, config)
+	bcache := config.BlockCache()
+	tlf := tlf.FakeID(1, tlf.Private)
+
+	block := NewFileBlock().(*FileBlock)
+	block.Contents = []byte{1, 2, 3, 4}
+	ptr := BlockPointer{ID: kbfsblock.FakeID(1)}
+	err := bcache.Put(ptr, tlf, block, TransientEntry)
+	require.NoError(t, err)
+
+	// Several duplicates of the known block, plus one unknown block.
+	var blocks []*FileBlock
+	for i := 0; i < 3; i++ {
+		dup := NewFileBlock().(*FileBlock)
+		dup.Contents = []byte{1, 2, 3, 4}
+		blocks = append(blocks, dup)
+	}
+	unknown := NewFileBlock().(*FileBlock)
+	unknown.Contents = []byte{4, 3, 2, 1}
+	blocks = append(blocks, unknown)
+
+	checkedPtrs, err := bcache.CheckForKnownPtrs(tlf, blocks)
+	require.NoError(t, err)
+	require.Len(t, checkedPtrs, 3)
+	for _, dup := range blocks[:3] {
+		require.Equal(t, ptr, checkedPtrs[dup])
+	}
+	_, ok := checkedPtrs[unknown]
+	require.False(t, ok)
+
+	// Indirect blocks aren't allowed.
+	ind := NewFileBlock().(*FileBlock)
+	ind.IsInd = true
+	_, err = bcache.CheckForKnownPtrs(tlf, append(blocks, ind))
+	require.IsType(t, NotDirectFileBlockError{}, err)
+}
+
+func TestBlockCachePinnedBytes(t *testing.T) {
+	ctx := context.Background()
+	config := blockCacheTestInit(t, 1, 1<<30)
+	defer CheckConfigAndShutdown(ctx, t, config)
+	cache := config.BlockCache().(*BlockCacheStandard)
+	id1 := kbfsblock.FakeID(1)
+	ptr1 := BlockPointer{ID: id1}
+	block := makeFakeFileBlock(t, false)
+	bytes := uint64(len(block.Contents))
+
+	t.Log("A pinned block counts toward the byte usage on its own.")
+	testBcachePutWithBlock(t, id1, cache, TransientEntry, block)
+	require.True(t, cache.Pin(ptr1))
+	require.True(t, cache.Pin(ptr1))
+	require.Equal(t, 2*bytes, cache.cleanTotalBytes)
+
+	t.Log("It keeps counting after the transient copy is evicted.")
+	block2 := NewFileBlock().(*FileBlock)
+	block2.Contents = []byte{1, 2, 3, 4, 5}
+	bytes2 := uint64(len(block2.Contents))
+	testBcachePutWithBlock(
+		t, kbfsblock.FakeID(2), cache, TransientEntry, block2)
+	require.Equal(t, bytes+bytes2, cache.cleanTotalBytes)
+	_, err := cache.Get(ptr1)
+	require.NoError(t, err)
+
+	t.Log("Releasing one of two pins keeps the block.")
+	cache.Unpin(ptr1)
+	require.Equal(t, bytes+bytes2, cache.cleanTotalBytes)
+	require.Equal(t, 1, cache.numPinned())
+
+	t.Log("Deleting the block drops its remaining pin and its bytes.")
+	err = cache.DeleteTransient(ptr1, tlf.FakeID(1, tlf.Private))
+	require.NoError(t, err)
+	require.Equal(t, 0, cache.numPinned())
+	require.Equal(t, bytes2, cache.cleanTotalBytes)
+	_, err = cache.Get(ptr1)
+	require.IsType(t, NoSuchBlockError{}, err)
+	cache.Unpin(ptr1)
+	require.Equal(t, bytes2, cache.cleanTotalBytes)
+
+	t.Log("DeletePermanent drops pins as well.")
+	ptr3 := BlockPointer{ID: kbfsblock.FakeID(3)}
+	testBcachePutWithBlock(
+		t, ptr3.ID, cache, PermanentEntry, makeFakeFileBlock(t, false))
+	require.True(t, cache.Pin(ptr3))
+	err = cache.DeletePermanent(ptr3.ID)
+	require.NoError(t, err)
+	require.Equal(t, 0, cache.numPinned())
+	require.Equal(t, bytes2, cache.cleanTotalBytes)
+}
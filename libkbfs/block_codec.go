@@ -0,0 +1,188 @@
+// Copyright 2026 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"encoding/binary"
+
+	"github.com/golang/snappy"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/pkg/errors"
+)
+
+// BlockCodec encodes blocks into the plaintext that gets padded and
+// encrypted before being put to the block server, and decodes them
+// again after they're fetched and decrypted.  By default blocks are
+// encoded with the config's codec (msgpack) by the crypto layer; a
+// folder can use a BlockCodec to store some of its blocks in another
+// format (see BlockOps.SetBlockCodec).
+type BlockCodec interface {
+	// Encode encodes the given block.  It also returns the data
+	// version that pointers to the encoded block must have at
+	// least, so that readers know to decode it with this codec,
+	// or FirstValidDataVer if the encoding needs nothing special.
+	Encode(block Block) (buf []byte, dataVer DataVer, err error)
+	// Decode decodes the given buffer, as returned by Encode, into
+	// the given block.
+	Decode(buf []byte, block Block) error
+}
+
+// rawFileBlockContentsPrefixSize is the size of the length prefix of
+// a direct file block encoded by RawFileBlockCodec.
+const rawFileBlockContentsPrefixSize = 8
+
+// RawFileBlockCodec stores the contents of direct file blocks as a
+// big-endian uint64 length followed by the raw bytes, so that they
+// can be read by tools that don't speak msgpack.  All other blocks
+// are encoded with the given codec as usual.
+type RawFileBlockCodec struct {
+	Codec kbfscodec.Codec
+}
+
+var _ BlockCodec = RawFileBlockCodec{}
+
+// Encode implements the BlockCodec interface for RawFileBlockCodec.
+func (c RawFileBlockCodec) Encode(block Block) (
+	buf []byte, dataVer DataVer, err error) {
+	fblock, ok := block.(*FileBlock)
+	if !ok || fblock.IsInd {
+		buf, err = c.Codec.Encode(block)
+		if err != nil {
+			return nil, 0, err
+		}
+		return buf, FirstValidDataVer, nil
+	}
+
+	buf = make([]byte, rawFileBlockContentsPrefixSize+len(fblock.Contents))
+	binary.BigEndian.PutUint64(buf, uint64(len(fblock.Contents)))
+	copy(buf[rawFileBlockContentsPrefixSize:], fblock.Contents)
+	return buf, RawFileBlockContentsDataVer, nil
+}
+
+// Decode implements the BlockCodec interface for RawFileBlockCodec.
+// It only decodes direct file blocks; everything else is decoded by
+// the crypto layer.
+func (c RawFileBlockCodec) Decode(buf []byte, block Block) error {
+	fblock, ok := block.(*FileBlock)
+	if !ok {
+		return errors.WithStack(BlockDecodeError{errors.Errorf(
+			"Can't decode raw file contents into a %T", block)})
+	}
+	if len(buf) < rawFileBlockContentsPrefixSize {
+		return errors.WithStack(BlockDecodeError{errors.Errorf(
+			"Raw file block of %d bytes is too short", len(buf))})
+	}
+	size := binary.BigEndian.Uint64(buf)
+	contents := buf[rawFileBlockContentsPrefixSize:]
+	if size != uint64(len(contents)) {
+		return errors.WithStack(BlockDecodeError{errors.Errorf(
+			"Raw file block has %d bytes of contents, expected %d",
+			len(contents), size)})
+	}
+
+	fblock.IsInd = false
+	fblock.IPtrs = nil
+	fblock.Contents = append([]byte(nil), contents...)
+	fblock.hash = nil
+	return nil
+}
+
+// The first byte of a direct file block encoded by
+// CompressedFileBlockCodec says how the rest of it is stored.
+const (
+	compressedFileBlockUncompressed byte = 0
+	compressedFileBlockSnappy       byte = 1
+)
+
+// CompressedFileBlockCodec compresses the contents of direct file
+// blocks with snappy before they're encrypted, so that compressible
+// data (like text or logs) takes up less space on the block server.
+// Contents that don't get any smaller are stored uncompressed, and a
+// flag byte in front of the contents says which is the case.  All
+// other blocks are encoded with the given codec as usual.
+type CompressedFileBlockCodec struct {
+	Codec kbfscodec.Codec
+}
+
+var _ BlockCodec = CompressedFileBlockCodec{}
+
+// Encode implements the BlockCodec interface for
+// CompressedFileBlockCodec.
+func (c CompressedFileBlockCodec) Encode(block Block) (
+	buf []byte, dataVer DataVer, err error) {
+	fblock, ok := block.(*FileBlock)
+	if !ok || fblock.IsInd {
+		buf, err = c.Codec.Encode(block)
+		if err != nil {
+			return nil, 0, err
+		}
+		return buf, FirstValidDataVer, nil
+	}
+
+	compressed := snappy.Encode(nil, fblock.Contents)
+	if len(compressed) < len(fblock.Contents) {
+		buf = make([]byte, 1+len(compressed))
+		buf[0] = compressedFileBlockSnappy
+		copy(buf[1:], compressed)
+	} else {
+		buf = make([]byte, 1+len(fblock.Contents))
+		buf[0] = compressedFileBlockUncompressed
+		copy(buf[1:], fblock.Contents)
+	}
+	return buf, CompressedFileBlockContentsDataVer, nil
+}
+
+// Decode implements the BlockCodec interface for
+// CompressedFileBlockCodec.  It only decodes direct file blocks;
+// everything else is decoded by the crypto layer.
+func (c CompressedFileBlockCodec) Decode(buf []byte, block Block) error {
+	fblock, ok := block.(*FileBlock)
+	if !ok {
+		return errors.WithStack(BlockDecodeError{errors.Errorf(
+			"Can't decode compressed file contents into a %T", block)})
+	}
+	if len(buf) < 1 {
+		return errors.WithStack(BlockDecodeError{errors.New(
+			"Compressed file block is missing its flag")})
+	}
+
+	var contents []byte
+	switch buf[0] {
+	case compressedFileBlockUncompressed:
+		contents = append([]byte(nil), buf[1:]...)
+	case compressedFileBlockSnappy:
+		var err error
+		contents, err = snappy.Decode(nil, buf[1:])
+		if err != nil {
+			return errors.WithStack(BlockDecodeError{err})
+		}
+	default:
+		return errors.WithStack(BlockDecodeError{errors.Errorf(
+			"Unknown compressed file block flag %d", buf[0])})
+	}
+
+	fblock.IsInd = false
+	fblock.IPtrs = nil
+	fblock.Contents = contents
+	fblock.hash = nil
+	return nil
+}
+
+// blockCodecForPointer returns the BlockCodec needed to decode the
+// block with the given pointer, or nil if the block should be
+// decoded by the crypto layer.
+func blockCodecForPointer(
+	codec kbfscodec.Codec, ptr BlockPointer) BlockCodec {
+	if ptr.DirectType != DirectBlock {
+		return nil
+	}
+	switch ptr.DataVer {
+	case RawFileBlockContentsDataVer:
+		return RawFileBlockCodec{codec}
+	case CompressedFileBlockContentsDataVer:
+		return CompressedFileBlockCodec{codec}
+	}
+	return nil
+}
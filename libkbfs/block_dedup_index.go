@@ -0,0 +1,192 @@
+// Copyright 2026 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfshash"
+	"github.com/keybase/kbfs/tlf"
+)
+
+// BlockDedupIndexMemory is a simple, unbounded in-memory
+// implementation of BlockDedupIndex.
+type BlockDedupIndexMemory struct {
+	lock   sync.RWMutex
+	ptrs   map[idCacheKey]BlockPointer
+	hashes map[dedupIndexIDKey]kbfshash.RawDefaultHash
+}
+
+type dedupIndexIDKey struct {
+	tlf tlf.ID
+	id  kbfsblock.ID
+}
+
+var _ BlockDedupIndex = (*BlockDedupIndexMemory)(nil)
+
+// NewBlockDedupIndexMemory constructs a new, empty
+// BlockDedupIndexMemory.
+func NewBlockDedupIndexMemory() *BlockDedupIndexMemory {
+	return &BlockDedupIndexMemory{
+		ptrs:   make(map[idCacheKey]BlockPointer),
+		hashes: make(map[dedupIndexIDKey]kbfshash.RawDefaultHash),
+	}
+}
+
+// Lookup implements the BlockDedupIndex interface for
+// BlockDedupIndexMemory.
+func (b *BlockDedupIndexMemory) Lookup(
+	tlfID tlf.ID, contentHash kbfshash.RawDefaultHash) (BlockPointer, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	ptr, ok := b.ptrs[idCacheKey{tlfID, contentHash}]
+	return ptr, ok
+}
+
+// Record implements the BlockDedupIndex interface for
+// BlockDedupIndexMemory.
+func (b *BlockDedupIndexMemory) Record(
+	tlfID tlf.ID, contentHash kbfshash.RawDefaultHash, ptr BlockPointer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	key := idCacheKey{tlfID, contentHash}
+	if old, ok := b.ptrs[key]; ok {
+		delete(b.hashes, dedupIndexIDKey{tlfID, old.ID})
+	}
+	b.ptrs[key] = ptr
+	b.hashes[dedupIndexIDKey{tlfID, ptr.ID}] = contentHash
+}
+
+// Forget implements the BlockDedupIndex interface for
+// BlockDedupIndexMemory.
+func (b *BlockDedupIndexMemory) Forget(
+	tlfID tlf.ID, contentHash kbfshash.RawDefaultHash) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	key := idCacheKey{tlfID, contentHash}
+	if ptr, ok := b.ptrs[key]; ok {
+		delete(b.hashes, dedupIndexIDKey{tlfID, ptr.ID})
+		delete(b.ptrs, key)
+	}
+}
+
+// ForgetID implements the BlockDedupIndex interface for
+// BlockDedupIndexMemory.
+func (b *BlockDedupIndexMemory) ForgetID(tlfID tlf.ID, id kbfsblock.ID) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	idKey := dedupIndexIDKey{tlfID, id}
+	if contentHash, ok := b.hashes[idKey]; ok {
+		delete(b.ptrs, idCacheKey{tlfID, contentHash})
+		delete(b.hashes, idKey)
+	}
+}
+
+// dedupIndexBlockCache is a BlockCache that also consults and
+// maintains a BlockDedupIndex when checking for known pointers, so
+// that dedup keeps working for blocks evicted from the cache.
+type dedupIndexBlockCache struct {
+	index BlockDedupIndex
+	BlockCache
+}
+
+var _ BlockCache = dedupIndexBlockCache{}
+
+// NewBlockCacheWithDedupIndex returns a BlockCache that behaves like
+// `bcache`, except that it falls back to `index` when checking for
+// known pointers, and records any transient direct file blocks in
+// `index`.  If `index` is nil, `bcache` is returned as-is.
+func NewBlockCacheWithDedupIndex(
+	bcache BlockCache, index BlockDedupIndex) BlockCache {
+	if index == nil {
+		return bcache
+	}
+	return dedupIndexBlockCache{index, bcache}
+}
+
+func (d dedupIndexBlockCache) recordIfDirectFileBlock(
+	ptr BlockPointer, tlfID tlf.ID, block Block,
+	lifetime BlockCacheLifetime) {
+	if lifetime != TransientEntry {
+		return
+	}
+	fBlock, ok := block.(*FileBlock)
+	if !ok || fBlock.IsInd {
+		return
+	}
+	// The ref nonce doesn't matter, just like for the cache's own
+	// known pointers.
+	ptr.RefNonce = kbfsblock.ZeroRefNonce
+	d.index.Record(tlfID, fBlock.GetHash(), ptr)
+}
+
+// Put implements the BlockCache interface for dedupIndexBlockCache.
+func (d dedupIndexBlockCache) Put(ptr BlockPointer, tlfID tlf.ID,
+	block Block, lifetime BlockCacheLifetime) error {
+	err := d.BlockCache.Put(ptr, tlfID, block, lifetime)
+	if err != nil {
+		return err
+	}
+	d.recordIfDirectFileBlock(ptr, tlfID, block, lifetime)
+	return nil
+}
+
+// PutWithPrefetch implements the BlockCache interface for
+// dedupIndexBlockCache.
+func (d dedupIndexBlockCache) PutWithPrefetch(ptr BlockPointer,
+	tlfID tlf.ID, block Block, lifetime BlockCacheLifetime,
+	prefetchStatus PrefetchStatus) error {
+	err := d.BlockCache.PutWithPrefetch(
+		ptr, tlfID, block, lifetime, prefetchStatus)
+	if err != nil {
+		return err
+	}
+	d.recordIfDirectFileBlock(ptr, tlfID, block, lifetime)
+	return nil
+}
+
+// CheckForKnownPtr implements the BlockCache interface for
+// dedupIndexBlockCache.
+func (d dedupIndexBlockCache) CheckForKnownPtr(
+	tlfID tlf.ID, block *FileBlock) (BlockPointer, error) {
+	ptr, err := d.BlockCache.CheckForKnownPtr(tlfID, block)
+	if err != nil || ptr.IsInitialized() {
+		return ptr, err
+	}
+	ptr, _ = d.index.Lookup(tlfID, block.GetHash())
+	return ptr, nil
+}
+
+// CheckForKnownPtrs implements the BlockCache interface for
+// dedupIndexBlockCache.
+func (d dedupIndexBlockCache) CheckForKnownPtrs(
+	tlfID tlf.ID, blocks []*FileBlock) (map[*FileBlock]BlockPointer, error) {
+	ptrs, err := d.BlockCache.CheckForKnownPtrs(tlfID, blocks)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range blocks {
+		if _, ok := ptrs[block]; ok {
+			continue
+		}
+		if ptr, ok := d.index.Lookup(tlfID, block.GetHash()); ok {
+			ptrs[block] = ptr
+		}
+	}
+	return ptrs, nil
+}
+
+// DeleteKnownPtr implements the BlockCache interface for
+// dedupIndexBlockCache.
+func (d dedupIndexBlockCache) DeleteKnownPtr(
+	tlfID tlf.ID, block *FileBlock) error {
+	err := d.BlockCache.DeleteKnownPtr(tlfID, block)
+	if err != nil {
+		return err
+	}
+	d.index.Forget(tlfID, block.GetHash())
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2026 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestBlockCacheWithDedupIndexNil(t *testing.T) {
+	bcache := NewBlockCacheStandard(10, 1<<20)
+	require.Equal(t, BlockCache(bcache),
+		NewBlockCacheWithDedupIndex(bcache, nil))
+}
+
+// Test that ReadyBlock dedups against a block that has been evicted
+// from the cache, as long as the index still knows about it.
+func TestReadyBlockDedupIndexAfterEviction(t *testing.T) {
+	config := makeTestBlockOpsConfig(t)
+	bops := NewBlockOpsStandard(config, testBlockRetrievalWorkerQueueSize,
+		testPrefetchWorkerQueueSize)
+	defer bops.Shutdown()
+
+	tlfID := tlf.FakeID(1, tlf.Private)
+	kmd := makeFakeKeyMetadata(tlfID, kbfsmd.FirstValidKeyGen)
+	crypto := MakeCryptoCommon(kbfscodec.NewMsgpack())
+	uid := keybase1.MakeTestUID(1).AsUserOrTeam()
+	ctx := context.Background()
+
+	// Only room for one known pointer in the cache itself.
+	bcache := NewBlockCacheStandard(1, 1<<20)
+	index := NewBlockDedupIndexMemory()
+	dedupCache := NewBlockCacheWithDedupIndex(bcache, index)
+
+	block := &FileBlock{Contents: []byte{1, 2, 3, 4, 5}}
+	origInfo, _, _, err := ReadyBlock(
+		ctx, dedupCache, bops, crypto, kmd, block, uid,
+		keybase1.BlockType_DATA)
+	require.NoError(t, err)
+	err = dedupCache.Put(origInfo.BlockPointer, tlfID, block, TransientEntry)
+	require.NoError(t, err)
+
+	// Simulate an eviction by caching a different block.
+	other := &FileBlock{Contents: []byte{6, 7, 8}}
+	otherInfo, _, _, err := ReadyBlock(
+		ctx, dedupCache, bops, crypto, kmd, other, uid,
+		keybase1.BlockType_DATA)
+	require.NoError(t, err)
+	err = dedupCache.Put(otherInfo.BlockPointer, tlfID, other, TransientEntry)
+	require.NoError(t, err)
+
+	dup := &FileBlock{Contents: []byte{1, 2, 3, 4, 5}}
+	ptr, err := bcache.CheckForKnownPtr(tlfID, dup)
+	require.NoError(t, err)
+	require.False(t, ptr.IsInitialized())
+
+	// The index still knows about the original block.
+	dupInfo, _, _, err := ReadyBlock(
+		ctx, dedupCache, bops, crypto, kmd, dup, uid,
+		keybase1.BlockType_DATA)
+	require.NoError(t, err)
+	require.Equal(t, origInfo.ID, dupInfo.ID)
+	require.NotEqual(t, kbfsblock.ZeroRefNonce, dupInfo.RefNonce)
+
+	ptrs, err := dedupCache.CheckForKnownPtrs(
+		tlfID, []*FileBlock{dup, other})
+	require.NoError(t, err)
+	require.Equal(t, origInfo.ID, ptrs[dup].ID)
+	require.Equal(t, otherInfo.ID, ptrs[other].ID)
+
+	// Without the index, the duplicate gets a brand new block.
+	noIndexInfo, _, _, err := ReadyBlock(
+		ctx, bcache, bops, crypto, kmd, dup, uid,
+		keybase1.BlockType_DATA)
+	require.NoError(t, err)
+	require.NotEqual(t, origInfo.ID, noIndexInfo.ID)
+
+	// Once the known pointer is deleted, the index forgets it too.
+	err = dedupCache.DeleteKnownPtr(tlfID, dup)
+	require.NoError(t, err)
+	ptr, err = dedupCache.CheckForKnownPtr(tlfID, dup)
+	require.NoError(t, err)
+	require.False(t, ptr.IsInitialized())
+}
+
+// Test that an index set on the Config is used for synced blocks,
+// and forgets them once quota reclamation deletes their last
+// reference.
+func TestBlockDedupIndexForgetsReclaimedBlocks(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	index := NewBlockDedupIndexMemory()
+	config.SetBlockDedupIndex(index)
+	require.Equal(t, BlockDedupIndex(index), config.BlockDedupIndex())
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	kbfsOps := config.KBFSOps()
+	data := []byte{1, 2, 3, 4, 5}
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Syncing the file records its block in the index.")
+	hash := (&FileBlock{Contents: data}).GetHash()
+	ptr, ok := index.Lookup(tlfID, hash)
+	require.True(t, ok)
+
+	t.Log("A second file with the same contents references the same block.")
+	fileNode2, _, err := kbfsOps.CreateFile(ctx, rootNode, "c", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode2, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	reclaim := func(name, dirName string) {
+		err := kbfsOps.RemoveEntry(ctx, rootNode, name)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+		now = now.Add(2 * config.QuotaReclamationMinUnrefAge())
+		clock.Set(now)
+		_, _, err = kbfsOps.CreateDir(ctx, rootNode, dirName)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+		ops.fbm.forceQuotaReclamation()
+		err = ops.fbm.waitForQuotaReclamations(ctx)
+		require.NoError(t, err)
+	}
+
+	t.Log("While the block still has a live reference, quota " +
+		"reclamation leaves it in the index.")
+	reclaim("a", "b")
+	ptr2, ok := index.Lookup(tlfID, hash)
+	require.True(t, ok)
+	require.Equal(t, ptr.ID, ptr2.ID)
+
+	t.Log("Once quota reclamation deletes the block, the index forgets it.")
+	reclaim("c", "d")
+	_, ok = index.Lookup(tlfID, hash)
+	require.False(t, ok)
+}
@@ -7,8 +7,11 @@ package libkbfs
 import (
 	"fmt"
 
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 	"golang.org/x/net/context"
 )
 
@@ -19,6 +22,26 @@ type blockGetter interface {
 		kbfscrypto.BlockCryptKeyServerHalf) error
 }
 
+// blockDecryptionKeyRefetcher is an optional interface that a
+// blockDecryptionKeyGetter can implement to resolve the key for a
+// block again, bypassing its locally-cached copy, e.g. by fetching
+// the server half of the key generation from KeyOps.  The returned
+// bool is false if no cached copy was used for the block, or if the
+// fresh key is the same as the cached one; either way, retrying the
+// decryption can't help.
+type blockDecryptionKeyRefetcher interface {
+	refetchTLFCryptKeyForBlockDecryption(ctx context.Context,
+		kmd KeyMetadata, blockPtr BlockPointer) (
+		kbfscrypto.TLFCryptKey, bool, error)
+}
+
+// isBlockKeyDecryptionError returns true if `err` means that a block
+// couldn't be decrypted with the key that was resolved for it.
+func isBlockKeyDecryptionError(err error) bool {
+	_, ok := errors.Cause(err).(libkb.DecryptionError)
+	return ok
+}
+
 // realBlockGetter obtains real blocks using the APIs available in Config.
 type realBlockGetter struct {
 	config blockOpsConfig
@@ -40,14 +63,105 @@ func (bg *realBlockGetter) getBlock(ctx context.Context, kmd KeyMetadata, blockP
 		return err
 	}
 
-	return assembleBlock(
-		ctx, bg.config.keyGetter(), bg.config.Codec(), bg.config.cryptoPure(),
-		kmd, blockPtr, block, buf, blockServerHalf)
+	return bg.assembleBlock(ctx, kmd, blockPtr, block, buf, blockServerHalf)
 }
 
 func (bg *realBlockGetter) assembleBlock(ctx context.Context,
 	kmd KeyMetadata, ptr BlockPointer, block Block, buf []byte,
 	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
-	return assembleBlock(ctx, bg.config.keyGetter(), bg.config.Codec(),
+	keyGetter := bg.config.keyGetter()
+	err := assembleBlock(ctx, keyGetter, bg.config.Codec(),
 		bg.config.cryptoPure(), kmd, ptr, block, buf, serverHalf)
+	if !isBlockKeyDecryptionError(err) {
+		return err
+	}
+	refetcher, ok := keyGetter.(blockDecryptionKeyRefetcher)
+	if !ok {
+		return err
+	}
+
+	// The locally-cached key for this block's generation may be
+	// stale, e.g. for old data from before a rekey, so fetch it
+	// again and retry, but only once, and only if the key changed.
+	// Otherwise the block itself is bad.
+	tlfCryptKey, changed, refetchErr :=
+		refetcher.refetchTLFCryptKeyForBlockDecryption(ctx, kmd, ptr)
+	if refetchErr != nil || !changed {
+		return err
+	}
+	return assembleBlockWithKey(bg.config.Codec(), bg.config.cryptoPure(),
+		ptr, block, buf, serverHalf, tlfCryptKey)
+}
+
+// blockServerMultiGetter is an optional interface that a BlockServer
+// can implement to return several blocks of the same TLF in a single
+// RPC.
+type blockServerMultiGetter interface {
+	// GetMany is like BlockServer.Get, but for all of `ids` at once.
+	// `contexts[i]` is the context for `ids[i]`, and the returned
+	// slices are in the same order as `ids`.
+	GetMany(ctx context.Context, tlfID tlf.ID, ids []kbfsblock.ID,
+		contexts []kbfsblock.Context) (
+		bufs [][]byte, serverHalves []kbfscrypto.BlockCryptKeyServerHalf,
+		err error)
+}
+
+// multiBlockGetter is an optional interface that a blockGetter can
+// implement to fetch several blocks of the same TLF at once.
+type multiBlockGetter interface {
+	// canGetBlocks returns true if getBlocks is currently able to
+	// fetch blocks in a batch.  If not, callers should fall back to
+	// getBlock.
+	canGetBlocks() bool
+	// getBlocks fetches `ptrs[i]` into `blocks[i]` for each `i`, and
+	// returns the error for each block in the same order.
+	getBlocks(ctx context.Context, kmd KeyMetadata, ptrs []BlockPointer,
+		blocks []Block) []error
+}
+
+var _ multiBlockGetter = (*realBlockGetter)(nil)
+
+// canGetBlocks implements the multiBlockGetter interface for
+// realBlockGetter.
+func (bg *realBlockGetter) canGetBlocks() bool {
+	_, ok := bg.config.BlockServer().(blockServerMultiGetter)
+	return ok
+}
+
+// getBlocks implements the multiBlockGetter interface for
+// realBlockGetter.
+func (bg *realBlockGetter) getBlocks(ctx context.Context, kmd KeyMetadata,
+	ptrs []BlockPointer, blocks []Block) []error {
+	errs := make([]error, len(ptrs))
+	bserv, ok := bg.config.BlockServer().(blockServerMultiGetter)
+	if !ok {
+		for i, ptr := range ptrs {
+			errs[i] = bg.getBlock(ctx, kmd, ptr, blocks[i])
+		}
+		return errs
+	}
+
+	ids := make([]kbfsblock.ID, len(ptrs))
+	contexts := make([]kbfsblock.Context, len(ptrs))
+	for i, ptr := range ptrs {
+		ids[i] = ptr.ID
+		contexts[i] = ptr.Context
+	}
+	bufs, serverHalves, err := bserv.GetMany(ctx, kmd.TlfID(), ids, contexts)
+	if err == nil && (len(bufs) != len(ptrs) || len(serverHalves) != len(ptrs)) {
+		err = errors.Errorf("GetMany returned %d blocks and %d server "+
+			"halves for %d IDs", len(bufs), len(serverHalves), len(ptrs))
+	}
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	for i, ptr := range ptrs {
+		errs[i] = bg.assembleBlock(
+			ctx, kmd, ptr, blocks[i], bufs[i], serverHalves[i])
+	}
+	return errs
 }
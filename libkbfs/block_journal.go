@@ -699,7 +699,7 @@ func (j *blockJournal) getNextEntriesToFlush(
 			entries.puts.addNewBlock(
 				BlockPointer{ID: id, Context: bctx},
 				nil, /* only used by folderBranchOps */
-				ReadyBlockData{data, serverHalf}, nil)
+				ReadyBlockData{buf: data, serverHalf: serverHalf}, nil)
 
 		case addRefOp:
 			id, bctx, err := entry.getSingleContext()
@@ -771,7 +771,8 @@ func flushNonBPSBlockJournalEntry(
 
 func flushBlockEntries(ctx context.Context, log, deferLog traceLogger,
 	bserver BlockServer, bcache BlockCache, reporter Reporter, tlfID tlf.ID,
-	tlfName tlf.CanonicalName, entries blockEntriesToFlush) error {
+	tlfName tlf.CanonicalName, entries blockEntriesToFlush,
+	maxParallelPuts int) error {
 	if !entries.flushNeeded() {
 		// Avoid logging anything when there's nothing to flush.
 		return nil
@@ -782,7 +783,7 @@ func flushBlockEntries(ctx context.Context, log, deferLog traceLogger,
 	// reference the former.
 	log.CDebugf(ctx, "Putting %d blocks", len(entries.puts.blockStates))
 	blocksToRemove, err := doBlockPuts(ctx, bserver, bcache, reporter,
-		log, deferLog, tlfID, tlfName, *entries.puts)
+		log, deferLog, tlfID, tlfName, *entries.puts, maxParallelPuts)
 	if err != nil {
 		if isRecoverableBlockError(err) {
 			log.CWarningf(ctx,
@@ -796,7 +797,7 @@ func flushBlockEntries(ctx context.Context, log, deferLog traceLogger,
 	log.CDebugf(ctx, "Adding %d block references",
 		len(entries.adds.blockStates))
 	blocksToRemove, err = doBlockPuts(ctx, bserver, bcache, reporter,
-		log, deferLog, tlfID, tlfName, *entries.adds)
+		log, deferLog, tlfID, tlfName, *entries.adds, maxParallelPuts)
 	if err != nil {
 		if isRecoverableBlockError(err) {
 			log.CWarningf(ctx,
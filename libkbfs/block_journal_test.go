@@ -467,7 +467,8 @@ func TestBlockJournalFlush(t *testing.T) {
 
 		err = flushBlockEntries(
 			ctx, j.log, j.deferLog, blockServer, bcache, reporter,
-			tlfID, tlf.CanonicalName("fake TLF"), entries)
+			tlfID, tlf.CanonicalName("fake TLF"), entries,
+			maxParallelBlockPuts)
 		require.NoError(t, err)
 
 		flushedBytes, err = j.removeFlushedEntries(
@@ -543,7 +544,7 @@ func flushBlockJournalOne(ctx context.Context, t *testing.T,
 	require.Equal(t, 1, entries.length())
 	err = flushBlockEntries(ctx, j.log, j.deferLog, blockServer,
 		bcache, reporter, tlfID, tlf.CanonicalName("fake TLF"),
-		entries)
+		entries, maxParallelBlockPuts)
 	require.NoError(t, err)
 	flushedBytes, err = j.removeFlushedEntries(
 		ctx, entries, tlfID, reporter)
@@ -722,7 +723,7 @@ func TestBlockJournalFlushMDRevMarker(t *testing.T) {
 	require.Equal(t, 2, entries.length())
 	err = flushBlockEntries(ctx, j.log, j.deferLog, blockServer,
 		bcache, reporter, tlfID, tlf.CanonicalName("fake TLF"),
-		entries)
+		entries, maxParallelBlockPuts)
 	require.NoError(t, err)
 	flushedBytes, err := j.removeFlushedEntries(
 		ctx, entries, tlfID, reporter)
@@ -788,7 +789,7 @@ func TestBlockJournalFlushMDRevMarkerForPendingLocalSquash(t *testing.T) {
 
 	err = flushBlockEntries(ctx, j.log, j.deferLog, blockServer,
 		bcache, reporter, tlfID, tlf.CanonicalName("fake TLF"),
-		entries)
+		entries, maxParallelBlockPuts)
 	require.NoError(t, err)
 
 	flushedBytes, err := j.removeFlushedEntries(
@@ -862,7 +863,7 @@ func TestBlockJournalIgnoreBlocks(t *testing.T) {
 	require.Equal(t, bID4, entries.puts.blockStates[1].blockPtr.ID)
 	err = flushBlockEntries(ctx, j.log, j.deferLog, blockServer,
 		bcache, reporter, tlfID, tlf.CanonicalName("fake TLF"),
-		entries)
+		entries, maxParallelBlockPuts)
 	require.NoError(t, err)
 	flushedBytes, err := j.removeFlushedEntries(
 		ctx, entries, tlfID, reporter)
@@ -921,7 +922,7 @@ func TestBlockJournalSaveUntilMDFlush(t *testing.T) {
 		require.NoError(t, err)
 		err = flushBlockEntries(ctx, j.log, j.deferLog, blockServer,
 			bcache, reporter, tlfID, tlf.CanonicalName("fake TLF"),
-			entries)
+			entries, maxParallelBlockPuts)
 		require.NoError(t, err)
 		flushedBytes, err := j.removeFlushedEntries(
 			ctx, entries, tlfID, reporter)
@@ -5,6 +5,8 @@
 package libkbfs
 
 import (
+	"sync"
+
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
@@ -22,6 +24,7 @@ type blockOpsConfig interface {
 	diskBlockCacheGetter
 	syncedTlfGetterSetter
 	initModeGetter
+	tunablesGetter
 }
 
 // BlockOpsStandard implements the BlockOps interface by relaying
@@ -30,6 +33,11 @@ type BlockOpsStandard struct {
 	config blockOpsConfig
 	log    traceLogger
 	queue  *blockRetrievalQueue
+
+	blockCodecLock sync.RWMutex
+	// blockCodecs holds the BlockCodecs of the folders that don't
+	// just use the crypto layer's encoding.
+	blockCodecs map[tlf.ID]BlockCodec
 }
 
 var _ BlockOps = (*BlockOpsStandard)(nil)
@@ -44,16 +52,43 @@ func NewBlockOpsStandard(config blockOpsConfig,
 	}
 	q := newBlockRetrievalQueue(queueSize, prefetchQueueSize, qConfig)
 	bops := &BlockOpsStandard{
-		config: config,
-		log:    traceLogger{config.MakeLogger("")},
-		queue:  q,
+		config:      config,
+		log:         traceLogger{config.MakeLogger("")},
+		queue:       q,
+		blockCodecs: make(map[tlf.ID]BlockCodec),
 	}
 	return bops
 }
 
+// SetBlockCodec implements the BlockOps interface for BlockOpsStandard.
+func (b *BlockOpsStandard) SetBlockCodec(tlfID tlf.ID, codec BlockCodec) {
+	b.blockCodecLock.Lock()
+	defer b.blockCodecLock.Unlock()
+	if codec == nil {
+		delete(b.blockCodecs, tlfID)
+		return
+	}
+	b.blockCodecs[tlfID] = codec
+}
+
+func (b *BlockOpsStandard) getBlockCodec(tlfID tlf.ID) BlockCodec {
+	b.blockCodecLock.RLock()
+	defer b.blockCodecLock.RUnlock()
+	return b.blockCodecs[tlfID]
+}
+
 // Get implements the BlockOps interface for BlockOpsStandard.
 func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
 	blockPtr BlockPointer, block Block, lifetime BlockCacheLifetime) error {
+	return b.GetWithPriority(
+		ctx, kmd, blockPtr, block, lifetime, defaultOnDemandRequestPriority)
+}
+
+// GetWithPriority implements the BlockOps interface for
+// BlockOpsStandard.
+func (b *BlockOpsStandard) GetWithPriority(ctx context.Context,
+	kmd KeyMetadata, blockPtr BlockPointer, block Block,
+	lifetime BlockCacheLifetime, priority int) error {
 	// Check the journal explicitly first, so we don't get stuck in
 	// the block-fetching queue.
 	if journalBServer, ok := b.config.BlockServer().(journalBlockServer); ok {
@@ -71,8 +106,7 @@ func (b *BlockOpsStandard) Get(ctx context.Context, kmd KeyMetadata,
 
 	b.log.LazyTrace(ctx, "BOps: Requesting %s", blockPtr.ID)
 
-	errCh := b.queue.Request(ctx, defaultOnDemandRequestPriority, kmd,
-		blockPtr, block, lifetime)
+	errCh := b.queue.Request(ctx, priority, kmd, blockPtr, block, lifetime)
 	err := <-errCh
 
 	b.log.LazyTrace(ctx, "BOps: Request fulfilled for %s (err=%v)", blockPtr.ID, err)
@@ -124,10 +158,15 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 
 	crypto := b.config.cryptoPure()
 
-	tlfCryptKey, err := b.config.keyGetter().
-		GetTLFCryptKeyForEncryption(ctx, kmd)
-	if err != nil {
-		return
+	// All public TLFs share the same well-known key, so there's no
+	// need to go through the key getter for them.
+	tlfCryptKey := kbfscrypto.PublicTLFCryptKey
+	if kmd.TlfID().Type() != tlf.Public {
+		tlfCryptKey, err = b.config.keyGetter().
+			GetTLFCryptKeyForEncryption(ctx, kmd)
+		if err != nil {
+			return
+		}
 	}
 
 	// New server key half for the block.
@@ -137,7 +176,19 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	}
 
 	blockKey := kbfscrypto.UnmaskBlockCryptKey(serverHalf, tlfCryptKey)
-	plainSize, encryptedBlock, err := crypto.EncryptBlock(block, blockKey)
+	var encryptedBlock kbfscrypto.EncryptedBlock
+	dataVer := FirstValidDataVer
+	if blockCodec := b.getBlockCodec(kmd.TlfID()); blockCodec != nil {
+		var encodedBlock []byte
+		encodedBlock, dataVer, err = blockCodec.Encode(block)
+		if err != nil {
+			return
+		}
+		plainSize, encryptedBlock, err = crypto.EncryptEncodedBlock(
+			encodedBlock, blockKey)
+	} else {
+		plainSize, encryptedBlock, err = crypto.EncryptBlock(block, blockKey)
+	}
 	if err != nil {
 		return
 	}
@@ -150,6 +201,7 @@ func (b *BlockOpsStandard) Ready(ctx context.Context, kmd KeyMetadata,
 	readyBlockData = ReadyBlockData{
 		buf:        buf,
 		serverHalf: serverHalf,
+		dataVer:    dataVer,
 	}
 
 	encodedSize := readyBlockData.GetEncodedSize()
@@ -5,11 +5,14 @@
 package libkbfs
 
 import (
+	"bytes"
+	"crypto/rand"
 	"fmt"
 	"sync"
 	"testing"
 
 	"github.com/golang/mock/gomock"
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscodec"
@@ -27,7 +30,7 @@ import (
 // fakeBlockKeyGetter.
 type fakeKeyMetadata struct {
 	// Embed a KeyMetadata that's always empty, so that all
-	// methods besides TlfID() panic.
+	// methods besides TlfID() and LatestKeyGeneration() panic.
 	KeyMetadata
 	tlfID tlf.ID
 	keys  []kbfscrypto.TLFCryptKey
@@ -53,6 +56,10 @@ func (kmd fakeKeyMetadata) TlfID() tlf.ID {
 	return kmd.tlfID
 }
 
+func (kmd fakeKeyMetadata) LatestKeyGeneration() kbfsmd.KeyGen {
+	return kbfsmd.FirstValidKeyGen + kbfsmd.KeyGen(len(kmd.keys)) - 1
+}
+
 type fakeBlockKeyGetter struct{}
 
 func (kg fakeBlockKeyGetter) GetTLFCryptKeyForEncryption(
@@ -108,7 +115,11 @@ func (config testBlockOpsConfig) BlockCache() BlockCache {
 }
 
 func (config testBlockOpsConfig) DataVersion() DataVer {
-	return ChildHolesDataVer
+	return CompressedFileBlockContentsDataVer
+}
+
+func (config testBlockOpsConfig) Tunables() Tunables {
+	return DefaultTunables()
 }
 
 func makeTestBlockOpsConfig(t *testing.T) testBlockOpsConfig {
@@ -183,6 +194,45 @@ func TestBlockOpsReadyFailKeyGet(t *testing.T) {
 	require.EqualError(t, err, "no keys for encryption")
 }
 
+// TestBlockOpsReadyPublic checks that BlockOpsStandard.Ready()
+// encrypts public TLF blocks with the public TLF key, without
+// needing a key from the key getter.
+func TestBlockOpsReadyPublic(t *testing.T) {
+	config := makeTestBlockOpsConfig(t)
+	bops := NewBlockOpsStandard(config, testBlockRetrievalWorkerQueueSize,
+		testPrefetchWorkerQueueSize)
+	defer bops.Shutdown()
+
+	// No keys, so the key getter would fail.
+	tlfID := tlf.FakeID(0, tlf.Public)
+	kmd := makeFakeKeyMetadata(tlfID, 0)
+
+	block := &FileBlock{
+		Contents: []byte{1, 2, 3, 4, 5},
+	}
+
+	ctx := context.Background()
+	id, _, readyBlockData, err := bops.Ready(ctx, kmd, block)
+	require.NoError(t, err)
+
+	err = kbfsblock.VerifyID(readyBlockData.buf, id)
+	require.NoError(t, err)
+
+	var encryptedBlock kbfscrypto.EncryptedBlock
+	err = config.Codec().Decode(readyBlockData.buf, &encryptedBlock)
+	require.NoError(t, err)
+
+	blockCryptKey := kbfscrypto.UnmaskBlockCryptKey(
+		readyBlockData.serverHalf, kbfscrypto.PublicTLFCryptKey)
+
+	decryptedBlock := &FileBlock{}
+	err = config.cryptoPure().DecryptBlock(
+		encryptedBlock, blockCryptKey, decryptedBlock)
+	require.NoError(t, err)
+	decryptedBlock.SetEncodedSize(uint32(readyBlockData.GetEncodedSize()))
+	require.Equal(t, block, decryptedBlock)
+}
+
 type badServerHalfMaker struct {
 	cryptoPure
 }
@@ -340,6 +390,190 @@ func TestBlockOpsGetSuccess(t *testing.T) {
 	require.Equal(t, block, decryptedBlock)
 }
 
+type testDataVersioner DataVer
+
+func (v testDataVersioner) DataVersion() DataVer {
+	return DataVer(v)
+}
+
+// TestBlockOpsRawFileBlockCodec checks that a folder using
+// RawFileBlockCodec stores its direct file blocks raw, that they can
+// be read back, and that their data version keeps older readers from
+// trying to decode them.
+func TestBlockOpsRawFileBlockCodec(t *testing.T) {
+	config := makeTestBlockOpsConfig(t)
+	bops := NewBlockOpsStandard(config, testBlockRetrievalWorkerQueueSize,
+		testPrefetchWorkerQueueSize)
+	defer bops.Shutdown()
+
+	tlfID := tlf.FakeID(0, tlf.Private)
+	var keyGen kbfsmd.KeyGen = 3
+	kmd := makeFakeKeyMetadata(tlfID, keyGen)
+	bops.SetBlockCodec(tlfID, RawFileBlockCodec{config.Codec()})
+
+	ctx := context.Background()
+	bCtx := kbfsblock.MakeFirstContext(
+		keybase1.MakeTestUID(1).AsUserOrTeam(), keybase1.BlockType_DATA)
+	readyAndGet := func(block, decodedBlock Block, directType BlockDirectType,
+		expectedDataVer DataVer) ReadyBlockData {
+		id, _, readyBlockData, err := bops.Ready(ctx, kmd, block)
+		require.NoError(t, err)
+		require.Equal(t, expectedDataVer, readyBlockData.dataVer)
+		err = config.bserver.Put(ctx, tlfID, id, bCtx,
+			readyBlockData.buf, readyBlockData.serverHalf)
+		require.NoError(t, err)
+
+		err = bops.Get(ctx, kmd,
+			BlockPointer{ID: id, DataVer: expectedDataVer, KeyGen: keyGen,
+				DirectType: directType, Context: bCtx},
+			decodedBlock, NoCacheEntry)
+		require.NoError(t, err)
+		return readyBlockData
+	}
+
+	t.Log("Direct file blocks are stored raw.")
+	block := &FileBlock{
+		Contents: []byte{1, 2, 3, 4, 5},
+	}
+	decodedBlock := &FileBlock{}
+	readyBlockData := readyAndGet(
+		block, decodedBlock, DirectBlock, RawFileBlockContentsDataVer)
+	require.Equal(t, block, decodedBlock)
+
+	var encryptedBlock kbfscrypto.EncryptedBlock
+	err := config.Codec().Decode(readyBlockData.buf, &encryptedBlock)
+	require.NoError(t, err)
+	blockCryptKey := kbfscrypto.UnmaskBlockCryptKey(
+		readyBlockData.serverHalf,
+		kmd.keys[keyGen-kbfsmd.FirstValidKeyGen])
+	encodedBlock, err := config.cryptoPure().DecryptEncodedBlock(
+		encryptedBlock, blockCryptKey)
+	require.NoError(t, err)
+	require.Equal(t,
+		[]byte{0, 0, 0, 0, 0, 0, 0, 5, 1, 2, 3, 4, 5}, encodedBlock)
+
+	t.Log("Other blocks are still encoded with the config's codec.")
+	indBlock := &FileBlock{
+		CommonBlock: CommonBlock{IsInd: true},
+		IPtrs: []IndirectFilePtr{{
+			BlockInfo: BlockInfo{
+				BlockPointer: BlockPointer{
+					ID:         kbfsblock.FakeID(1),
+					DataVer:    RawFileBlockContentsDataVer,
+					DirectType: DirectBlock,
+				},
+				EncodedSize: 10,
+			},
+			Off: 0,
+		}},
+	}
+	decodedIndBlock := &FileBlock{}
+	readyAndGet(indBlock, decodedIndBlock, IndirectBlock, FirstValidDataVer)
+	require.True(t, decodedIndBlock.IsInd)
+	require.Len(t, decodedIndBlock.IPtrs, 1)
+	require.Equal(t, indBlock.IPtrs[0].BlockPointer,
+		decodedIndBlock.IPtrs[0].BlockPointer)
+
+	t.Log("Only readers that know about raw blocks can read them.")
+	p := path{FolderBranch{Tlf: tlfID}, []pathNode{{
+		BlockPointer{ID: kbfsblock.FakeID(2),
+			DataVer: RawFileBlockContentsDataVer}, "a"}}}
+	err = checkDataVersion(
+		testDataVersioner(AtLeastTwoLevelsOfChildrenDataVer), p,
+		p.tailPointer())
+	require.Equal(t,
+		NewDataVersionError{p, RawFileBlockContentsDataVer}, err)
+	err = checkDataVersion(
+		testDataVersioner(RawFileBlockContentsDataVer), p, p.tailPointer())
+	require.NoError(t, err)
+}
+
+// TestBlockOpsCompressedFileBlockCodec checks that a folder using
+// CompressedFileBlockCodec stores compressible direct file blocks in
+// fewer bytes, that incompressible ones aren't made bigger, and that
+// both can be read back.
+func TestBlockOpsCompressedFileBlockCodec(t *testing.T) {
+	config := makeTestBlockOpsConfig(t)
+	bops := NewBlockOpsStandard(config, testBlockRetrievalWorkerQueueSize,
+		testPrefetchWorkerQueueSize)
+	defer bops.Shutdown()
+
+	tlfID := tlf.FakeID(0, tlf.Private)
+	var keyGen kbfsmd.KeyGen = 3
+	kmd := makeFakeKeyMetadata(tlfID, keyGen)
+
+	ctx := context.Background()
+	bCtx := kbfsblock.MakeFirstContext(
+		keybase1.MakeTestUID(1).AsUserOrTeam(), keybase1.BlockType_DATA)
+	readyAndGet := func(block *FileBlock) ReadyBlockData {
+		id, _, readyBlockData, err := bops.Ready(ctx, kmd, block)
+		require.NoError(t, err)
+		err = config.bserver.Put(ctx, tlfID, id, bCtx,
+			readyBlockData.buf, readyBlockData.serverHalf)
+		require.NoError(t, err)
+
+		decodedBlock := &FileBlock{}
+		err = bops.Get(ctx, kmd,
+			BlockPointer{ID: id, DataVer: readyBlockData.dataVer,
+				KeyGen: keyGen, DirectType: DirectBlock, Context: bCtx},
+			decodedBlock, NoCacheEntry)
+		require.NoError(t, err)
+		require.Equal(t, block.Contents, decodedBlock.Contents)
+		require.False(t, decodedBlock.IsInd)
+		return readyBlockData
+	}
+
+	compressible := bytes.Repeat(
+		[]byte("INFO: handled request for /a/b/c in 5ms\n"), 1000)
+	incompressible := make([]byte, len(compressible))
+	_, err := rand.Read(incompressible)
+	require.NoError(t, err)
+
+	// Get the sizes with the default encoding first.
+	plainCompressible := readyAndGet(&FileBlock{Contents: compressible})
+	require.Equal(t, FirstValidDataVer, plainCompressible.dataVer)
+	plainIncompressible := readyAndGet(&FileBlock{Contents: incompressible})
+
+	bops.SetBlockCodec(tlfID, CompressedFileBlockCodec{config.Codec()})
+
+	t.Log("Compressible blocks shrink.")
+	rbd := readyAndGet(&FileBlock{Contents: compressible})
+	require.Equal(t, CompressedFileBlockContentsDataVer, rbd.dataVer)
+	require.True(t,
+		rbd.GetEncodedSize() < plainCompressible.GetEncodedSize(),
+		"compressed size %d, plain size %d", rbd.GetEncodedSize(),
+		plainCompressible.GetEncodedSize())
+
+	t.Log("Incompressible blocks are stored as is.")
+	rbd = readyAndGet(&FileBlock{Contents: incompressible})
+	require.Equal(t, CompressedFileBlockContentsDataVer, rbd.dataVer)
+	require.True(t,
+		rbd.GetEncodedSize() <= plainIncompressible.GetEncodedSize(),
+		"compressed size %d, plain size %d", rbd.GetEncodedSize(),
+		plainIncompressible.GetEncodedSize())
+	buf, _, err := CompressedFileBlockCodec{config.Codec()}.Encode(
+		&FileBlock{Contents: incompressible})
+	require.NoError(t, err)
+	require.Equal(t, compressedFileBlockUncompressed, buf[0])
+	require.Equal(t, incompressible, buf[1:])
+
+	t.Log("Empty blocks round-trip too.")
+	readyAndGet(&FileBlock{})
+
+	t.Log("Only readers that know about compressed blocks can read them.")
+	p := path{FolderBranch{Tlf: tlfID}, []pathNode{{
+		BlockPointer{ID: kbfsblock.FakeID(2),
+			DataVer: CompressedFileBlockContentsDataVer}, "a"}}}
+	err = checkDataVersion(
+		testDataVersioner(IndirectDirsDataVer), p, p.tailPointer())
+	require.Equal(t,
+		NewDataVersionError{p, CompressedFileBlockContentsDataVer}, err)
+	err = checkDataVersion(
+		testDataVersioner(CompressedFileBlockContentsDataVer), p,
+		p.tailPointer())
+	require.NoError(t, err)
+}
+
 // TestBlockOpsReadySuccess checks that BlockOpsStandard.Get() fails
 // if it can't retrieve the block from the server.
 func TestBlockOpsGetFailServerGet(t *testing.T) {
@@ -691,3 +925,136 @@ func TestBlockOpsArchiveFail(t *testing.T) {
 	err := bops.Archive(ctx, tlfID, []BlockPointer{b1, b2})
 	require.Equal(t, expectedErr, err)
 }
+
+// staleBlockKeyGetter is a fakeBlockKeyGetter that hands out the
+// wrong decryption keys, as if stale ones were cached locally, until
+// a key is refetched.
+type staleBlockKeyGetter struct {
+	fakeBlockKeyGetter
+	// cached is whether the wrong keys come from the local cache.
+	cached bool
+	// refetchFixes is whether refetching a key returns the right one.
+	refetchFixes bool
+
+	lock      sync.Mutex
+	gets      int
+	refetches int
+	fixed     bool
+}
+
+func (kg *staleBlockKeyGetter) GetTLFCryptKeyForBlockDecryption(
+	ctx context.Context, kmd KeyMetadata, blockPtr BlockPointer) (
+	kbfscrypto.TLFCryptKey, error) {
+	kg.lock.Lock()
+	defer kg.lock.Unlock()
+	kg.gets++
+	return kg.getLocked(ctx, kmd, blockPtr)
+}
+
+func (kg *staleBlockKeyGetter) getLocked(
+	ctx context.Context, kmd KeyMetadata, blockPtr BlockPointer) (
+	kbfscrypto.TLFCryptKey, error) {
+	if kg.fixed {
+		return kg.fakeBlockKeyGetter.GetTLFCryptKeyForBlockDecryption(
+			ctx, kmd, blockPtr)
+	}
+	return kbfscrypto.MakeTLFCryptKey([32]byte{0xff}), nil
+}
+
+func (kg *staleBlockKeyGetter) refetchTLFCryptKeyForBlockDecryption(
+	ctx context.Context, kmd KeyMetadata, blockPtr BlockPointer) (
+	kbfscrypto.TLFCryptKey, bool, error) {
+	if !kg.cached {
+		return kbfscrypto.TLFCryptKey{}, false, nil
+	}
+	kg.lock.Lock()
+	defer kg.lock.Unlock()
+	kg.refetches++
+	kg.fixed = kg.refetchFixes
+	key, err := kg.getLocked(ctx, kmd, blockPtr)
+	return key, kg.refetchFixes, err
+}
+
+func (kg *staleBlockKeyGetter) getGets() int {
+	kg.lock.Lock()
+	defer kg.lock.Unlock()
+	return kg.gets
+}
+
+func (kg *staleBlockKeyGetter) getRefetches() int {
+	kg.lock.Lock()
+	defer kg.lock.Unlock()
+	return kg.refetches
+}
+
+// staleKeyBlockOpsConfig is a testBlockOpsConfig that resolves its
+// keys with a staleBlockKeyGetter.
+type staleKeyBlockOpsConfig struct {
+	testBlockOpsConfig
+	kg *staleBlockKeyGetter
+}
+
+func (config staleKeyBlockOpsConfig) keyGetter() blockKeyGetter {
+	return config.kg
+}
+
+// TestBlockGetterRefetchesKey checks that realBlockGetter refetches
+// the cached key of a block that it can't decrypt, and retries the
+// decryption exactly once, with the refetched key, if the key
+// changed.
+func TestBlockGetterRefetchesKey(t *testing.T) {
+	config := makeTestBlockOpsConfig(t)
+	bops := NewBlockOpsStandard(config, testBlockRetrievalWorkerQueueSize,
+		testPrefetchWorkerQueueSize)
+	defer bops.Shutdown()
+
+	tlfID := tlf.FakeID(0, tlf.Private)
+	var latestKeyGen kbfsmd.KeyGen = 5
+	kmd := makeFakeKeyMetadata(tlfID, latestKeyGen)
+
+	ctx := context.Background()
+	block := &FileBlock{Contents: []byte{1, 2, 3, 4, 5}}
+	id, _, readyBlockData, err := bops.Ready(ctx, kmd, block)
+	require.NoError(t, err)
+
+	bCtx := kbfsblock.MakeFirstContext(
+		keybase1.MakeTestUID(1).AsUserOrTeam(), keybase1.BlockType_DATA)
+	err = config.bserver.Put(ctx, tlfID, id, bCtx,
+		readyBlockData.buf, readyBlockData.serverHalf)
+	require.NoError(t, err)
+	ptr := BlockPointer{ID: id, DataVer: FirstValidDataVer,
+		KeyGen: latestKeyGen, Context: bCtx}
+
+	t.Log("A refetched key decrypts the block.")
+	kg := &staleBlockKeyGetter{cached: true, refetchFixes: true}
+	bg := &realBlockGetter{config: staleKeyBlockOpsConfig{config, kg}}
+	decryptedBlock := &FileBlock{}
+	err = bg.getBlock(ctx, kmd, ptr, decryptedBlock)
+	require.NoError(t, err)
+	require.Equal(t, block.Contents, decryptedBlock.Contents)
+	require.Equal(t, 1, kg.getRefetches())
+	require.Equal(t, 1, kg.getGets())
+
+	t.Log("The refetched key stays cached.")
+	decryptedBlock = &FileBlock{}
+	err = bg.getBlock(ctx, kmd, ptr, decryptedBlock)
+	require.NoError(t, err)
+	require.Equal(t, block.Contents, decryptedBlock.Contents)
+	require.Equal(t, 1, kg.getRefetches())
+
+	t.Log("A key that's unchanged after a refetch isn't retried.")
+	kg = &staleBlockKeyGetter{cached: true}
+	bg = &realBlockGetter{config: staleKeyBlockOpsConfig{config, kg}}
+	decryptedBlock = &FileBlock{}
+	err = bg.getBlock(ctx, kmd, ptr, decryptedBlock)
+	require.IsType(t, libkb.DecryptionError{}, errors.Cause(err))
+	require.Equal(t, 1, kg.getRefetches())
+
+	t.Log("A key that wasn't cached isn't refetched.")
+	kg = &staleBlockKeyGetter{}
+	bg = &realBlockGetter{config: staleKeyBlockOpsConfig{config, kg}}
+	decryptedBlock = &FileBlock{}
+	err = bg.getBlock(ctx, kmd, ptr, decryptedBlock)
+	require.IsType(t, libkb.DecryptionError{}, errors.Cause(err))
+	require.Equal(t, 0, kg.getRefetches())
+}
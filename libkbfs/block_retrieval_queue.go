@@ -7,10 +7,12 @@ package libkbfs
 import (
 	"container/heap"
 	"io"
+	"math"
 	"reflect"
 	"sync"
 
 	"github.com/keybase/client/go/logger"
+	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/pkg/errors"
 	"golang.org/x/net/context"
@@ -25,8 +27,16 @@ const (
 	testPrefetchWorkerQueueSize          int = 1
 	defaultOnDemandRequestPriority       int = 1 << 30
 	lowestTriggerPrefetchPriority        int = 1
+	// backgroundRequestPriority is used for on-demand fetches made by
+	// background traversals, so they don't delay interactive
+	// requests.  It is below the priority given to prefetches for
+	// synced TLFs.
+	backgroundRequestPriority int = defaultOnDemandRequestPriority - 2
 	// Channel buffer size can be big because we use the empty struct.
 	workerQueueSize int = 1<<31 - 1
+	// maxBlocksPerGroupFetch is the most grouped retrievals that a
+	// worker will fetch from the server in one batch.
+	maxBlocksPerGroupFetch int = 16
 )
 
 type blockRetrievalPartialConfig interface {
@@ -36,6 +46,7 @@ type blockRetrievalPartialConfig interface {
 	diskBlockCacheGetter
 	syncedTlfGetterSetter
 	initModeGetter
+	tunablesGetter
 }
 
 type blockRetrievalConfig interface {
@@ -58,6 +69,48 @@ type blockRetrievalRequest struct {
 	doneCh chan error
 }
 
+// blockRetrievalGroupKey identifies one child of an indirect file
+// block within its group.
+type blockRetrievalGroupKey struct {
+	// parent is the ID of the indirect block containing the child.
+	parent kbfsblock.ID
+	// off is the offset of the child within the file.
+	off int64
+}
+
+// blockRetrievalGroup is an optional grouping key for a retrieval of
+// a child of an indirect file block.  Queued retrievals of adjacent
+// children of the same parent can be fetched together in a single
+// call to the block server.
+type blockRetrievalGroup struct {
+	blockRetrievalGroupKey
+	// nextOff is the offset of the next child of `parent`, or -1 if
+	// this is the last child.
+	nextOff int64
+}
+
+type ctxBlockRetrievalGroupKey int
+
+const (
+	ctxBlockRetrievalGroupID ctxBlockRetrievalGroupKey = iota
+)
+
+// withBlockRetrievalGroup returns a context that tags the block
+// requests made with it with the given group.
+func withBlockRetrievalGroup(ctx context.Context, parent kbfsblock.ID,
+	off, nextOff int64) context.Context {
+	return context.WithValue(ctx, ctxBlockRetrievalGroupID,
+		blockRetrievalGroup{blockRetrievalGroupKey{parent, off}, nextOff})
+}
+
+// blockRetrievalGroupFromContext returns the group that `ctx` was
+// tagged with by withBlockRetrievalGroup, if any.
+func blockRetrievalGroupFromContext(ctx context.Context) (
+	blockRetrievalGroup, bool) {
+	group, ok := ctx.Value(ctxBlockRetrievalGroupID).(blockRetrievalGroup)
+	return group, ok
+}
+
 // blockRetrieval contains the metadata for a given block retrieval. May
 // represent many requests, all of which will be handled at once.
 type blockRetrieval struct {
@@ -87,6 +140,8 @@ type blockRetrieval struct {
 	// state of global request counter when this retrieval was created;
 	// maintains FIFO
 	insertionOrder uint64
+	// the group of the retrieval, or nil if it isn't grouped
+	group *blockRetrievalGroup
 }
 
 // blockPtrLookup is used to uniquely identify block retrieval requests. The
@@ -105,10 +160,12 @@ type blockPtrLookup struct {
 type blockRetrievalQueue struct {
 	config blockRetrievalConfig
 	log    logger.Logger
-	// protects ptrs, insertionCount, and the heap
+	// protects ptrs, groups, insertionCount, and the heap
 	mtx sync.RWMutex
 	// queued or in progress retrievals
 	ptrs map[blockPtrLookup]*blockRetrieval
+	// grouped retrievals that are still in the heap
+	groups map[blockRetrievalGroupKey]*blockRetrieval
 	// global counter of insertions to queue
 	// capacity: ~584 years at 1 billion requests/sec
 	insertionCount uint64
@@ -121,6 +178,12 @@ type blockRetrievalQueue struct {
 	prefetchWorkerCh chan<- struct{}
 	// slices to store the workers so we can terminate them when we're done
 	workers []*blockRetrievalWorker
+	// the number of each type of worker
+	numWorkers         int
+	numPrefetchWorkers int
+	// the number of on-demand workers currently working on prefetch
+	// requests; protected by mtx
+	numWorkersOnPrefetch int
 	// channel to be closed when we're done accepting requests
 	doneCh chan struct{}
 
@@ -143,34 +206,141 @@ func newBlockRetrievalQueue(numWorkers int, numPrefetchWorkers int,
 		config:           config,
 		log:              config.MakeLogger(""),
 		ptrs:             make(map[blockPtrLookup]*blockRetrieval),
+		groups:           make(map[blockRetrievalGroupKey]*blockRetrieval),
 		heap:             &blockRetrievalHeap{},
 		workerCh:         workerCh,
 		prefetchWorkerCh: prefetchWorkerCh,
 		doneCh:           make(chan struct{}),
 		workers: make([]*blockRetrievalWorker, 0,
 			numWorkers+numPrefetchWorkers),
+		numWorkers:         numWorkers,
+		numPrefetchWorkers: numPrefetchWorkers,
 	}
 	q.prefetcher = newBlockPrefetcher(q, config, nil)
 	for i := 0; i < numWorkers; i++ {
 		q.workers = append(q.workers, newBlockRetrievalWorker(
-			config.blockGetter(), q, workerCh))
+			config.blockGetter(), q, workerCh, true))
 	}
 	for i := 0; i < numPrefetchWorkers; i++ {
 		q.workers = append(q.workers, newBlockRetrievalWorker(
-			config.blockGetter(), q, prefetchWorkerCh))
+			config.blockGetter(), q, prefetchWorkerCh, false))
 	}
 	return q
 }
 
+// popLocked pops the next retrieval from the heap, and removes it
+// from its group.  brq.mtx must be held by the caller.
+func (brq *blockRetrievalQueue) popLocked() *blockRetrieval {
+	retrieval := heap.Pop(brq.heap).(*blockRetrieval)
+	if retrieval.group != nil &&
+		brq.groups[retrieval.group.blockRetrievalGroupKey] == retrieval {
+		delete(brq.groups, retrieval.group.blockRetrievalGroupKey)
+	}
+	return retrieval
+}
+
 func (brq *blockRetrievalQueue) popIfNotEmpty() *blockRetrieval {
 	brq.mtx.Lock()
 	defer brq.mtx.Unlock()
 	if brq.heap.Len() > 0 {
-		return heap.Pop(brq.heap).(*blockRetrieval)
+		return brq.popLocked()
 	}
 	return nil
 }
 
+// popGroupAfter removes from the heap, and returns, the queued
+// retrievals for the children of the same indirect block that
+// directly follow `retrieval`, up to a total batch size of `max`
+// including `retrieval` itself.  It returns nil if `retrieval` isn't
+// grouped, or if the next child isn't queued.
+func (brq *blockRetrievalQueue) popGroupAfter(
+	retrieval *blockRetrieval, max int) (next []*blockRetrieval) {
+	if retrieval.group == nil {
+		return nil
+	}
+	brq.mtx.Lock()
+	defer brq.mtx.Unlock()
+	key := blockRetrievalGroupKey{
+		retrieval.group.parent, retrieval.group.nextOff}
+	for len(next)+1 < max && key.off >= 0 {
+		br, ok := brq.groups[key]
+		if !ok {
+			break
+		}
+		heap.Remove(brq.heap, br.index)
+		delete(brq.groups, key)
+		next = append(next, br)
+		key.off = br.group.nextOff
+	}
+	return next
+}
+
+// numReservedWorkers returns the number of on-demand workers that
+// are reserved for on-demand requests (i.e., those with priority >=
+// defaultOnDemandRequestPriority), according to the configured
+// Tunables.ReservedOnDemandWorkerFraction, rounded up.  Without a
+// reservation, a flood of prefetch requests can occupy every
+// on-demand worker, and make foreground reads wait.  If there are no
+// prefetch workers, nothing is reserved, since otherwise nobody could
+// serve prefetch requests.
+func (brq *blockRetrievalQueue) numReservedWorkers() int {
+	fraction := brq.config.Tunables().ReservedOnDemandWorkerFraction
+	if brq.numPrefetchWorkers == 0 || fraction <= 0 {
+		return 0
+	}
+	reserved := int(math.Ceil(fraction * float64(brq.numWorkers)))
+	if reserved > brq.numWorkers {
+		reserved = brq.numWorkers
+	}
+	return reserved
+}
+
+// popForOnDemandWorker is like popIfNotEmpty, but for on-demand
+// workers.  If the next retrieval is only a prefetch, and taking it
+// would leave fewer than the reserved number of on-demand workers
+// free, it leaves it in the heap for the prefetch workers instead.
+// `isPrefetch` is true if the returned retrieval is a prefetch, in
+// which case the worker must call `doneWithPrefetch` once it's done.
+func (brq *blockRetrievalQueue) popForOnDemandWorker() (
+	retrieval *blockRetrieval, isPrefetch bool) {
+	priority, forward := func() (int, bool) {
+		brq.mtx.Lock()
+		defer brq.mtx.Unlock()
+		if brq.heap.Len() == 0 {
+			return 0, false
+		}
+		priority := (*brq.heap)[0].priority
+		if priority >= defaultOnDemandRequestPriority {
+			retrieval = brq.popLocked()
+			return priority, false
+		}
+		if brq.numWorkersOnPrefetch >=
+			brq.numWorkers-brq.numReservedWorkers() {
+			return priority, true
+		}
+		brq.numWorkersOnPrefetch++
+		retrieval = brq.popLocked()
+		isPrefetch = true
+		return priority, false
+	}()
+	if forward {
+		// Make sure a prefetch worker picks this up, since the
+		// notification we got might have been the only one for it.
+		// This must happen outside of `mtx`, since `notifyWorker`
+		// might pop from the heap itself during shutdown.
+		brq.notifyWorker(priority)
+	}
+	return retrieval, isPrefetch
+}
+
+// doneWithPrefetch is called by an on-demand worker once it finishes
+// a prefetch retrieval obtained from `popForOnDemandWorker`.
+func (brq *blockRetrievalQueue) doneWithPrefetch() {
+	brq.mtx.Lock()
+	defer brq.mtx.Unlock()
+	brq.numWorkersOnPrefetch--
+}
+
 func (brq *blockRetrievalQueue) shutdownRetrieval() {
 	retrieval := brq.popIfNotEmpty()
 	if retrieval != nil {
@@ -194,8 +364,9 @@ func (brq *blockRetrievalQueue) notifyWorker(priority int) {
 	// highly improbable), requests of one type could starve the other. By
 	// design, on-demand requests _should_ starve prefetch requests, so this is
 	// a problem only if prefetch requests can starve on-demand workers. But
-	// because there are far more on-demand workers than prefetch workers, this
-	// should never actually happen.
+	// because there are far more on-demand workers than prefetch workers, and
+	// some on-demand workers are reserved and never take prefetch requests
+	// (see popForOnDemandWorker), this should never actually happen.
 	workerCh := brq.workerCh
 	if priority < defaultOnDemandRequestPriority {
 		workerCh = brq.prefetchWorkerCh
@@ -317,7 +488,29 @@ func (brq *blockRetrievalQueue) Request(ctx context.Context,
 	}
 
 	bpLookup := blockPtrLookup{ptr, reflect.TypeOf(block)}
+	maxQueued := 0
+	if isPrefetchRequest(ctx) {
+		maxQueued = brq.config.Tunables().MaxQueuedBlockRetrievals
+	}
+	if !brq.insertRequest(ctx, priority, kmd, ptr, block, lifetime, bpLookup,
+		maxQueued, ch) {
+		// Cancel outside of `brq.mtx`, since the prefetcher may call
+		// back into the queue.
+		brq.Prefetcher().CancelPrefetch(ptr.ID)
+		ch <- blockRetrievalQueueFullError{ptr.ID, maxQueued}
+	}
+	return ch
+}
 
+// insertRequest adds a request for `bpLookup` to the heap, or joins
+// it to an existing retrieval for the same block.  If `maxQueued` is
+// positive and a new retrieval would grow the heap beyond it, it
+// inserts nothing and returns false; the capacity check and the
+// insert happen under the same lock.
+func (brq *blockRetrievalQueue) insertRequest(ctx context.Context,
+	priority int, kmd KeyMetadata, ptr BlockPointer, block Block,
+	lifetime BlockCacheLifetime, bpLookup blockPtrLookup, maxQueued int,
+	ch chan error) bool {
 	brq.mtx.Lock()
 	defer brq.mtx.Unlock()
 	// We might have to retry if the context has been canceled.  This loop will
@@ -327,6 +520,9 @@ func (brq *blockRetrievalQueue) Request(ctx context.Context,
 	for {
 		br, exists := brq.ptrs[bpLookup]
 		if !exists {
+			if maxQueued > 0 && brq.heap.Len() >= maxQueued {
+				return false
+			}
 			// Add to the heap
 			br = &blockRetrieval{
 				blockPtr:       ptr,
@@ -340,6 +536,12 @@ func (brq *blockRetrievalQueue) Request(ctx context.Context,
 			brq.insertionCount++
 			brq.ptrs[bpLookup] = br
 			heap.Push(brq.heap, br)
+			if group, ok := blockRetrievalGroupFromContext(ctx); ok {
+				if _, exists := brq.groups[group.blockRetrievalGroupKey]; !exists {
+					br.group = &group
+					brq.groups[group.blockRetrievalGroupKey] = br
+				}
+			}
 			brq.notifyWorker(priority)
 		} else {
 			err := br.ctx.AddContext(ctx)
@@ -376,7 +578,7 @@ func (brq *blockRetrievalQueue) Request(ctx context.Context,
 				brq.notifyWorker(priority)
 			}
 		}
-		return ch
+		return true
 	}
 }
 
@@ -23,6 +23,7 @@ type testBlockRetrievalConfig struct {
 	*testDiskBlockCacheGetter
 	*testSyncedTlfGetterSetter
 	initModeGetter
+	tunables Tunables
 }
 
 func newTestBlockRetrievalConfig(t *testing.T, bg blockGetter,
@@ -35,6 +36,7 @@ func newTestBlockRetrievalConfig(t *testing.T, bg blockGetter,
 		newTestDiskBlockCacheGetter(t, dbc),
 		newTestSyncedTlfGetterSetter(),
 		testInitModeGetter{InitDefault},
+		DefaultTunables(),
 	}
 }
 
@@ -50,6 +52,10 @@ func (c testBlockRetrievalConfig) blockGetter() blockGetter {
 	return c.bg
 }
 
+func (c testBlockRetrievalConfig) Tunables() Tunables {
+	return c.tunables
+}
+
 func makeRandomBlockPointer(t *testing.T) BlockPointer {
 	id, err := kbfsblock.MakeTemporaryID()
 	require.NoError(t, err)
@@ -128,6 +134,43 @@ func TestBlockRetrievalQueuePreemptPriority(t *testing.T) {
 	require.Equal(t, uint64(0), br.insertionOrder)
 }
 
+func TestBlockRetrievalQueueForegroundPreemptsBackground(t *testing.T) {
+	t.Log("A foreground request preempts queued background requests.")
+	q := newBlockRetrievalQueue(0, 0, newTestBlockRetrievalConfig(t, nil, nil))
+	require.NotNil(t, q)
+	defer q.Shutdown()
+
+	ctx := context.Background()
+	ptr1 := makeRandomBlockPointer(t)
+	ptr2 := makeRandomBlockPointer(t)
+	ptr3 := makeRandomBlockPointer(t)
+	block := &DirBlock{}
+	t.Log("Request background retrievals for ptr1 and ptr2, and then a " +
+		"foreground retrieval for ptr3.")
+	_ = q.Request(ctx, backgroundRequestPriority, makeKMD(), ptr1, block,
+		TransientEntry)
+	_ = q.Request(ctx, backgroundRequestPriority, makeKMD(), ptr2, block,
+		TransientEntry)
+	_ = q.Request(ctx, defaultOnDemandRequestPriority, makeKMD(), ptr3,
+		block, TransientEntry)
+
+	t.Log("Begin working on the foreground ptr3 request.")
+	br := q.popIfNotEmpty()
+	defer q.FinalizeRequest(br, &DirBlock{}, io.EOF)
+	require.Equal(t, ptr3, br.blockPtr)
+	require.Equal(t, defaultOnDemandRequestPriority, br.priority)
+
+	t.Log("Then work on the background requests in order.")
+	br = q.popIfNotEmpty()
+	defer q.FinalizeRequest(br, &DirBlock{}, io.EOF)
+	require.Equal(t, ptr1, br.blockPtr)
+	require.Equal(t, backgroundRequestPriority, br.priority)
+	br = q.popIfNotEmpty()
+	defer q.FinalizeRequest(br, &DirBlock{}, io.EOF)
+	require.Equal(t, ptr2, br.blockPtr)
+	require.Equal(t, backgroundRequestPriority, br.priority)
+}
+
 func TestBlockRetrievalQueueInterleavedPreemption(t *testing.T) {
 	t.Log("Handle a first request and then preempt another one.")
 	q := newBlockRetrievalQueue(0, 0, newTestBlockRetrievalConfig(t, nil, nil))
@@ -288,3 +331,61 @@ func TestBlockRetrievalQueueCurrentlyProcessingRequest(t *testing.T) {
 	require.Len(t, br.requests, 1)
 	require.Equal(t, block, br.requests[0].block)
 }
+
+func TestBlockRetrievalQueueMaxQueuedRetrievals(t *testing.T) {
+	t.Log("Fill the queue to capacity, and make sure only prefetch " +
+		"requests are rejected.")
+	config := newTestBlockRetrievalConfig(t, nil, nil)
+	config.tunables.MaxQueuedBlockRetrievals = 2
+	q := newBlockRetrievalQueue(0, 0, config)
+	require.NotNil(t, q)
+	defer q.Shutdown()
+
+	ctx := context.Background()
+	prefetchCtx := context.WithValue(ctx, ctxPrefetchIDKey, "prefetch")
+	ptr1 := makeRandomBlockPointer(t)
+	ptr2 := makeRandomBlockPointer(t)
+	ptr3 := makeRandomBlockPointer(t)
+	ptr4 := makeRandomBlockPointer(t)
+	ptr5 := makeRandomBlockPointer(t)
+	block := &FileBlock{}
+	t.Log("Fill the queue with two prefetch requests.")
+	_ = q.Request(prefetchCtx, 1, makeKMD(), ptr1, block, NoCacheEntry)
+	_ = q.Request(prefetchCtx, 1, makeKMD(), ptr2, block, NoCacheEntry)
+
+	t.Log("Another prefetch request for a new block is rejected.")
+	ch := q.Request(prefetchCtx, 1, makeKMD(), ptr3, block, NoCacheEntry)
+	err := <-ch
+	require.IsType(t, blockRetrievalQueueFullError{}, err)
+
+	t.Log("A prefetch request for an already-queued block is admitted.")
+	ch = q.Request(prefetchCtx, 1, makeKMD(), ptr1, block, NoCacheEntry)
+	select {
+	case err := <-ch:
+		t.Fatalf("Unexpected result for queued block: %+v", err)
+	default:
+	}
+
+	t.Log("A background on-demand request is admitted despite the " +
+		"full queue.")
+	ch = q.Request(ctx, backgroundRequestPriority, makeKMD(), ptr5, block,
+		NoCacheEntry)
+	select {
+	case err := <-ch:
+		t.Fatalf("Unexpected result for background request: %+v", err)
+	default:
+	}
+
+	t.Log("An on-demand request is admitted despite the full queue.")
+	_ = q.Request(ctx, defaultOnDemandRequestPriority, makeKMD(), ptr4,
+		block, NoCacheEntry)
+
+	t.Log("The retrievals come out in priority, then FIFO, order.")
+	for _, ptr := range []BlockPointer{ptr4, ptr5, ptr1, ptr2} {
+		br := q.popIfNotEmpty()
+		require.NotNil(t, br)
+		require.Equal(t, ptr, br.blockPtr)
+		q.FinalizeRequest(br, &FileBlock{}, io.EOF)
+	}
+	require.Nil(t, q.popIfNotEmpty())
+}
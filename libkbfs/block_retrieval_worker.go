@@ -6,6 +6,8 @@ package libkbfs
 
 import (
 	"io"
+
+	"golang.org/x/net/context"
 )
 
 // blockRetrievalWorker processes blockRetrievalQueue requests
@@ -14,6 +16,9 @@ type blockRetrievalWorker struct {
 	stopCh chan struct{}
 	queue  *blockRetrievalQueue
 	workCh <-chan struct{}
+	// onDemand is true if this worker is notified of on-demand
+	// requests, rather than prefetch requests.
+	onDemand bool
 }
 
 // run runs the worker loop until Shutdown is called
@@ -32,12 +37,13 @@ func (brw *blockRetrievalWorker) run() {
 // blockRetrievalQueue, using the passed in blockGetter to obtain blocks for
 // requests.
 func newBlockRetrievalWorker(bg blockGetter, q *blockRetrievalQueue,
-	workCh <-chan struct{}) *blockRetrievalWorker {
+	workCh <-chan struct{}, onDemand bool) *blockRetrievalWorker {
 	brw := &blockRetrievalWorker{
 		blockGetter: bg,
 		stopCh:      make(chan struct{}),
 		queue:       q,
 		workCh:      workCh,
+		onDemand:    onDemand,
 	}
 	go brw.run()
 	return brw
@@ -46,12 +52,23 @@ func newBlockRetrievalWorker(bg blockGetter, q *blockRetrievalQueue,
 // HandleRequest is the main work method for the worker. It obtains a
 // blockRetrieval from the queue, retrieves the block using
 // blockGetter.getBlock, and responds to the subscribed requestors with the
-// results.
+// results.  If the retrieval is grouped, and the blockGetter can
+// fetch several blocks at once, any queued retrievals for the
+// adjacent children of the same indirect block are fetched along
+// with it.
 func (brw *blockRetrievalWorker) HandleRequest() (err error) {
 	var retrieval *blockRetrieval
 	select {
 	case <-brw.workCh:
-		retrieval = brw.queue.popIfNotEmpty()
+		if brw.onDemand {
+			var isPrefetch bool
+			retrieval, isPrefetch = brw.queue.popForOnDemandWorker()
+			if isPrefetch {
+				defer brw.queue.doneWithPrefetch()
+			}
+		} else {
+			retrieval = brw.queue.popIfNotEmpty()
+		}
 		if retrieval == nil {
 			return nil
 		}
@@ -59,6 +76,16 @@ func (brw *blockRetrievalWorker) HandleRequest() (err error) {
 		return io.EOF
 	}
 
+	if getter, ok := brw.blockGetter.(multiBlockGetter); ok &&
+		retrieval.group != nil && getter.canGetBlocks() {
+		next := brw.queue.popGroupAfter(retrieval, maxBlocksPerGroupFetch)
+		if len(next) > 0 {
+			brw.handleGroup(
+				getter, append([]*blockRetrieval{retrieval}, next...))
+			return nil
+		}
+	}
+
 	var block Block
 	defer func() {
 		brw.queue.FinalizeRequest(retrieval, block, err)
@@ -80,6 +107,54 @@ func (brw *blockRetrievalWorker) HandleRequest() (err error) {
 	return brw.getBlock(retrieval.ctx, retrieval.kmd, retrieval.blockPtr, block)
 }
 
+// handleGroup fetches the blocks for `retrievals` in a single call
+// to `getter`, and finalizes each of the retrievals.  Retrievals
+// whose contexts have already been canceled are finalized without
+// being fetched.
+func (brw *blockRetrievalWorker) handleGroup(
+	getter multiBlockGetter, retrievals []*blockRetrieval) {
+	var ctx *CoalescingContext
+	live := make([]*blockRetrieval, 0, len(retrievals))
+	ptrs := make([]BlockPointer, 0, len(retrievals))
+	blocks := make([]Block, 0, len(retrievals))
+	for _, retrieval := range retrievals {
+		var block Block
+		func() {
+			retrieval.reqMtx.RLock()
+			defer retrieval.reqMtx.RUnlock()
+			block = retrieval.requests[0].block.NewEmpty()
+		}()
+
+		select {
+		case <-retrieval.ctx.Done():
+			brw.queue.FinalizeRequest(retrieval, block, retrieval.ctx.Err())
+			continue
+		default:
+		}
+
+		if ctx == nil {
+			var cancel context.CancelFunc
+			ctx, cancel = NewCoalescingContext(retrieval.ctx)
+			defer cancel()
+		} else {
+			// If this retrieval's context was canceled in the
+			// meantime, it will just be fetched anyway.
+			_ = ctx.AddContext(retrieval.ctx)
+		}
+		live = append(live, retrieval)
+		ptrs = append(ptrs, retrieval.blockPtr)
+		blocks = append(blocks, block)
+	}
+	if len(live) == 0 {
+		return
+	}
+
+	errs := getter.getBlocks(ctx, live[0].kmd, ptrs, blocks)
+	for i, retrieval := range live {
+		brw.queue.FinalizeRequest(retrieval, blocks[i], errs[i])
+	}
+}
+
 // Shutdown shuts down the blockRetrievalWorker once its current work is done.
 func (brw *blockRetrievalWorker) Shutdown() {
 	select {
@@ -378,3 +378,165 @@ func TestBlockRetrievalWorkerPrefetchedPriorityElevation(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, testBlock1, block1)
 }
+
+func TestBlockRetrievalWorkerReservedOnDemandWorkers(t *testing.T) {
+	t.Log("Test that a flood of prefetches can't occupy the on-demand " +
+		"workers reserved for on-demand requests.")
+	bg := newFakeBlockGetter(false)
+	config := newTestBlockRetrievalConfig(t, bg, nil)
+	config.tunables.ReservedOnDemandWorkerFraction = 0.5
+	q := newBlockRetrievalQueue(2, 1, config)
+	require.NotNil(t, q)
+	defer q.Shutdown()
+
+	t.Log("Setup source blocks")
+	const numPrefetches = 4
+	ptrs := make([]BlockPointer, numPrefetches)
+	startChs := make([]<-chan struct{}, numPrefetches)
+	continueChs := make([]chan<- error, numPrefetches)
+	for i := range ptrs {
+		ptrs[i] = makeRandomBlockPointer(t)
+		startChs[i], continueChs[i] = bg.setBlockToReturn(
+			ptrs[i], makeFakeFileBlock(t, false))
+	}
+	onDemandPtr := makeRandomBlockPointer(t)
+	onDemandBlock := makeFakeFileBlock(t, false)
+	onDemandStartCh, onDemandContinueCh := bg.setBlockToReturn(
+		onDemandPtr, onDemandBlock)
+
+	t.Log("Flood the queue with prefetches. The prefetch worker takes " +
+		"the first one.")
+	reqChs := make([]<-chan error, numPrefetches)
+	for i := range ptrs {
+		reqChs[i] = q.Request(context.Background(), 1, makeKMD(), ptrs[i],
+			&FileBlock{}, NoCacheEntry)
+	}
+	<-startChs[0]
+
+	t.Log("Wake up both on-demand workers, as if they'd been notified " +
+		"in place of the prefetch workers. Only one of them may take a " +
+		"prefetch.")
+	q.notifyWorker(defaultOnDemandRequestPriority)
+	q.notifyWorker(defaultOnDemandRequestPriority)
+	<-startChs[1]
+
+	t.Log("Make an on-demand request, which the reserved worker must " +
+		"serve even though all the other workers are busy.")
+	block := &FileBlock{}
+	onDemandReqCh := q.Request(context.Background(),
+		defaultOnDemandRequestPriority, makeKMD(), onDemandPtr, block,
+		NoCacheEntry)
+	select {
+	case <-onDemandStartCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("On-demand request wasn't started by a reserved worker")
+	}
+	onDemandContinueCh <- nil
+	err := <-onDemandReqCh
+	require.NoError(t, err)
+	require.Equal(t, onDemandBlock, block)
+
+	t.Log("Let all the prefetches complete.")
+	for i := range ptrs {
+		continueChs[i] <- nil
+		err := <-reqChs[i]
+		require.NoError(t, err)
+	}
+}
+
+// fakeMultiBlockGetter is a fakeBlockGetter that can also fetch
+// several blocks at once, and records the pointers of each batch.
+type fakeMultiBlockGetter struct {
+	*fakeBlockGetter
+
+	batchMtx sync.Mutex
+	batches  [][]BlockPointer
+}
+
+func (bg *fakeMultiBlockGetter) canGetBlocks() bool {
+	return true
+}
+
+func (bg *fakeMultiBlockGetter) getBlocks(ctx context.Context,
+	kmd KeyMetadata, ptrs []BlockPointer, blocks []Block) []error {
+	bg.batchMtx.Lock()
+	bg.batches = append(bg.batches, ptrs)
+	bg.batchMtx.Unlock()
+
+	bg.mtx.RLock()
+	defer bg.mtx.RUnlock()
+	errs := make([]error, len(ptrs))
+	for i, ptr := range ptrs {
+		errs[i] = bg.assembleBlock(ctx, kmd, ptr, blocks[i], nil,
+			kbfscrypto.BlockCryptKeyServerHalf{})
+	}
+	return errs
+}
+
+func TestBlockRetrievalWorkerGroupedRequests(t *testing.T) {
+	t.Log("Test that queued requests for adjacent children of the same " +
+		"indirect block are fetched in one batch.")
+	bg := &fakeMultiBlockGetter{fakeBlockGetter: newFakeBlockGetter(false)}
+	q := newBlockRetrievalQueue(0, 1, newTestBlockRetrievalConfig(t, bg, nil))
+	require.NotNil(t, q)
+	defer q.Shutdown()
+
+	busyPtr := makeRandomBlockPointer(t)
+	busyStartCh, busyContinueCh := bg.setBlockToReturn(
+		busyPtr, makeFakeFileBlock(t, false))
+	parentID := makeRandomBlockPointer(t).ID
+	offs := []int64{0, 10, 20}
+	ptrs := make([]BlockPointer, len(offs))
+	expected := make([]*FileBlock, len(offs))
+	blocks := make([]*FileBlock, len(offs))
+	reqChs := make([]<-chan error, len(offs))
+	for i := range offs {
+		ptrs[i] = makeRandomBlockPointer(t)
+		expected[i] = makeFakeFileBlock(t, false)
+		_, _ = bg.setBlockToReturn(ptrs[i], expected[i])
+	}
+	otherPtr := makeRandomBlockPointer(t)
+	otherBlock := makeFakeFileBlock(t, false)
+	_, otherContinueCh := bg.setBlockToReturn(otherPtr, otherBlock)
+
+	t.Log("Keep the only worker busy while the grouped requests queue up.")
+	busyCh := q.Request(context.Background(), 1, makeKMD(), busyPtr,
+		&FileBlock{}, NoCacheEntry)
+	<-busyStartCh
+
+	for i, off := range offs {
+		nextOff := int64(-1)
+		if i+1 < len(offs) {
+			nextOff = offs[i+1]
+		}
+		ctx := withBlockRetrievalGroup(
+			context.Background(), parentID, off, nextOff)
+		blocks[i] = &FileBlock{}
+		reqChs[i] = q.Request(ctx, 1, makeKMD(), ptrs[i], blocks[i],
+			NoCacheEntry)
+	}
+
+	t.Log("A child of a different parent isn't part of the batch.")
+	otherCtx := withBlockRetrievalGroup(context.Background(),
+		makeRandomBlockPointer(t).ID, offs[1], -1)
+	block := &FileBlock{}
+	otherCh := q.Request(otherCtx, 1, makeKMD(), otherPtr, block,
+		NoCacheEntry)
+
+	busyContinueCh <- nil
+	require.NoError(t, <-busyCh)
+	for i := range reqChs {
+		require.NoError(t, <-reqChs[i])
+		require.Equal(t, expected[i], blocks[i])
+	}
+	otherContinueCh <- nil
+	require.NoError(t, <-otherCh)
+	require.Equal(t, otherBlock, block)
+
+	t.Log("Wait for the prefetcher to finish with the fetched blocks.")
+	<-q.Prefetcher().Shutdown()
+
+	bg.batchMtx.Lock()
+	defer bg.batchMtx.Unlock()
+	require.Equal(t, [][]BlockPointer{ptrs}, bg.batches)
+}
@@ -115,6 +115,12 @@ type DirBlock struct {
 	Children map[string]DirEntry `codec:"c,omitempty"`
 	// if indirect, contains the indirect pointers to the next level of blocks
 	IPtrs []IndirectDirPtr `codec:"i,omitempty"`
+
+	// assembledFrom holds the pointers of the indirect dir block
+	// this (direct) block was assembled from, if any, so that a
+	// sync can tell which of the old child blocks it may reuse or
+	// must unreference.  It is never serialized.
+	assembledFrom []IndirectDirPtr
 }
 
 // NewDirBlock creates a new, empty DirBlock.
@@ -140,6 +146,7 @@ func (db *DirBlock) Set(other Block) {
 	dbCopy := otherDb.DeepCopy()
 	db.Children = dbCopy.Children
 	db.IPtrs = dbCopy.IPtrs
+	db.assembledFrom = dbCopy.assembledFrom
 	db.ToCommonBlock().Set(dbCopy.ToCommonBlock())
 }
 
@@ -149,15 +156,33 @@ func (db *DirBlock) DeepCopy() *DirBlock {
 	for k, v := range db.Children {
 		childrenCopy[k] = v
 	}
-	// TODO KBFS-3: add a copy for IPtrs too once we support indirect dir
-	// blocks
+	var iptrsCopy []IndirectDirPtr
+	if db.IPtrs != nil {
+		iptrsCopy = make([]IndirectDirPtr, len(db.IPtrs))
+		copy(iptrsCopy, db.IPtrs)
+	}
+	var assembledFromCopy []IndirectDirPtr
+	if db.assembledFrom != nil {
+		assembledFromCopy = make([]IndirectDirPtr, len(db.assembledFrom))
+		copy(assembledFromCopy, db.assembledFrom)
+	}
 	return &DirBlock{
-		CommonBlock: db.CommonBlock.DeepCopy(),
-		Children:    childrenCopy,
-		IPtrs:       db.IPtrs,
+		CommonBlock:   db.CommonBlock.DeepCopy(),
+		Children:      childrenCopy,
+		IPtrs:         iptrsCopy,
+		assembledFrom: assembledFromCopy,
 	}
 }
 
+// DataVersion returns data version for this block, which is assumed
+// to have been modified locally.
+func (db *DirBlock) DataVersion() DataVer {
+	if db.IsInd {
+		return IndirectDirsDataVer
+	}
+	return FirstValidDataVer
+}
+
 // FileBlock is the contents of a file
 type FileBlock struct {
 	CommonBlock
@@ -94,9 +94,11 @@ func doOneBlockPut(ctx context.Context, bserv BlockServer, reporter Reporter,
 //
 // Returns a slice of block pointers that resulted in recoverable
 // errors and should be removed by the caller from any saved state.
+// At most `maxParallelPuts` blocks are put at the same time.
 func doBlockPuts(ctx context.Context, bserv BlockServer, bcache BlockCache,
 	reporter Reporter, log, deferLog traceLogger, tlfID tlf.ID, tlfName tlf.CanonicalName,
-	bps blockPutState) (blocksToRemove []BlockPointer, err error) {
+	bps blockPutState, maxParallelPuts int) (
+	blocksToRemove []BlockPointer, err error) {
 	blockCount := len(bps.blockStates)
 	log.LazyTrace(ctx, "doBlockPuts with %d blocks", blockCount)
 	defer func() {
@@ -108,8 +110,8 @@ func doBlockPuts(ctx context.Context, bserv BlockServer, bcache BlockCache,
 	blocks := make(chan blockState, len(bps.blockStates))
 
 	numWorkers := len(bps.blockStates)
-	if numWorkers > maxParallelBlockPuts {
-		numWorkers = maxParallelBlockPuts
+	if numWorkers > maxParallelPuts {
+		numWorkers = maxParallelPuts
 	}
 	// A channel to list any blocks that have been archived or
 	// deleted.  Any of these will result in an error, so the maximum
@@ -178,20 +180,43 @@ func assembleBlock(ctx context.Context, keyGetter blockKeyGetter,
 		return err
 	}
 
+	return assembleBlockWithKey(codec, cryptoPure, blockPtr, block, buf,
+		blockServerHalf, tlfCryptKey)
+}
+
+// assembleBlockWithKey is like assembleBlock, but decrypts the block
+// with the given TLF crypt key instead of resolving one.  It assumes
+// `buf` has already been verified against `blockPtr.ID`.
+func assembleBlockWithKey(codec kbfscodec.Codec, cryptoPure cryptoPure,
+	blockPtr BlockPointer, block Block, buf []byte,
+	blockServerHalf kbfscrypto.BlockCryptKeyServerHalf,
+	tlfCryptKey kbfscrypto.TLFCryptKey) error {
 	// construct the block crypt key
 	blockCryptKey := kbfscrypto.UnmaskBlockCryptKey(
 		blockServerHalf, tlfCryptKey)
 
 	var encryptedBlock kbfscrypto.EncryptedBlock
-	err = codec.Decode(buf, &encryptedBlock)
+	err := codec.Decode(buf, &encryptedBlock)
 	if err != nil {
 		return err
 	}
 
 	// decrypt the block
-	err = cryptoPure.DecryptBlock(encryptedBlock, blockCryptKey, block)
-	if err != nil {
-		return err
+	if blockCodec := blockCodecForPointer(codec, blockPtr); blockCodec != nil {
+		encodedBlock, err := cryptoPure.DecryptEncodedBlock(
+			encryptedBlock, blockCryptKey)
+		if err != nil {
+			return err
+		}
+		err = blockCodec.Decode(encodedBlock, block)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = cryptoPure.DecryptBlock(encryptedBlock, blockCryptKey, block)
+		if err != nil {
+			return err
+		}
 	}
 
 	block.SetEncodedSize(uint32(len(buf)))
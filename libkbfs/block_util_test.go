@@ -2,10 +2,14 @@ package libkbfs
 
 import (
 	"errors"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/keybase/client/go/logger"
 	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/tlf"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
@@ -99,3 +103,81 @@ func TestBlockUtilPutFail(t *testing.T) {
 	err := putBlockToServer(ctx, bserver, tlfID, blockPtr, readyBlockData)
 	require.Equal(t, expectedErr, err)
 }
+
+// concurrencyCountingBlockServer counts how many Puts are in
+// progress at once.  Each Put blocks until releaseCh is closed.
+type concurrencyCountingBlockServer struct {
+	BlockServer
+	startedCh chan struct{}
+	releaseCh chan struct{}
+
+	lock    sync.Mutex
+	curr    int
+	maxSeen int
+}
+
+func (b *concurrencyCountingBlockServer) Put(
+	ctx context.Context, tlfID tlf.ID, id kbfsblock.ID,
+	bCtx kbfsblock.Context, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	b.lock.Lock()
+	b.curr++
+	if b.curr > b.maxSeen {
+		b.maxSeen = b.curr
+	}
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.curr--
+	}()
+
+	b.startedCh <- struct{}{}
+	select {
+	case <-b.releaseCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestBlockUtilDoBlockPutsMaxParallel(t *testing.T) {
+	const numBlocks = 20
+	const maxParallelPuts = 3
+	bserver := &concurrencyCountingBlockServer{
+		startedCh: make(chan struct{}, numBlocks),
+		releaseCh: make(chan struct{}),
+	}
+	bps := newBlockPutState(numBlocks)
+	for i := 0; i < numBlocks; i++ {
+		bps.addNewBlock(BlockPointer{ID: kbfsblock.FakeID(byte(i))},
+			&FileBlock{}, ReadyBlockData{buf: []byte{byte(i)}}, nil)
+	}
+
+	ctx := context.Background()
+	log := traceLogger{logger.NewTestLogger(t)}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := doBlockPuts(ctx, bserver, nil, nil, log, log,
+			tlf.FakeID(1, tlf.Private), "", *bps, maxParallelPuts)
+		errCh <- err
+	}()
+
+	// Wait for the maximum number of puts to start, and make sure no
+	// more start while they're blocked.
+	for i := 0; i < maxParallelPuts; i++ {
+		<-bserver.startedCh
+	}
+	select {
+	case <-bserver.startedCh:
+		t.Fatal("Too many parallel puts")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(bserver.releaseCh)
+	err := <-errCh
+	require.NoError(t, err)
+	bserver.lock.Lock()
+	defer bserver.lock.Unlock()
+	require.Equal(t, maxParallelPuts, bserver.maxSeen)
+}
@@ -0,0 +1,64 @@
+// Copyright 2026 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+// splitHintBlockSplitter is a BlockSplitter that splits file data
+// into leaf blocks of a fixed target size, overriding the boundaries
+// chosen by the wrapped BlockSplitter.  It's used when syncing a file
+// with a split hint, e.g. to make bigger blocks for an append-only
+// log.  All other methods come from the wrapped BlockSplitter.
+type splitHintBlockSplitter struct {
+	BlockSplitter
+	targetSize int64
+}
+
+var _ BlockSplitter = splitHintBlockSplitter{}
+
+// newSplitHintBlockSplitter wraps `bsplit` so that it splits leaf
+// blocks at `targetSize` bytes, capped at the MaxSize of `bsplit`.
+func newSplitHintBlockSplitter(
+	bsplit BlockSplitter, targetSize int64) splitHintBlockSplitter {
+	if maxSize := bsplit.MaxSize(); targetSize > maxSize {
+		targetSize = maxSize
+	}
+	return splitHintBlockSplitter{bsplit, targetSize}
+}
+
+// CopyUntilSplit implements the BlockSplitter interface for
+// splitHintBlockSplitter.
+func (s splitHintBlockSplitter) CopyUntilSplit(
+	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+	currLen := int64(len(block.Contents))
+	toCopy := int64(len(data))
+	if off+toCopy > currLen {
+		// Only grow the block up to the target size.
+		if off+toCopy > s.targetSize {
+			toCopy = s.targetSize - off
+		}
+		if toCopy <= 0 {
+			return 0
+		}
+		if off+toCopy > currLen {
+			block.Contents = append(
+				block.Contents, make([]byte, off+toCopy-currLen)...)
+		}
+	}
+	copy(block.Contents[off:], data[:toCopy])
+	return toCopy
+}
+
+// CheckSplit implements the BlockSplitter interface for
+// splitHintBlockSplitter.
+func (s splitHintBlockSplitter) CheckSplit(block *FileBlock) int64 {
+	size := int64(len(block.Contents))
+	switch {
+	case size > s.targetSize:
+		return s.targetSize
+	case size < s.targetSize:
+		return -1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2026 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+// layoutBlockSplitter is a BlockSplitter for writing data whose block
+// boundaries were chosen by the caller, rather than by the configured
+// splitter.  It never appends data to the end of a non-empty block,
+// so each range of data written separately starts a new block, and
+// it copies as much of each range into that block as the wrapped
+// BlockSplitter's MaxSize allows; any remainder spills into more
+// blocks.  All other methods come from the wrapped BlockSplitter.
+type layoutBlockSplitter struct {
+	BlockSplitter
+}
+
+var _ BlockSplitter = layoutBlockSplitter{}
+
+// CopyUntilSplit implements the BlockSplitter interface for
+// layoutBlockSplitter.
+func (l layoutBlockSplitter) CopyUntilSplit(
+	block *FileBlock, lastBlock bool, data []byte, off int64) int64 {
+	currLen := int64(len(block.Contents))
+	if currLen > 0 && off >= currLen {
+		// Force a new block to start here.
+		return 0
+	}
+
+	n := int64(len(data))
+	if maxSize := l.MaxSize(); off+n > maxSize {
+		n = maxSize - off
+		if n <= 0 {
+			return 0
+		}
+	}
+	if off+n > currLen {
+		block.Contents = append(
+			block.Contents, make([]byte, off+n-currLen)...)
+	}
+	copy(block.Contents[off:], data[:n])
+	return n
+}
@@ -135,6 +135,12 @@ func (b *BlockSplitterSimple) CheckSplit(block *FileBlock) int64 {
 	return 0
 }
 
+// MaxSize implements the BlockSplitter interface for
+// BlockSplitterSimple.
+func (b *BlockSplitterSimple) MaxSize() int64 {
+	return b.maxSize
+}
+
 // MaxPtrsPerBlock implements the BlockSplitter interface for
 // BlockSplitterSimple.
 func (b *BlockSplitterSimple) MaxPtrsPerBlock() int {
@@ -0,0 +1,60 @@
+// Copyright 2026 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"sync"
+	"time"
+)
+
+// ClockWithSkew wraps a Clock, and keeps track of how far ahead of
+// it the timestamps provided by other parties (like the writer of an
+// MD revision, or of a file's mtime) have been observed to be.
+// Install it with Config.SetClock to make the skew available for
+// diagnostics.
+type ClockWithSkew struct {
+	Clock
+
+	lock    sync.Mutex
+	maxSkew time.Duration
+}
+
+var _ Clock = (*ClockWithSkew)(nil)
+
+// NewClockWithSkew returns a new ClockWithSkew wrapping the given
+// clock.
+func NewClockWithSkew(clock Clock) *ClockWithSkew {
+	return &ClockWithSkew{Clock: clock}
+}
+
+// ReportTimestamp records a timestamp provided by another party, and
+// returns how far it is ahead of the local clock (negative if it's
+// in the past).
+func (c *ClockWithSkew) ReportTimestamp(ts time.Time) time.Duration {
+	skew := ts.Sub(c.Now())
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if skew > c.maxSkew {
+		c.maxSkew = skew
+	}
+	return skew
+}
+
+// MaxSkew returns the furthest any reported timestamp has been ahead
+// of the local clock, or 0 if none of them have been.
+func (c *ClockWithSkew) MaxSkew() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.maxSkew
+}
+
+// reportClockSkew returns how far `ts` is ahead of the current time
+// of `clock`, and records it if `clock` is a ClockWithSkew.
+func reportClockSkew(clock Clock, ts time.Time) time.Duration {
+	if c, ok := clock.(*ClockWithSkew); ok {
+		return c.ReportTimestamp(ts)
+	}
+	return ts.Sub(clock.Now())
+}
@@ -34,6 +34,8 @@ import (
 const (
 	// Max supported size of a directory entry name.
 	maxNameBytesDefault = 255
+	// Max supported plaintext size of a file in KBFS.
+	maxFileBytesDefault = 1 << 40
 	// Maximum supported plaintext size of a directory in KBFS. TODO:
 	// increase this once we support levels of indirection for
 	// directories.
@@ -47,6 +49,9 @@ const (
 	qrPeriodDefault = 1 * time.Minute
 	// How long must something be unreferenced before we reclaim it?
 	qrUnrefAgeDefault = 1 * time.Minute
+	// How far in the future can an MD timestamp be before we stop
+	// trusting it for QR purposes?
+	qrMaxClockSkewDefault = 5 * time.Minute
 	// How old must the most recent TLF revision be before another
 	// device can run QR on that TLF?  This is large, to avoid
 	// unnecessary conflicts on the TLF between devices.
@@ -107,6 +112,7 @@ type ConfigLocal struct {
 	kbCtx            Context
 
 	maxNameBytes  uint32
+	maxFileBytes  uint64
 	maxDirBytes   uint64
 	rekeyQueue    RekeyQueue
 	storageRoot   string
@@ -135,6 +141,13 @@ type ConfigLocal struct {
 	// before syncing a set of changes to the servers.
 	bgFlushPeriod time.Duration
 
+	// tunables holds the numeric settings that tune resource usage.
+	tunables Tunables
+
+	// dedupIndex, if non-nil, is the index that `bcache` was
+	// wrapped with by SetBlockDedupIndex.
+	dedupIndex BlockDedupIndex
+
 	// metadataVersion is the version to use when creating new metadata.
 	metadataVersion kbfsmd.MetadataVer
 
@@ -142,6 +155,9 @@ type ConfigLocal struct {
 
 	quotaUsage      map[keybase1.UserOrTeamID]*EventuallyConsistentQuotaUsage
 	rekeyFSMLimiter *OngoingWorkLimiter
+
+	// archivePointers is shared by the block managers of all folders.
+	archivePointers *archivePointersLimit
 }
 
 // DiskCacheMode represents the mode of initialization for the disk cache.
@@ -388,6 +404,7 @@ func NewConfigLocal(mode InitMode, loggerFn func(module string) logger.Logger,
 	config.SetRekeyQueue(NewRekeyQueueStandard(config))
 
 	config.maxNameBytes = maxNameBytesDefault
+	config.maxFileBytes = maxFileBytesDefault
 	config.maxDirBytes = maxDirBytesDefault
 	config.rwpWaitTime = rekeyWithPromptWaitTimeDefault
 
@@ -406,6 +423,9 @@ func NewConfigLocal(mode InitMode, loggerFn func(module string) logger.Logger,
 	config.tlfValidDuration = tlfValidDurationDefault
 	config.bgFlushDirOpBatchSize = bgFlushDirOpBatchSizeDefault
 	config.bgFlushPeriod = bgFlushPeriodDefault
+	config.tunables = DefaultTunables()
+	config.archivePointers = newArchivePointersLimit(
+		maxArchivePointersInFlightDefault)
 	config.metadataVersion = defaultClientMetadataVer
 	config.defaultBlockType = defaultBlockTypeDefault
 	config.quotaUsage =
@@ -795,7 +815,7 @@ func (c *ConfigLocal) SetMetadataVersion(mdVer kbfsmd.MetadataVer) {
 
 // DataVersion implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) DataVersion() DataVer {
-	return AtLeastTwoLevelsOfChildrenDataVer
+	return CompressedFileBlockContentsDataVer
 }
 
 // DefaultBlockType implements the Config interface for ConfigLocal.
@@ -894,6 +914,11 @@ func (c *ConfigLocal) MaxNameBytes() uint32 {
 	return c.maxNameBytes
 }
 
+// MaxFileBytes implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) MaxFileBytes() uint64 {
+	return c.maxFileBytes
+}
+
 // MaxDirBytes implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) MaxDirBytes() uint64 {
 	return c.maxDirBytes
@@ -1082,6 +1107,43 @@ func (c *ConfigLocal) BGFlushPeriod() time.Duration {
 	return c.bgFlushPeriod
 }
 
+// Tunables implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) Tunables() Tunables {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tunables
+}
+
+// SetTunables implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetTunables(t Tunables) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tunables = t
+	return nil
+}
+
+// SetBlockDedupIndex implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) SetBlockDedupIndex(index BlockDedupIndex) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dedupIndex = index
+	bcache := c.bcache
+	if d, ok := bcache.(dedupIndexBlockCache); ok {
+		bcache = d.BlockCache
+	}
+	c.bcache = NewBlockCacheWithDedupIndex(bcache, index)
+}
+
+// BlockDedupIndex implements the Config interface for ConfigLocal.
+func (c *ConfigLocal) BlockDedupIndex() BlockDedupIndex {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.dedupIndex
+}
+
 // Shutdown implements the Config interface for ConfigLocal.
 func (c *ConfigLocal) Shutdown(ctx context.Context) error {
 	c.RekeyQueue().Shutdown()
@@ -1448,6 +1510,12 @@ func (c *ConfigLocal) GetRekeyFSMLimiter() *OngoingWorkLimiter {
 	return c.rekeyFSMLimiter
 }
 
+// archivePointersLimit implements the archivePointersLimitGetter
+// interface for ConfigLocal.
+func (c *ConfigLocal) archivePointersLimit() *archivePointersLimit {
+	return c.archivePointers
+}
+
 // SetKBFSService sets the KBFSService for this ConfigLocal.
 func (c *ConfigLocal) SetKBFSService(k *KBFSService) {
 	c.lock.Lock()
@@ -127,11 +127,13 @@ func NewConfigMock(c *gomock.Controller, ctr *SafeTestReporter) *ConfigMock {
 	config.noBGFlush = true
 
 	config.maxNameBytes = maxNameBytesDefault
+	config.maxFileBytes = maxFileBytesDefault
 	config.maxDirBytes = maxDirBytesDefault
 	config.rwpWaitTime = rekeyWithPromptWaitTimeDefault
 
 	config.qrPeriod = 0 * time.Second // no auto reclamation
 	config.qrUnrefAge = qrUnrefAgeDefault
+	config.tunables = DefaultTunables()
 	config.SetMetadataVersion(defaultClientMetadataVer)
 
 	return config
@@ -2988,7 +2988,8 @@ func (cr *ConflictResolver) completeResolution(ctx context.Context,
 	// Put all the blocks.  TODO: deal with recoverable block errors?
 	_, err = doBlockPuts(ctx, cr.config.BlockServer(), cr.config.BlockCache(),
 		cr.config.Reporter(), cr.log, cr.deferLog, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+		md.GetTlfHandle().GetCanonicalName(), *bps,
+		cr.config.Tunables().MaxParallelBlockPuts)
 	if err != nil {
 		return err
 	}
@@ -184,7 +184,14 @@ func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 	if err != nil {
 		return -1, kbfscrypto.EncryptedBlock{}, err
 	}
+	return c.EncryptEncodedBlock(encodedBlock, key)
+}
 
+// EncryptEncodedBlock implements the Crypto interface for
+// CryptoCommon.
+func (c CryptoCommon) EncryptEncodedBlock(
+	encodedBlock []byte, key kbfscrypto.BlockCryptKey) (
+	plainSize int, encryptedBlock kbfscrypto.EncryptedBlock, err error) {
 	paddedBlock, err := c.padBlock(encodedBlock)
 	if err != nil {
 		return -1, kbfscrypto.EncryptedBlock{}, err
@@ -204,12 +211,7 @@ func (c CryptoCommon) EncryptBlock(block Block, key kbfscrypto.BlockCryptKey) (
 func (c CryptoCommon) DecryptBlock(
 	encryptedBlock kbfscrypto.EncryptedBlock, key kbfscrypto.BlockCryptKey,
 	block Block) error {
-	paddedBlock, err := kbfscrypto.DecryptBlock(encryptedBlock, key)
-	if err != nil {
-		return err
-	}
-
-	encodedBlock, err := c.depadBlock(paddedBlock)
+	encodedBlock, err := c.DecryptEncodedBlock(encryptedBlock, key)
 	if err != nil {
 		return err
 	}
@@ -220,3 +222,15 @@ func (c CryptoCommon) DecryptBlock(
 	}
 	return nil
 }
+
+// DecryptEncodedBlock implements the Crypto interface for
+// CryptoCommon.
+func (c CryptoCommon) DecryptEncodedBlock(
+	encryptedBlock kbfscrypto.EncryptedBlock,
+	key kbfscrypto.BlockCryptKey) ([]byte, error) {
+	paddedBlock, err := kbfscrypto.DecryptBlock(encryptedBlock, key)
+	if err != nil {
+		return nil, err
+	}
+	return c.depadBlock(paddedBlock)
+}
@@ -115,9 +115,21 @@ const (
 // arbitrary tree structure of blocks. However, we only write files
 // such that all paths to leaves have the same depth.
 //
+// 2.75) Since nothing inside a block says how it was encoded, DataVer
+// is also how a reader knows which format a block is in, when that
+// isn't plain msgpack: RawFileBlockContentsDataVer and
+// CompressedFileBlockContentsDataVer mark direct file blocks encoded
+// by RawFileBlockCodec and CompressedFileBlockCodec, and
+// IndirectDirsDataVer marks split directory blocks.  Each new format
+// gets the next DataVer, even though the formats aren't more capable
+// versions of each other, so that a client whose DataVersion()
+// predates a format refuses those blocks with a NewDataVersionError
+// (see checkDataVersion) instead of misreading them.
+//
 // Currently, in addition to 2.5, we have the following constraints on block
 // tree structures:
-// a) Direct blocks are always v1.
+// a) Direct blocks are always v1, unless their contents are in one of
+// the formats from 2.75.
 // b) Indirect blocks of depth 2 (meaning one indirect block pointing
 // to all direct blocks) can be v1 (if it has no holes) or v2 (if it has
 // holes). However, all its indirect pointers will have DataVer
@@ -144,6 +156,18 @@ const (
 	// blocks that have multiple levels of indirection below them
 	// (i.e., indirect blocks that point to other indirect blocks).
 	AtLeastTwoLevelsOfChildrenDataVer DataVer = 3
+	// RawFileBlockContentsDataVer is the data version for direct
+	// file blocks whose contents are stored raw by
+	// RawFileBlockCodec, rather than msgpack-encoded.
+	RawFileBlockContentsDataVer DataVer = 4
+	// IndirectDirsDataVer is the data version for indirect
+	// directory blocks, whose entries are split across child dir
+	// blocks.
+	IndirectDirsDataVer DataVer = 5
+	// CompressedFileBlockContentsDataVer is the data version for
+	// direct file blocks whose contents may be compressed by
+	// CompressedFileBlockCodec.
+	CompressedFileBlockContentsDataVer DataVer = 6
 )
 
 // BlockRef is a block ID/ref nonce pair, which defines a unique
@@ -271,6 +295,10 @@ type ReadyBlockData struct {
 	// These fields should not be used outside of putBlockToServer.
 	buf        []byte
 	serverHalf kbfscrypto.BlockCryptKeyServerHalf
+
+	// dataVer is the minimum data version needed by pointers to
+	// this block, because of the BlockCodec that encoded it.
+	dataVer DataVer
 }
 
 // GetEncodedSize returns the size of the encoded (and encrypted)
@@ -528,6 +556,13 @@ type EntryInfo struct {
 	TeamWriter keybase1.UID `codec:"tw,omitempty"`
 }
 
+// NamedEntryInfo is an EntryInfo along with the name of the entry in
+// its parent directory.
+type NamedEntryInfo struct {
+	Name string
+	EntryInfo
+}
+
 // ReportedError represents an error reported by KBFS.
 type ReportedError struct {
 	Time  time.Time
@@ -0,0 +1,145 @@
+// Copyright 2026 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	"github.com/keybase/kbfs/kbfscodec"
+)
+
+// dirEntryNameHash returns the hash of a directory entry name, which
+// decides the child block of an indirect dir block that holds the
+// entry.  Child blocks hold contiguous ranges of name hashes, so that
+// the entries of a huge directory are spread evenly over them, and
+// an update to a single entry only rewrites a single child block.
+func dirEntryNameHash(name string) string {
+	h := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(h[:])
+}
+
+// dirChildIndexForName returns the index of the pointer in `iptrs`,
+// which must be sorted by offset, whose range of name hashes covers
+// the given name.
+func dirChildIndexForName(iptrs []IndirectDirPtr, name string) int {
+	hash := dirEntryNameHash(name)
+	i := sort.Search(len(iptrs), func(i int) bool {
+		return iptrs[i].Off > hash
+	})
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
+
+type hashedDirEntryName struct {
+	hash string
+	name string
+}
+
+type hashedDirEntryNames []hashedDirEntryName
+
+func (h hashedDirEntryNames) Len() int           { return len(h) }
+func (h hashedDirEntryNames) Less(i, j int) bool { return h[i].hash < h[j].hash }
+func (h hashedDirEntryNames) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+// dirEntryRange is the set of entries that goes into a single child
+// block of an indirect dir block.
+type dirEntryRange struct {
+	// off is the smallest name hash that belongs in this range.
+	off   string
+	names hashedDirEntryNames
+	block *DirBlock
+	// buf is the encoding of `block`.
+	buf []byte
+	// oldPtr is the existing child block at the same offset, if
+	// any, and reused is true if it can be used for this range
+	// as-is, in which case `block` and `buf` are left empty.
+	oldPtr IndirectDirPtr
+	reused bool
+}
+
+func (r *dirEntryRange) encode(
+	codec kbfscodec.Codec, children map[string]DirEntry) error {
+	r.block = &DirBlock{Children: make(map[string]DirEntry, len(r.names))}
+	for _, n := range r.names {
+		r.block.Children[n.name] = children[n.name]
+	}
+	buf, err := codec.Encode(r.block)
+	if err != nil {
+		return err
+	}
+	r.buf = buf
+	return nil
+}
+
+// splitDirEntries splits the given entries into ranges of name
+// hashes, such that each range encodes into a child dir block of at
+// most `maxSize` bytes (unless it holds a single entry that's bigger
+// than that).  The ranges start out at the given offsets, which
+// should be those of the existing child blocks of the directory, if
+// any; a range is only split further if it has gotten too big, and
+// left out if it has become empty.  This keeps the boundaries stable
+// across syncs.  A range for which `reusable` returns true is kept
+// as-is without being encoded, so it's up to the caller to make sure
+// that it still fits.
+func splitDirEntries(codec kbfscodec.Codec, children map[string]DirEntry,
+	offs []string, maxSize int, reusable func(*dirEntryRange) bool) (
+	[]*dirEntryRange, error) {
+	names := make(hashedDirEntryNames, 0, len(children))
+	for name := range children {
+		names = append(names, hashedDirEntryName{dirEntryNameHash(name), name})
+	}
+	sort.Sort(names)
+
+	if len(offs) == 0 || offs[0] != "" {
+		offs = append([]string{""}, offs...)
+	}
+	ranges := make([]*dirEntryRange, 0, len(offs))
+	for _, off := range offs {
+		ranges = append(ranges, &dirEntryRange{off: off})
+	}
+	i := 0
+	for _, n := range names {
+		for i+1 < len(ranges) && n.hash >= ranges[i+1].off {
+			i++
+		}
+		ranges[i].names = append(ranges[i].names, n)
+	}
+
+	var result []*dirEntryRange
+	for len(ranges) > 0 {
+		r := ranges[0]
+		ranges = ranges[1:]
+		if len(r.names) == 0 {
+			continue
+		}
+		if reusable != nil && reusable(r) {
+			r.reused = true
+			result = append(result, r)
+			continue
+		}
+		err := r.encode(codec, children)
+		if err != nil {
+			return nil, err
+		}
+		if len(r.buf) <= maxSize || len(r.names) == 1 {
+			result = append(result, r)
+			continue
+		}
+		// Split the range in half, and check both halves again.
+		mid := len(r.names) / 2
+		left := &dirEntryRange{off: r.off, names: r.names[:mid]}
+		right := &dirEntryRange{off: r.names[mid].hash, names: r.names[mid:]}
+		ranges = append([]*dirEntryRange{left, right}, ranges...)
+	}
+	if len(result) > 0 {
+		// The first range must cover all the hashes below it too.
+		result[0].off = ""
+	}
+	return result, nil
+}
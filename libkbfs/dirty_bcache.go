@@ -640,6 +640,13 @@ func (d *DirtyBlockCacheStandard) ShouldForceSync(_ tlf.ID) bool {
 	return d.waitBufBytes >= d.syncBufferCap
 }
 
+// MaxUnsyncedBytes implements the DirtyBlockCache interface for
+// DirtyBlockCacheStandard.
+func (d *DirtyBlockCacheStandard) MaxUnsyncedBytes(_ tlf.ID) int64 {
+	// Matches the limit in acceptNewWrite.
+	return d.maxSyncBufCap * 2
+}
+
 // Shutdown implements the DirtyBlockCache interface for
 // DirtyBlockCacheStandard.
 func (d *DirtyBlockCacheStandard) Shutdown() error {
@@ -80,6 +80,13 @@ type dirtyFile struct {
 	// the channel on an outstanding Sync() completes.  If they
 	// receive an error, they should fail the write.
 	errListeners []chan<- error
+	// splitHint, if positive, is the leaf block size that the next
+	// sync of this file should aim for, instead of the block
+	// boundaries chosen by the configured BlockSplitter.
+	splitHint int64
+	// recoverableSyncErrors is the number of syncs of this file that
+	// have failed with a recoverable error.
+	recoverableSyncErrors int
 }
 
 func newDirtyFile(file path, dirtyBcache DirtyBlockCache) *dirtyFile {
@@ -90,12 +97,45 @@ func newDirtyFile(file path, dirtyBcache DirtyBlockCache) *dirtyFile {
 	}
 }
 
+func (df *dirtyFile) setSplitHint(targetBlockSize int64) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	df.splitHint = targetBlockSize
+}
+
+func (df *dirtyFile) getSplitHint() int64 {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	return df.splitHint
+}
+
 func (df *dirtyFile) blockNeedsCopy(ptr BlockPointer) bool {
 	df.lock.Lock()
 	defer df.lock.Unlock()
 	return df.fileBlockStates[ptr].copy == blockNeedsCopy
 }
 
+// getDirtyBytes returns the number of the file's dirty bytes that
+// haven't finished syncing yet, and whether a sync of the file is in
+// progress.
+func (df *dirtyFile) getDirtyBytes() (bytes int64, syncing bool) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	for _, state := range df.fileBlockStates {
+		if state.sync != blockNotSyncing {
+			syncing = true
+			break
+		}
+	}
+	return df.notYetSyncingBytes + df.totalSyncBytes, syncing
+}
+
+func (df *dirtyFile) getNotYetSyncingBytes() int64 {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	return df.notYetSyncingBytes
+}
+
 func (df *dirtyFile) updateNotYetSyncingBytes(newBytes int64) {
 	df.lock.Lock()
 	defer df.lock.Unlock()
@@ -143,6 +183,19 @@ func (df *dirtyFile) isBlockSyncing(ptr BlockPointer) bool {
 	return df.fileBlockStates[ptr].sync == blockSyncing
 }
 
+// isSyncing returns whether any of the file's blocks are part of a
+// sync that hasn't finished yet.
+func (df *dirtyFile) isSyncing() bool {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	for _, state := range df.fileBlockStates {
+		if state.sync != blockNotSyncing {
+			return true
+		}
+	}
+	return false
+}
+
 func (df *dirtyFile) isBlockDirty(ptr BlockPointer) bool {
 	df.lock.Lock()
 	defer df.lock.Unlock()
@@ -155,6 +208,30 @@ func (df *dirtyFile) isBlockOrphaned(ptr BlockPointer) bool {
 	return df.fileBlockStates[ptr].orphaned
 }
 
+// hasChildBlocks returns whether any non-orphaned block other than
+// the top block is being tracked for this file, which can only be
+// the case for a file with an indirect top block.
+func (df *dirtyFile) hasChildBlocks() bool {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	for ptr, state := range df.fileBlockStates {
+		if ptr != df.path.tailPointer() && !state.orphaned {
+			return true
+		}
+	}
+	return false
+}
+
+func (df *dirtyFile) getBlockPtrs() []BlockPointer {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	ptrs := make([]BlockPointer, 0, len(df.fileBlockStates))
+	for ptr := range df.fileBlockStates {
+		ptrs = append(ptrs, ptr)
+	}
+	return ptrs
+}
+
 func (df *dirtyFile) setBlockSyncing(ptr BlockPointer) error {
 	df.lock.Lock()
 	defer df.lock.Unlock()
@@ -300,6 +377,35 @@ func (df *dirtyFile) addErrListener(listener chan<- error) {
 	df.errListeners = append(df.errListeners, listener)
 }
 
+// removeErrListener unregisters a listener that was previously added
+// with addErrListener, if it hasn't already been notified.  It
+// returns true if the file has no dirty state left at all afterward.
+func (df *dirtyFile) removeErrListener(listener chan<- error) (
+	isEmpty bool) {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	for i, l := range df.errListeners {
+		if l == listener {
+			df.errListeners = append(
+				df.errListeners[:i], df.errListeners[i+1:]...)
+			break
+		}
+	}
+	return len(df.errListeners) == 0 && len(df.fileBlockStates) == 0 &&
+		df.notYetSyncingBytes == 0 && df.totalSyncBytes == 0 &&
+		df.deferredNewBytes == 0 && df.splitHint == 0 &&
+		df.recoverableSyncErrors == 0
+}
+
+// incRecoverableSyncErrors counts another sync of this file that
+// failed with a recoverable error, and returns the new count.
+func (df *dirtyFile) incRecoverableSyncErrors() int {
+	df.lock.Lock()
+	defer df.lock.Unlock()
+	df.recoverableSyncErrors++
+	return df.recoverableSyncErrors
+}
+
 func (df *dirtyFile) notifyErrListeners(err error) {
 	df.lock.Lock()
 	listeners := df.errListeners
@@ -105,11 +105,19 @@ func (e InvalidBlockRefError) Error() string {
 // InvalidPathError indicates an invalid path was encountered.
 type InvalidPathError struct {
 	p path
+	// index is the index of the first node of `p` with an invalid
+	// block pointer, or -1 if `p` has no nodes at all.
+	index int
 }
 
 // Error implements the error interface for InvalidPathError.
 func (e InvalidPathError) Error() string {
-	return fmt.Sprintf("Invalid path %s", e.p.DebugString())
+	if e.index < 0 || e.index >= len(e.p.path) {
+		return fmt.Sprintf("Invalid path %s", e.p.DebugString())
+	}
+	return fmt.Sprintf("Invalid path %s: invalid block pointer %v for "+
+		"node %d (%q)", e.p.DebugString(), e.p.path[e.index].BlockPointer,
+		e.index, e.p.path[e.index].Name)
 }
 
 // InvalidParentPathError indicates a path without a valid parent was
@@ -638,6 +646,28 @@ func (e NodeNotFoundError) Error() string {
 	return fmt.Sprintf("No node found for pointer %v", e.ptr)
 }
 
+// PathNotFoundError indicates that we tried to find the path of the
+// given BlockRef in a TLF's directory tree, and failed.
+type PathNotFoundError struct {
+	ref BlockRef
+}
+
+// Error implements the error interface for PathNotFoundError.
+func (e PathNotFoundError) Error() string {
+	return fmt.Sprintf("No path found for ref %v", e.ref)
+}
+
+// DirTooDeepError indicates that a recursive walk of a directory tree
+// gave up because the tree was too deep.
+type DirTooDeepError struct {
+	dir path
+}
+
+// Error implements the error interface for DirTooDeepError.
+func (e DirTooDeepError) Error() string {
+	return fmt.Sprintf("Directory %v is nested too deeply", e.dir)
+}
+
 // ParentNodeNotFoundError indicates that we tried to update a Node's
 // parent with a BlockPointer that we don't yet know about.
 type ParentNodeNotFoundError struct {
@@ -766,6 +796,40 @@ func (e FileTooBigError) Error() string {
 		"over the supported limit of %d bytes", e.p, e.size, e.maxAllowedBytes)
 }
 
+// BlockPlaintextTooBigError indicates that a write would have made
+// one of a file's blocks bigger than the block server accepts.
+type BlockPlaintextTooBigError struct {
+	p               path
+	ptr             BlockPointer
+	size            int64
+	maxAllowedBytes int64
+}
+
+// Error implements the error interface for BlockPlaintextTooBigError.
+func (e BlockPlaintextTooBigError) Error() string {
+	return fmt.Sprintf("Block %v of file %s would have grown to %d bytes, "+
+		"which is over the block limit of %d bytes", e.ptr, e.p, e.size,
+		e.maxAllowedBytes)
+}
+
+// BadBlockReadError indicates that a read stopped early, because one
+// of the file's blocks couldn't be fetched or decrypted.  The data
+// before the block was still read successfully.
+type BadBlockReadError struct {
+	// Off is the offset in the file at which the bad block starts.
+	Off int64
+	// Ptr is the pointer to the bad block.
+	Ptr BlockPointer
+	// Err is the error encountered while reading the block.
+	Err error
+}
+
+// Error implements the error interface for BadBlockReadError.
+func (e BadBlockReadError) Error() string {
+	return fmt.Sprintf("Couldn't read block %v at offset %d: %+v",
+		e.Ptr, e.Off, e.Err)
+}
+
 // NameTooLongError indicates that the user tried to write a directory
 // entry name that would be bigger than KBFS's supported size.
 type NameTooLongError struct {
@@ -1058,6 +1122,18 @@ func (e cachePutCacheFullError) Error() string {
 		e.blockID)
 }
 
+// blockRetrievalQueueFullError indicates that a low-priority block
+// request was rejected because the retrieval queue is at capacity.
+type blockRetrievalQueueFullError struct {
+	blockID kbfsblock.ID
+	maxSize int
+}
+
+func (e blockRetrievalQueueFullError) Error() string {
+	return fmt.Sprintf("failed to request block %s due to full retrieval "+
+		"queue (max size %d)", e.blockID, e.maxSize)
+}
+
 // FileTooBigForCRError indicates that a file is too big to fit in
 // memory, and CR can't handle it.
 type FileTooBigForCRError struct {
@@ -1121,6 +1197,116 @@ func (e NoUpdatesWhileDirtyError) Error() string {
 	return "Ignoring MD updates while writes are dirty"
 }
 
+// DirtyBlockMissingError indicates that a sync expected to find a
+// block in the dirty block cache, but it wasn't there.  The sync
+// can't safely continue without that block, so this error isn't
+// recoverable.
+type DirtyBlockMissingError struct {
+	ptr  BlockPointer
+	file path
+}
+
+// Error implements the error interface for DirtyBlockMissingError.
+func (e DirtyBlockMissingError) Error() string {
+	return fmt.Sprintf("Dirty block %v for file %v is missing from the "+
+		"dirty block cache", e.ptr, e.file)
+}
+
+// BlockLayoutError indicates that data couldn't be written with the
+// requested block layout, either because the block boundaries aren't
+// strictly increasing offsets within the written data, or because the
+// write doesn't append to the end of the file.
+type BlockLayoutError struct {
+	off        int64
+	length     int
+	boundaries []int64
+	fileSize   uint64
+}
+
+// Error implements the error interface for BlockLayoutError.
+func (e BlockLayoutError) Error() string {
+	return fmt.Sprintf("Can't write %d bytes at offset %d of a %d-byte "+
+		"file with block boundaries %v", e.length, e.off, e.fileSize,
+		e.boundaries)
+}
+
+// FileBlockImportError indicates that a set of existing blocks
+// couldn't be imported as the contents of a file, either because the
+// given block layout doesn't make sense, or because the file isn't in
+// a state that can accept it.
+type FileBlockImportError struct {
+	file   path
+	reason string
+}
+
+// Error implements the error interface for FileBlockImportError.
+func (e FileBlockImportError) Error() string {
+	return fmt.Sprintf("Can't import blocks into %v: %s", e.file, e.reason)
+}
+
+// FileBlockTypeMismatchError indicates that the top block of a file
+// being synced is direct even though the file's dirty state says it
+// must be indirect, or vice versa.  Syncing it anyway would write out
+// the wrong blocks, so this error isn't recoverable.
+type FileBlockTypeMismatchError struct {
+	ptr              BlockPointer
+	file             path
+	expectedIndirect bool
+}
+
+// Error implements the error interface for FileBlockTypeMismatchError.
+func (e FileBlockTypeMismatchError) Error() string {
+	expected, got := "direct", "indirect"
+	if e.expectedIndirect {
+		expected, got = got, expected
+	}
+	return fmt.Sprintf("Top block %v for file %v is %s, but should be %s",
+		e.ptr, e.file, got, expected)
+}
+
+// SyncErrorBudgetExceededError indicates that syncs of a file have
+// failed with recoverable errors too many times.  It's reported to
+// writers waiting on the file's sync instead of the latest
+// recoverable error, so they stop waiting for a retry to succeed.
+type SyncErrorBudgetExceededError struct {
+	ptr       BlockPointer
+	numErrors int
+	err       error
+}
+
+// Error implements the error interface for SyncErrorBudgetExceededError.
+func (e SyncErrorBudgetExceededError) Error() string {
+	return fmt.Sprintf("Syncs of file %v have hit %d recoverable errors; "+
+		"latest error: %v", e.ptr, e.numErrors, e.err)
+}
+
+// BlockArchivedError indicates that a block known to be archived
+// couldn't be read, because the server refused to serve it.
+type BlockArchivedError struct {
+	ptr BlockPointer
+}
+
+// Error implements the error interface for BlockArchivedError.
+func (e BlockArchivedError) Error() string {
+	return fmt.Sprintf("Archived block %v could not be read", e.ptr)
+}
+
+// BlockEncodedSizeError indicates that a readied block has an
+// encoded size that can't be valid for it, either because it doesn't
+// fit in the uint32 used to record it, or because it's smaller than
+// the block's plaintext contents.
+type BlockEncodedSizeError struct {
+	id          kbfsblock.ID
+	encodedSize int64
+	plainSize   int
+}
+
+// Error implements the error interface for BlockEncodedSizeError.
+func (e BlockEncodedSizeError) Error() string {
+	return fmt.Sprintf("Block %v has an invalid encoded size of %d bytes "+
+		"(plaintext size %d bytes)", e.id, e.encodedSize, e.plainSize)
+}
+
 // Disk Cache Errors
 const (
 	// StatusCodeDiskBlockCacheError is a generic disk cache error.
@@ -1148,3 +1334,31 @@ func (e DiskBlockCacheError) ToStatus() (s keybase1.Status) {
 func (e DiskBlockCacheError) Error() string {
 	return "DiskBlockCacheError{" + e.Msg + "}"
 }
+
+// ErrRenameCycle indicates that the user tried to move a directory
+// into itself or one of its own descendants.
+type ErrRenameCycle struct {
+	dir       path
+	newParent path
+}
+
+// Error implements the error interface for ErrRenameCycle.
+func (e ErrRenameCycle) Error() string {
+	return fmt.Sprintf("Cannot move directory %s into its own "+
+		"subdirectory %s", e.dir, e.newParent)
+}
+
+// LastModifiedRevisionNotFoundError indicates that no revision
+// referencing the given file pointer was found among the most recent
+// revisions of a TLF.
+type LastModifiedRevisionNotFoundError struct {
+	file         BlockPointer
+	numInspected int
+}
+
+// Error implements the error interface for
+// LastModifiedRevisionNotFoundError.
+func (e LastModifiedRevisionNotFoundError) Error() string {
+	return fmt.Sprintf("No revision modifying %v found in the last %d "+
+		"revisions", e.file, e.numInspected)
+}
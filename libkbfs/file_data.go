@@ -16,6 +16,13 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
+const (
+	// maxParallelBlockGetsDefault is the default limit on how many
+	// blocks a single fileData operation fetches concurrently when
+	// walking the tree for an offset range.
+	maxParallelBlockGetsDefault = 10
+)
+
 // fileBlockGetter is a function that gets a block suitable for
 // reading or writing, and also returns whether the block was already
 // dirty.  It may be called from new goroutines, and must handle any
@@ -38,6 +45,21 @@ type fileData struct {
 	getter    fileBlockGetter
 	cacher    dirtyBlockCacher
 	log       logger.Logger
+
+	// maxParallelGets bounds the number of concurrent block fetches
+	// made by getBlocksForOffsetRange.
+	maxParallelGets int
+
+	// appendFastPath lets writes at the end of the file follow the
+	// right-most pointers down the tree, rather than searching for
+	// the offset at each level.
+	appendFastPath bool
+
+	// maxBlockPlaintextSize bounds the plaintext size of the leaf
+	// blocks made by write; data that the splitter would have put
+	// past it goes into the next block instead.  If 0, the splitter
+	// alone decides.
+	maxBlockPlaintextSize int64
 }
 
 func newFileData(file path, chargedTo keybase1.UserOrTeamID, crypto cryptoPure,
@@ -52,6 +74,9 @@ func newFileData(file path, chargedTo keybase1.UserOrTeamID, crypto cryptoPure,
 		getter:    getter,
 		cacher:    cacher,
 		log:       log,
+
+		maxParallelGets: maxParallelBlockGetsDefault,
+		appendFastPath:  true,
 	}
 }
 
@@ -131,6 +156,45 @@ func (fd *fileData) getFileBlockAtOffset(ctx context.Context,
 	return ptr, parentBlocks, block, nextBlockStartOff, startOff, wasDirty, nil
 }
 
+// getFileBlockAtEOF is like getFileBlockAtOffset for an `off` at the
+// very end of the file, except that it doesn't search the indirect
+// pointers at each level; it just takes the right-most one.  If the
+// right-most leaf block doesn't end exactly at `off`, `ok` is false
+// and the caller should fall back to getFileBlockAtOffset.
+func (fd *fileData) getFileBlockAtEOF(ctx context.Context,
+	topBlock *FileBlock, off int64, rtype blockReqType) (
+	ptr BlockPointer, parentBlocks []parentBlockAndChildIndex,
+	block *FileBlock, startOff int64, wasDirty, ok bool, err error) {
+	ptr = fd.rootBlockPointer()
+	block = topBlock
+	if !topBlock.IsInd {
+		_, wasDirty, err = fd.getter(ctx, fd.kmd, ptr, fd.file, rtype)
+		if err != nil {
+			return zeroPtr, nil, nil, 0, false, false, err
+		}
+	}
+
+	for block.IsInd {
+		if len(block.IPtrs) == 0 {
+			return zeroPtr, nil, nil, 0, false, false, nil
+		}
+		lastIndex := len(block.IPtrs) - 1
+		parentBlocks = append(parentBlocks,
+			parentBlockAndChildIndex{block, lastIndex})
+		startOff = block.IPtrs[lastIndex].Off
+		ptr = block.IPtrs[lastIndex].BlockPointer
+		block, wasDirty, err = fd.getter(ctx, fd.kmd, ptr, fd.file, rtype)
+		if err != nil {
+			return zeroPtr, nil, nil, 0, false, false, err
+		}
+	}
+
+	if startOff+int64(len(block.Contents)) != off {
+		return zeroPtr, nil, nil, 0, false, false, nil
+	}
+	return ptr, parentBlocks, block, startOff, wasDirty, true, nil
+}
+
 // getNextDirtyFileBlockAtOffsetAtLevel does the same thing as
 // `getNextDirtyFileBlockAtOffset` (see the comments on that function)
 // on a subsection of the file tree (not necessarily starting from the
@@ -286,10 +350,31 @@ func (fd *fileData) getNextDirtyFileBlockAtOffset(ctx context.Context,
 //   * nextBlockOff is the offset of the block that follows the last
 //     block given in `pathsFromRoot`.  If `pathsFromRoot` contains
 //     the last block among the children, nextBlockOff is -1.
+//
+// The child blocks are fetched concurrently, but no more than
+// `fd.maxParallelGets` fetches are outstanding at any one time.
 func (fd *fileData) getBlocksForOffsetRange(ctx context.Context,
 	ptr BlockPointer, pblock *FileBlock, startOff, endOff int64,
 	prefixOk bool, getDirect bool) (pathsFromRoot [][]parentBlockAndChildIndex,
 	blocks map[BlockPointer]*FileBlock, nextBlockOffset int64, err error) {
+	maxParallelGets := fd.maxParallelGets
+	if maxParallelGets <= 0 {
+		maxParallelGets = maxParallelBlockGetsDefault
+	}
+	getPermits := make(chan struct{}, maxParallelGets)
+	return fd.getBlocksForOffsetRangeWithPermits(
+		ctx, ptr, pblock, startOff, endOff, prefixOk, getDirect, getPermits)
+}
+
+// getBlocksForOffsetRangeWithPermits is a helper for
+// getBlocksForOffsetRange.  A fetch may only proceed once it has
+// been able to send on `getPermits`, which is shared by the whole
+// recursion.
+func (fd *fileData) getBlocksForOffsetRangeWithPermits(ctx context.Context,
+	ptr BlockPointer, pblock *FileBlock, startOff, endOff int64,
+	prefixOk bool, getDirect bool, getPermits chan struct{}) (
+	pathsFromRoot [][]parentBlockAndChildIndex,
+	blocks map[BlockPointer]*FileBlock, nextBlockOffset int64, err error) {
 	if !pblock.IsInd {
 		// Return a single empty path, under the assumption that the
 		// caller already checked the range for this block.
@@ -339,6 +424,10 @@ func (fd *fileData) getBlocksForOffsetRange(ctx context.Context,
 
 		childPtr := iptr.BlockPointer
 		childIndex := i
+		childNextOff := int64(-1)
+		if i+1 < len(pblock.IPtrs) {
+			childNextOff = pblock.IPtrs[i+1].Off
+		}
 		respCh := make(chan resp, 1)
 		respChans = append(respChans, respCh)
 		// Don't reference the uncaptured `i` or `iptr` variables below.
@@ -352,16 +441,30 @@ func (fd *fileData) getBlocksForOffsetRange(ctx context.Context,
 			// blocks, since there weren't multiple levels of
 			// indirection before the introduction of the flag.
 			if getDirect || childPtr.DirectType == IndirectBlock {
+				// Only hold the permit for the fetch itself, and
+				// not while recursing, so that the children can
+				// get permits of their own.
+				select {
+				case getPermits <- struct{}{}:
+				case <-groupCtx.Done():
+					return groupCtx.Err()
+				}
+				// Tag the fetch so that it can be batched with
+				// the fetches of its neighbors.
+				getCtx := withBlockRetrievalGroup(
+					groupCtx, ptr.ID, iptr.Off, childNextOff)
 				block, _, err := fd.getter(
-					groupCtx, fd.kmd, childPtr, fd.file, blockReadParallel)
+					getCtx, fd.kmd, childPtr, fd.file, blockReadParallel)
+				<-getPermits
 				if err != nil {
 					return err
 				}
 
 				// Recurse down to the level of the child.
-				pfr, blocks, nextBlockOffset, err = fd.getBlocksForOffsetRange(
-					groupCtx, childPtr, block, startOff, endOff, prefixOk,
-					getDirect)
+				pfr, blocks, nextBlockOffset, err =
+					fd.getBlocksForOffsetRangeWithPermits(
+						groupCtx, childPtr, block, startOff, endOff,
+						prefixOk, getDirect, getPermits)
 				if err != nil {
 					return err
 				}
@@ -653,6 +756,104 @@ func (fd *fileData) read(ctx context.Context, dest []byte, startOff int64) (
 	return currLen, nil
 }
 
+// readWithBudget is like read, except that it reads from at most
+// `maxBlocks` leaf blocks.  If the requested range spans more leaf
+// blocks than that, the read stops at the start of the first block
+// past the budget, and `budgetExhausted` is true.  Holes between
+// blocks don't count against the budget, since they don't need to be
+// fetched.
+func (fd *fileData) readWithBudget(ctx context.Context, dest []byte,
+	startOff int64, maxBlocks int) (
+	n int64, budgetExhausted bool, err error) {
+	if maxBlocks <= 0 {
+		return 0, false, fmt.Errorf("Bad block budget %d", maxBlocks)
+	} else if len(dest) == 0 {
+		return 0, false, nil
+	}
+
+	topBlock, _, err := fd.getter(ctx, fd.kmd, fd.rootBlockPointer(),
+		fd.file, blockRead)
+	if err != nil {
+		return 0, false, err
+	}
+	if topBlock.IsInd {
+		// Find the leaf blocks in range without fetching them, and
+		// shorten the read to cover only the first `maxBlocks` of
+		// them.
+		pfr, err := fd.getIndirectBlocksForOffsetRange(
+			ctx, topBlock, startOff, startOff+int64(len(dest)))
+		if err != nil {
+			return 0, false, err
+		}
+		if len(pfr) > maxBlocks {
+			p := pfr[maxBlocks]
+			endOff := p[len(p)-1].childIPtr().Off
+			dest = dest[:endOff-startOff]
+			budgetExhausted = true
+		}
+	}
+
+	n, err = fd.read(ctx, dest, startOff)
+	if err != nil {
+		return 0, false, err
+	}
+	return n, budgetExhausted, nil
+}
+
+// readUntilBadBlock is like read, except that if one of the leaf
+// blocks in range can't be fetched or decrypted, it returns the bytes
+// read from the blocks before it along with a BadBlockReadError,
+// instead of failing the whole read.  The indirect blocks leading to
+// the leaves must still be readable.
+func (fd *fileData) readUntilBadBlock(ctx context.Context, dest []byte,
+	startOff int64) (int64, error) {
+	if len(dest) == 0 {
+		return 0, nil
+	}
+
+	topBlock, _, err := fd.getter(ctx, fd.kmd, fd.rootBlockPointer(),
+		fd.file, blockRead)
+	if err != nil {
+		return 0, BadBlockReadError{0, fd.rootBlockPointer(), err}
+	}
+	if !topBlock.IsInd {
+		return fd.read(ctx, dest, startOff)
+	}
+
+	endOff := startOff + int64(len(dest))
+	pfr, err := fd.getIndirectBlocksForOffsetRange(
+		ctx, topBlock, startOff, endOff)
+	if err != nil {
+		return 0, err
+	}
+
+	// Read one leaf block at a time, so we know exactly where to stop.
+	n := int64(0)
+	for i, p := range pfr {
+		iptr := p[len(p)-1].childIPtr()
+		blockStart := iptr.Off
+		if i == 0 || blockStart < startOff {
+			blockStart = startOff
+		}
+		blockEnd := endOff
+		if i+1 < len(pfr) {
+			nextP := pfr[i+1]
+			blockEnd = nextP[len(nextP)-1].childIPtr().Off
+		}
+		readLen, err := fd.read(
+			ctx, dest[blockStart-startOff:blockEnd-startOff], blockStart)
+		if err != nil {
+			return n, BadBlockReadError{iptr.Off, iptr.BlockPointer, err}
+		}
+		n += readLen
+		if readLen < blockEnd-blockStart {
+			// We've reached the end of the file.
+			break
+		}
+	}
+	return n, nil
+}
+
 // getBytes returns a buffer containing data from the file, in the
 // half-inclusive range `[startOff, endOff)`.  If `endOff` == -1, it
 // returns data until the end of the file.
@@ -677,6 +878,75 @@ func (fd *fileData) getBytes(ctx context.Context, startOff, endOff int64) (
 	return data, nil
 }
 
+// blockAlignedData describes one leaf block of a file, or one hole
+// between leaf blocks, as returned by `fileData.readBlocks`.
+type blockAlignedData struct {
+	// off is the offset within the file where this block starts.
+	off int64
+	// size is the number of bytes covered by this block.
+	size int64
+	// isHole is true if this range is a hole, in which case `data`
+	// is nil and the range should be read as `size` zero bytes.
+	isHole bool
+	// data is a copy of the block's contents.
+	data []byte
+}
+
+// readBlocks returns up to `count` whole leaf blocks (or holes
+// between them), starting with the one containing `startOff`.  It
+// returns fewer than `count` if it reaches the end of the file.
+func (fd *fileData) readBlocks(ctx context.Context, startOff int64,
+	count int) ([]blockAlignedData, error) {
+	if startOff < 0 {
+		return nil, fmt.Errorf("Bad offset %d", startOff)
+	} else if count <= 0 {
+		return nil, nil
+	}
+
+	topBlock, _, err := fd.getter(ctx, fd.kmd, fd.rootBlockPointer(),
+		fd.file, blockRead)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []blockAlignedData
+	off := startOff
+	for len(blocks) < count {
+		_, _, block, nextBlockStartOff, blockStartOff, _, err :=
+			fd.getFileBlockAtOffset(ctx, topBlock, off, blockRead)
+		if err != nil {
+			return nil, err
+		}
+
+		blockEndOff := blockStartOff + int64(len(block.Contents))
+		if off < blockEndOff {
+			data := make([]byte, len(block.Contents))
+			copy(data, block.Contents)
+			blocks = append(blocks, blockAlignedData{
+				off:  blockStartOff,
+				size: int64(len(data)),
+				data: data,
+			})
+		}
+
+		if nextBlockStartOff < 0 {
+			break
+		}
+
+		// Any gap between the end of this block and the start of the
+		// next one is a hole.
+		if nextBlockStartOff > blockEndOff && len(blocks) < count {
+			blocks = append(blocks, blockAlignedData{
+				off:    blockEndOff,
+				size:   nextBlockStartOff - blockEndOff,
+				isHole: true,
+			})
+		}
+		off = nextBlockStartOff
+	}
+	return blocks, nil
+}
+
 // createIndirectBlock creates a new indirect block and pick a new id
 // for the existing block, and use the existing block's ID for the new
 // indirect block that becomes the parent.
@@ -1057,6 +1327,22 @@ func (fd *fileData) markParentsDirty(ctx context.Context,
 	return dirtyPtrs, unrefs, nil
 }
 
+// makeParentsWritable replaces the indirect blocks in `parentBlocks`
+// that were fetched without blockWrite, other than the top block,
+// with copies that are safe to modify.
+func (fd *fileData) makeParentsWritable(ctx context.Context,
+	parentBlocks []parentBlockAndChildIndex) error {
+	for i := 1; i < len(parentBlocks); i++ {
+		ptr := parentBlocks[i-1].childIPtr().BlockPointer
+		pblock, _, err := fd.getter(ctx, fd.kmd, ptr, fd.file, blockWrite)
+		if err != nil {
+			return err
+		}
+		parentBlocks[i].pblock = pblock
+	}
+	return nil
+}
+
 // write sets the given data and the given offset within the file,
 // making new blocks and new levels of indirection as needed. Return
 // params:
@@ -1084,12 +1370,32 @@ func (fd *fileData) write(ctx context.Context, data []byte, off int64,
 
 	fd.log.CDebugf(ctx, "Writing %d bytes at off %d", n, off)
 
+	// A write at the current end of the file keeps landing at the
+	// end of the file as it goes, so it can always use the
+	// right-most leaf block without searching for its offset.
+	appending := fd.appendFastPath && off == int64(oldDe.Size)
+
 	dirtyMap := make(map[BlockPointer]bool)
 	for nCopied < n {
-		ptr, parentBlocks, block, nextBlockOff, startOff, wasDirty, err :=
-			fd.getFileBlockAtOffset(ctx, topBlock, off+nCopied, blockWrite)
-		if err != nil {
-			return newDe, nil, unrefs, newlyDirtiedChildBytes, 0, err
+		var ptr BlockPointer
+		var parentBlocks []parentBlockAndChildIndex
+		var block *FileBlock
+		var nextBlockOff, startOff int64
+		var wasDirty bool
+		if appending {
+			nextBlockOff = -1
+			ptr, parentBlocks, block, startOff, wasDirty, appending, err =
+				fd.getFileBlockAtEOF(ctx, topBlock, off+nCopied, blockWrite)
+			if err != nil {
+				return newDe, nil, unrefs, newlyDirtiedChildBytes, 0, err
+			}
+		}
+		if !appending {
+			ptr, parentBlocks, block, nextBlockOff, startOff, wasDirty, err =
+				fd.getFileBlockAtOffset(ctx, topBlock, off+nCopied, blockWrite)
+			if err != nil {
+				return newDe, nil, unrefs, newlyDirtiedChildBytes, 0, err
+			}
 		}
 
 		oldLen := len(block.Contents)
@@ -1102,9 +1408,24 @@ func (fd *fileData) write(ctx context.Context, data []byte, off int64,
 				max = room
 			}
 		}
+		// Force a split rather than letting a misconfigured splitter
+		// grow the block past what the block server accepts.
+		blockOff := off + nCopied - startOff
+		if limit := fd.maxBlockPlaintextSize; limit > 0 &&
+			int64(max)-nCopied > limit-blockOff {
+			max = int(nCopied + limit - blockOff)
+		}
 		oldNCopied := nCopied
-		nCopied += fd.bsplit.CopyUntilSplit(
-			block, nextBlockOff < 0, data[nCopied:max], off+nCopied-startOff)
+		if int64(max) >= nCopied {
+			nCopied += fd.bsplit.CopyUntilSplit(
+				block, nextBlockOff < 0, data[nCopied:max], blockOff)
+		}
+		if limit := fd.maxBlockPlaintextSize; limit > 0 &&
+			int64(len(block.Contents)) > limit {
+			return newDe, nil, unrefs, newlyDirtiedChildBytes, 0,
+				BlockPlaintextTooBigError{
+					fd.file, ptr, int64(len(block.Contents)), limit}
+		}
 
 		// If we need another block but there are no more, then make one.
 		switchToIndirect := false
@@ -1480,6 +1801,142 @@ func (fd *fileData) truncateShrink(ctx context.Context, size uint64,
 	return newDe, dirtyPtrs, unrefs, newlyDirtiedChildBytes, nil
 }
 
+// punchHole deallocates the byte range `[off, off+length)` of the
+// file, which must be within the file's current size, without
+// changing the size.  Leaf blocks entirely inside the range are
+// removed from their parents and unreferenced, leaving a hole in the
+// parent's list of pointers; the exception is the first child of
+// each parent and the last block of the file, which keep their place
+// in the tree but have their covered bytes zeroed.  Blocks only
+// partially inside the range also have their covered bytes zeroed.
+// Return params:
+// * newDe: a new directory entry with the EncodedSize cleared.
+// * dirtyPtrs: a slice of the BlockPointers that have been dirtied
+//   during the punch.
+// * unrefs: a slice of BlockInfos that must be unreferenced as part of an
+//   eventual sync of this punch.  May be non-nil even if err != nil.
+// * newlyDirtiedChildBytes is the total amount of block data dirtied by
+//   this punch, as for truncateShrink.  As above, it may be non-zero even
+//   if err != nil.
+// * dropped: the pointers of the leaf blocks removed from the file.
+//   Any of them that are dirty should be dropped from the dirty cache
+//   by the caller.
+func (fd *fileData) punchHole(ctx context.Context, off, length int64,
+	topBlock *FileBlock, oldDe DirEntry) (
+	newDe DirEntry, dirtyPtrs []BlockPointer, unrefs []BlockInfo,
+	newlyDirtiedChildBytes int64, dropped []BlockPointer, err error) {
+	endOff := off + length
+	fd.log.CDebugf(ctx, "punchHole: punching [%d, %d) in file %v",
+		off, endOff, fd.rootBlockPointer())
+
+	dirtyMap := make(map[BlockPointer]bool)
+	for currOff := off; currOff < endOff; {
+		// Look the block up without copying it first, since a block
+		// that gets dropped from the file is never modified.
+		ptr, parentBlocks, block, nextBlockOff, startOff, wasDirty, err :=
+			fd.getFileBlockAtOffset(ctx, topBlock, currOff, blockLookup)
+		if err != nil {
+			return DirEntry{}, nil, unrefs, newlyDirtiedChildBytes, nil, err
+		}
+		nextOff := nextBlockOff
+		if nextOff < 0 || nextOff > endOff {
+			nextOff = endOff
+		}
+
+		covered := startOff >= off && nextBlockOff > 0 &&
+			nextBlockOff <= endOff
+		drop := covered && len(parentBlocks) > 0 &&
+			parentBlocks[len(parentBlocks)-1].childIndex > 0
+		if drop {
+			err = fd.makeParentsWritable(ctx, parentBlocks)
+		} else {
+			ptr, parentBlocks, block, nextBlockOff, startOff, wasDirty, err =
+				fd.getFileBlockAtOffset(ctx, topBlock, currOff, blockWrite)
+		}
+		if err != nil {
+			return DirEntry{}, nil, unrefs, newlyDirtiedChildBytes, nil, err
+		}
+
+		newDirtyPtrs, newUnrefs, err := fd.markParentsDirty(ctx, parentBlocks)
+		unrefs = append(unrefs, newUnrefs...)
+		if err != nil {
+			return DirEntry{}, nil, unrefs, newlyDirtiedChildBytes, nil, err
+		}
+		for _, p := range newDirtyPtrs {
+			dirtyMap[p] = true
+		}
+		for _, pb := range parentBlocks {
+			pb.pblock.IPtrs[pb.childIndex].Holes = true
+		}
+
+		if drop {
+			// Drop the block from its parent, so that the bytes up
+			// to the next block become part of the hole following
+			// the previous block.  `markParentsDirty` has already
+			// unreferenced the block if it wasn't dirty.
+			pb := parentBlocks[len(parentBlocks)-1]
+			fd.log.CDebugf(ctx, "punchHole: removing block %v at off=%d",
+				ptr, startOff)
+			iptrs := make([]IndirectFilePtr, 0, len(pb.pblock.IPtrs)-1)
+			iptrs = append(iptrs, pb.pblock.IPtrs[:pb.childIndex]...)
+			iptrs = append(iptrs, pb.pblock.IPtrs[pb.childIndex+1:]...)
+			iptrs[pb.childIndex-1].Holes = true
+			pb.pblock.IPtrs = iptrs
+			dropped = append(dropped, ptr)
+			currOff = nextOff
+			continue
+		}
+
+		oldLen := int64(len(block.Contents))
+		zeroStart := currOff - startOff
+		zeroEnd := nextOff - startOff
+		if zeroEnd > oldLen {
+			zeroEnd = oldLen
+		}
+		if covered {
+			// The block has to stay, but none of its contents
+			// are needed.
+			block.Contents = nil
+		} else if zeroStart < zeroEnd {
+			// Note we make a new slice before zeroing, since
+			// `block` may share its contents with the clean copy.
+			contents := append([]byte(nil), block.Contents...)
+			for i := zeroStart; i < zeroEnd; i++ {
+				contents[i] = 0
+			}
+			block.Contents = contents
+		}
+
+		newlyDirtiedChildBytes += int64(len(block.Contents))
+		if wasDirty {
+			newlyDirtiedChildBytes -= oldLen
+		}
+		if err = fd.cacher(ptr, block); err != nil {
+			return DirEntry{}, nil, unrefs, newlyDirtiedChildBytes, nil, err
+		}
+		dirtyMap[ptr] = true
+		currOff = nextOff
+	}
+
+	if topBlock.IsInd {
+		// Always make the top block dirty, as in truncateShrink.
+		if err = fd.cacher(fd.rootBlockPointer(), topBlock); err != nil {
+			return DirEntry{}, nil, unrefs, newlyDirtiedChildBytes, nil, err
+		}
+		dirtyMap[fd.rootBlockPointer()] = true
+	}
+
+	newDe = oldDe
+	newDe.EncodedSize = 0
+
+	dirtyPtrs = make([]BlockPointer, 0, len(dirtyMap))
+	for p := range dirtyMap {
+		dirtyPtrs = append(dirtyPtrs, p)
+	}
+
+	return newDe, dirtyPtrs, unrefs, newlyDirtiedChildBytes, dropped, nil
+}
+
 // split, if given an indirect top block of a file, checks whether any
 // of the dirty leaf blocks in that file need to be split up
 // differently (i.e., if the BlockSplitter is using
@@ -1592,7 +2049,16 @@ func (fd *fileData) split(ctx context.Context, id tlf.ID,
 			unrefs = append(unrefs, pb.childIPtr().BlockInfo)
 			pb.pblock.IPtrs[pb.childIndex].EncodedSize = 0
 
+			// Mark all parents as dirty, before the right block's
+			// pointer might be removed from its parent below.
+			_, newUnrefs, err := fd.markParentsDirty(ctx, rParentBlocks)
+			unrefs = append(unrefs, newUnrefs...)
+			if err != nil {
+				return unrefs, err
+			}
+
 			// For the right block, adjust offset or delete as needed.
+			nextOff := endOfBlock
 			if len(rblock.Contents) > 0 {
 				if err = fd.cacher(rPtr, rblock); err != nil {
 					return unrefs, err
@@ -1614,33 +2080,51 @@ func (fd *fileData) split(ctx context.Context, id tlf.ID,
 				iptrs := pb.pblock.IPtrs
 				pb.pblock.IPtrs =
 					append(iptrs[:pb.childIndex], iptrs[pb.childIndex+1:]...)
+				// The whole right block fit into this one, so check
+				// whether this block needs even more bytes.  Only
+				// splitters whose CheckSplit can ask for more bytes
+				// (e.g., a split hint merging blocks smaller than
+				// its target size) get here; BlockSplitterSimple
+				// never does.
+				nextOff = startOff
 			}
 
-			// Mark all parents as dirty.
-			_, newUnrefs, err := fd.markParentsDirty(ctx, rParentBlocks)
-			unrefs = append(unrefs, newUnrefs...)
-			if err != nil {
-				return unrefs, err
-			}
-
-			off = endOfBlock
+			off = nextOff
 		}
 	}
 	return unrefs, nil
 }
 
+// checkReadiedFileBlockSize makes sure the encoded size of a
+// newly-readied file block is in the range we expect, since it feeds
+// directly into the folder's byte accounting.  An encoded block can
+// never be empty, or smaller than the plaintext that was encrypted
+// for it.  `plainSize` is that plaintext's size as returned by
+// `BlockOps.Ready`, which with a `BlockCodec` may be smaller than the
+// block's contents, or 0 if the block wasn't encrypted again.
+func checkReadiedFileBlockSize(info BlockInfo, plainSize int) error {
+	if info.EncodedSize == 0 || int64(info.EncodedSize) < int64(plainSize) {
+		return BlockEncodedSizeError{
+			info.ID, int64(info.EncodedSize), plainSize}
+	}
+	return nil
+}
+
 // readyHelper takes a set of paths from a root down to a child block,
 // and readies all the blocks represented in those paths.  If the
 // caller wants leaf blocks readied, then the last element of each
 // slice in `pathsFromRoot` should contain a leaf block, with a child
 // index of -1.  It's assumed that all slices in `pathsFromRoot` have
-// the same size. This function returns a map pointing from the new
-// block info from any readied block to its corresponding old block
-// pointer.
+// the same size. If `knownPtrs` is non-nil, it holds the results of
+// a batched duplicate check for the leaf blocks, and no further
+// per-block checks are made. This function returns a map pointing
+// from the new block info from any readied block to its corresponding
+// old block pointer.
 func (fd *fileData) readyHelper(ctx context.Context, id tlf.ID,
 	bcache BlockCache, bops BlockOps, bps *blockPutState,
-	pathsFromRoot [][]parentBlockAndChildIndex,
-	df *dirtyFile) (map[BlockInfo]BlockPointer, error) {
+	pathsFromRoot [][]parentBlockAndChildIndex, df *dirtyFile,
+	knownPtrs map[*FileBlock]BlockPointer) (
+	map[BlockInfo]BlockPointer, error) {
 	oldPtrs := make(map[BlockInfo]BlockPointer)
 	newPtrs := make(map[BlockPointer]bool)
 
@@ -1661,9 +2145,23 @@ func (fd *fileData) readyHelper(ctx context.Context, id tlf.ID,
 				continue
 			}
 
-			newInfo, _, readyBlockData, err := ReadyBlock(
-				ctx, bcache, bops, fd.crypto, fd.kmd, pb.pblock, fd.chargedTo,
-				fd.rootBlockPointer().GetBlockType())
+			var newInfo BlockInfo
+			var plainSize int
+			var readyBlockData ReadyBlockData
+			var err error
+			if knownPtrs != nil {
+				newInfo, plainSize, readyBlockData, err = readyBlockWithKnownPtr(
+					ctx, bcache, bops, fd.crypto, fd.kmd, pb.pblock, fd.chargedTo,
+					fd.rootBlockPointer().GetBlockType(), knownPtrs[pb.pblock])
+			} else {
+				newInfo, plainSize, readyBlockData, err = ReadyBlock(
+					ctx, bcache, bops, fd.crypto, fd.kmd, pb.pblock,
+					fd.chargedTo, fd.rootBlockPointer().GetBlockType())
+			}
+			if err != nil {
+				return nil, err
+			}
+			err = checkReadiedFileBlockSize(newInfo, plainSize)
 			if err != nil {
 				return nil, err
 			}
@@ -1733,7 +2231,19 @@ func (fd *fileData) ready(ctx context.Context, id tlf.ID, bcache BlockCache,
 		return nil, nil
 	}
 
-	return fd.readyHelper(ctx, id, bcache, bops, bps, dirtyLeafPaths, df)
+	// Look up all the dirty leaf blocks in the known-block index in
+	// one batch, rather than once per block while readying.
+	leafBlocks := make([]*FileBlock, 0, len(dirtyLeafPaths))
+	for _, path := range dirtyLeafPaths {
+		leafBlocks = append(leafBlocks, path[len(path)-1].pblock)
+	}
+	knownPtrs, err := bcache.CheckForKnownPtrs(id, leafBlocks)
+	if err != nil {
+		return nil, err
+	}
+
+	return fd.readyHelper(
+		ctx, id, bcache, bops, bps, dirtyLeafPaths, df, knownPtrs)
 }
 
 func (fd *fileData) getIndirectFileBlockInfosWithTopBlock(ctx context.Context,
@@ -2039,7 +2549,7 @@ func (fd *fileData) undupChildrenInCopy(ctx context.Context,
 	}
 
 	newInfos, err := fd.readyHelper(
-		ctx, fd.file.Tlf, bcache, bops, bps, pfr, nil)
+		ctx, fd.file.Tlf, bcache, bops, bps, pfr, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -2075,7 +2585,7 @@ func (fd *fileData) readyNonLeafBlocksInCopy(ctx context.Context,
 	}
 
 	newInfos, err := fd.readyHelper(
-		ctx, fd.file.Tlf, bcache, bops, bps, pfr, nil)
+		ctx, fd.file.Tlf, bcache, bops, bps, pfr, nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -9,18 +9,21 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 )
 
-func setupFileDataTest(t *testing.T, maxBlockSize int64,
+func setupFileDataTest(t testing.TB, maxBlockSize int64,
 	maxPtrsPerBlock int) (*fileData, BlockCache, DirtyBlockCache, *dirtyFile) {
 	// Make a fake file.
 	ptr := BlockPointer{
@@ -865,3 +868,413 @@ func TestFileDataWriteExtendExistingFileWithGap(t *testing.T) {
 		})
 	}
 }
+
+type testFileDataReadyBlockOps struct {
+	BlockOps
+	nextID byte
+}
+
+func (tbo *testFileDataReadyBlockOps) Ready(
+	_ context.Context, _ KeyMetadata, block Block) (
+	kbfsblock.ID, int, ReadyBlockData, error) {
+	tbo.nextID++
+	return kbfsblock.FakeID(tbo.nextID), 0,
+		ReadyBlockData{buf: make([]byte, 10)}, nil
+}
+
+type testFileDataKnownPtrCountingBlockCache struct {
+	BlockCache
+	singleChecks int
+	batchChecks  int
+}
+
+func (tbc *testFileDataKnownPtrCountingBlockCache) CheckForKnownPtr(
+	tlf tlf.ID, block *FileBlock) (BlockPointer, error) {
+	tbc.singleChecks++
+	return tbc.BlockCache.CheckForKnownPtr(tlf, block)
+}
+
+func (tbc *testFileDataKnownPtrCountingBlockCache) CheckForKnownPtrs(
+	tlf tlf.ID, blocks []*FileBlock) (map[*FileBlock]BlockPointer, error) {
+	tbc.batchChecks++
+	return tbc.BlockCache.CheckForKnownPtrs(tlf, blocks)
+}
+
+func TestFileDataReadyDedupsInOneBatch(t *testing.T) {
+	fd, cleanBcache, dirtyBcache, df := setupFileDataTest(t, 10, 4)
+	topBlock := NewFileBlock().(*FileBlock)
+	// Cache a separate empty block for the root, so its cached hash
+	// doesn't get aliased to the first leaf after the write.
+	cleanBcache.Put(fd.rootBlockPointer(), fd.file.Tlf,
+		NewFileBlock(), TransientEntry)
+
+	// Write four identical leaf blocks.
+	data := make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i % 10)
+	}
+	ctx := context.Background()
+	_, _, _, _, _, err := fd.write(ctx, data, 0, topBlock, DirEntry{}, df)
+	require.NoError(t, err)
+	topBlock, _, err = fd.getter(
+		ctx, nil, fd.rootBlockPointer(), path{}, blockWrite)
+	require.NoError(t, err)
+	require.True(t, topBlock.IsInd)
+	require.Len(t, topBlock.IPtrs, 4)
+
+	// Make the contents of those blocks known to the cache.
+	knownBlock := NewFileBlock().(*FileBlock)
+	knownBlock.Contents = data[:10]
+	knownPtr := BlockPointer{
+		ID:      kbfsblock.FakeID(100),
+		KeyGen:  1,
+		DataVer: FirstValidDataVer,
+	}
+	err = cleanBcache.Put(
+		knownPtr, fd.file.Tlf, knownBlock, TransientEntry)
+	require.NoError(t, err)
+
+	bcache := &testFileDataKnownPtrCountingBlockCache{BlockCache: cleanBcache}
+	bops := &testFileDataReadyBlockOps{}
+	bps := newBlockPutState(1)
+	oldPtrs, err := fd.ready(
+		ctx, fd.file.Tlf, bcache, dirtyBcache, bops, bps, topBlock, df)
+	require.NoError(t, err)
+	require.Len(t, oldPtrs, 4)
+	require.Equal(t, 1, bcache.batchChecks)
+	require.Equal(t, 0, bcache.singleChecks)
+
+	// Every leaf should have been deduped to the known block, with a
+	// fresh ref nonce and the right creator.
+	nonces := make(map[kbfsblock.RefNonce]bool)
+	for _, iptr := range topBlock.IPtrs {
+		require.Equal(t, knownPtr.ID, iptr.ID)
+		require.Equal(t, DirectBlock, iptr.DirectType)
+		require.Equal(t, fd.chargedTo, iptr.GetWriter())
+		require.NotEqual(t, kbfsblock.ZeroRefNonce, iptr.RefNonce)
+		nonces[iptr.RefNonce] = true
+	}
+	require.Len(t, nonces, 4)
+}
+
+// setupFileDataParallelReadTest makes a one-level file with
+// `numBlocks` leaf blocks of `blockSize` bytes each, all in the clean
+// cache, where every leaf fetch takes `getDelay`.  It returns the
+// file's data, and a pointer to the max number of concurrent leaf
+// fetches seen.
+func setupFileDataParallelReadTest(tb testing.TB, numBlocks, blockSize int,
+	getDelay time.Duration) (fd *fileData, data []byte, maxInFlight *int32) {
+	fd, cleanCache, _, _ := setupFileDataTest(
+		tb, int64(blockSize), numBlocks)
+	topBlock := NewFileBlock().(*FileBlock)
+	topBlock.IsInd = true
+	for i := 0; i < numBlocks; i++ {
+		ptr := BlockPointer{
+			ID:         kbfsblock.FakeID(byte(100 + i)),
+			KeyGen:     1,
+			DataVer:    FirstValidDataVer,
+			DirectType: DirectBlock,
+		}
+		block := NewFileBlock().(*FileBlock)
+		block.Contents = bytes.Repeat([]byte{byte(i)}, blockSize)
+		data = append(data, block.Contents...)
+		err := cleanCache.Put(ptr, fd.file.Tlf, block, TransientEntry)
+		require.NoError(tb, err)
+		topBlock.IPtrs = append(topBlock.IPtrs, IndirectFilePtr{
+			BlockInfo: BlockInfo{BlockPointer: ptr, EncodedSize: 1},
+			Off:       int64(i * blockSize),
+		})
+	}
+	err := cleanCache.Put(
+		fd.rootBlockPointer(), fd.file.Tlf, topBlock, TransientEntry)
+	require.NoError(tb, err)
+
+	var inFlight int32
+	maxInFlight = new(int32)
+	getter := fd.getter
+	fd.getter = func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
+		file path, rtype blockReqType) (*FileBlock, bool, error) {
+		if ptr != fd.rootBlockPointer() {
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				max := atomic.LoadInt32(maxInFlight)
+				if n <= max ||
+					atomic.CompareAndSwapInt32(maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(getDelay)
+		}
+		return getter(ctx, kmd, ptr, file, rtype)
+	}
+	return fd, data, maxInFlight
+}
+
+func TestFileDataReadBoundedParallelism(t *testing.T) {
+	fd, data, maxInFlight := setupFileDataParallelReadTest(
+		t, 20, 10, 5*time.Millisecond)
+	fd.maxParallelGets = 3
+	ctx := context.Background()
+
+	dest := make([]byte, len(data))
+	n, err := fd.read(ctx, dest, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, dest)
+	require.True(t, *maxInFlight > 1, "maxInFlight=%d", *maxInFlight)
+	require.True(t, *maxInFlight <= 3, "maxInFlight=%d", *maxInFlight)
+
+	// A read past the end of the file is still short.
+	dest = make([]byte, 30)
+	n, err = fd.read(ctx, dest, int64(len(data)-15))
+	require.NoError(t, err)
+	require.Equal(t, int64(15), n)
+	require.Equal(t, data[len(data)-15:], dest[:n])
+}
+
+func benchmarkFileDataRead(b *testing.B, maxParallelGets int) {
+	const numBlocks = 100
+	fd, data, _ := setupFileDataParallelReadTest(
+		b, numBlocks, 10, time.Millisecond)
+	fd.maxParallelGets = maxParallelGets
+	ctx := context.Background()
+	dest := make([]byte, len(data))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := fd.read(ctx, dest, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFileDataReadSequential(b *testing.B) {
+	benchmarkFileDataRead(b, 1)
+}
+
+func BenchmarkFileDataReadParallel(b *testing.B) {
+	benchmarkFileDataRead(b, maxParallelBlockGetsDefault)
+}
+
+func benchmarkFileDataAppend(b *testing.B, appendFastPath bool) {
+	const numBlocks = 1000
+	const blockSize = 64
+	ctx := context.Background()
+	data := make([]byte, blockSize)
+
+	var fd *fileData
+	var df *dirtyFile
+	var de DirEntry
+	write := func(data []byte) {
+		topBlock, _, err := fd.getter(
+			ctx, fd.kmd, fd.rootBlockPointer(), fd.file, blockWrite)
+		if err != nil {
+			b.Fatal(err)
+		}
+		de, _, _, _, _, err = fd.write(
+			ctx, data, int64(de.Size), topBlock, de, df)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	// Start over with a file of `numBlocks` blocks, with room for
+	// `numBlocks` more before another level is needed.
+	reset := func() {
+		var cleanBcache BlockCache
+		fd, cleanBcache, _, df = setupFileDataTest(
+			b, blockSize, 2*numBlocks)
+		fd.appendFastPath = appendFastPath
+		cleanBcache.Put(fd.rootBlockPointer(), fd.file.Tlf,
+			NewFileBlock(), TransientEntry)
+		de = DirEntry{}
+		write(make([]byte, numBlocks*blockSize))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%numBlocks == 0 {
+			b.StopTimer()
+			reset()
+			b.StartTimer()
+		}
+		write(data)
+	}
+}
+
+func BenchmarkFileDataAppendGeneral(b *testing.B) {
+	benchmarkFileDataAppend(b, false)
+}
+
+func BenchmarkFileDataAppendFast(b *testing.B) {
+	benchmarkFileDataAppend(b, true)
+}
+
+func TestFileDataReadBlocks(t *testing.T) {
+	fd, cleanCache, _, _ := setupFileDataTest(t, 2, 2)
+	data := make([]byte, 10)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	// Leaf blocks start at offsets 0, 2, 4 and 8, with a hole in
+	// [5, 8).
+	_, _ = testFileDataLevelExistingBlocks(
+		t, fd, 2, 2, data, []testFileDataHole{{5, 8}}, cleanCache)
+	ctx := context.Background()
+
+	dataBlock := func(off, end int64) blockAlignedData {
+		return blockAlignedData{
+			off: off, size: end - off, data: data[off:end]}
+	}
+	holeBlock := blockAlignedData{off: 5, size: 3, isHole: true}
+
+	type test struct {
+		name     string
+		startOff int64
+		count    int
+		expected []blockAlignedData
+	}
+	tests := []test{
+		{"Whole", 0, 10, []blockAlignedData{
+			dataBlock(0, 2), dataBlock(2, 4), dataBlock(4, 5), holeBlock,
+			dataBlock(8, 10)}},
+		{"MidBlock", 3, 2, []blockAlignedData{
+			dataBlock(2, 4), dataBlock(4, 5)}},
+		{"StopAtHole", 4, 2, []blockAlignedData{
+			dataBlock(4, 5), holeBlock}},
+		{"InHole", 6, 5, []blockAlignedData{
+			holeBlock, dataBlock(8, 10)}},
+		{"PastEnd", 10, 1, nil},
+	}
+
+	for _, test := range tests {
+		// capture range variable.
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			blocks, err := fd.readBlocks(ctx, test.startOff, test.count)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, blocks)
+		})
+	}
+}
+
+func TestFileDataReadWithBudget(t *testing.T) {
+	fd, cleanCache, _, _ := setupFileDataTest(t, 2, 4)
+	data := make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	// Leaf blocks start at offsets 0, 2, 4, 8, 10, ..., 38, with a
+	// hole in [5, 8).
+	_, _ = testFileDataLevelExistingBlocks(
+		t, fd, 2, 4, data, []testFileDataHole{{5, 8}}, cleanCache)
+	expectedData := append([]byte{}, data...)
+	copy(expectedData[5:8], make([]byte, 3))
+	ctx := context.Background()
+
+	type test struct {
+		name              string
+		startOff          int64
+		destLen           int
+		maxBlocks         int
+		expectedEnd       int64
+		expectedExhausted bool
+	}
+	tests := []test{
+		{"StopsAtBudget", 0, 40, 4, 10, true},
+		{"HoleIsFree", 3, 20, 2, 8, true},
+		{"WithinBudget", 0, 40, 19, 40, false},
+		{"ShortDest", 9, 4, 1, 10, true},
+		{"PastEnd", 36, 10, 5, 40, false},
+	}
+
+	for _, test := range tests {
+		// capture range variable.
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			dest := make([]byte, test.destLen)
+			n, exhausted, err := fd.readWithBudget(
+				ctx, dest, test.startOff, test.maxBlocks)
+			require.NoError(t, err)
+			require.Equal(t, test.expectedExhausted, exhausted)
+			require.Equal(t, test.expectedEnd-test.startOff, n)
+			require.Equal(t,
+				expectedData[test.startOff:test.expectedEnd], dest[:n])
+		})
+	}
+}
+
+func TestFileDataReadUntilBadBlock(t *testing.T) {
+	fd, cleanCache, _, _ := setupFileDataTest(t, 2, 4)
+	data := make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	// Leaf blocks start at offsets 0, 2, 4, 8, 10, ..., 38, with a
+	// hole in [5, 8).
+	_, _ = testFileDataLevelExistingBlocks(
+		t, fd, 2, 4, data, []testFileDataHole{{5, 8}}, cleanCache)
+	expectedData := append([]byte{}, data...)
+	copy(expectedData[5:8], make([]byte, 3))
+	ctx := context.Background()
+
+	// Make the block at offset 10 fail to decrypt.
+	topBlock, _, err := fd.getter(
+		ctx, nil, fd.rootBlockPointer(), path{}, blockRead)
+	require.NoError(t, err)
+	pfr, err := fd.getIndirectBlocksForOffsetRange(ctx, topBlock, 10, 11)
+	require.NoError(t, err)
+	require.Len(t, pfr, 1)
+	badIPtr := pfr[0][len(pfr[0])-1].childIPtr()
+	require.Equal(t, int64(10), badIPtr.Off)
+	badErr := errors.New("Fake decryption failure")
+	getter := fd.getter
+	fd.getter = func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
+		file path, rtype blockReqType) (*FileBlock, bool, error) {
+		if ptr == badIPtr.BlockPointer {
+			return nil, false, badErr
+		}
+		return getter(ctx, kmd, ptr, file, rtype)
+	}
+
+	t.Log("A strict read returns nothing.")
+	dest := make([]byte, 40)
+	n, err := fd.read(ctx, dest, 0)
+	require.Error(t, err)
+	require.Equal(t, int64(0), n)
+
+	t.Log("Reading until the bad block returns the prefix before it.")
+	dest = make([]byte, 40)
+	n, err = fd.readUntilBadBlock(ctx, dest, 3)
+	require.Equal(t, BadBlockReadError{10, badIPtr.BlockPointer, badErr},
+		errors.Cause(err))
+	require.Equal(t, int64(7), n)
+	require.Equal(t, expectedData[3:10], dest[:n])
+
+	t.Log("Reads that avoid the bad block are unaffected.")
+	dest = make([]byte, 40)
+	n, err = fd.readUntilBadBlock(ctx, dest, 12)
+	require.NoError(t, err)
+	require.Equal(t, int64(28), n)
+	require.Equal(t, expectedData[12:], dest[:n])
+}
+
+func TestFileDataReadBlocksDirect(t *testing.T) {
+	fd, cleanCache, _, _ := setupFileDataTest(t, 10, 2)
+	data := []byte{1, 2, 3, 4}
+	topBlock := NewFileBlock().(*FileBlock)
+	topBlock.Contents = data
+	err := cleanCache.Put(
+		fd.rootBlockPointer(), fd.file.Tlf, topBlock, TransientEntry)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	blocks, err := fd.readBlocks(ctx, 2, 3)
+	require.NoError(t, err)
+	require.Equal(t, []blockAlignedData{{off: 0, size: 4, data: data}},
+		blocks)
+
+	blocks, err = fd.readBlocks(ctx, 4, 3)
+	require.NoError(t, err)
+	require.Len(t, blocks, 0)
+}
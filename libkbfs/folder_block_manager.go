@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/keybase/backoff"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -29,16 +30,34 @@ type fbmHelper interface {
 const (
 	// How many pointers to downgrade in a single Archive/Delete call.
 	numPointersToDowngradePerChunk = 20
+	// The most block pointers that may be in the middle of being
+	// archived at once, across all the folders of a config, which
+	// bounds the memory used by archive workers no matter how many
+	// revisions are waiting to be archived.
+	maxArchivePointersInFlightDefault = 500
 	// Once the number of pointers being deleted in a single gc op
 	// passes this threshold, we'll stop garbage collection at the
 	// current revision.
 	numPointersPerGCThresholdDefault = 100
 	// The most revisions to consider for each QR run.
 	numMaxRevisionsPerQR = 100
+	// The most revisions to scan when looking for the revisions to
+	// reclaim.  If the last GC revision hasn't been found by then,
+	// QR proceeds as if there had never been a GC.
+	numMaxRevisionsToScanPerQR = 10000
+	// The most future-dated revisions each folder remembers as
+	// untrustworthy for QR.
+	maxFutureDatedRevs = 1000
+	// The most recently-archived block pointers each folder
+	// remembers, so that it can skip archiving them again.
+	maxRecentlyArchivedPtrs = 10000
 
 	// The delay to wait for before trying a failed block deletion
 	// again. Used by enqueueBlocksToDeleteAfterShortDelay().
 	deleteBlocksRetryDelay = 10 * time.Millisecond
+	// The delay to wait for before trying to get the truncate lock
+	// again, if someone else holds it.
+	truncateLockRetryDelay = 1 * time.Second
 )
 
 type blockDeleteType int
@@ -62,6 +81,42 @@ type blocksToDelete struct {
 	backoff backoff.BackOff
 }
 
+// archivePointersLimit bounds the number of block pointers that can
+// be in the middle of being archived at once.
+type archivePointersLimit struct {
+	// sem holds one resource for each block pointer that may be sent
+	// to the block server for archiving, out of max total.
+	sem *kbfssync.Semaphore
+	max int64
+}
+
+func newArchivePointersLimit(max int64) *archivePointersLimit {
+	l := &archivePointersLimit{
+		sem: kbfssync.NewSemaphore(),
+		max: max,
+	}
+	l.sem.Release(max)
+	return l
+}
+
+// archivePointersLimitGetter is implemented by configs that share one
+// archivePointersLimit among all of their folders.
+type archivePointersLimitGetter interface {
+	archivePointersLimit() *archivePointersLimit
+}
+
+// getArchivePointersLimit returns the limit shared by all the folders
+// of `config`, or a new one just for the caller if the config doesn't
+// have one.
+func getArchivePointersLimit(config Config) *archivePointersLimit {
+	if g, ok := config.(archivePointersLimitGetter); ok {
+		if l := g.archivePointersLimit(); l != nil {
+			return l
+		}
+	}
+	return newArchivePointersLimit(maxArchivePointersInFlightDefault)
+}
+
 // folderBlockManager is a helper class for managing the blocks in a
 // particular TLF.  It archives historical blocks and reclaims quota
 // usage, all in the background.
@@ -82,8 +137,30 @@ type folderBlockManager struct {
 	// archiveGroup tracks the outstanding archives.
 	archiveGroup kbfssync.RepeatedWaitGroup
 
+	// archiveCancelLock protects archiveCancel and archiveRevision,
+	// the revision whose unrefs are currently being archived (or
+	// kbfsmd.RevisionUninitialized if none).
 	archiveCancelLock sync.Mutex
 	archiveCancel     context.CancelFunc
+	archiveRevision   kbfsmd.Revision
+
+	// futureDatedRevs holds the revisions whose timestamps were
+	// further in the future than QuotaReclamationMaxClockSkew when
+	// we checked them.  Their timestamps are never trusted again,
+	// even once the local clock catches up to them.
+	futureDatedRevs *lru.Cache
+
+	// archivePointers limits the block pointers that may be sent to
+	// the block server for archiving at once.  It's normally shared
+	// by all the folders of the config.
+	archivePointers *archivePointersLimit
+
+	// recentlyArchived maps each block pointer that was archived
+	// successfully within the last Tunables.RecentlyArchivedWindow to
+	// the time it was archived, so that archives of overlapping
+	// unrefs (e.g., from conflict resolution) don't send it again.
+	// Only the last maxRecentlyArchivedPtrs pointers are remembered.
+	recentlyArchived *lru.Cache
 
 	// blocksToDeleteChan is a list of blocks, for a given
 	// metadata revision, that may have been Put as part of a failed
@@ -101,6 +178,15 @@ type folderBlockManager struct {
 	// process.
 	forceReclamationChan chan struct{}
 
+	// lastReclamationStart is only accessed by the
+	// reclaimQuotaInBackground goroutine.
+	lastReclamationStart time.Time
+
+	// reclamationPauseChan pauses quota reclamation until the
+	// given channel is closed.  Timed reclamations are suppressed
+	// while paused, and forced ones are deferred until unpaused.
+	reclamationPauseChan chan (<-chan struct{})
+
 	// reclamationGroup tracks the outstanding quota reclamations.
 	reclamationGroup kbfssync.RepeatedWaitGroup
 
@@ -109,6 +195,9 @@ type folderBlockManager struct {
 
 	helper fbmHelper
 
+	observersLock sync.Mutex
+	observers     []BlockManagerObserver
+
 	// Remembers what happened last time during quota reclamation.
 	lastQRLock          sync.Mutex
 	lastQRHeadRev       kbfsmd.Revision
@@ -121,17 +210,29 @@ func newFolderBlockManager(config Config, fb FolderBranch,
 	helper fbmHelper) *folderBlockManager {
 	tlfStringFull := fb.Tlf.String()
 	log := config.MakeLogger(fmt.Sprintf("FBM %s", tlfStringFull[:8]))
+	futureDatedRevs, err := lru.New(maxFutureDatedRevs)
+	if err != nil {
+		panic(err.Error())
+	}
+	recentlyArchived, err := lru.New(maxRecentlyArchivedPtrs)
+	if err != nil {
+		panic(err.Error())
+	}
 	fbm := &folderBlockManager{
 		config:       config,
 		log:          log,
 		shutdownChan: make(chan struct{}),
 		id:           fb.Tlf,
 		numPointersPerGCThreshold: numPointersPerGCThresholdDefault,
+		archivePointers:           getArchivePointersLimit(config),
+		futureDatedRevs:           futureDatedRevs,
+		recentlyArchived:          recentlyArchived,
 		archiveChan:               make(chan ReadOnlyRootMetadata, 500),
 		archivePauseChan:          make(chan (<-chan struct{})),
 		blocksToDeleteChan:        make(chan blocksToDelete, 25),
 		blocksToDeletePauseChan:   make(chan (<-chan struct{})),
 		forceReclamationChan:      make(chan struct{}, 1),
+		reclamationPauseChan:      make(chan (<-chan struct{})),
 		helper:                    helper,
 	}
 	// Pass in the BlockOps here so that the archive goroutine
@@ -154,6 +255,36 @@ func newFolderBlockManager(config Config, fb FolderBranch,
 	return fbm
 }
 
+func (fbm *folderBlockManager) registerObserver(obs BlockManagerObserver) {
+	fbm.observersLock.Lock()
+	defer fbm.observersLock.Unlock()
+	fbm.observers = append(fbm.observers, obs)
+}
+
+func (fbm *folderBlockManager) unregisterObserver(obs BlockManagerObserver) {
+	fbm.observersLock.Lock()
+	defer fbm.observersLock.Unlock()
+	for i, o := range fbm.observers {
+		if o == obs {
+			fbm.observers = append(fbm.observers[:i], fbm.observers[i+1:]...)
+			return
+		}
+	}
+}
+
+// notifyObservers calls `f` on each registered observer, without
+// holding any locks.
+func (fbm *folderBlockManager) notifyObservers(
+	f func(obs BlockManagerObserver)) {
+	fbm.observersLock.Lock()
+	observers := make([]BlockManagerObserver, len(fbm.observers))
+	copy(observers, fbm.observers)
+	fbm.observersLock.Unlock()
+	for _, obs := range observers {
+		f(obs)
+	}
+}
+
 func (fbm *folderBlockManager) setBlocksToDeleteCancel(cancel context.CancelFunc) {
 	fbm.blocksToDeleteCancelLock.Lock()
 	defer fbm.blocksToDeleteCancelLock.Unlock()
@@ -173,10 +304,12 @@ func (fbm *folderBlockManager) cancelBlocksToDelete() {
 	}
 }
 
-func (fbm *folderBlockManager) setArchiveCancel(cancel context.CancelFunc) {
+func (fbm *folderBlockManager) setArchiveCancel(
+	cancel context.CancelFunc, rev kbfsmd.Revision) {
 	fbm.archiveCancelLock.Lock()
 	defer fbm.archiveCancelLock.Unlock()
 	fbm.archiveCancel = cancel
+	fbm.archiveRevision = rev
 }
 
 func (fbm *folderBlockManager) cancelArchive() {
@@ -185,6 +318,7 @@ func (fbm *folderBlockManager) cancelArchive() {
 		defer fbm.archiveCancelLock.Unlock()
 		archiveCancel := fbm.archiveCancel
 		fbm.archiveCancel = nil
+		fbm.archiveRevision = kbfsmd.RevisionUninitialized
 		return archiveCancel
 	}()
 	if archiveCancel != nil {
@@ -192,6 +326,42 @@ func (fbm *folderBlockManager) cancelArchive() {
 	}
 }
 
+// CurrentArchive returns the revision whose unreferenced blocks are
+// being archived right now, and false if no archive is running.
+func (fbm *folderBlockManager) CurrentArchive() (kbfsmd.Revision, bool) {
+	fbm.archiveCancelLock.Lock()
+	defer fbm.archiveCancelLock.Unlock()
+	if fbm.archiveCancel == nil {
+		return kbfsmd.RevisionUninitialized, false
+	}
+	return fbm.archiveRevision, true
+}
+
+// CancelArchiveForRevision cancels the running archive, but only if
+// it's for the given revision, e.g. because conflict resolution is
+// about to undo that revision's unrefs.  It returns true if an
+// archive was canceled.  Archives of the revision that are still
+// queued aren't affected.
+func (fbm *folderBlockManager) CancelArchiveForRevision(
+	rev kbfsmd.Revision) bool {
+	archiveCancel := func() context.CancelFunc {
+		fbm.archiveCancelLock.Lock()
+		defer fbm.archiveCancelLock.Unlock()
+		if fbm.archiveCancel == nil || fbm.archiveRevision != rev {
+			return nil
+		}
+		archiveCancel := fbm.archiveCancel
+		fbm.archiveCancel = nil
+		fbm.archiveRevision = kbfsmd.RevisionUninitialized
+		return archiveCancel
+	}()
+	if archiveCancel == nil {
+		return false
+	}
+	archiveCancel()
+	return true
+}
+
 func (fbm *folderBlockManager) setReclamationCancel(cancel context.CancelFunc) {
 	fbm.reclamationCancelLock.Lock()
 	defer fbm.reclamationCancelLock.Unlock()
@@ -302,6 +472,112 @@ func (fbm *folderBlockManager) enqueueBlocksToDeleteNoWait(toDelete blocksToDele
 	}
 }
 
+// getRefsInMD returns all the block pointers that the ops in the
+// given MD newly reference.
+func getRefsInMD(rmd ImmutableRootMetadata) []BlockPointer {
+	var ptrs []BlockPointer
+	for _, op := range rmd.data.Changes.Ops {
+		for _, ptr := range op.Refs() {
+			if ptr != zeroPtr {
+				ptrs = append(ptrs, ptr)
+			}
+		}
+		for _, update := range op.allUpdates() {
+			if update.Ref != zeroPtr {
+				ptrs = append(ptrs, update.Ref)
+			}
+		}
+	}
+	return ptrs
+}
+
+// getBranchOnlyBlocks returns the block pointers referenced by the
+// given unmerged MDs, minus any references that the given merged MDs
+// also make (e.g., because conflict resolution reused a block from
+// the unmerged branch).
+func getBranchOnlyBlocks(
+	unmergedRmds, mergedRmds []ImmutableRootMetadata) []BlockPointer {
+	mergedRefs := make(map[BlockRef]bool)
+	for _, rmd := range mergedRmds {
+		for _, ptr := range getRefsInMD(rmd) {
+			mergedRefs[ptr.Ref()] = true
+		}
+	}
+
+	var ptrs []BlockPointer
+	seen := make(map[BlockRef]bool)
+	for _, rmd := range unmergedRmds {
+		for _, ptr := range getRefsInMD(rmd) {
+			ref := ptr.Ref()
+			if mergedRefs[ref] || seen[ref] {
+				continue
+			}
+			seen[ref] = true
+			ptrs = append(ptrs, ptr)
+		}
+	}
+	return ptrs
+}
+
+// OnBranchPruned deletes the blocks that were only referenced by the
+// unmerged revisions of the given branch, which must already have
+// been pruned.  Quota reclamation only walks the merged history, so
+// it would only find these blocks through the caller's unref of them.
+// References that the merged history made since the branch point are
+// left alone.  It returns the pointers whose deletion the block
+// server confirmed, which don't need to be unreferenced again by any
+// later revision.  If the deletion fails, it returns an error and no
+// pointers, and the caller must keep unreferencing all of them.
+func (fbm *folderBlockManager) OnBranchPruned(
+	ctx context.Context, bid kbfsmd.BranchID) ([]BlockPointer, error) {
+	if bid == kbfsmd.NullBranchID ||
+		bid == kbfsmd.PendingLocalSquashBranchID {
+		// These branches never existed on the server.
+		return nil, nil
+	}
+
+	head, err := fbm.config.MDOps().GetUnmergedForTLF(ctx, fbm.id, bid)
+	if err != nil {
+		return nil, err
+	}
+	if head == (ImmutableRootMetadata{}) {
+		fbm.log.CDebugf(ctx, "No unmerged revisions found for branch %s", bid)
+		return nil, nil
+	}
+
+	_, unmergedRmds, err := getUnmergedMDUpdates(
+		ctx, fbm.config, fbm.id, bid, head.Revision())
+	if err != nil {
+		return nil, err
+	}
+	if len(unmergedRmds) == 0 {
+		return nil, nil
+	}
+
+	// The branch forked off the merged history right before its
+	// first revision, so only merged revisions from that point on
+	// could share references with it.
+	mergedRmds, err := getMergedMDUpdates(
+		ctx, fbm.config, fbm.id, unmergedRmds[0].Revision(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ptrs := getBranchOnlyBlocks(unmergedRmds, mergedRmds)
+	fbm.log.CDebugf(ctx, "Deleting %d blocks from pruned branch %s "+
+		"(revisions %d-%d)", len(ptrs), bid, unmergedRmds[0].Revision(),
+		head.Revision())
+	if len(ptrs) == 0 {
+		return nil, nil
+	}
+
+	_, err = fbm.deleteBlockRefs(ctx, fbm.id, ptrs)
+	if err != nil {
+		return nil, err
+	}
+	return ptrs, nil
+}
+
 func isArchivableOp(op op) bool {
 	switch op.(type) {
 	case *createOp:
@@ -394,6 +670,28 @@ func (fbm *folderBlockManager) waitForQuotaReclamations(
 	return fbm.reclamationGroup.Wait(ctx)
 }
 
+func (fbm *folderBlockManager) waitForArchivesWithTimeout(
+	timeout time.Duration) error {
+	return fbm.archiveGroup.WaitWithTimeout(timeout)
+}
+
+func (fbm *folderBlockManager) waitForQuotaReclamationsWithTimeout(
+	timeout time.Duration) error {
+	return fbm.reclamationGroup.WaitWithTimeout(timeout)
+}
+
+// numOutstandingArchives returns the number of archive requests that
+// haven't finished yet, without blocking.
+func (fbm *folderBlockManager) numOutstandingArchives() int {
+	return fbm.archiveGroup.OutstandingCount()
+}
+
+// numOutstandingQuotaReclamations returns the number of quota
+// reclamations that haven't finished yet, without blocking.
+func (fbm *folderBlockManager) numOutstandingQuotaReclamations() int {
+	return fbm.reclamationGroup.OutstandingCount()
+}
+
 func (fbm *folderBlockManager) forceQuotaReclamation() {
 	fbm.reclamationGroup.Add(1)
 	select {
@@ -403,25 +701,83 @@ func (fbm *folderBlockManager) forceQuotaReclamation() {
 	}
 }
 
+// downgradeChunking returns how many pointers to send in each
+// Archive/Delete call when downgrading `numPtrs` pointers, how many
+// calls that makes, and how many workers should make them.  Normally
+// each call has numPointersToDowngradePerChunk pointers, with one
+// worker per call up to the configured number of parallel block
+// puts.  But if that would leave fewer than the configured minimum
+// number of downgrade workers, the pointers are split into smaller
+// chunks so they can be spread across that many workers.  The
+// minimum never raises the number of workers past the number of
+// parallel block puts, though.  Archive
+// chunks are also capped at the maximum of `fbm.archivePointers`, so
+// that each one can get its resources from the shared semaphore.
+func (fbm *folderBlockManager) downgradeChunking(numPtrs int, archive bool) (
+	chunkSize, numChunks, numWorkers int) {
+	chunkSize = numPointersToDowngradePerChunk
+	maxWorkers := fbm.config.Tunables().MaxParallelBlockPuts
+	minWorkers := fbm.config.Tunables().MinDowngradeWorkers
+	if minWorkers > maxWorkers {
+		minWorkers = maxWorkers
+	}
+	if minWorkers > 1 {
+		// Round up, so there are never more than minWorkers
+		// chunks because of this.
+		if minChunkSize := (numPtrs + minWorkers - 1) / minWorkers; minChunkSize < chunkSize {
+			chunkSize = minChunkSize
+		}
+		if chunkSize < 1 {
+			chunkSize = 1
+		}
+	}
+	if archive && int64(chunkSize) > fbm.archivePointers.max {
+		chunkSize = int(fbm.archivePointers.max)
+	}
+
+	// Round up to find the number of chunks.
+	numChunks = (numPtrs + chunkSize - 1) / chunkSize
+	numWorkers = numChunks
+	if numWorkers > maxWorkers {
+		numWorkers = maxWorkers
+	}
+	return chunkSize, numChunks, numWorkers
+}
+
 // doChunkedDowngrades sends batched archive or delete messages to the
 // block server for the given block pointers.  For deletes, it returns
 // a list of block IDs that no longer have any references.
 func (fbm *folderBlockManager) doChunkedDowngrades(ctx context.Context,
 	tlfID tlf.ID, ptrs []BlockPointer, archive bool) (
 	[]kbfsblock.ID, error) {
+	if archive {
+		numPtrs := len(ptrs)
+		ptrs = fbm.skipRecentlyArchived(ptrs)
+		if skipped := numPtrs - len(ptrs); skipped > 0 {
+			fbm.log.CDebugf(ctx, "Skipping %d recently-archived pointers",
+				skipped)
+		}
+		if len(ptrs) == 0 {
+			return nil, nil
+		}
+	}
 	fbm.log.CDebugf(ctx, "Downgrading %d pointers (archive=%t)",
 		len(ptrs), archive)
 	bops := fbm.config.BlockOps()
 
-	// Round up to find the number of chunks.
-	numChunks := (len(ptrs) + numPointersToDowngradePerChunk - 1) /
-		numPointersToDowngradePerChunk
-	numWorkers := numChunks
-	if numWorkers > maxParallelBlockPuts {
-		numWorkers = maxParallelBlockPuts
-	}
+	chunkSize, numChunks, numWorkers := fbm.downgradeChunking(len(ptrs), archive)
 	chunks := make(chan []BlockPointer, numChunks)
 
+	if archive {
+		// This runs after all the workers have exited, so it only
+		// releases the chunks that no worker ever got to.
+		defer func() {
+			for chunk := range chunks {
+				fbm.archivePointers.sem.Release(int64(len(chunk)))
+			}
+		}()
+	}
+
 	var wg sync.WaitGroup
 	defer wg.Wait()
 
@@ -441,6 +797,10 @@ func (fbm *folderBlockManager) doChunkedDowngrades(ctx context.Context,
 			fbm.log.CDebugf(ctx, "Downgrading chunk of %d pointers", len(chunk))
 			if archive {
 				res.err = bops.Archive(ctx, tlfID, chunk)
+				fbm.archivePointers.sem.Release(int64(len(chunk)))
+				if res.err == nil {
+					fbm.markRecentlyArchived(chunk)
+				}
 			} else {
 				var liveCounts map[kbfsblock.ID]int
 				liveCounts, res.err = bops.Delete(ctx, tlfID, chunk)
@@ -466,17 +826,29 @@ func (fbm *folderBlockManager) doChunkedDowngrades(ctx context.Context,
 		go worker()
 	}
 
-	for start := 0; start < len(ptrs); start += numPointersToDowngradePerChunk {
-		end := start + numPointersToDowngradePerChunk
+	numSent := 0
+	var sendErr error
+	for start := 0; start < len(ptrs); start += chunkSize {
+		end := start + chunkSize
 		if end > len(ptrs) {
 			end = len(ptrs)
 		}
+		if archive {
+			// Wait for room among all the archive pointers in
+			// flight, across all concurrent archives in all folders.
+			_, sendErr = fbm.archivePointers.sem.Acquire(
+				ctx, int64(end-start))
+			if sendErr != nil {
+				break
+			}
+		}
 		chunks <- ptrs[start:end]
+		numSent++
 	}
 	close(chunks)
 
 	var zeroRefCounts []kbfsblock.ID
-	for i := 0; i < numChunks; i++ {
+	for i := 0; i < numSent; i++ {
 		result := <-chunkResults
 		if result.err != nil {
 			// deferred cancel will stop the other workers.
@@ -484,15 +856,85 @@ func (fbm *folderBlockManager) doChunkedDowngrades(ctx context.Context,
 		}
 		zeroRefCounts = append(zeroRefCounts, result.zeroRefCounts...)
 	}
+	if sendErr != nil {
+		return nil, sendErr
+	}
 	return zeroRefCounts, nil
 }
 
+// skipRecentlyArchived returns the pointers in `ptrs` that haven't
+// been archived successfully within the recently-archived window,
+// without any duplicates.
+func (fbm *folderBlockManager) skipRecentlyArchived(
+	ptrs []BlockPointer) []BlockPointer {
+	window := fbm.config.Tunables().RecentlyArchivedWindow
+	if window <= 0 {
+		return ptrs
+	}
+	now := fbm.config.Clock().Now()
+	seen := make(map[BlockPointer]bool, len(ptrs))
+	toArchive := make([]BlockPointer, 0, len(ptrs))
+	for _, ptr := range ptrs {
+		if seen[ptr] {
+			continue
+		}
+		seen[ptr] = true
+		if archived, ok := fbm.recentlyArchived.Get(ptr); ok &&
+			now.Sub(archived.(time.Time)) < window {
+			continue
+		}
+		toArchive = append(toArchive, ptr)
+	}
+	return toArchive
+}
+
+// markRecentlyArchived records that `ptrs` were just archived
+// successfully.
+func (fbm *folderBlockManager) markRecentlyArchived(ptrs []BlockPointer) {
+	if fbm.config.Tunables().RecentlyArchivedWindow <= 0 {
+		return
+	}
+	now := fbm.config.Clock().Now()
+	for _, ptr := range ptrs {
+		fbm.recentlyArchived.Add(ptr, now)
+	}
+}
+
 // deleteBlockRefs sends batched delete messages to the block server
 // for the given block pointers.  It returns a list of block IDs that
-// no longer have any references.
+// no longer have any references.  Only those blocks are also removed
+// from the BlockCache and its dedup index, if any, so new blocks
+// can't be deduplicated against them; blocks that are still live
+// stay in the index.
 func (fbm *folderBlockManager) deleteBlockRefs(ctx context.Context,
 	tlfID tlf.ID, ptrs []BlockPointer) ([]kbfsblock.ID, error) {
-	return fbm.doChunkedDowngrades(ctx, tlfID, ptrs, false)
+	zeroRefCounts, err := fbm.doChunkedDowngrades(ctx, tlfID, ptrs, false)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := make(map[kbfsblock.ID]bool, len(zeroRefCounts))
+	for _, id := range zeroRefCounts {
+		deleted[id] = true
+	}
+	bcache := fbm.config.BlockCache()
+	index := fbm.config.BlockDedupIndex()
+	for _, ptr := range ptrs {
+		if !deleted[ptr.ID] {
+			continue
+		}
+		if err := bcache.DeleteTransient(ptr, tlfID); err != nil {
+			fbm.log.CDebugf(ctx,
+				"Couldn't delete transient entry for %v: %v", ptr, err)
+		}
+		if index != nil {
+			// Forget by ID, since the block may have been evicted
+			// from the cache already, so its hash can't be looked
+			// up.
+			index.ForgetID(tlfID, ptr.ID)
+		}
+	}
+	return zeroRefCounts, nil
 }
 
 func (fbm *folderBlockManager) processBlocksToDelete(ctx context.Context, toDelete blocksToDelete) error {
@@ -663,12 +1105,20 @@ func (fbm *folderBlockManager) archiveBlocksInBackground() {
 				// use the long timeout to make sure things get
 				// unblocked eventually, but no need for a short timeout.
 				ctx, cancel := context.WithTimeout(ctx, backgroundTaskTimeout)
-				fbm.setArchiveCancel(cancel)
+				fbm.setArchiveCancel(cancel, md.Revision())
 				defer fbm.cancelArchive()
 
 				fbm.log.CDebugf(ctx, "Archiving %d block pointers as a result "+
 					"of revision %d", len(ptrs), md.Revision())
+				fbm.notifyObservers(func(obs BlockManagerObserver) {
+					obs.OnArchiveStarted(
+						ctx, md.TlfID(), md.Revision(), len(ptrs))
+				})
 				err = fbm.archiveBlockRefs(ctx, md.TlfID(), ptrs)
+				fbm.notifyObservers(func(obs BlockManagerObserver) {
+					obs.OnArchiveCompleted(
+						ctx, md.TlfID(), md.Revision(), len(ptrs), err)
+				})
 				if err != nil {
 					fbm.log.CWarningf(ctx, "Couldn't archive blocks: %v", err)
 					return err
@@ -727,11 +1177,29 @@ func (fbm *folderBlockManager) deleteBlocksInBackground() {
 	}
 }
 
-func (fbm *folderBlockManager) isOldEnough(rmd ImmutableRootMetadata) bool {
-	// Trust the server's timestamp on this MD.
+func (fbm *folderBlockManager) isOldEnough(
+	ctx context.Context, rmd ImmutableRootMetadata) bool {
+	// Trust the server's timestamp on this MD, unless it's further in
+	// the future than we can explain by clock skew.  In that case
+	// don't trust it at all, even after our clock catches up to it,
+	// since a writer with a bad clock could otherwise get its
+	// revisions reclaimed early.
+	if fbm.futureDatedRevs.Contains(rmd.Revision()) {
+		return false
+	}
 	mtime := rmd.localTimestamp
+	clock := fbm.config.Clock()
+	now := clock.Now()
+	skew := reportClockSkew(clock, mtime)
+	if maxSkew := fbm.config.Tunables().QuotaReclamationMaxClockSkew; skew > maxSkew {
+		fbm.log.CWarningf(ctx, "Revision %d has a timestamp %s in the "+
+			"future (max skew %s); treating as not old enough",
+			rmd.Revision(), skew, maxSkew)
+		fbm.futureDatedRevs.Add(rmd.Revision(), nil)
+		return false
+	}
 	unrefAge := fbm.config.QuotaReclamationMinUnrefAge()
-	return mtime.Add(unrefAge).Before(fbm.config.Clock().Now())
+	return mtime.Add(unrefAge).Before(now)
 }
 
 // getMostRecentOldEnoughAndGCRevisions returns the most recent MD
@@ -745,6 +1213,7 @@ func (fbm *folderBlockManager) getMostRecentOldEnoughAndGCRevisions(
 	// this scan once we have some way to get the MD corresponding to
 	// a given timestamp.
 	currHead := head.Revision()
+	numScanned := 0
 	mostRecentOldEnoughRev = kbfsmd.RevisionUninitialized
 	lastGCRev = kbfsmd.RevisionUninitialized
 	if head.data.LastGCRevision >= kbfsmd.RevisionInitial {
@@ -768,10 +1237,11 @@ func (fbm *folderBlockManager) getMostRecentOldEnoughAndGCRevisions(
 		}
 
 		numNew := len(rmds)
+		numScanned += numNew
 		for i := len(rmds) - 1; i >= 0; i-- {
 			rmd := rmds[i]
 			if mostRecentOldEnoughRev == kbfsmd.RevisionUninitialized &&
-				fbm.isOldEnough(rmd) {
+				fbm.isOldEnough(ctx, rmd) {
 				fbm.log.CDebugf(ctx, "Revision %d is older than the unref "+
 					"age %s", rmd.Revision(),
 					fbm.config.QuotaReclamationMinUnrefAge())
@@ -804,14 +1274,36 @@ func (fbm *folderBlockManager) getMostRecentOldEnoughAndGCRevisions(
 			}
 		}
 
+		prevHead := currHead
 		if numNew > 0 {
 			currHead = rmds[0].Revision() - 1
+			// Guard against a bad range of MDs sending us around in
+			// circles forever: the range must reach all the way back
+			// to `startRev`.
+			if currHead >= startRev {
+				return kbfsmd.RevisionUninitialized,
+					kbfsmd.RevisionUninitialized, fmt.Errorf(
+						"MD revisions didn't decrease while scanning for "+
+							"QR: range [%d, %d] started at revision %d",
+						startRev, prevHead, rmds[0].Revision())
+			}
 		}
 
 		if numNew < maxMDsAtATime || currHead < kbfsmd.RevisionInitial {
 			break
 		}
 
+		if numScanned >= numMaxRevisionsToScanPerQR {
+			// Don't let a long history without any GC make every
+			// QR scan all the way back to the first revision.
+			// Starting over from the beginning is safe, since
+			// already-deleted blocks are just deleted again.
+			fbm.log.CDebugf(ctx, "Stopping QR scan after %d revisions "+
+				"(most recent old-enough rev %d, last GC rev %d)",
+				numScanned, mostRecentOldEnoughRev, lastGCRev)
+			break
+		}
+
 		if lastGCRev != kbfsmd.RevisionUninitialized &&
 			currHead < head.Revision()-numMaxRevisionsPerQR {
 			// If we've already found the latest gc rev, we should
@@ -1017,7 +1509,72 @@ func (fbm *folderBlockManager) isQRNecessary(
 	// Do QR if the head was not reclaimable at the last QR time, but
 	// is old enough now.
 	return fbm.lastQRHeadRev > fbm.lastQROldEnoughRev &&
-		fbm.isOldEnough(head)
+		fbm.isOldEnough(ctx, head)
+}
+
+// tryTruncateLock makes a single attempt to get the truncate lock
+// for this folder, and returns false if someone else holds it.
+func (fbm *folderBlockManager) tryTruncateLock(ctx context.Context) (
+	bool, error) {
+	locked, err := fbm.config.MDServer().TruncateLock(ctx, fbm.id)
+	switch err.(type) {
+	case nil:
+		return locked, nil
+	case kbfsmd.ServerErrorLocked:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// getTruncateLock tries to get the truncate lock for this folder.
+// By default it only tries once, and if someone else holds the lock
+// it returns an error so QR skips this pass and tries again next
+// period.  If `Tunables.QuotaReclamationTruncateLockTimeout` is
+// positive, it instead keeps retrying for up to that long, since
+// doReclamation itself runs without a deadline.
+func (fbm *folderBlockManager) getTruncateLock(ctx context.Context) error {
+	timeout := fbm.config.Tunables().QuotaReclamationTruncateLockTimeout
+	if timeout == 0 {
+		locked, err := fbm.tryTruncateLock(ctx)
+		if err != nil {
+			return err
+		}
+		if !locked {
+			fbm.log.CDebugf(ctx, "Couldn't get the truncate lock; "+
+				"skipping this reclamation")
+			return fmt.Errorf("Couldn't get the truncate lock for "+
+				"folder %s", fbm.id)
+		}
+		return nil
+	}
+
+	lockCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		locked, err := fbm.tryTruncateLock(lockCtx)
+		if err != nil {
+			return err
+		}
+		if locked {
+			return nil
+		}
+
+		fbm.log.CDebugf(ctx, "Couldn't get the truncate lock; retrying")
+		t := time.NewTimer(truncateLockRetryDelay)
+		select {
+		case <-t.C:
+		case <-lockCtx.Done():
+			t.Stop()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fbm.log.CDebugf(ctx, "Giving up on the truncate lock after %s",
+				timeout)
+			return fmt.Errorf("Couldn't get the truncate lock for folder "+
+				"%s within %s", fbm.id, timeout)
+		}
+	}
 }
 
 func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
@@ -1086,15 +1643,10 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 
 	// Then grab the lock for this folder, so we're the only one doing
 	// garbage collection for a while.
-	locked, err := fbm.config.MDServer().TruncateLock(ctx, fbm.id)
+	err = fbm.getTruncateLock(ctx)
 	if err != nil {
 		return err
 	}
-	if !locked {
-		fbm.log.CDebugf(ctx, "Couldn't get the truncate lock")
-		return fmt.Errorf("Couldn't get the truncate lock for folder %d",
-			fbm.id)
-	}
 	defer func() {
 		unlocked, unlockErr := fbm.config.MDServer().TruncateUnlock(ctx, fbm.id)
 		if unlockErr != nil {
@@ -1129,9 +1681,16 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 	// Don't print these until we know for sure that we'll be
 	// reclaiming some quota, to avoid log pollution.
 	fbm.log.CDebugf(ctx, "Starting quota reclamation process")
+	fbm.notifyObservers(func(obs BlockManagerObserver) {
+		obs.OnReclamationStarted(ctx, fbm.id)
+	})
+	var numReclaimed int
 	defer func() {
 		fbm.log.CDebugf(ctx, "Ending quota reclamation process: %v", err)
 		reclamationTime = fbm.config.Clock().Now()
+		fbm.notifyObservers(func(obs BlockManagerObserver) {
+			obs.OnReclamationCompleted(ctx, fbm.id, numReclaimed, err)
+		})
 	}()
 
 	ptrs, latestRev, complete, err :=
@@ -1151,6 +1710,7 @@ func (fbm *folderBlockManager) doReclamation(timer *time.Timer) (err error) {
 	if err != nil {
 		return err
 	}
+	numReclaimed = len(ptrs)
 
 	return fbm.finalizeReclamation(ctx, ptrs, zeroRefCounts, latestRev)
 }
@@ -1171,8 +1731,17 @@ func (fbm *folderBlockManager) reclaimQuotaInBackground() {
 		case <-timerChan:
 			fbm.reclamationGroup.Add(1)
 		case <-fbm.forceReclamationChan:
+			if !fbm.waitForForcedReclamationWindow(timer) {
+				return
+			}
+		case unpause := <-fbm.reclamationPauseChan:
+			if !fbm.waitForReclamationUnpause(timer, unpause) {
+				return
+			}
+			continue
 		}
 
+		fbm.lastReclamationStart = fbm.config.Clock().Now()
 		err := fbm.doReclamation(timer)
 		_, isWriteError := err.(WriteAccessError)
 		_, isFinalError := err.(kbfsmd.MetadataIsFinalError)
@@ -1188,6 +1757,77 @@ func (fbm *folderBlockManager) reclaimQuotaInBackground() {
 	}
 }
 
+// waitForForcedReclamationWindow delays a forced reclamation until
+// at least the configured minimum interval has passed since the last
+// reclamation started.  Any other forced reclamations requested in
+// the meantime are coalesced into this one.  Pausing QR while
+// waiting holds the forced reclamation back until it's unpaused.  It
+// returns false if the fbm was shut down while waiting.
+func (fbm *folderBlockManager) waitForForcedReclamationWindow(
+	timer *time.Timer) bool {
+	interval := fbm.config.Tunables().QuotaReclamationMinForcedInterval
+	clock := fbm.config.Clock()
+	for interval > 0 && !fbm.lastReclamationStart.IsZero() {
+		wait := interval - clock.Now().Sub(fbm.lastReclamationStart)
+		if wait <= 0 {
+			break
+		}
+		fbm.log.CDebugf(context.Background(),
+			"Delaying forced reclamation for %s", wait)
+		waitCh, stopWait := newClockTimer(clock, wait)
+		select {
+		case <-waitCh:
+		case unpause := <-fbm.reclamationPauseChan:
+			stopWait()
+			if !fbm.waitForReclamationUnpause(timer, unpause) {
+				return false
+			}
+		case <-fbm.shutdownChan:
+			stopWait()
+			return false
+		}
+	}
+
+	// The caller will run a reclamation for the force it already
+	// received; account for any others as part of that same run.
+	for {
+		select {
+		case <-fbm.forceReclamationChan:
+			fbm.reclamationGroup.Done()
+		default:
+			return true
+		}
+	}
+}
+
+// waitForReclamationUnpause stops the QR timer and blocks until
+// `unpause` is closed, then restarts the timer.  A forced reclamation
+// that arrives while paused stays queued in forceReclamationChan, so
+// it runs once this returns.  It returns false if the fbm was shut
+// down while paused.
+func (fbm *folderBlockManager) waitForReclamationUnpause(
+	timer *time.Timer, unpause <-chan struct{}) bool {
+	ctx := context.Background()
+	fbm.log.CInfof(ctx, "Quota reclamation paused")
+	if !timer.Stop() {
+		// Drain any pending fire, so it doesn't trigger a
+		// reclamation as soon as we're unpaused.
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+
+	select {
+	case <-unpause:
+		fbm.log.CInfof(ctx, "Quota reclamation unpaused")
+	case <-fbm.shutdownChan:
+		return false
+	}
+	timer.Reset(fbm.config.QuotaReclamationPeriod())
+	return true
+}
+
 func (fbm *folderBlockManager) getLastQRData() (time.Time, kbfsmd.Revision) {
 	fbm.lastQRLock.Lock()
 	defer fbm.lastQRLock.Unlock()
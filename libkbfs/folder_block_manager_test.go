@@ -6,12 +6,18 @@ package libkbfs
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
 	"golang.org/x/net/context"
 )
@@ -810,3 +816,1449 @@ func TestQuotaReclamationGCOpsForGCOps(t *testing.T) {
 		t.Fatalf("Last GCOp revision was unexpected: %d vs %d", g, e)
 	}
 }
+
+// Test that revisions written by a device whose clock is too far in
+// the future aren't reclaimed, even once the local clock has moved
+// past the unref age.
+func TestQuotaReclamationFutureDatedRevision(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	// Write and remove a directory with a clock that's far ahead.
+	skewed := now.Add(10 * config.Tunables().QuotaReclamationMaxClockSkew)
+	clock.Set(skewed)
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't remove dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	err = kbfsOps.SyncFromServerForTesting(ctx,
+		rootNode.GetFolderBranch(), nil)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %+v", err)
+	}
+
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	head, err := config.MDOps().GetForTLF(
+		ctx, rootNode.GetFolderBranch().Tlf, nil)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %+v", err)
+	}
+
+	// Go back to the real time, past the unref age.
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	if ops.fbm.isOldEnough(ctx, head) {
+		t.Fatalf("Future-dated revision %d considered old enough",
+			head.Revision())
+	}
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	if !ok {
+		t.Fatalf("Bad block server")
+	}
+	preQRBlocks, err := bserverLocal.getAllRefsForTest(
+		ctx, rootNode.GetFolderBranch().Tlf)
+	if err != nil {
+		t.Fatalf("Couldn't get blocks: %+v", err)
+	}
+
+	checkNoReclamation := func() {
+		ops.fbm.forceQuotaReclamation()
+		err = ops.fbm.waitForQuotaReclamations(ctx)
+		if err != nil {
+			t.Fatalf("Couldn't wait for QR: %+v", err)
+		}
+
+		postQRBlocks, err := bserverLocal.getAllRefsForTest(
+			ctx, rootNode.GetFolderBranch().Tlf)
+		if err != nil {
+			t.Fatalf("Couldn't get blocks: %+v", err)
+		}
+
+		if !reflect.DeepEqual(preQRBlocks, postQRBlocks) {
+			t.Fatalf("Future-dated blocks were reclaimed (%v vs %v)!",
+				preQRBlocks, postQRBlocks)
+		}
+	}
+	checkNoReclamation()
+
+	// Even once the clock passes the unref age measured from the
+	// skewed timestamps, the revisions still aren't trusted.
+	clock.Set(skewed.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	if ops.fbm.isOldEnough(ctx, head) {
+		t.Fatalf("Future-dated revision %d considered old enough "+
+			"after the clock caught up", head.Revision())
+	}
+	checkNoReclamation()
+}
+
+// Test that a ClockWithSkew installed in the config records how far
+// ahead of the local clock the timestamps written by others are.
+func TestClockWithSkewReportsMaxSkew(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	clock, now := newTestClockAndTimeNow()
+	skewClock := NewClockWithSkew(clock)
+	config.SetClock(skewClock)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %+v", err)
+	}
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %+v", err)
+	}
+	if skew := skewClock.MaxSkew(); skew != 0 {
+		t.Fatalf("Unexpected skew before any future timestamps: %s", skew)
+	}
+
+	// An mtime set an hour into the future gets reported when the
+	// next write replaces it.
+	futureMtime := now.Add(time.Hour)
+	err = kbfsOps.SetMtime(ctx, fileNode, &futureMtime)
+	if err != nil {
+		t.Fatalf("Couldn't set mtime: %+v", err)
+	}
+	err = kbfsOps.Write(ctx, fileNode, []byte{4}, 3)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %+v", err)
+	}
+	if skew := skewClock.MaxSkew(); skew != time.Hour {
+		t.Fatalf("Unexpected skew after a future mtime: %s", skew)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+
+	// A revision written with a clock that's further ahead gets
+	// reported when checking whether it's old enough to reclaim.
+	clock.Set(now.Add(2 * time.Hour))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	head, err := config.MDOps().GetForTLF(
+		ctx, rootNode.GetFolderBranch().Tlf, nil)
+	if err != nil {
+		t.Fatalf("Couldn't get MD: %+v", err)
+	}
+	clock.Set(now)
+	ops.fbm.isOldEnough(ctx, head)
+	expectedSkew := head.localTimestamp.Sub(now)
+	if expectedSkew <= time.Hour {
+		t.Fatalf("Revision skew %s is too small for the test", expectedSkew)
+	}
+	if skew := skewClock.MaxSkew(); skew != expectedSkew {
+		t.Fatalf("Unexpected skew after a future revision: %s vs %s",
+			skew, expectedSkew)
+	}
+}
+
+// Test that QR gives up, rather than hanging, when another device
+// holds the truncate lock, and that it succeeds on a later run once
+// the lock is released.
+func TestQuotaReclamationTruncateLockTimeout(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, uid, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't remove dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+
+	// Make a new revision that's old enough for QR to consider.
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	err = kbfsOps.SyncFromServerForTesting(ctx,
+		rootNode.GetFolderBranch(), nil)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %+v", err)
+	}
+
+	// Grab the truncate lock from a second device.
+	config2 := ConfigAsUser(config, userName)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	AddDeviceForLocalUserOrBust(t, config, uid)
+	devIndex := AddDeviceForLocalUserOrBust(t, config2, uid)
+	SwitchDeviceForLocalUserOrBust(t, config2, devIndex)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	locked, err := config2.MDServer().TruncateLock(ctx, tlfID)
+	if err != nil {
+		t.Fatalf("Couldn't get truncate lock: %+v", err)
+	}
+	if !locked {
+		t.Fatalf("Truncate lock not acquired")
+	}
+
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	if !ok {
+		t.Fatalf("Bad block server")
+	}
+	preQRBlocks, err := bserverLocal.getAllRefsForTest(ctx, tlfID)
+	if err != nil {
+		t.Fatalf("Couldn't get blocks: %+v", err)
+	}
+
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	waitCtx, waitCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer waitCancel()
+	checkNotReclaimed := func() {
+		err := ops.fbm.waitForQuotaReclamations(waitCtx)
+		if err != nil {
+			t.Fatalf("Couldn't wait for QR: %+v", err)
+		}
+		postQRBlocks, err := bserverLocal.getAllRefsForTest(ctx, tlfID)
+		if err != nil {
+			t.Fatalf("Couldn't get blocks: %+v", err)
+		}
+		if !reflect.DeepEqual(preQRBlocks, postQRBlocks) {
+			t.Fatalf("Blocks reclaimed without the truncate lock "+
+				"(%v vs %v)!", preQRBlocks, postQRBlocks)
+		}
+	}
+
+	// By default, QR tries for the lock only once, and skips this
+	// pass without reclaiming.
+	ops.fbm.forceQuotaReclamation()
+	checkNotReclaimed()
+
+	// With a timeout, QR should back off after the timeout, without
+	// reclaiming.
+	tunables := config.Tunables()
+	tunables.QuotaReclamationTruncateLockTimeout = 10 * time.Millisecond
+	err = config.SetTunables(tunables)
+	if err != nil {
+		t.Fatalf("Couldn't set the truncate lock timeout: %+v", err)
+	}
+	ops.fbm.forceQuotaReclamation()
+	checkNotReclaimed()
+
+	// Once the lock is released, the next QR should go through.
+	unlocked, err := config2.MDServer().TruncateUnlock(ctx, tlfID)
+	if err != nil {
+		t.Fatalf("Couldn't release truncate lock: %+v", err)
+	}
+	if !unlocked {
+		t.Fatalf("Truncate lock not released")
+	}
+
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(waitCtx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for QR: %+v", err)
+	}
+
+	postQRBlocks, err := bserverLocal.getAllRefsForTest(ctx, tlfID)
+	if err != nil {
+		t.Fatalf("Couldn't get blocks: %+v", err)
+	}
+	if pre, post := totalBlockRefs(preQRBlocks),
+		totalBlockRefs(postQRBlocks); post >= pre {
+		t.Errorf("Blocks didn't shrink after reclamation: pre: %d, post %d",
+			pre, post)
+	}
+}
+
+type qrCountingFBMHelper struct {
+	fbmHelper
+
+	lock sync.Mutex
+	runs int
+}
+
+func (h *qrCountingFBMHelper) getMostRecentFullyMergedMD(
+	ctx context.Context) (ImmutableRootMetadata, error) {
+	h.lock.Lock()
+	h.runs++
+	h.lock.Unlock()
+	return h.fbmHelper.getMostRecentFullyMergedMD(ctx)
+}
+
+func (h *qrCountingFBMHelper) getRuns() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.runs
+}
+
+// Test that many forced reclamations within the minimum interval are
+// coalesced into at most two runs, and that the second one waits
+// until the interval has passed on the config's clock.
+func TestQuotaReclamationForceMinInterval(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	helper := &qrCountingFBMHelper{fbmHelper: ops.fbm.helper}
+	ops.fbm.helper = helper
+	const interval = 1 * time.Minute
+	tunables := config.Tunables()
+	tunables.QuotaReclamationMinForcedInterval = interval
+	err := config.SetTunables(tunables)
+	if err != nil {
+		t.Fatalf("Couldn't set interval: %+v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		ops.fbm.forceQuotaReclamation()
+	}
+	const realWait = 1 * time.Second
+	err = ops.fbm.waitForQuotaReclamationsWithTimeout(realWait)
+	switch err {
+	case nil:
+		// All the forced reclamations were coalesced into one run.
+	case context.DeadlineExceeded:
+		// A second run is waiting out the interval, and only
+		// runs once the clock has moved past it.
+		if runs := helper.getRuns(); runs != 1 {
+			t.Fatalf("Unexpected number of QR runs: %d", runs)
+		}
+		clock.Add(interval)
+		err = ops.fbm.waitForQuotaReclamations(ctx)
+		if err != nil {
+			t.Fatalf("Couldn't wait for QR: %+v", err)
+		}
+	default:
+		t.Fatalf("Couldn't wait for QR: %+v", err)
+	}
+	if n := ops.fbm.numOutstandingQuotaReclamations(); n != 0 {
+		t.Fatalf("Unexpected outstanding QRs: %d", n)
+	}
+
+	runs := helper.getRuns()
+	if runs < 1 || runs > 2 {
+		t.Fatalf("Unexpected number of QR runs: %d", runs)
+	}
+
+	// A forced reclamation waiting out the interval can be paused.
+	ops.fbm.forceQuotaReclamation()
+	unpause := make(chan struct{})
+	ops.fbm.reclamationPauseChan <- unpause
+	clock.Add(interval)
+	err = ops.fbm.waitForQuotaReclamationsWithTimeout(realWait)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error waiting for paused QR: %+v", err)
+	}
+	if newRuns := helper.getRuns(); newRuns != runs {
+		t.Fatalf("QR ran while paused: %d vs %d", newRuns, runs)
+	}
+	close(unpause)
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for QR: %+v", err)
+	}
+	if newRuns := helper.getRuns(); newRuns != runs+1 {
+		t.Fatalf("Unexpected number of QR runs: %d vs %d", newRuns, runs+1)
+	}
+}
+
+// Test that a paused QR doesn't run a forced reclamation until it is
+// unpaused.
+func TestQuotaReclamationPause(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't remove dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+
+	// Make a new revision that's old enough for QR to consider.
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	err = kbfsOps.SyncFromServerForTesting(ctx,
+		rootNode.GetFolderBranch(), nil)
+	if err != nil {
+		t.Fatalf("Couldn't sync from server: %+v", err)
+	}
+
+	tlfID := rootNode.GetFolderBranch().Tlf
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	if !ok {
+		t.Fatalf("Bad block server")
+	}
+	preQRBlocks, err := bserverLocal.getAllRefsForTest(ctx, tlfID)
+	if err != nil {
+		t.Fatalf("Couldn't get blocks: %+v", err)
+	}
+
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	unpause := make(chan struct{})
+	ops.fbm.reclamationPauseChan <- unpause
+
+	// The forced reclamation should stay outstanding while paused.
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamationsWithTimeout(10 * time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error waiting for paused QR: %+v", err)
+	}
+	if n := ops.fbm.numOutstandingQuotaReclamations(); n != 1 {
+		t.Fatalf("Unexpected outstanding QRs while paused: %d", n)
+	}
+	pausedBlocks, err := bserverLocal.getAllRefsForTest(ctx, tlfID)
+	if err != nil {
+		t.Fatalf("Couldn't get blocks: %+v", err)
+	}
+	if !reflect.DeepEqual(preQRBlocks, pausedBlocks) {
+		t.Fatalf("Blocks deleted while paused (%v vs %v)!",
+			preQRBlocks, pausedBlocks)
+	}
+
+	// Once unpaused, the deferred reclamation runs.
+	close(unpause)
+	err = ops.fbm.waitForQuotaReclamationsWithTimeout(10 * time.Second)
+	if err != nil {
+		t.Fatalf("Couldn't wait for QR: %+v", err)
+	}
+	postQRBlocks, err := bserverLocal.getAllRefsForTest(ctx, tlfID)
+	if err != nil {
+		t.Fatalf("Couldn't get blocks: %+v", err)
+	}
+	if pre, post := totalBlockRefs(preQRBlocks),
+		totalBlockRefs(postQRBlocks); post >= pre {
+		t.Errorf("Blocks didn't shrink after reclamation: pre: %d, post %d",
+			pre, post)
+	}
+}
+
+// Test that the outstanding archive and QR counts reflect background
+// work, and that the timed waits respect their bounds.
+func TestFolderBlockManagerOutstandingCounts(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+
+	err := ops.fbm.waitForArchivesWithTimeout(10 * time.Second)
+	if err != nil {
+		t.Fatalf("Couldn't wait for archives: %+v", err)
+	}
+	if n := ops.fbm.numOutstandingArchives(); n != 0 {
+		t.Fatalf("Unexpected outstanding archives before pause: %d", n)
+	}
+
+	// Pause archiving so that new archives stay outstanding.
+	unpause := make(chan struct{})
+	ops.fbm.archivePauseChan <- unpause
+
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't remove dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+
+	if n := ops.fbm.numOutstandingArchives(); n == 0 {
+		t.Fatalf("No outstanding archives while paused")
+	}
+	err = ops.fbm.waitForArchivesWithTimeout(10 * time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error waiting for paused archives: %+v", err)
+	}
+
+	close(unpause)
+	err = ops.fbm.waitForArchivesWithTimeout(10 * time.Second)
+	if err != nil {
+		t.Fatalf("Couldn't wait for archives: %+v", err)
+	}
+	if n := ops.fbm.numOutstandingArchives(); n != 0 {
+		t.Fatalf("Unexpected outstanding archives after unpause: %d", n)
+	}
+
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamationsWithTimeout(10 * time.Second)
+	if err != nil {
+		t.Fatalf("Couldn't wait for QR: %+v", err)
+	}
+	if n := ops.fbm.numOutstandingQuotaReclamations(); n != 0 {
+		t.Fatalf("Unexpected outstanding QRs: %d", n)
+	}
+}
+
+type failingDeleteBlockServer struct {
+	BlockServer
+}
+
+func (b failingDeleteBlockServer) RemoveBlockReferences(ctx context.Context,
+	tlfID tlf.ID, contexts kbfsblock.ContextMap) (
+	liveCounts map[kbfsblock.ID]int, err error) {
+	return nil, errors.New("Fake delete failure")
+}
+
+func testFolderBlockManagerOnBranchPruned(t *testing.T, failDelete bool) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1, u2)
+	defer kbfsTestShutdownNoMocks(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, u2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := u1.String() + "," + u2.String()
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+	kbfsOps1 := config1.KBFSOps()
+	aNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %+v", err)
+	}
+	err = kbfsOps1.Write(ctx, aNode1, []byte{1, 2, 3, 4, 5}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %+v", err)
+	}
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %+v", err)
+	}
+
+	// Keep u2 from seeing u1's next update, so u2's next write
+	// lands on an unmerged branch.
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+	fb := rootNode2.GetFolderBranch()
+	_, err = DisableUpdatesForTesting(config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't disable updates: %+v", err)
+	}
+	err = DisableCRForTesting(config2, fb)
+	if err != nil {
+		t.Fatalf("Couldn't disable CR: %+v", err)
+	}
+
+	_, _, err = kbfsOps1.CreateDir(ctx, rootNode1, "b")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %+v", err)
+	}
+
+	kbfsOps2 := config2.KBFSOps()
+	cNode2, _, err := kbfsOps2.CreateFile(ctx, rootNode2, "c", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %+v", err)
+	}
+	err = kbfsOps2.Write(ctx, cNode2, []byte{5, 4, 3, 2, 1}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %+v", err)
+	}
+	err = kbfsOps2.SyncAll(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %+v", err)
+	}
+
+	ops2 := getOps(config2, fb.Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops2.getHead(lState)
+	bid := head.BID()
+	if bid == kbfsmd.NullBranchID {
+		t.Fatalf("u2 didn't end up on an unmerged branch")
+	}
+	_, unmergedRmds, err := getUnmergedMDUpdates(
+		ctx, config2, fb.Tlf, bid, head.Revision())
+	if err != nil {
+		t.Fatalf("Couldn't get unmerged MDs: %+v", err)
+	}
+	branchPtrs := getBranchOnlyBlocks(unmergedRmds, nil)
+	if len(branchPtrs) == 0 {
+		t.Fatalf("No blocks referenced on the branch")
+	}
+	branchRefs := make(map[BlockRef]bool)
+	for _, ptr := range branchPtrs {
+		branchRefs[ptr.Ref()] = true
+	}
+
+	bserverLocal, ok := config1.BlockServer().(blockServerLocal)
+	if !ok {
+		t.Fatalf("Bad block server")
+	}
+	preBlocks, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	if err != nil {
+		t.Fatalf("Couldn't get blocks: %+v", err)
+	}
+	for _, ptr := range branchPtrs {
+		if _, ok := preBlocks[ptr.ID][ptr.RefNonce]; !ok {
+			t.Fatalf("Branch block %v doesn't exist", ptr)
+		}
+	}
+
+	if failDelete {
+		bserver := config2.BlockServer()
+		config2.SetBlockServer(failingDeleteBlockServer{bserver})
+		defer config2.SetBlockServer(bserver)
+	}
+
+	// Unstaging prunes the branch, which cleans up its blocks.
+	err = kbfsOps2.UnstageForTesting(ctx, fb)
+	if err != nil {
+		t.Fatalf("Couldn't unstage: %+v", err)
+	}
+
+	postBlocks, err := bserverLocal.getAllRefsForTest(ctx, fb.Tlf)
+	if err != nil {
+		t.Fatalf("Couldn't get blocks: %+v", err)
+	}
+	for _, ptr := range branchPtrs {
+		_, ok := postBlocks[ptr.ID][ptr.RefNonce]
+		if !failDelete && ok {
+			t.Errorf("Branch block %v wasn't deleted", ptr)
+		} else if failDelete && !ok {
+			t.Errorf("Branch block %v was deleted", ptr)
+		}
+	}
+
+	// Blocks that couldn't be deleted must still be unreferenced
+	// by the unstage's resolutionOp, so that quota reclamation
+	// deletes them later.
+	head, _ = ops2.getHead(lState)
+	unrefs := make(map[BlockPointer]bool)
+	for _, op := range head.data.Changes.Ops {
+		if _, ok := op.(*resolutionOp); !ok {
+			continue
+		}
+		for _, ptr := range op.Unrefs() {
+			unrefs[ptr] = true
+		}
+	}
+	for _, ptr := range branchPtrs {
+		if failDelete && !unrefs[ptr] {
+			t.Errorf("Undeleted branch block %v isn't unreferenced", ptr)
+		} else if !failDelete && unrefs[ptr] {
+			t.Errorf("Deleted branch block %v is unreferenced again", ptr)
+		}
+	}
+	for id, refs := range preBlocks {
+		for nonce := range refs {
+			if branchRefs[BlockRef{id, nonce}] {
+				continue
+			}
+			if _, ok := postBlocks[id][nonce]; !ok {
+				t.Errorf("Merged block %v (nonce %v) was deleted", id, nonce)
+			}
+		}
+	}
+}
+
+// Test that once an unmerged branch is pruned, the blocks referenced
+// only by that branch get deleted, while the blocks referenced by the
+// merged history survive.
+func TestFolderBlockManagerOnBranchPruned(t *testing.T) {
+	testFolderBlockManagerOnBranchPruned(t, false)
+}
+
+// Test that if the blocks of a pruned branch can't be deleted, they
+// stay unreferenced by the unstage, rather than leaking.
+func TestFolderBlockManagerOnBranchPrunedDeleteFails(t *testing.T) {
+	testFolderBlockManagerOnBranchPruned(t, true)
+}
+
+type archiveCountingBlockOps struct {
+	BlockOps
+
+	lock        sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (bops *archiveCountingBlockOps) Archive(
+	ctx context.Context, tlfID tlf.ID, ptrs []BlockPointer) error {
+	bops.lock.Lock()
+	bops.inFlight += len(ptrs)
+	if bops.inFlight > bops.maxInFlight {
+		bops.maxInFlight = bops.inFlight
+	}
+	bops.lock.Unlock()
+
+	// Give the other archive workers a chance to pile up.
+	time.Sleep(time.Millisecond)
+
+	bops.lock.Lock()
+	bops.inFlight -= len(ptrs)
+	bops.lock.Unlock()
+	return nil
+}
+
+func testFolderBlockManagerArchivePointersCap(
+	t *testing.T, maxInFlight int64) {
+	var u1, u2 libkb.NormalizedUsername = "u1", "u2"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, u1, u2)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Every folder's block manager shares the config's limit, so
+	// set it before any of them are made.
+	limit := newArchivePointersLimit(maxInFlight)
+	config.archivePointers = limit
+
+	var fbms []*folderBlockManager
+	var heads []ImmutableRootMetadata
+	for _, h := range []struct {
+		name string
+		t    tlf.Type
+	}{
+		{u1.String(), tlf.Private},
+		{u1.String(), tlf.Public},
+		{u1.String() + "," + u2.String(), tlf.Private},
+	} {
+		rootNode := GetRootNodeOrBust(ctx, t, config, h.name, h.t)
+		ops := config.KBFSOps().(*KBFSOpsStandard).getOpsByNode(
+			ctx, rootNode)
+		if ops.fbm.archivePointers != limit {
+			t.Fatalf("Folder %s doesn't use the config's limit", h.name)
+		}
+		err := ops.fbm.waitForArchives(ctx)
+		if err != nil {
+			t.Fatalf("Couldn't wait for archives: %+v", err)
+		}
+		fbms = append(fbms, ops.fbm)
+		head, _ := ops.getHead(makeFBOLockState())
+		heads = append(heads, head)
+	}
+
+	bops := &archiveCountingBlockOps{BlockOps: config.BlockOps()}
+	config.SetBlockOps(bops)
+	defer config.SetBlockOps(bops.BlockOps)
+
+	// In every folder at once, enqueue several revisions that each
+	// unreference many blocks, and archive another big batch
+	// directly at the same time.
+	var wg sync.WaitGroup
+	errs := make(chan error, len(fbms))
+	for i, fbm := range fbms {
+		for j := 0; j < 5; j++ {
+			rmd, err := heads[i].deepCopy(config.Codec())
+			if err != nil {
+				t.Fatalf("Couldn't copy MD: %+v", err)
+			}
+			rmd.data.Changes.Ops = nil
+			resOp := newResolutionOp()
+			for k := 0; k < 10*numPointersToDowngradePerChunk; k++ {
+				resOp.AddUnrefBlock(
+					BlockPointer{ID: kbfsblock.FakeID(byte(k))})
+			}
+			rmd.AddOp(resOp)
+			fbm.archiveUnrefBlocks(rmd.ReadOnly())
+		}
+
+		wg.Add(1)
+		go func(fbm *folderBlockManager) {
+			defer wg.Done()
+			ptrs := make([]BlockPointer, 10*numPointersToDowngradePerChunk)
+			for k := range ptrs {
+				ptrs[k] = BlockPointer{ID: kbfsblock.FakeID(byte(k))}
+			}
+			errs <- fbm.archiveBlockRefs(ctx, fbm.id, ptrs)
+		}(fbm)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Couldn't archive blocks: %+v", err)
+		}
+	}
+	for _, fbm := range fbms {
+		err := fbm.waitForArchives(ctx)
+		if err != nil {
+			t.Fatalf("Couldn't wait for archives: %+v", err)
+		}
+	}
+
+	bops.lock.Lock()
+	defer bops.lock.Unlock()
+	if bops.maxInFlight == 0 {
+		t.Fatalf("No blocks were archived")
+	}
+	if int64(bops.maxInFlight) > maxInFlight {
+		t.Fatalf("%d pointers were archived at once; cap is %d",
+			bops.maxInFlight, maxInFlight)
+	}
+	if n := limit.sem.Count(); n != maxInFlight {
+		t.Fatalf("Only %d of %d archive resources were released",
+			n, maxInFlight)
+	}
+}
+
+// Test that no matter how many pointers are waiting to be archived,
+// in however many folders, the number being archived at once stays
+// under the cap.
+func TestFolderBlockManagerArchivePointersCap(t *testing.T) {
+	testFolderBlockManagerArchivePointersCap(
+		t, 2*numPointersToDowngradePerChunk)
+}
+
+// Test that archiving still makes progress when the cap is smaller
+// than a single chunk.
+func TestFolderBlockManagerArchivePointersCapBelowChunkSize(t *testing.T) {
+	testFolderBlockManagerArchivePointersCap(
+		t, numPointersToDowngradePerChunk/2)
+}
+
+type deleteCountingBlockOps struct {
+	BlockOps
+
+	lock       sync.Mutex
+	chunkSizes []int
+	live       map[kbfsblock.ID]bool
+}
+
+func (bops *deleteCountingBlockOps) Delete(
+	ctx context.Context, tlfID tlf.ID, ptrs []BlockPointer) (
+	map[kbfsblock.ID]int, error) {
+	bops.lock.Lock()
+	defer bops.lock.Unlock()
+	bops.chunkSizes = append(bops.chunkSizes, len(ptrs))
+	liveCounts := make(map[kbfsblock.ID]int, len(ptrs))
+	for _, ptr := range ptrs {
+		if bops.live[ptr.ID] {
+			liveCounts[ptr.ID] = 1
+		} else {
+			liveCounts[ptr.ID] = 0
+		}
+	}
+	return liveCounts, nil
+}
+
+// Test that a delete that fits in a single chunk is still spread
+// across the minimum number of workers, and that the zero-ref IDs
+// from all the workers are reported.
+func TestFolderBlockManagerDeleteMinWorkers(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	ops := config.KBFSOps().(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+
+	bops := &deleteCountingBlockOps{
+		BlockOps: config.BlockOps(),
+		live:     make(map[kbfsblock.ID]bool),
+	}
+	config.SetBlockOps(bops)
+	defer config.SetBlockOps(bops.BlockOps)
+
+	const minWorkers = 4
+	tunables := config.Tunables()
+	tunables.MinDowngradeWorkers = minWorkers
+	if err := config.SetTunables(tunables); err != nil {
+		t.Fatalf("Couldn't set min downgrade workers: %+v", err)
+	}
+
+	// Every odd pointer still has a live reference.
+	ptrs := make([]BlockPointer, numPointersToDowngradePerChunk)
+	expectedZero := make(map[kbfsblock.ID]bool)
+	for i := range ptrs {
+		id := kbfsblock.FakeID(byte(i))
+		ptrs[i] = BlockPointer{ID: id}
+		if i%2 == 1 {
+			bops.live[id] = true
+		} else {
+			expectedZero[id] = true
+		}
+	}
+
+	zeroRefCounts, err := ops.fbm.deleteBlockRefs(
+		ctx, rootNode.GetFolderBranch().Tlf, ptrs)
+	if err != nil {
+		t.Fatalf("Couldn't delete blocks: %+v", err)
+	}
+	if len(zeroRefCounts) != len(expectedZero) {
+		t.Fatalf("Expected %d zero-ref blocks, got %d",
+			len(expectedZero), len(zeroRefCounts))
+	}
+	for _, id := range zeroRefCounts {
+		if !expectedZero[id] {
+			t.Fatalf("Unexpected zero-ref block %v", id)
+		}
+		delete(expectedZero, id)
+	}
+
+	bops.lock.Lock()
+	defer bops.lock.Unlock()
+	if len(bops.chunkSizes) != minWorkers {
+		t.Fatalf("Expected %d delete calls, got %d",
+			minWorkers, len(bops.chunkSizes))
+	}
+	for _, n := range bops.chunkSizes {
+		if n != numPointersToDowngradePerChunk/minWorkers {
+			t.Fatalf("Unexpected chunk size %d", n)
+		}
+	}
+}
+
+// stuckMDCache returns the same MD for every revision.
+type stuckMDCache struct {
+	MDCache
+	md ImmutableRootMetadata
+}
+
+func (mdcache stuckMDCache) Get(
+	_ tlf.ID, _ kbfsmd.Revision, _ kbfsmd.BranchID) (
+	ImmutableRootMetadata, error) {
+	return mdcache.md, nil
+}
+
+// Test that scanning for the QR revisions stops with an error, rather
+// than looping forever, if the MD ranges it gets don't move backwards.
+func TestFolderBlockManagerQRScanNotDecreasing(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	// Make enough revisions for a couple of full MD ranges.
+	for i := 0; i < 2*maxMDsAtATime; i++ {
+		_, _, err := kbfsOps.CreateFile(
+			ctx, rootNode, fmt.Sprintf("f%d", i), false, NoExcl)
+		if err != nil {
+			t.Fatalf("Couldn't create file: %+v", err)
+		}
+		err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		if err != nil {
+			t.Fatalf("Couldn't sync all: %+v", err)
+		}
+	}
+
+	ops := config.KBFSOps().(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+
+	mdcache := config.MDCache()
+	config.SetMDCache(stuckMDCache{mdcache, head})
+	defer config.SetMDCache(mdcache)
+
+	_, _, err := ops.fbm.getMostRecentOldEnoughAndGCRevisions(
+		ctx, head.ReadOnly())
+	if err == nil {
+		t.Fatalf("Scanning a non-decreasing MD range didn't fail")
+	}
+}
+
+// fakeRevsMDCache returns a copy of the same MD for every revision,
+// with the revision number changed to match.
+type fakeRevsMDCache struct {
+	MDCache
+	t     *testing.T
+	codec kbfscodec.Codec
+	md    ImmutableRootMetadata
+	ts    time.Time
+
+	lock   sync.Mutex
+	numGet int
+}
+
+func (mdcache *fakeRevsMDCache) makeMD(
+	rev kbfsmd.Revision) ImmutableRootMetadata {
+	rmd, err := mdcache.md.deepCopy(mdcache.codec)
+	if err != nil {
+		mdcache.t.Fatalf("Couldn't copy MD: %+v", err)
+	}
+	rmd.SetRevision(rev)
+	return MakeImmutableRootMetadata(rmd, mdcache.md.lastWriterVerifyingKey,
+		mdcache.md.mdID, mdcache.ts, true)
+}
+
+func (mdcache *fakeRevsMDCache) Get(
+	_ tlf.ID, rev kbfsmd.Revision, _ kbfsmd.BranchID) (
+	ImmutableRootMetadata, error) {
+	mdcache.lock.Lock()
+	defer mdcache.lock.Unlock()
+	mdcache.numGet++
+	return mdcache.makeMD(rev), nil
+}
+
+// Test that scanning for the QR revisions stops after
+// numMaxRevisionsToScanPerQR revisions when there's no GC op to be
+// found, and reclaims as if there had never been a GC.
+func TestFolderBlockManagerQRScanCap(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	ops := config.KBFSOps().(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+
+	// Every revision is old enough, and none has a GC op.
+	mdcache := &fakeRevsMDCache{
+		MDCache: config.MDCache(),
+		t:       t,
+		codec:   config.Codec(),
+		md:      head,
+		ts: config.Clock().Now().Add(
+			-2 * config.QuotaReclamationMinUnrefAge()),
+	}
+	config.SetMDCache(mdcache)
+	defer config.SetMDCache(mdcache.MDCache)
+
+	headRev := kbfsmd.Revision(3 * numMaxRevisionsToScanPerQR)
+	fakeHead := mdcache.makeMD(headRev)
+	mostRecentOldEnoughRev, lastGCRev, err :=
+		ops.fbm.getMostRecentOldEnoughAndGCRevisions(
+			ctx, fakeHead.ReadOnly())
+	if err != nil {
+		t.Fatalf("Couldn't scan for QR revisions: %+v", err)
+	}
+	if mostRecentOldEnoughRev != headRev {
+		t.Fatalf("Expected most recent old-enough rev %d, got %d",
+			headRev, mostRecentOldEnoughRev)
+	}
+	if lastGCRev != kbfsmd.RevisionUninitialized {
+		t.Fatalf("Unexpected last GC rev %d", lastGCRev)
+	}
+	mdcache.lock.Lock()
+	defer mdcache.lock.Unlock()
+	if mdcache.numGet > numMaxRevisionsToScanPerQR+maxMDsAtATime {
+		t.Fatalf("Scanned %d revisions", mdcache.numGet)
+	}
+}
+
+type recordingBlockManagerObserver struct {
+	lock   sync.Mutex
+	events []string
+}
+
+func (o *recordingBlockManagerObserver) record(
+	format string, args ...interface{}) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *recordingBlockManagerObserver) OnArchiveStarted(
+	_ context.Context, _ tlf.ID, rev kbfsmd.Revision, numPtrs int) {
+	o.record("archive started %d %d", rev, numPtrs)
+}
+
+func (o *recordingBlockManagerObserver) OnArchiveCompleted(
+	_ context.Context, _ tlf.ID, rev kbfsmd.Revision, numPtrs int,
+	err error) {
+	o.record("archive completed %d %d %v", rev, numPtrs, err)
+}
+
+func (o *recordingBlockManagerObserver) OnReclamationStarted(
+	_ context.Context, _ tlf.ID) {
+	o.record("reclamation started")
+}
+
+func (o *recordingBlockManagerObserver) OnReclamationCompleted(
+	_ context.Context, _ tlf.ID, numPtrs int, err error) {
+	o.record("reclamation completed %t %v", numPtrs > 0, err)
+}
+
+func (o *recordingBlockManagerObserver) takeEvents() []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	events := o.events
+	o.events = nil
+	return events
+}
+
+func TestFolderBlockManagerObserver(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock, now := newTestClockAndTimeNow()
+	config.SetClock(clock)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := kbfsOps.(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	_, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	err = ops.fbm.waitForArchives(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for archives: %+v", err)
+	}
+
+	obs := &recordingBlockManagerObserver{}
+	err = kbfsOps.RegisterBlockManagerObserver(
+		ctx, rootNode.GetFolderBranch(), obs)
+	if err != nil {
+		t.Fatalf("Couldn't register observer: %+v", err)
+	}
+	defer func() {
+		err := kbfsOps.UnregisterBlockManagerObserver(
+			ctx, rootNode.GetFolderBranch(), obs)
+		if err != nil {
+			t.Errorf("Couldn't unregister observer: %+v", err)
+		}
+	}()
+
+	err = kbfsOps.RemoveDir(ctx, rootNode, "a")
+	if err != nil {
+		t.Fatalf("Couldn't remove dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	err = ops.fbm.waitForArchives(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for archives: %+v", err)
+	}
+	head, _ := ops.getHead(makeFBOLockState())
+	numUnrefs := 0
+	for _, op := range head.data.Changes.Ops {
+		numUnrefs += len(op.Unrefs())
+		for _, update := range op.allUpdates() {
+			if update.Ref != update.Unref {
+				numUnrefs++
+			}
+		}
+	}
+	expected := []string{
+		fmt.Sprintf("archive started %d %d", head.Revision(), numUnrefs),
+		fmt.Sprintf("archive completed %d %d <nil>",
+			head.Revision(), numUnrefs),
+	}
+	if events := obs.takeEvents(); !reflect.DeepEqual(expected, events) {
+		t.Fatalf("Expected archive events %v, got %v", expected, events)
+	}
+
+	// Make the removal old enough to be reclaimed.
+	clock.Set(now.Add(2 * config.QuotaReclamationMinUnrefAge()))
+	_, _, err = kbfsOps.CreateDir(ctx, rootNode, "b")
+	if err != nil {
+		t.Fatalf("Couldn't create dir: %+v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	err = ops.fbm.waitForArchives(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for archives: %+v", err)
+	}
+	obs.takeEvents()
+
+	ops.fbm.forceQuotaReclamation()
+	err = ops.fbm.waitForQuotaReclamations(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for QR: %+v", err)
+	}
+	// Writing the gcOp may trigger an archive concurrently, so only
+	// look at the reclamation events.
+	var events []string
+	for _, e := range obs.takeEvents() {
+		if strings.HasPrefix(e, "reclamation ") {
+			events = append(events, e)
+		}
+	}
+	expected = []string{
+		"reclamation started",
+		"reclamation completed true <nil>",
+	}
+	if !reflect.DeepEqual(expected, events) {
+		t.Fatalf("Expected reclamation events %v, got %v", expected, events)
+	}
+}
+
+type blockingArchiveBlockOps struct {
+	BlockOps
+
+	started chan struct{}
+}
+
+func (bops *blockingArchiveBlockOps) Archive(
+	ctx context.Context, tlfID tlf.ID, ptrs []BlockPointer) error {
+	select {
+	case bops.started <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// Test that a running archive can be observed, and canceled only by
+// its own revision.
+func TestFolderBlockManagerCancelArchiveForRevision(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	ops := config.KBFSOps().(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	err := ops.fbm.waitForArchives(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for archives: %+v", err)
+	}
+	if rev, ok := ops.fbm.CurrentArchive(); ok {
+		t.Fatalf("Unexpected current archive for revision %d", rev)
+	}
+
+	bops := &blockingArchiveBlockOps{
+		BlockOps: config.BlockOps(),
+		started:  make(chan struct{}, 1),
+	}
+	config.SetBlockOps(bops)
+	defer config.SetBlockOps(bops.BlockOps)
+
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	rmd, err := head.deepCopy(config.Codec())
+	if err != nil {
+		t.Fatalf("Couldn't copy MD: %+v", err)
+	}
+	rmd.data.Changes.Ops = nil
+	resOp := newResolutionOp()
+	resOp.AddUnrefBlock(BlockPointer{ID: kbfsblock.FakeID(1)})
+	rmd.AddOp(resOp)
+	ops.fbm.archiveUnrefBlocks(rmd.ReadOnly())
+
+	select {
+	case <-bops.started:
+	case <-ctx.Done():
+		t.Fatalf("Archive didn't start: %+v", ctx.Err())
+	}
+	rev, ok := ops.fbm.CurrentArchive()
+	if !ok || rev != rmd.Revision() {
+		t.Fatalf("Current archive is %d (%t), expected %d",
+			rev, ok, rmd.Revision())
+	}
+
+	if ops.fbm.CancelArchiveForRevision(rmd.Revision() + 1) {
+		t.Fatalf("Canceled the archive of the wrong revision")
+	}
+	if n := ops.fbm.numOutstandingArchives(); n != 1 {
+		t.Fatalf("Unexpected outstanding archives: %d", n)
+	}
+
+	if !ops.fbm.CancelArchiveForRevision(rmd.Revision()) {
+		t.Fatalf("Didn't cancel the archive")
+	}
+	err = ops.fbm.waitForArchives(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for archives: %+v", err)
+	}
+	if rev, ok := ops.fbm.CurrentArchive(); ok {
+		t.Fatalf("Unexpected current archive for revision %d", rev)
+	}
+}
+
+type archiveRecordingBlockOps struct {
+	BlockOps
+
+	lock     sync.Mutex
+	archived map[BlockPointer]int
+	failNext bool
+}
+
+func (bops *archiveRecordingBlockOps) Archive(
+	ctx context.Context, tlfID tlf.ID, ptrs []BlockPointer) error {
+	bops.lock.Lock()
+	defer bops.lock.Unlock()
+	if bops.failNext {
+		bops.failNext = false
+		return errors.New("archive failed")
+	}
+	for _, ptr := range ptrs {
+		bops.archived[ptr]++
+	}
+	return nil
+}
+
+// Test that pointers that were archived recently aren't archived
+// again by overlapping revisions, unless their archive failed.
+func TestFolderBlockManagerSkipRecentlyArchived(t *testing.T) {
+	var userName libkb.NormalizedUsername = "test_user"
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, userName)
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(
+		ctx, t, config, userName.String(), tlf.Private)
+	ops := config.KBFSOps().(*KBFSOpsStandard).getOpsByNode(ctx, rootNode)
+	err := ops.fbm.waitForArchives(ctx)
+	if err != nil {
+		t.Fatalf("Couldn't wait for archives: %+v", err)
+	}
+
+	bops := &archiveRecordingBlockOps{
+		BlockOps: config.BlockOps(),
+		archived: make(map[BlockPointer]int),
+	}
+	config.SetBlockOps(bops)
+	defer config.SetBlockOps(bops.BlockOps)
+
+	// Enqueue revisions whose unrefs overlap by half.
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	const numPtrs = 2 * numPointersToDowngradePerChunk
+	const numRevs = 3
+	for i := 0; i < numRevs; i++ {
+		rmd, err := head.deepCopy(config.Codec())
+		if err != nil {
+			t.Fatalf("Couldn't copy MD: %+v", err)
+		}
+		rmd.data.Changes.Ops = nil
+		resOp := newResolutionOp()
+		for j := 0; j < numPtrs; j++ {
+			resOp.AddUnrefBlock(BlockPointer{
+				ID: kbfsblock.FakeID(byte(i*numPtrs/2 + j))})
+		}
+		rmd.AddOp(resOp)
+		ops.fbm.archiveUnrefBlocks(rmd.ReadOnly())
+		err = ops.fbm.waitForArchives(ctx)
+		if err != nil {
+			t.Fatalf("Couldn't wait for archives: %+v", err)
+		}
+	}
+
+	bops.lock.Lock()
+	if len(bops.archived) != (numRevs+1)*numPtrs/2 {
+		t.Fatalf("Expected %d archived pointers, got %d",
+			(numRevs+1)*numPtrs/2, len(bops.archived))
+	}
+	for ptr, n := range bops.archived {
+		if n != 1 {
+			t.Fatalf("Pointer %v was archived %d times", ptr, n)
+		}
+	}
+	bops.failNext = true
+	bops.lock.Unlock()
+
+	// A failed archive doesn't count, so its pointers are archived
+	// again next time.
+	tlfID := rootNode.GetFolderBranch().Tlf
+	ptr := BlockPointer{ID: kbfsblock.FakeID(255)}
+	err = ops.fbm.archiveBlockRefs(ctx, tlfID, []BlockPointer{ptr})
+	if err == nil {
+		t.Fatal("Unexpected archive success")
+	}
+	err = ops.fbm.archiveBlockRefs(ctx, tlfID, []BlockPointer{ptr})
+	if err != nil {
+		t.Fatalf("Couldn't archive blocks: %+v", err)
+	}
+	err = ops.fbm.archiveBlockRefs(ctx, tlfID, []BlockPointer{ptr})
+	if err != nil {
+		t.Fatalf("Couldn't archive blocks: %+v", err)
+	}
+
+	bops.lock.Lock()
+	if n := bops.archived[ptr]; n != 1 {
+		t.Fatalf("Pointer %v was archived %d times", ptr, n)
+	}
+	bops.lock.Unlock()
+
+	// With no window, nothing is skipped.
+	tunables := config.Tunables()
+	tunables.RecentlyArchivedWindow = 0
+	err = config.SetTunables(tunables)
+	if err != nil {
+		t.Fatalf("Couldn't set the recently-archived window: %+v", err)
+	}
+	err = ops.fbm.archiveBlockRefs(ctx, tlfID, []BlockPointer{ptr})
+	if err != nil {
+		t.Fatalf("Couldn't archive blocks: %+v", err)
+	}
+
+	bops.lock.Lock()
+	defer bops.lock.Unlock()
+	if n := bops.archived[ptr]; n != 2 {
+		t.Fatalf("Pointer %v was archived %d times", ptr, n)
+	}
+}
@@ -5,10 +5,17 @@
 package libkbfs
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfsblock"
@@ -42,8 +49,9 @@ const (
 	// goroutine than the blockLock rlock holder, using the same lState.
 	blockReadParallel
 	// We are looking up a block for the purposes of creating a new
-	// node in the node cache for it; avoid any unlocks as part of the
-	// lookup process.
+	// node in the node cache for it, or a file block that won't be
+	// modified while the blockLock is held for writing; avoid any
+	// unlocks or copies as part of the lookup process.
 	blockLookup
 )
 
@@ -51,11 +59,114 @@ const (
 	// numBlockSizeWorkersMax is the max number of workers to use when
 	// fetching a set of block sizes.
 	numBlockSizeWorkersMax = 50
-	// truncateExtendCutoffPoint is the amount of data in extending
-	// truncate that will trigger the extending with a hole algorithm.
+	// truncateExtendCutoffPoint is the default amount of data in
+	// extending truncate that will trigger the extending with a hole
+	// algorithm.
 	truncateExtendCutoffPoint = 128 * 1024
+	// dirListingCacheTTL is how long a cached directory listing may
+	// be used to answer entry lookups for that directory's children.
+	dirListingCacheTTL = 10 * time.Second
+	// defaultSyncRecoverableErrorBudget is the number of recoverable
+	// errors that syncs of a single dirty file may hit before they
+	// are surfaced to the file's blocked writers.
+	defaultSyncRecoverableErrorBudget = 3 * maxRetriesOnRecoverableErrors
+	// defaultMaxDirtyBytesDivisor is the fraction (1/n) of the dirty
+	// block cache's limit that a single folder may use by default.
+	defaultMaxDirtyBytesDivisor = 2
+	// maxDirSizeDepth is the deepest DirSize will descend below the
+	// directory it was called on.
+	maxDirSizeDepth = 1024
+	// maxAssembledDirs is the number of directories assembled from
+	// indirect dir blocks that a folder keeps cached.
+	maxAssembledDirs = 16
+	// maxDirListings is the number of directory listings that a
+	// folder keeps cached.
+	maxDirListings = 100
 )
 
+// blockCacheStats counts where the blocks requested by a folder's
+// reads and writes were found.
+type blockCacheStats struct {
+	// Blocks found in the DirtyBlockCache.
+	DirtyHits int64
+	// Blocks found in the clean BlockCache.
+	CleanHits int64
+	// Blocks that had to be requested from the block retriever,
+	// which may still find them in the disk block cache.
+	NetworkFetches int64
+}
+
+// DirtyRefInfo describes one entry with unsynced changes in a
+// folder, for showing the pending changes of each file.
+type DirtyRefInfo struct {
+	Ref BlockRef
+	// DirtyBytes is the number of dirty bytes of the file that
+	// haven't finished syncing yet.  It's 0 for directories, and
+	// for files with only dirty attributes.
+	DirtyBytes int64
+	// Syncing is true if a sync of the file is in progress.
+	Syncing bool
+}
+
+// syncErrorStats counts the failed syncs of a folder's files, by
+// whether the error that failed them was recoverable.
+type syncErrorStats struct {
+	// Syncs that failed with a recoverable block error, and so
+	// will be retried.
+	Recoverable int64
+	// Syncs that failed with any other error.
+	Fatal int64
+}
+
+// BlockSizeHistogram counts the readied direct file blocks of a
+// folder by plaintext size.  Each key is the lower bound of a
+// power-of-two bucket, and maps to the number of blocks with a size
+// in [key, 2*key).  Empty blocks are counted under 0.
+type BlockSizeHistogram map[int]uint64
+
+func blockSizeBucket(size int) int {
+	if size <= 0 {
+		return 0
+	}
+	bucket := 1
+	for bucket <= size/2 {
+		bucket *= 2
+	}
+	return bucket
+}
+
+// ForceSyncPolicy describes when a folder should force a sync of its
+// dirty files, in addition to whenever the dirty block cache reports
+// that the system's dirty buffer is full.  A zero field disables that
+// trigger.
+type ForceSyncPolicy struct {
+	// DirtyBytes forces a sync once the folder's files have at
+	// least this many dirty bytes that aren't yet being synced.
+	DirtyBytes int64
+	// Writes forces a sync once the folder has seen this many
+	// writes and truncates since the last sync started.
+	Writes int
+}
+
+// FileTreeEntry describes one indirect pointer in the block tree of
+// a file, as returned by DumpFileTree.
+type FileTreeEntry struct {
+	// Depth is 1 for the pointers in the file's top block, 2 for
+	// the pointers in its children, etc.
+	Depth int
+	IndirectFilePtr
+	// Dirty and Syncing reflect the local state of the pointed-to
+	// block, if the file has any unsynced changes.
+	Dirty   bool
+	Syncing bool
+}
+
+func (e FileTreeEntry) String() string {
+	return fmt.Sprintf("%s%v off=%d size=%d holes=%t dirty=%t syncing=%t",
+		strings.Repeat("  ", e.Depth-1), e.BlockPointer, e.Off,
+		e.EncodedSize, e.Holes, e.Dirty, e.Syncing)
+}
+
 type mdToCleanIfUnused struct {
 	md  ReadOnlyRootMetadata
 	bps *blockPutState
@@ -69,6 +180,9 @@ type syncInfo struct {
 	refBytes        uint64
 	unrefBytes      uint64
 	toCleanIfUnused []mdToCleanIfUnused
+	// importedRefs are existing blocks that became part of the file
+	// via ImportFileBlocks, and still need a reference of their own.
+	importedRefs []BlockInfo
 }
 
 func (si *syncInfo) DeepCopy(codec kbfscodec.Codec) (*syncInfo, error) {
@@ -79,6 +193,10 @@ func (si *syncInfo) DeepCopy(codec kbfscodec.Codec) (*syncInfo, error) {
 	}
 	newSi.unrefs = make([]BlockInfo, len(si.unrefs))
 	copy(newSi.unrefs, si.unrefs)
+	if si.importedRefs != nil {
+		newSi.importedRefs = make([]BlockInfo, len(si.importedRefs))
+		copy(newSi.importedRefs, si.importedRefs)
+	}
 	if si.bps != nil {
 		newSi.bps = si.bps.DeepCopy()
 	}
@@ -128,6 +246,44 @@ func (si *syncInfo) mergeUnrefCache(md *RootMetadata) {
 	}
 }
 
+// Merge folds the state of `other`, which must be a syncInfo for the
+// same file, into `si`.  It appends other's unrefs and
+// to-be-cleaned MDs, sums the ref and unref byte counts, and adds
+// other's writes and truncates to si's op, coalescing the resulting
+// write range.  If si has no op, it gets a deep copy of other's, so
+// later changes to either syncInfo don't leak into the other.  si
+// keeps its own oldInfo and bps.
+func (si *syncInfo) Merge(other *syncInfo) {
+	si.unrefs = append(si.unrefs, other.unrefs...)
+	si.refBytes += other.refBytes
+	si.unrefBytes += other.unrefBytes
+	si.toCleanIfUnused = append(si.toCleanIfUnused, other.toCleanIfUnused...)
+
+	if other.op == nil {
+		return
+	}
+	if si.op == nil {
+		si.op = other.op.deepCopy().(*syncOp)
+		return
+	}
+	for _, w := range other.op.Writes {
+		if w.isTruncate() {
+			si.op.addTruncate(w.Off)
+		} else {
+			si.op.addWrite(w.Off, w.Len)
+		}
+	}
+	si.op.Writes = si.op.collapseWriteRange(nil)
+}
+
+// dirListing is a cached copy of the possibly-dirty children of a
+// directory, used to answer entry lookups for those children without
+// re-reading the parent block.
+type dirListing struct {
+	children map[string]DirEntry
+	expires  time.Time
+}
+
 type deCacheEntry struct {
 	// dirEntry is the dirty directory entry corresponding to the
 	// BlockPointer that maps to this struct.
@@ -167,11 +323,23 @@ func (dece deCacheEntry) deepCopy() deCacheEntry {
 	return copy
 }
 
+// deferredWrite is a write or truncate to a file that was being
+// sync'd, which needs to be replayed after the sync finishes.
+type deferredWrite struct {
+	// off is the offset of the first byte written, or the new size
+	// of the file for a truncate.
+	off uint64
+	// newlyDirtiedChildBytes is the number of bytes this operation
+	// dirtied, which will be dirtied again when it is replayed.
+	newlyDirtiedChildBytes int64
+	replay                 func(context.Context, *lockState, KeyMetadata, path) error
+}
+
 type deferredState struct {
 	// Writes and truncates for blocks that were being sync'd, and
 	// need to be replayed after the sync finishes on top of the new
 	// versions of the blocks.
-	writes []func(context.Context, *lockState, KeyMetadata, path) error
+	writes []deferredWrite
 	// Blocks that need to be deleted from the dirty cache before any
 	// deferred writes are replayed.
 	dirtyDeletes []BlockPointer
@@ -234,6 +402,19 @@ type deferredState struct {
 //     their previous old pointers, and so dirtyFile needs to know their old
 //     bytes can be cleaned up now.
 type folderBlockOps struct {
+	// Where requested blocks were found.  Its fields must be
+	// accessed atomically, and it must stay first in the struct to
+	// keep them 64-bit aligned on 32-bit platforms.
+	cacheStats blockCacheStats
+	// How many syncs failed with recoverable and non-recoverable
+	// errors.  These must be accessed atomically, and stay right
+	// after cacheStats for alignment.
+	recoverableSyncErrors int64
+	fatalSyncErrors       int64
+	// How many syncs took the fast path for empty files.  Also
+	// accessed atomically.
+	emptyFileSyncs int64
+
 	config       Config
 	log          logger.Logger
 	folderBranch FolderBranch
@@ -262,9 +443,57 @@ type folderBlockOps struct {
 	// Track deferred operations on a per-file basis.
 	deferred map[BlockRef]deferredState
 
+	// Short-lived directory listings, keyed by the directory's block
+	// pointer.  Listings are filled in while only holding blockLock
+	// for reading, so they rely on the LRU's own locking instead;
+	// they must only be cleared while holding blockLock for writing.
+	dirListings *lru.Cache
+
 	// set to true if this write or truncate should be deferred
 	doDeferWrite bool
 
+	// The sizes of all the child file blocks readied by syncs in
+	// this folder.
+	blockSizes BlockSizeHistogram
+
+	// writerBytesLock protects writerBytes.
+	writerBytesLock sync.Mutex
+	// The total encoded size of the new blocks put by this client
+	// for this folder, by the creator of each block.
+	writerBytes map[keybase1.UserOrTeamID]int64
+
+	// The number of recoverable errors that syncs of a single dirty
+	// file may hit before the next one is surfaced to the file's
+	// blocked writers.  If 0, defaultSyncRecoverableErrorBudget is
+	// used.
+	syncRecoverableErrorBudget int
+
+	// The maximum plaintext size of any file in this folder.  If 0,
+	// the config's MaxFileBytes is used.
+	maxFileBytes uint64
+
+	// assembledDirs caches the direct views assembled from
+	// indirect dir blocks, keyed by the pointer of the top block.
+	// Blocks are immutable, so entries never need invalidating.
+	assembledDirs *lru.Cache
+
+	// The number of directory levels below the root that
+	// SearchForNodes descends into.  If 0, searches aren't bounded.
+	maxSearchDepth int
+
+	// forceSyncPolicy lets this folder force syncs earlier than the
+	// global dirty block cache would, and writesSinceSync counts the
+	// writes and truncates it has seen since the last sync started.
+	forceSyncPolicy ForceSyncPolicy
+	writesSinceSync int
+
+	// reservedDirtyBytes counts the bytes of the writes and
+	// truncates currently admitted under the per-folder dirty byte
+	// limit, and dirtyBytesDecreased, if non-nil, is closed the next
+	// time the number of unsynced bytes goes down.
+	reservedDirtyBytes  int64
+	dirtyBytesDecreased chan struct{}
+
 	// nodeCache itself is goroutine-safe, but write/truncate must
 	// call PathFromNode() only under blockLock (see nodeCache
 	// comments in folder_branch_ops.go).
@@ -285,6 +514,126 @@ func (fbo *folderBlockOps) branch() BranchName {
 	return fbo.folderBranch.Branch
 }
 
+// EnableLockStats turns on contention stats collection for
+// blockLock.  It's off by default.
+func (fbo *folderBlockOps) EnableLockStats() {
+	fbo.blockLock.stats.enable()
+}
+
+// LockStats returns the contention stats collected for blockLock
+// since EnableLockStats was called.  This can help determine whether
+// the single blockLock is a bottleneck for a folder under heavy
+// concurrent load.
+func (fbo *folderBlockOps) LockStats() blockLockStats {
+	return fbo.blockLock.stats.get()
+}
+
+// CacheStats returns how many of the blocks requested in this folder
+// so far were found in the dirty cache, found in the clean cache, or
+// fetched from the server.  This can help show whether a workload is
+// cache-friendly.
+func (fbo *folderBlockOps) CacheStats() blockCacheStats {
+	return blockCacheStats{
+		DirtyHits:      atomic.LoadInt64(&fbo.cacheStats.DirtyHits),
+		CleanHits:      atomic.LoadInt64(&fbo.cacheStats.CleanHits),
+		NetworkFetches: atomic.LoadInt64(&fbo.cacheStats.NetworkFetches),
+	}
+}
+
+// SyncErrorStats returns how many syncs in this folder have failed
+// so far with recoverable and non-recoverable errors.  A high rate
+// of recoverable errors points to a flaky block server that is
+// driving sync retries.
+func (fbo *folderBlockOps) SyncErrorStats() syncErrorStats {
+	return syncErrorStats{
+		Recoverable: atomic.LoadInt64(&fbo.recoverableSyncErrors),
+		Fatal:       atomic.LoadInt64(&fbo.fatalSyncErrors),
+	}
+}
+
+// EmptyFileSyncs returns how many syncs in this folder so far were
+// of empty files, which skip splitting and readying child blocks.
+func (fbo *folderBlockOps) EmptyFileSyncs() int64 {
+	return atomic.LoadInt64(&fbo.emptyFileSyncs)
+}
+
+// BlockSizeHistogram returns a copy of the histogram of plaintext
+// sizes of the child file blocks readied by syncs in this folder.
+// This helps show whether the block splitter is producing
+// well-sized blocks.
+func (fbo *folderBlockOps) BlockSizeHistogram(
+	lState *lockState) BlockSizeHistogram {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	h := make(BlockSizeHistogram, len(fbo.blockSizes))
+	for bucket, count := range fbo.blockSizes {
+		h[bucket] = count
+	}
+	return h
+}
+
+// WriterByteStats returns the total encoded size of the blocks put
+// to the server by this client for this folder, broken down by the
+// creator recorded in each block's pointer (the user or team that is
+// charged for it).  Blocks that were deduplicated against an existing
+// block only add a reference to it, and so aren't counted again.
+// This helps attribute quota usage to writers in shared folders.
+func (fbo *folderBlockOps) WriterByteStats() map[keybase1.UserOrTeamID]int64 {
+	fbo.writerBytesLock.Lock()
+	defer fbo.writerBytesLock.Unlock()
+	stats := make(map[keybase1.UserOrTeamID]int64, len(fbo.writerBytes))
+	for creator, bytes := range fbo.writerBytes {
+		stats[creator] = bytes
+	}
+	return stats
+}
+
+// recordWriterBytes adds the encoded sizes of the brand new blocks
+// in `bps`, which have been successfully put, to the per-creator byte
+// counts.
+func (fbo *folderBlockOps) recordWriterBytes(bps *blockPutState) {
+	fbo.writerBytesLock.Lock()
+	defer fbo.writerBytesLock.Unlock()
+	for _, bs := range bps.blockStates {
+		if !bs.blockPtr.IsFirstRef() {
+			// Just a new reference to an existing block.
+			continue
+		}
+		if fbo.writerBytes == nil {
+			fbo.writerBytes = make(map[keybase1.UserOrTeamID]int64)
+		}
+		fbo.writerBytes[bs.blockPtr.GetCreator()] +=
+			int64(bs.readyBlockData.GetEncodedSize())
+	}
+}
+
+// recordBlockSizesLocked adds the sizes of the newly-readied direct
+// file blocks in `bps` to the block size histogram.
+func (fbo *folderBlockOps) recordBlockSizesLocked(lState *lockState,
+	bps *blockPutState, newInfos map[BlockInfo]BlockPointer) {
+	fbo.blockLock.AssertLocked(lState)
+	if len(newInfos) == 0 {
+		return
+	}
+	newPtrs := make(map[BlockPointer]bool, len(newInfos))
+	for info := range newInfos {
+		newPtrs[info.BlockPointer] = true
+	}
+	for _, bs := range bps.blockStates {
+		if !newPtrs[bs.blockPtr] {
+			continue
+		}
+		fblock, ok := bs.block.(*FileBlock)
+		if !ok || fblock.IsInd {
+			continue
+		}
+		if fbo.blockSizes == nil {
+			fbo.blockSizes = make(BlockSizeHistogram)
+		}
+		fbo.blockSizes[blockSizeBucket(len(fblock.Contents))]++
+	}
+}
+
 // GetState returns the overall block state of this TLF.
 func (fbo *folderBlockOps) GetState(lState *lockState) overallBlockState {
 	fbo.blockLock.RLock(lState)
@@ -359,16 +708,21 @@ func (fbo *folderBlockOps) getCleanEncodedBlockSizeLocked(ctx context.Context,
 
 // getBlockHelperLocked retrieves the block pointed to by ptr, which
 // must be valid, either from the cache or from the server. If
-// notifyPath is valid and the block isn't cached, trigger a read
-// notification.  If `rtype` is `blockReadParallel`, it's assumed that
-// some coordinating goroutine is holding the correct locks, and
-// in that case `lState` must be `nil`.
+// notifyPath is valid, `suppressNotify` is false, and the block isn't
+// cached, trigger a read notification.  Internal traversals must set
+// `suppressNotify`, so that they never cause user-facing read
+// notifications, whatever path they pass in.  If `rtype` is
+// `blockReadParallel`, it's assumed that some coordinating goroutine
+// is holding the correct locks, and in that case `lState` must be
+// `nil`.  `priority` is the priority
+// with which the block is requested from the block retrieval queue,
+// if it isn't already cached.
 //
 // This must be called only by get{File,Dir}BlockHelperLocked().
 func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, ptr BlockPointer, branch BranchName,
 	newBlock makeNewBlock, lifetime BlockCacheLifetime, notifyPath path,
-	rtype blockReqType) (Block, error) {
+	suppressNotify bool, rtype blockReqType, priority int) (Block, error) {
 	if rtype != blockReadParallel {
 		fbo.blockLock.AssertAnyLocked(lState)
 	} else if lState != nil {
@@ -382,17 +736,18 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 
 	if block, err := fbo.config.DirtyBlockCache().Get(
 		fbo.id(), ptr, branch); err == nil {
+		atomic.AddInt64(&fbo.cacheStats.DirtyHits, 1)
 		return block, nil
 	}
 
 	if block, prefetchStatus, lifetime, err :=
 		fbo.config.BlockCache().GetWithPrefetch(ptr); err == nil {
+		atomic.AddInt64(&fbo.cacheStats.CleanHits, 1)
 		// If the block was cached in the past, we need to handle it as if it's
 		// an on-demand request so that its downstream prefetches are triggered
 		// correctly according to the new on-demand fetch priority.
 		fbo.config.BlockOps().Prefetcher().ProcessBlockForPrefetch(ctx, ptr,
-			block, kmd, defaultOnDemandRequestPriority, lifetime,
-			prefetchStatus)
+			block, kmd, priority, lifetime, prefetchStatus)
 		return block, nil
 	}
 
@@ -400,7 +755,7 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 		return nil, err
 	}
 
-	if notifyPath.isValidForNotification() {
+	if !suppressNotify && notifyPath.isValidForNotification() {
 		fbo.config.Reporter().Notify(ctx, readNotification(notifyPath, false))
 		defer fbo.config.Reporter().Notify(ctx,
 			readNotification(notifyPath, true))
@@ -417,15 +772,22 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 	// goroutines may be operating on the data assuming they have the
 	// lock.
 	// fetch the block, and add to cache
+	atomic.AddInt64(&fbo.cacheStats.NetworkFetches, 1)
 	block := newBlock()
 	bops := fbo.config.BlockOps()
+	get := func() error {
+		if priority == defaultOnDemandRequestPriority {
+			return bops.Get(ctx, kmd, ptr, block, lifetime)
+		}
+		return bops.GetWithPriority(ctx, kmd, ptr, block, lifetime, priority)
+	}
 	var err error
 	if rtype != blockReadParallel && rtype != blockLookup {
 		fbo.blockLock.DoRUnlockedIfPossible(lState, func(*lockState) {
-			err = bops.Get(ctx, kmd, ptr, block, lifetime)
+			err = get()
 		})
 	} else {
-		err = bops.Get(ctx, kmd, ptr, block, lifetime)
+		err = get()
 	}
 	if err != nil {
 		return nil, err
@@ -445,11 +807,13 @@ func (fbo *folderBlockOps) getBlockHelperLocked(ctx context.Context,
 // getFileBlockLocked(), and getFileLocked().
 //
 // p is used only when reporting errors and sending read
-// notifications, and can be empty.
+// notifications, and can be empty.  No read notifications are sent if
+// `suppressNotify` is true.  Blocks fetched from the server are only
+// cached if `policy` is `CacheBlocks`.
 func (fbo *folderBlockOps) getFileBlockHelperLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, ptr BlockPointer,
-	branch BranchName, p path, rtype blockReqType) (
-	*FileBlock, error) {
+	branch BranchName, p path, suppressNotify bool, rtype blockReqType,
+	policy BlockCachePolicy) (*FileBlock, error) {
 	if rtype != blockReadParallel {
 		fbo.blockLock.AssertAnyLocked(lState)
 	} else if lState != nil {
@@ -457,8 +821,13 @@ func (fbo *folderBlockOps) getFileBlockHelperLocked(ctx context.Context,
 			"with blockReadParallel")
 	}
 
+	lifetime := TransientEntry
+	if policy != CacheBlocks {
+		lifetime = NoCacheEntry
+	}
 	block, err := fbo.getBlockHelperLocked(
-		ctx, lState, kmd, ptr, branch, NewFileBlock, TransientEntry, p, rtype)
+		ctx, lState, kmd, ptr, branch, NewFileBlock, lifetime, p,
+		suppressNotify, rtype, defaultOnDemandRequestPriority)
 	if err != nil {
 		return nil, err
 	}
@@ -485,7 +854,31 @@ func (fbo *folderBlockOps) GetBlockForReading(ctx context.Context,
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
 	return fbo.getBlockHelperLocked(ctx, lState, kmd, ptr, branch,
-		NewCommonBlock, NoCacheEntry, path{}, blockRead)
+		NewCommonBlock, NoCacheEntry, path{}, true, blockRead,
+		defaultOnDemandRequestPriority)
+}
+
+// GetArchivedBlockForReading retrieves the block pointed to by ptr,
+// which is known to have been archived, e.g. because it's only
+// referenced by a historical revision of the folder.  Archived
+// blocks are still readable by the folder's writers, so this uses
+// the normal BlockOps fetch, but it doesn't cache the block.  If the
+// server refuses to serve the archived block, a BlockArchivedError
+// is returned.
+func (fbo *folderBlockOps) GetArchivedBlockForReading(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, ptr BlockPointer, branch BranchName) (
+	Block, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	block, err := fbo.getBlockHelperLocked(ctx, lState, kmd, ptr, branch,
+		NewCommonBlock, NoCacheEntry, path{}, true, blockRead,
+		defaultOnDemandRequestPriority)
+	if _, ok := errors.Cause(err).(kbfsblock.ServerErrorBlockArchived); ok {
+		return nil, BlockArchivedError{ptr}
+	} else if err != nil {
+		return nil, err
+	}
+	return block, nil
 }
 
 // GetCleanEncodedBlocksSizeSum retrieves the sum of the encoded sizes
@@ -566,18 +959,21 @@ func (fbo *folderBlockOps) GetCleanEncodedBlocksSizeSum(ctx context.Context,
 // This must be called only by GetDirBlockForReading() and
 // getDirLocked().
 //
-// p is used only when reporting errors, and can be empty.
+// p is used only when reporting errors, and can be empty.  If the
+// block isn't cached, it is fetched with the given priority.
 func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, ptr BlockPointer,
-	branch BranchName, p path, rtype blockReqType) (*DirBlock, error) {
+	branch BranchName, p path, rtype blockReqType, priority int) (
+	*DirBlock, error) {
 	if rtype != blockReadParallel {
 		fbo.blockLock.AssertAnyLocked(lState)
 	}
 
-	// Pass in an empty notify path because notifications should only
-	// trigger for file reads.
+	// Suppress notifications because they should only trigger for
+	// file reads.
 	block, err := fbo.getBlockHelperLocked(
-		ctx, lState, kmd, ptr, branch, NewDirBlock, TransientEntry, path{}, rtype)
+		ctx, lState, kmd, ptr, branch, NewDirBlock, TransientEntry, p,
+		true, rtype, priority)
 	if err != nil {
 		return nil, err
 	}
@@ -587,9 +983,125 @@ func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
 		return nil, NotDirBlockError{ptr, branch, p}
 	}
 
+	if dblock.IsInd {
+		return fbo.assembleIndirectDirBlockLocked(
+			ctx, lState, kmd, ptr, dblock, branch, p, rtype, priority)
+	}
 	return dblock, nil
 }
 
+// assembleIndirectDirBlockLocked fetches all the child blocks of the
+// given indirect dir block, and returns a direct dir block holding
+// all of their entries, which must not be modified.  The returned
+// block remembers the pointers it was assembled from, so that a sync
+// can rewrite only the child blocks that have changed.  Assembled
+// blocks are cached, so this only fetches the children once per
+// version of the directory.
+func (fbo *folderBlockOps) assembleIndirectDirBlockLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	ptr BlockPointer, topBlock *DirBlock, branch BranchName, p path,
+	rtype blockReqType, priority int) (*DirBlock, error) {
+	if cached, ok := fbo.assembledDirs.Get(ptr); ok {
+		return cached.(*DirBlock), nil
+	}
+
+	// Child blocks are never modified in place, so they can always
+	// be fetched for reading.
+	childRType := blockRead
+	if rtype == blockReadParallel || rtype == blockLookup {
+		childRType = rtype
+	}
+
+	assembled := &DirBlock{
+		Children:      make(map[string]DirEntry),
+		assembledFrom: make([]IndirectDirPtr, len(topBlock.IPtrs)),
+	}
+	copy(assembled.assembledFrom, topBlock.IPtrs)
+	for _, iptr := range topBlock.IPtrs {
+		block, err := fbo.getBlockHelperLocked(
+			ctx, lState, kmd, iptr.BlockPointer, branch, NewDirBlock,
+			TransientEntry, p, true, childRType, priority)
+		if err != nil {
+			return nil, err
+		}
+		child, ok := block.(*DirBlock)
+		if !ok {
+			return nil, NotDirBlockError{iptr.BlockPointer, branch, p}
+		}
+		if child.IsInd {
+			return nil, errors.Errorf(
+				"Indirect dir block %v has more than one level of "+
+					"indirection", ptr)
+		}
+		for name, de := range child.Children {
+			assembled.Children[name] = de
+		}
+	}
+	fbo.assembledDirs.Add(ptr, assembled)
+	return assembled, nil
+}
+
+// getIndirectDirEntryLocked looks up the entry for the tail of `file`
+// when its parent directory is stored as an indirect dir block, by
+// fetching only the one child block whose range of name hashes
+// covers the name.  It returns false if the entry must be looked up
+// in the whole directory instead, e.g. because the directory is
+// direct or dirty, or has already been assembled.
+func (fbo *folderBlockOps) getIndirectDirEntryLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, file path, includeDeleted bool) (
+	de DirEntry, ok bool, err error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	if !file.hasValidParent() {
+		return DirEntry{}, false, nil
+	}
+	parentPath := *file.parentPath()
+	ptr := parentPath.tailPointer()
+	if _, ok := fbo.deCache[parentPath.tailRef()]; ok ||
+		fbo.assembledDirs.Contains(ptr) ||
+		fbo.config.DirtyBlockCache().IsDirty(
+			fbo.id(), ptr, parentPath.Branch) {
+		return DirEntry{}, false, nil
+	}
+
+	block, err := fbo.getBlockHelperLocked(
+		ctx, lState, kmd, ptr, parentPath.Branch, NewDirBlock,
+		TransientEntry, parentPath, true, blockLookup,
+		defaultOnDemandRequestPriority)
+	if err != nil {
+		return DirEntry{}, false, err
+	}
+	top, isDir := block.(*DirBlock)
+	if !isDir || !top.IsInd || len(top.IPtrs) == 0 {
+		return DirEntry{}, false, nil
+	}
+
+	name := file.tailName()
+	iptr := top.IPtrs[dirChildIndexForName(top.IPtrs, name)]
+	block, err = fbo.getBlockHelperLocked(
+		ctx, lState, kmd, iptr.BlockPointer, parentPath.Branch,
+		NewDirBlock, TransientEntry, parentPath, true, blockLookup,
+		defaultOnDemandRequestPriority)
+	if err != nil {
+		return DirEntry{}, false, err
+	}
+	child, isDir := block.(*DirBlock)
+	if !isDir || child.IsInd {
+		return DirEntry{}, false, nil
+	}
+
+	de, exists := child.Children[name]
+	if !exists || (file.tailPointer().IsValid() &&
+		de.BlockPointer != file.tailPointer()) {
+		if includeDeleted {
+			// Let the full lookup check the unlinked nodes.
+			return DirEntry{}, false, nil
+		}
+		return DirEntry{}, false, NoSuchNameError{name}
+	}
+	_, de = fbo.updateDirtyEntryFromCacheLocked(ctx, lState, de)
+	return de, true, nil
+}
+
 // GetFileBlockForReading retrieves the block pointed to by ptr, which
 // must be valid, either from the cache or from the server. An error
 // is returned if the retrieved block is not a file block.
@@ -598,14 +1110,15 @@ func (fbo *folderBlockOps) getDirBlockHelperLocked(ctx context.Context,
 // resolution and state checking. "Real" operations should use
 // getFileBlockLocked() and getFileLocked() instead.
 //
-// p is used only when reporting errors, and can be empty.
+// p is used only when reporting errors, and can be empty.  This never
+// triggers read notifications, even if p is valid.
 func (fbo *folderBlockOps) GetFileBlockForReading(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, ptr BlockPointer,
 	branch BranchName, p path) (*FileBlock, error) {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
 	return fbo.getFileBlockHelperLocked(
-		ctx, lState, kmd, ptr, branch, p, blockRead)
+		ctx, lState, kmd, ptr, branch, p, true, blockRead, CacheBlocks)
 }
 
 // GetDirBlockForReading retrieves the block pointed to by ptr, which
@@ -623,7 +1136,8 @@ func (fbo *folderBlockOps) GetDirBlockForReading(ctx context.Context,
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
 	return fbo.getDirBlockHelperLocked(
-		ctx, lState, kmd, ptr, branch, p, blockRead)
+		ctx, lState, kmd, ptr, branch, p, blockRead,
+		defaultOnDemandRequestPriority)
 }
 
 // getFileBlockLocked retrieves the block pointed to by ptr, which
@@ -659,10 +1173,13 @@ func (fbo *folderBlockOps) GetDirBlockForReading(ctx context.Context,
 // correctly.
 //
 // This method also returns whether the block was already dirty.
+// `policy` controls how a block fetched from the server is cached.
+// Internal operations that have to go through this method anyway
+// must set `suppressNotify`, so no read notification is triggered.
 func (fbo *folderBlockOps) getFileBlockLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, ptr BlockPointer,
-	file path, rtype blockReqType) (
-	fblock *FileBlock, wasDirty bool, err error) {
+	file path, suppressNotify bool, rtype blockReqType,
+	policy BlockCachePolicy) (fblock *FileBlock, wasDirty bool, err error) {
 	switch rtype {
 	case blockRead:
 		fbo.blockLock.AssertRLocked(lState)
@@ -676,18 +1193,22 @@ func (fbo *folderBlockOps) getFileBlockLocked(ctx context.Context,
 				"with blockReadParallel")
 		}
 	case blockLookup:
-		panic("blockLookup should only be used for directory blocks")
+		fbo.blockLock.AssertAnyLocked(lState)
 	default:
 		panic(fmt.Sprintf("Unknown block req type: %d", rtype))
 	}
 
 	fblock, err = fbo.getFileBlockHelperLocked(
-		ctx, lState, kmd, ptr, file.Branch, file, rtype)
+		ctx, lState, kmd, ptr, file.Branch, file, suppressNotify, rtype,
+		policy)
 	if err != nil {
 		return nil, false, err
 	}
 
 	wasDirty = fbo.config.DirtyBlockCache().IsDirty(fbo.id(), ptr, file.Branch)
+	if policy == CacheBlocksLowPriority && !wasDirty {
+		fbo.cacheBlockIfRoomLocked(ctx, ptr, fblock)
+	}
 	if rtype == blockWrite {
 		// Copy the block if it's for writing, and either the
 		// block is not yet dirty or the block is currently
@@ -705,16 +1226,104 @@ func (fbo *folderBlockOps) getFileBlockLocked(ctx context.Context,
 func (fbo *folderBlockOps) getFileLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path,
 	rtype blockReqType) (*FileBlock, error) {
-	// Callers should have already done this check, but it doesn't
-	// hurt to do it again.
-	if !file.isValid() {
-		return nil, InvalidPathError{file}
-	}
+	// Read, Write, Truncate and syncs validate the whole path on
+	// entry.
+	file.assertValid()
 	fblock, _, err := fbo.getFileBlockLocked(
-		ctx, lState, kmd, file.tailPointer(), file, rtype)
+		ctx, lState, kmd, file.tailPointer(), file, false, rtype,
+		CacheBlocks)
 	return fblock, err
 }
 
+// cacheBlockIfRoomLocked puts the given clean block into the
+// BlockCache as a transient entry, but only if that won't evict any
+// other entries.
+func (fbo *folderBlockOps) cacheBlockIfRoomLocked(
+	ctx context.Context, ptr BlockPointer, block Block) {
+	bcache := fbo.config.BlockCache()
+	if !bcache.HasRoomForTransient(block) {
+		return
+	}
+	err := bcache.Put(ptr, fbo.id(), block, TransientEntry)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't cache block %v: %+v", ptr, err)
+	}
+}
+
+// pinCleanBlocksLocked pins the clean cached blocks along the given
+// path, so they can't be evicted from the BlockCache while a sync
+// still needs them.  Dirty blocks are skipped, since the
+// DirtyBlockCache never evicts them.  It returns the pointers that
+// were pinned, which must be passed to unpinBlocks later.
+func (fbo *folderBlockOps) pinCleanBlocksLocked(
+	lState *lockState, p path) (pinned []BlockPointer) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	bcache := fbo.config.BlockCache()
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	for _, pn := range p.path {
+		if dirtyBcache.IsDirty(fbo.id(), pn.BlockPointer, fbo.branch()) {
+			continue
+		}
+		if bcache.Pin(pn.BlockPointer) {
+			pinned = append(pinned, pn.BlockPointer)
+		}
+	}
+	return pinned
+}
+
+// unpinBlocks undoes a previous pinCleanBlocksLocked call.
+func (fbo *folderBlockOps) unpinBlocks(ptrs []BlockPointer) {
+	bcache := fbo.config.BlockCache()
+	for _, ptr := range ptrs {
+		bcache.Unpin(ptr)
+	}
+}
+
+// EncodedFileSize returns the total encoded size of the given file's
+// blocks on the server, including its top block, as opposed to the
+// logical size of the file.  Holes don't take up any space.  For
+// blocks that have been dirtied since the last sync, the encoded
+// size of their last synced version is used; blocks that have never
+// been synced don't count.
+func (fbo *folderBlockOps) EncodedFileSize(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, file path) (uint64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file, false)
+	if err != nil {
+		return 0, err
+	}
+
+	// Dirtied blocks keep their pointers until the next sync, and
+	// their last synced sizes are remembered as unrefs.
+	syncedSizes := make(map[BlockPointer]uint32)
+	if si, ok := fbo.unrefCache[file.tailRef()]; ok {
+		syncedSizes[si.oldInfo.BlockPointer] = si.oldInfo.EncodedSize
+		for _, info := range si.unrefs {
+			syncedSizes[info.BlockPointer] = info.EncodedSize
+		}
+	}
+	encodedSize := func(info BlockInfo) uint64 {
+		if info.EncodedSize != 0 {
+			return uint64(info.EncodedSize)
+		}
+		return uint64(syncedSizes[info.BlockPointer])
+	}
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newInternalFileData(lState, file, id, kmd)
+	infos, err := fd.getIndirectFileBlockInfos(ctx)
+	if err != nil {
+		return 0, err
+	}
+	size := encodedSize(de.BlockInfo)
+	for _, info := range infos {
+		size += encodedSize(info)
+	}
+	return size, nil
+}
+
 // GetIndirectFileBlockInfos returns a list of BlockInfos for all
 // indirect blocks of the given file. If the returned error is a
 // recoverable one (as determined by
@@ -726,10 +1335,94 @@ func (fbo *folderBlockOps) GetIndirectFileBlockInfos(ctx context.Context,
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
 	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
-	fd := fbo.newFileData(lState, file, id, kmd)
+	fd := fbo.newInternalFileData(lState, file, id, kmd)
 	return fd.getIndirectFileBlockInfos(ctx)
 }
 
+// GetIndirectDirBlockInfos returns the BlockInfos of the child
+// blocks of the given directory, if it's stored as an indirect dir
+// block.
+func (fbo *folderBlockOps) GetIndirectDirBlockInfos(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path) ([]BlockInfo, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	dblock, err := fbo.getDirLocked(
+		ctx, lState, kmd, dir, blockRead, defaultOnDemandRequestPriority)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]BlockInfo, 0, len(dblock.assembledFrom))
+	for _, iptr := range dblock.assembledFrom {
+		infos = append(infos, iptr.BlockInfo)
+	}
+	return infos, nil
+}
+
+// DumpFileTree returns an entry for every indirect pointer in the
+// block tree of the given file, in depth-first order, as seen
+// locally (i.e., including any dirty blocks).  It's meant for
+// debugging the structure of large files.  A file made of a single
+// direct block has no entries.
+func (fbo *folderBlockOps) DumpFileTree(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, file path) (
+	[]FileTreeEntry, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newInternalFileData(lState, file, id, kmd)
+	topBlock, _, err := fd.getter(
+		ctx, kmd, fd.rootBlockPointer(), file, blockRead)
+	if err != nil {
+		return nil, err
+	}
+	if !topBlock.IsInd {
+		return nil, nil
+	}
+
+	// Gather all the indirect blocks by their pointers, so we can
+	// visit them in order.
+	pfr, err := fd.getIndirectBlocksForOffsetRange(ctx, topBlock, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	indBlocks := make(map[BlockPointer]*FileBlock)
+	for _, p := range pfr {
+		for i := 0; i < len(p)-1; i++ {
+			indBlocks[p[i].childIPtr().BlockPointer] = p[i+1].pblock
+		}
+	}
+
+	df := fbo.dirtyFiles[file.tailPointer()]
+	var entries []FileTreeEntry
+	var visit func(pblock *FileBlock, depth int) error
+	visit = func(pblock *FileBlock, depth int) error {
+		for _, iptr := range pblock.IPtrs {
+			entry := FileTreeEntry{Depth: depth, IndirectFilePtr: iptr}
+			if df != nil {
+				entry.Dirty = df.isBlockDirty(iptr.BlockPointer)
+				entry.Syncing = df.isBlockSyncing(iptr.BlockPointer)
+			}
+			entries = append(entries, entry)
+			if iptr.DirectType != IndirectBlock {
+				continue
+			}
+			child, ok := indBlocks[iptr.BlockPointer]
+			if !ok {
+				return fmt.Errorf("No indirect block found for %v at depth %d",
+					iptr.BlockPointer, depth)
+			}
+			if err := visit(child, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(topBlock, 1); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
 // GetIndirectFileBlockInfosWithTopBlock returns a list of BlockInfos
 // for all indirect blocks of the given file, starting from the given
 // top-most block. If the returned error is a recoverable one (as
@@ -744,62 +1437,274 @@ func (fbo *folderBlockOps) GetIndirectFileBlockInfosWithTopBlock(
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
 	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
-	fd := fbo.newFileData(lState, file, id, kmd)
+	fd := fbo.newInternalFileData(lState, file, id, kmd)
 	return fd.getIndirectFileBlockInfosWithTopBlock(ctx, topBlock)
 }
 
-// DeepCopyFile makes a complete copy of the given file, deduping leaf
-// blocks and making new random BlockPointers for all indirect blocks.
-// It returns the new top pointer of the copy, and all the new child
-// pointers in the copy.  It takes a custom DirtyBlockCache, which
-// directs where the resulting block copies are stored.
-func (fbo *folderBlockOps) DeepCopyFile(
-	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
-	dirtyBcache DirtyBlockCache, dataVer DataVer) (
-	newTopPtr BlockPointer, allChildPtrs []BlockPointer, err error) {
-	// Deep copying doesn't alter any data in use, it only makes copy,
-	// so only a read lock is needed.
+// CollectAllBlockRefs returns the BlockInfos of all the blocks
+// referenced by the directory tree of `md`: the root directory
+// block, the blocks of every directory and file under it, and all
+// the indirect blocks of multi-block files.  It's meant for auditing
+// the blocks referenced by a TLF against the block server, so the
+// caller should make sure there are no local dirty changes for the
+// folder, since those would be visited instead of the synced blocks.
+func (fbo *folderBlockOps) CollectAllBlockRefs(ctx context.Context,
+	lState *lockState, md ReadOnlyRootMetadata) ([]BlockInfo, error) {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
-	chargedTo, err := chargedToForTLF(
-		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), kmd.GetTlfHandle())
-	if err != nil {
-		return BlockPointer{}, nil, err
+
+	rootPath := path{
+		FolderBranch: fbo.folderBranch,
+		path: []pathNode{{
+			md.data.Dir.BlockPointer,
+			string(md.GetTlfHandle().GetCanonicalName()),
+		}},
 	}
-	fd := fbo.newFileDataWithCache(
-		lState, file, chargedTo, kmd, dirtyBcache)
-	return fd.deepCopy(ctx, dataVer)
+	infos := []BlockInfo{md.data.Dir.BlockInfo}
+	return fbo.collectDirBlockRefsLocked(ctx, lState, md, rootPath, infos)
 }
 
-func (fbo *folderBlockOps) UndupChildrenInCopy(ctx context.Context,
-	lState *lockState, kmd KeyMetadata, file path, bps *blockPutState,
-	dirtyBcache DirtyBlockCache, topBlock *FileBlock) ([]BlockInfo, error) {
-	fbo.blockLock.Lock(lState)
-	defer fbo.blockLock.Unlock(lState)
-	chargedTo, err := chargedToForTLF(
-		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), kmd.GetTlfHandle())
+// collectDirBlockRefsLocked appends the BlockInfos of all the blocks
+// under the directory at `dir` to `infos`, not including the
+// directory's own block.
+func (fbo *folderBlockOps) collectDirBlockRefsLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path, infos []BlockInfo) (
+	[]BlockInfo, error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	dblock, err := fbo.getDirBlockHelperLocked(
+		ctx, lState, kmd, dir.tailPointer(), dir.Branch, dir, blockRead,
+		defaultOnDemandRequestPriority)
 	if err != nil {
 		return nil, err
 	}
-	fd := fbo.newFileDataWithCache(
-		lState, file, chargedTo, kmd, dirtyBcache)
-	return fd.undupChildrenInCopy(ctx, fbo.config.BlockCache(),
-		fbo.config.BlockOps(), bps, topBlock)
-}
 
-func (fbo *folderBlockOps) ReadyNonLeafBlocksInCopy(ctx context.Context,
-	lState *lockState, kmd KeyMetadata, file path, bps *blockPutState,
-	dirtyBcache DirtyBlockCache, topBlock *FileBlock) ([]BlockInfo, error) {
-	fbo.blockLock.RLock(lState)
-	defer fbo.blockLock.RUnlock(lState)
-	chargedTo, err := chargedToForTLF(
-		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), kmd.GetTlfHandle())
-	if err != nil {
-		return nil, err
+	// Visit the children in a fixed order, so the result is
+	// deterministic.
+	names := make([]string, 0, len(dblock.Children))
+	for name := range dblock.Children {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	fd := fbo.newFileDataWithCache(
-		lState, file, chargedTo, kmd, dirtyBcache)
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	for _, name := range names {
+		de := dblock.Children[name]
+		if de.Type == Sym {
+			// Symlinks don't have any blocks.
+			continue
+		}
+		infos = append(infos, de.BlockInfo)
+		childPath := dir.ChildPath(name, de.BlockPointer)
+		switch de.Type {
+		case Dir:
+			infos, err = fbo.collectDirBlockRefsLocked(
+				ctx, lState, kmd, childPath, infos)
+		default:
+			fd := fbo.newInternalFileData(lState, childPath, id, kmd)
+			var fileInfos []BlockInfo
+			fileInfos, err = fd.getIndirectFileBlockInfos(ctx)
+			infos = append(infos, fileInfos...)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return infos, nil
+}
+
+// ReconstructPath finds the path to the entry with the given tail
+// ref by walking the directory tree of `md`, for use when the node
+// cache no longer knows about the entry (e.g., a dirty file whose
+// node has been forgotten).  It returns a PathNotFoundError if no
+// entry in the tree has that ref.
+func (fbo *folderBlockOps) ReconstructPath(ctx context.Context,
+	lState *lockState, md ReadOnlyRootMetadata, tailRef BlockRef) (
+	path, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	rootPath := path{
+		FolderBranch: fbo.folderBranch,
+		path: []pathNode{{
+			md.data.Dir.BlockPointer,
+			string(md.GetTlfHandle().GetCanonicalName()),
+		}},
+	}
+	if rootPath.tailRef() == tailRef {
+		return rootPath, nil
+	}
+	p, found, err := fbo.reconstructPathInDirLocked(
+		ctx, lState, md, rootPath, tailRef)
+	if err != nil {
+		return path{}, err
+	}
+	if !found {
+		return path{}, PathNotFoundError{tailRef}
+	}
+	return p, nil
+}
+
+// reconstructPathInDirLocked searches the directory at `dir`, and
+// all of its subdirectories, for an entry with the given ref.
+func (fbo *folderBlockOps) reconstructPathInDirLocked(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path, tailRef BlockRef) (
+	p path, found bool, err error) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	// This is a background traversal, so don't let it delay
+	// interactive directory fetches.
+	dblock, err := fbo.getDirBlockHelperLocked(
+		ctx, lState, kmd, dir.tailPointer(), dir.Branch, dir, blockRead,
+		backgroundRequestPriority)
+	if err != nil {
+		return path{}, false, err
+	}
+
+	// Check all the direct children before descending.
+	for name, de := range dblock.Children {
+		if de.Ref() == tailRef {
+			return dir.ChildPath(name, de.BlockPointer), true, nil
+		}
+	}
+
+	for name, de := range dblock.Children {
+		if de.Type != Dir {
+			continue
+		}
+		p, found, err = fbo.reconstructPathInDirLocked(
+			ctx, lState, kmd, dir.ChildPath(name, de.BlockPointer), tailRef)
+		if err != nil || found {
+			return p, found, err
+		}
+	}
+	return path{}, false, nil
+}
+
+// DirSize returns the total size of all the files in the directory
+// tree under `dir`, and the number of those files, as seen locally
+// (i.e., including any unsynced writes).  Directories are fetched with
+// a background priority, so that the walk doesn't delay interactive
+// reads, and `blockLock` is only held while each directory is read,
+// so the walk doesn't hold up writers either.  It fails with a
+// DirTooDeepError if the tree is more than maxDirSizeDepth levels
+// deep.
+func (fbo *folderBlockOps) DirSize(ctx context.Context, lState *lockState,
+	kmd KeyMetadata, dir path) (totalBytes uint64, fileCount int, err error) {
+	return fbo.dirSizeWithMaxDepth(ctx, lState, kmd, dir, maxDirSizeDepth)
+}
+
+func (fbo *folderBlockOps) dirSizeWithMaxDepth(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path, maxDepth int) (
+	totalBytes uint64, fileCount int, err error) {
+	type dirToWalk struct {
+		dir      path
+		maxDepth int
+	}
+	toWalk := []dirToWalk{{dir, maxDepth}}
+	for len(toWalk) > 0 {
+		next := toWalk[len(toWalk)-1]
+		toWalk = toWalk[:len(toWalk)-1]
+
+		bytes, count, subdirs, err := fbo.dirLevelSize(
+			ctx, lState, kmd, next.dir)
+		if err != nil {
+			return 0, 0, err
+		}
+		totalBytes += bytes
+		fileCount += count
+
+		for _, subdir := range subdirs {
+			if next.maxDepth <= 0 {
+				return 0, 0, DirTooDeepError{
+					next.dir.ChildPathNoPtr(subdir.tailName())}
+			}
+			toWalk = append(toWalk, dirToWalk{subdir, next.maxDepth - 1})
+		}
+	}
+	return totalBytes, fileCount, nil
+}
+
+// dirLevelSize returns the total size and number of the files
+// directly within `dir`, along with the paths of its subdirectories.
+func (fbo *folderBlockOps) dirLevelSize(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, dir path) (
+	totalBytes uint64, fileCount int, subdirs []path, err error) {
+	// Cached directories don't check the context themselves.
+	if err := ctx.Err(); err != nil {
+		return 0, 0, nil, err
+	}
+
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	dblock, err := fbo.getDirtyDirLocked(
+		ctx, lState, kmd, dir, blockRead, backgroundRequestPriority)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	for name, de := range dblock.Children {
+		switch de.Type {
+		case File, Exec:
+			totalBytes += de.Size
+			fileCount++
+		case Dir:
+			subdirs = append(subdirs, dir.ChildPath(name, de.BlockPointer))
+		}
+	}
+	return totalBytes, fileCount, subdirs, nil
+}
+
+// DeepCopyFile makes a complete copy of the given file, deduping leaf
+// blocks and making new random BlockPointers for all indirect blocks.
+// It returns the new top pointer of the copy, and all the new child
+// pointers in the copy.  It takes a custom DirtyBlockCache, which
+// directs where the resulting block copies are stored.
+func (fbo *folderBlockOps) DeepCopyFile(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	dirtyBcache DirtyBlockCache, dataVer DataVer) (
+	newTopPtr BlockPointer, allChildPtrs []BlockPointer, err error) {
+	// Deep copying doesn't alter any data in use, it only makes copy,
+	// so only a read lock is needed.
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), kmd.GetTlfHandle())
+	if err != nil {
+		return BlockPointer{}, nil, err
+	}
+	fd := fbo.newFileDataWithCache(
+		lState, file, chargedTo, kmd, dirtyBcache)
+	return fd.deepCopy(ctx, dataVer)
+}
+
+func (fbo *folderBlockOps) UndupChildrenInCopy(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, file path, bps *blockPutState,
+	dirtyBcache DirtyBlockCache, topBlock *FileBlock) ([]BlockInfo, error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), kmd.GetTlfHandle())
+	if err != nil {
+		return nil, err
+	}
+	fd := fbo.newFileDataWithCache(
+		lState, file, chargedTo, kmd, dirtyBcache)
+	return fd.undupChildrenInCopy(ctx, fbo.config.BlockCache(),
+		fbo.config.BlockOps(), bps, topBlock)
+}
+
+func (fbo *folderBlockOps) ReadyNonLeafBlocksInCopy(ctx context.Context,
+	lState *lockState, kmd KeyMetadata, file path, bps *blockPutState,
+	dirtyBcache DirtyBlockCache, topBlock *FileBlock) ([]BlockInfo, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), kmd.GetTlfHandle())
+	if err != nil {
+		return nil, err
+	}
+
+	fd := fbo.newFileDataWithCache(
+		lState, file, chargedTo, kmd, dirtyBcache)
 	return fd.readyNonLeafBlocksInCopy(ctx, fbo.config.BlockCache(),
 		fbo.config.BlockOps(), bps, topBlock)
 }
@@ -825,19 +1730,20 @@ func (fbo *folderBlockOps) ReadyNonLeafBlocksInCopy(ctx context.Context,
 // don't need a copy of parent dir blocks, and non-file write
 // operations do need to copy dir blocks for modifications.
 func (fbo *folderBlockOps) getDirLocked(ctx context.Context,
-	lState *lockState, kmd KeyMetadata, dir path, rtype blockReqType) (
-	*DirBlock, error) {
+	lState *lockState, kmd KeyMetadata, dir path, rtype blockReqType,
+	priority int) (*DirBlock, error) {
 	fbo.blockLock.AssertAnyLocked(lState)
 
 	// Callers should have already done this check, but it doesn't
 	// hurt to do it again.
-	if !dir.isValid() {
-		return nil, InvalidPathError{dir}
+	if err := dir.checkValid(); err != nil {
+		return nil, err
 	}
 
 	// Get the block for the last element in the path.
 	dblock, err := fbo.getDirBlockHelperLocked(
-		ctx, lState, kmd, dir.tailPointer(), dir.Branch, dir, rtype)
+		ctx, lState, kmd, dir.tailPointer(), dir.Branch, dir, rtype,
+		priority)
 	if err != nil {
 		return nil, err
 	}
@@ -865,12 +1771,15 @@ func (fbo *folderBlockOps) getDirLocked(ctx context.Context,
 // and returns it.  If this method might be called again for the same
 // block within a single operation, it is the caller's responsibility
 // to write that block back to the cache as dirty.
+//
+// If the block isn't cached, it is fetched with the given priority;
+// interactive callers should use defaultOnDemandRequestPriority.
 func (fbo *folderBlockOps) GetDir(
 	ctx context.Context, lState *lockState, kmd KeyMetadata, dir path,
-	rtype blockReqType) (*DirBlock, error) {
+	rtype blockReqType, priority int) (*DirBlock, error) {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
-	return fbo.getDirLocked(ctx, lState, kmd, dir, rtype)
+	return fbo.getDirLocked(ctx, lState, kmd, dir, rtype, priority)
 }
 
 type dirCacheUndoFn func(lState *lockState)
@@ -883,12 +1792,70 @@ func (fbo *folderBlockOps) wrapWithBlockLock(fn func()) dirCacheUndoFn {
 		fbo.blockLock.Lock(lState)
 		defer fbo.blockLock.Unlock(lState)
 		fn()
+		fbo.clearDirListingsLocked(lState)
+	}
+}
+
+// cacheDirListingLocked caches the children of the given (possibly
+// dirty) directory block, so they can be returned by subsequent
+// entry lookups without fetching the directory again.
+func (fbo *folderBlockOps) cacheDirListingLocked(
+	lState *lockState, dir path, dblock *DirBlock) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	children := make(map[string]DirEntry, len(dblock.Children))
+	for k, de := range dblock.Children {
+		children[k] = de
+	}
+
+	fbo.dirListings.Add(dir.tailPointer(), dirListing{
+		children: children,
+		expires:  fbo.config.Clock().Now().Add(dirListingCacheTTL),
+	})
+}
+
+// getCachedDirListingEntryLocked returns the cached entry for the
+// given file from its parent's directory listing, if there's a
+// current one.
+func (fbo *folderBlockOps) getCachedDirListingEntryLocked(
+	ctx context.Context, lState *lockState, file path) (DirEntry, bool) {
+	fbo.blockLock.AssertAnyLocked(lState)
+	if !file.hasValidParent() {
+		return DirEntry{}, false
 	}
+	parentPtr := file.parentPath().tailPointer()
+
+	cached, ok := fbo.dirListings.Get(parentPtr)
+	if !ok {
+		return DirEntry{}, false
+	}
+	listing := cached.(dirListing)
+	if !fbo.config.Clock().Now().Before(listing.expires) {
+		fbo.dirListings.Remove(parentPtr)
+		return DirEntry{}, false
+	}
+	de, ok := listing.children[file.tailName()]
+	if !ok || (file.tailPointer().IsValid() &&
+		de.BlockPointer != file.tailPointer()) {
+		return DirEntry{}, false
+	}
+
+	// The child itself may have been written since the listing was
+	// cached.
+	_, de = fbo.updateDirtyEntryFromCacheLocked(ctx, lState, de)
+	return de, true
+}
+
+// clearDirListingsLocked drops all cached directory listings.  It
+// must be called after any change to a directory's cached entries.
+func (fbo *folderBlockOps) clearDirListingsLocked(lState *lockState) {
+	fbo.blockLock.AssertLocked(lState)
+	fbo.dirListings.Purge()
 }
 
 func (fbo *folderBlockOps) addDirEntryInCacheLocked(lState *lockState, dir path,
 	newName string, newDe DirEntry) func() {
 	fbo.blockLock.AssertLocked(lState)
+	fbo.clearDirListingsLocked(lState)
 	cacheEntry, dirEntryExisted := fbo.deCache[dir.tailRef()]
 	cacheEntryCopy := cacheEntry.deepCopy()
 	if newDe.IsInitialized() {
@@ -960,6 +1927,7 @@ func (fbo *folderBlockOps) AddDirEntryInCache(lState *lockState, dir path,
 func (fbo *folderBlockOps) removeDirEntryInCacheLocked(lState *lockState,
 	dir path, oldName string, oldDe DirEntry) func() {
 	fbo.blockLock.AssertLocked(lState)
+	fbo.clearDirListingsLocked(lState)
 	cacheEntry, dirEntryExisted := fbo.deCache[dir.tailRef()]
 	cacheEntryCopy := cacheEntry.deepCopy()
 
@@ -1103,6 +2071,7 @@ func (fbo *folderBlockOps) setCachedAttrLocked(
 	lState *lockState, ref BlockRef, attr attrChange, realEntry *DirEntry,
 	doCreate bool) {
 	fbo.blockLock.AssertLocked(lState)
+	fbo.clearDirListingsLocked(lState)
 	fileEntry, ok := fbo.deCache[ref]
 	if !ok || !fileEntry.dirEntry.IsInitialized() {
 		if !doCreate {
@@ -1166,6 +2135,7 @@ func (fbo *folderBlockOps) ClearCachedRef(
 	}
 
 	delete(fbo.deCache, ref)
+	fbo.clearDirListingsLocked(lState)
 	return true
 }
 
@@ -1175,6 +2145,7 @@ func (fbo *folderBlockOps) ClearCachedDirEntry(lState *lockState, dir path) {
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
 	delete(fbo.deCache, dir.tailRef())
+	fbo.clearDirListingsLocked(lState)
 	err := fbo.config.DirtyBlockCache().Delete(
 		fbo.id(), dir.tailPointer(), fbo.branch())
 	if err != nil {
@@ -1329,11 +2300,11 @@ func (fbo *folderBlockOps) updateWithDirtyEntriesLocked(ctx context.Context,
 // has entries possibly pointing to dirty files, and/or that its
 // children list is dirty.
 func (fbo *folderBlockOps) getDirtyDirLocked(ctx context.Context,
-	lState *lockState, kmd KeyMetadata, dir path, rtype blockReqType) (
-	*DirBlock, error) {
+	lState *lockState, kmd KeyMetadata, dir path, rtype blockReqType,
+	priority int) (*DirBlock, error) {
 	fbo.blockLock.AssertAnyLocked(lState)
 
-	dblock, err := fbo.getDirLocked(ctx, lState, kmd, dir, rtype)
+	dblock, err := fbo.getDirLocked(ctx, lState, kmd, dir, rtype, priority)
 	if err != nil {
 		return nil, err
 	}
@@ -1350,22 +2321,50 @@ func (fbo *folderBlockOps) GetDirtyDir(
 	rtype blockReqType) (*DirBlock, error) {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
-	return fbo.getDirtyDirLocked(ctx, lState, kmd, dir, rtype)
+	return fbo.getDirtyDirLocked(
+		ctx, lState, kmd, dir, rtype, defaultOnDemandRequestPriority)
 }
 
 var hiddenEntries = map[string]bool{
 	".kbfs_git": true,
 }
 
+// WarmDirCache fetches the (possibly dirty) directory block for the
+// given directory, and caches the entries of all its children for a
+// short while, so that subsequent GetDirtyEntry calls for those
+// children don't need to look up the directory block again.  The
+// cached listing is dropped on any write to a directory.
+func (fbo *folderBlockOps) WarmDirCache(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, dir path) error {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	dblock, err := fbo.getDirtyDirLocked(
+		ctx, lState, kmd, dir, blockRead, defaultOnDemandRequestPriority)
+	if err != nil {
+		return err
+	}
+	fbo.cacheDirListingLocked(lState, dir, dblock)
+	return nil
+}
+
 // GetDirtyDirChildren returns a map of EntryInfos for the (possibly
-// dirty) children entries of the given directory.
+// dirty) children entries of the given directory.  If the directory
+// block isn't cached, it is fetched with the given priority.
 func (fbo *folderBlockOps) GetDirtyDirChildren(
-	ctx context.Context, lState *lockState, kmd KeyMetadata, dir path) (
-	map[string]EntryInfo, error) {
+	ctx context.Context, lState *lockState, kmd KeyMetadata, dir path,
+	priority int) (map[string]EntryInfo, error) {
 	dblock, err := func() (*DirBlock, error) {
 		fbo.blockLock.RLock(lState)
 		defer fbo.blockLock.RUnlock(lState)
-		return fbo.getDirtyDirLocked(ctx, lState, kmd, dir, blockRead)
+		dblock, err := fbo.getDirtyDirLocked(
+			ctx, lState, kmd, dir, blockRead, priority)
+		if err != nil {
+			return nil, err
+		}
+		// Callers listing a directory often look up each child
+		// next, so keep the listing around for a little while.
+		fbo.cacheDirListingLocked(lState, dir, dblock)
+		return dblock, nil
 	}()
 	if err != nil {
 		return nil, err
@@ -1382,6 +2381,82 @@ func (fbo *folderBlockOps) GetDirtyDirChildren(
 	return children, nil
 }
 
+// GetDirtyDirChildrenSorted is like GetDirtyDirChildren, but returns
+// the children sorted by name, so callers get the same order every
+// time without sorting the listing themselves.
+func (fbo *folderBlockOps) GetDirtyDirChildrenSorted(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, dir path,
+	priority int) ([]NamedEntryInfo, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	dblock, err := fbo.getDirtyDirLocked(
+		ctx, lState, kmd, dir, blockRead, priority)
+	if err != nil {
+		return nil, err
+	}
+	fbo.cacheDirListingLocked(lState, dir, dblock)
+
+	names := make([]string, 0, len(dblock.Children))
+	for name := range dblock.Children {
+		if hiddenEntries[name] {
+			fbo.log.CDebugf(ctx, "Hiding entry %s", name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	children := make([]NamedEntryInfo, 0, len(names))
+	for _, name := range names {
+		children = append(children,
+			NamedEntryInfo{name, dblock.Children[name].EntryInfo})
+	}
+	return children, nil
+}
+
+// GetDirtyDirChildrenPaged returns up to `limit` of the (possibly
+// dirty) children entries of the given directory, sorted by name and
+// starting just after `afterName`.  An empty `afterName` starts at
+// the beginning, and a non-positive `limit` returns all remaining
+// entries.  If more entries remain, `nextCursor` is the name to pass
+// as `afterName` to get the next page; otherwise it is empty.
+// Entries added or removed between pages are reflected in later
+// pages, as long as they sort after the cursor.
+func (fbo *folderBlockOps) GetDirtyDirChildrenPaged(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, dir path,
+	afterName string, limit int) (
+	children dirEntries, nextCursor string, err error) {
+	dblock, err := func() (*DirBlock, error) {
+		fbo.blockLock.RLock(lState)
+		defer fbo.blockLock.RUnlock(lState)
+		return fbo.getDirtyDirLocked(
+			ctx, lState, kmd, dir, blockRead, defaultOnDemandRequestPriority)
+	}()
+	if err != nil {
+		return nil, "", err
+	}
+
+	names := make([]string, 0, len(dblock.Children))
+	for name := range dblock.Children {
+		if hiddenEntries[name] || name <= afterName {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if limit > 0 && len(names) > limit {
+		names = names[:limit]
+		nextCursor = names[limit-1]
+	}
+
+	children = make(dirEntries, 0, len(names))
+	for _, name := range names {
+		children = append(
+			children, dirEntryWithName{dblock.Children[name], name})
+	}
+	return children, nextCursor, nil
+}
+
 // file must have a valid parent.
 func (fbo *folderBlockOps) getDirtyParentAndEntryLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path, rtype blockReqType,
@@ -1395,7 +2470,8 @@ func (fbo *folderBlockOps) getDirtyParentAndEntryLocked(ctx context.Context,
 
 	parentPath := file.parentPath()
 	dblock, err := fbo.getDirtyDirLocked(
-		ctx, lState, kmd, *parentPath, rtype)
+		ctx, lState, kmd, *parentPath, rtype,
+		defaultOnDemandRequestPriority)
 	if err != nil {
 		return nil, DirEntry{}, err
 	}
@@ -1444,8 +2520,20 @@ func (fbo *folderBlockOps) GetDirtyParentAndEntry(
 func (fbo *folderBlockOps) getDirtyEntryLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, file path, includeDeleted bool) (
 	DirEntry, error) {
-	// TODO: Since we only need a single DirEntry, avoid having to
-	// look up every entry in the DirBlock.
+	if de, ok := fbo.getCachedDirListingEntryLocked(
+		ctx, lState, file); ok {
+		return de, nil
+	}
+
+	// Avoid looking up every entry of a huge directory when we only
+	// need a single one.
+	if de, ok, err := fbo.getIndirectDirEntryLocked(
+		ctx, lState, kmd, file, includeDeleted); err != nil {
+		return DirEntry{}, err
+	} else if ok {
+		return de, nil
+	}
+
 	_, de, err := fbo.getDirtyParentAndEntryLocked(
 		ctx, lState, kmd, file, blockLookup, includeDeleted)
 	return de, err
@@ -1495,8 +2583,8 @@ func (fbo *folderBlockOps) Lookup(
 	defer fbo.blockLock.RUnlock(lState)
 
 	dirPath := fbo.nodeCache.PathFromNode(dir)
-	if !dirPath.isValid() {
-		return nil, DirEntry{}, InvalidPathError{dirPath}
+	if err := dirPath.checkValid(); err != nil {
+		return nil, DirEntry{}, err
 	}
 
 	childPath := dirPath.ChildPathNoPtr(name)
@@ -1587,6 +2675,28 @@ func (fbo *folderBlockOps) GetDirtyFileBlockRefs(lState *lockState) []BlockRef {
 	return dirtyRefs
 }
 
+// GetDirtyRefsWithBytes returns the references of all the entries
+// with cached dirty changes, along with the number of dirty bytes of
+// each dirty file, and whether it's being synced.
+func (fbo *folderBlockOps) GetDirtyRefsWithBytes(
+	lState *lockState) []DirtyRefInfo {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+	dirtyFiles := make(map[BlockRef]*dirtyFile, len(fbo.dirtyFiles))
+	for ptr, df := range fbo.dirtyFiles {
+		dirtyFiles[ptr.Ref()] = df
+	}
+	infos := make([]DirtyRefInfo, 0, len(fbo.deCache))
+	for ref := range fbo.deCache {
+		info := DirtyRefInfo{Ref: ref}
+		if df, ok := dirtyFiles[ref]; ok {
+			info.DirtyBytes, info.Syncing = df.getDirtyBytes()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
 // GetDirtyDirBlockRefs returns a list of references of all known dirty
 // directories.
 func (fbo *folderBlockOps) GetDirtyDirBlockRefs(lState *lockState) []BlockRef {
@@ -1614,10 +2724,12 @@ func (fbo *folderBlockOps) GetDirtyDirBlockRefs(lState *lockState) []BlockRef {
 // failed with a recoverable block error on a multi-block file.  It
 // makes sure that any outstanding dirty versions of the file are
 // fixed up to reflect the fact that some of the indirect pointers now
-// need to change.
+// need to change.  It returns a DirtyBlockMissingError if the dirty
+// top block of the file can't be found; any other problems are just
+// logged.
 func (fbo *folderBlockOps) fixChildBlocksAfterRecoverableErrorLocked(
 	ctx context.Context, lState *lockState, file path, kmd KeyMetadata,
-	redirtyOnRecoverableError map[BlockPointer]BlockPointer) {
+	redirtyOnRecoverableError map[BlockPointer]BlockPointer) error {
 	fbo.blockLock.AssertLocked(lState)
 
 	defer func() {
@@ -1645,18 +2757,18 @@ func (fbo *folderBlockOps) fixChildBlocksAfterRecoverableErrorLocked(
 	topBlock, err := dirtyBcache.Get(fbo.id(), file.tailPointer(), fbo.branch())
 	fblock, ok := topBlock.(*FileBlock)
 	if err != nil || !ok {
-		fbo.log.CWarningf(ctx, "Couldn't find dirtied "+
+		fbo.log.CErrorf(ctx, "Couldn't find dirtied "+
 			"top-block for %v: %v", file.tailPointer(), err)
-		return
+		return DirtyBlockMissingError{file.tailPointer(), file}
 	}
 
 	chargedTo, err := chargedToForTLF(
 		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), kmd.GetTlfHandle())
 	if err != nil {
 		fbo.log.CWarningf(ctx, "Couldn't find uid during recovery: %v", err)
-		return
+		return nil
 	}
-	fd := fbo.newFileData(lState, file, chargedTo, kmd)
+	fd := fbo.newInternalFileData(lState, file, chargedTo, kmd)
 
 	// If a copy of the top indirect block was made, we need to
 	// redirty all the sync'd blocks under their new IDs, so that
@@ -1669,7 +2781,7 @@ func (fbo *folderBlockOps) fixChildBlocksAfterRecoverableErrorLocked(
 	if err != nil {
 		fbo.log.CWarningf(
 			ctx, "Couldn't find and clear iptrs during recovery: %v", err)
-		return
+		return nil
 	}
 	for newPtr, oldPtr := range redirtyOnRecoverableError {
 		if !found[newPtr] {
@@ -1696,15 +2808,33 @@ func (fbo *folderBlockOps) fixChildBlocksAfterRecoverableErrorLocked(
 			fbo.log.CDebugf(ctx, "Couldn't del-dirty %v: %v", oldPtr, err)
 		}
 	}
+	return nil
 }
 
 func (fbo *folderBlockOps) nowUnixNano() int64 {
 	return fbo.config.Clock().Now().UnixNano()
 }
 
+// updateWriteTimes sets the mtime and ctime of the given entry to the
+// current time, after a write.  The mtime being replaced may have
+// come from another writer's clock, so it is reported for skew
+// tracking first.
+func (fbo *folderBlockOps) updateWriteTimes(de *DirEntry) {
+	clock := fbo.config.Clock()
+	reportClockSkew(clock, time.Unix(0, de.Mtime))
+	now := clock.Now().UnixNano()
+	de.Mtime = now
+	de.Ctime = now
+}
+
 // PrepRename prepares the given rename operation. It returns the old
 // and new parent block (which may be the same, and which shouldn't be
-// modified), and what is to be the new DirEntry.
+// modified), and what is to be the new DirEntry.  If the entry is a
+// directory and `newParent` passes through it, it returns
+// ErrRenameCycle.  It doesn't change any cached state itself, so
+// there is nothing to roll back if the rename fails after this call;
+// the in-memory directory edits are made later by
+// RenameDirEntryInCache, which returns its own undo function.
 func (fbo *folderBlockOps) PrepRename(
 	ctx context.Context, lState *lockState, kmd KeyMetadata,
 	oldParent path, oldName string, newParent path, newName string) (
@@ -1715,7 +2845,8 @@ func (fbo *folderBlockOps) PrepRename(
 
 	// Look up in the old path. Won't be modified, so only fetch for reading.
 	oldPBlock, err = fbo.getDirtyDirLocked(
-		ctx, lState, kmd, oldParent, blockRead)
+		ctx, lState, kmd, oldParent, blockRead,
+		defaultOnDemandRequestPriority)
 	if err != nil {
 		return nil, nil, DirEntry{}, nil, err
 	}
@@ -1725,6 +2856,17 @@ func (fbo *folderBlockOps) PrepRename(
 		return nil, nil, DirEntry{}, nil, NoSuchNameError{oldName}
 	}
 
+	// Moving a directory into itself or one of its descendants would
+	// detach the whole subtree into a loop.
+	if newDe.Type == Dir {
+		for _, pn := range newParent.path {
+			if pn.BlockPointer == newDe.BlockPointer {
+				return nil, nil, DirEntry{}, nil, ErrRenameCycle{
+					oldParent.ChildPathNoPtr(oldName), newParent}
+			}
+		}
+	}
+
 	oldParentPtr := oldParent.tailPointer()
 	newParentPtr := newParent.tailPointer()
 	ro, err = newRenameOp(oldName, oldParentPtr, newName, newParentPtr,
@@ -1746,7 +2888,8 @@ func (fbo *folderBlockOps) PrepRename(
 		newPBlock = oldPBlock
 	} else {
 		newPBlock, err = fbo.getDirtyDirLocked(
-			ctx, lState, kmd, newParent, blockRead)
+			ctx, lState, kmd, newParent, blockRead,
+			defaultOnDemandRequestPriority)
 		if err != nil {
 			return nil, nil, DirEntry{}, nil, err
 		}
@@ -1757,6 +2900,21 @@ func (fbo *folderBlockOps) PrepRename(
 
 func (fbo *folderBlockOps) newFileData(lState *lockState,
 	file path, chargedTo keybase1.UserOrTeamID, kmd KeyMetadata) *fileData {
+	return fbo.newFileDataWithCachePolicy(
+		lState, file, chargedTo, kmd, CacheBlocks, false)
+}
+
+// newInternalFileData is like newFileData, but for internal
+// traversals of the file that must not trigger read notifications.
+func (fbo *folderBlockOps) newInternalFileData(lState *lockState,
+	file path, chargedTo keybase1.UserOrTeamID, kmd KeyMetadata) *fileData {
+	return fbo.newFileDataWithCachePolicy(
+		lState, file, chargedTo, kmd, CacheBlocks, true)
+}
+
+func (fbo *folderBlockOps) newFileDataWithCachePolicy(lState *lockState,
+	file path, chargedTo keybase1.UserOrTeamID, kmd KeyMetadata,
+	policy BlockCachePolicy, suppressNotify bool) *fileData {
 	fbo.blockLock.AssertAnyLocked(lState)
 	return newFileData(file, chargedTo, fbo.config.Crypto(),
 		fbo.config.BlockSplitter(), kmd,
@@ -1767,7 +2925,7 @@ func (fbo *folderBlockOps) newFileData(lState *lockState,
 				lState = nil
 			}
 			return fbo.getFileBlockLocked(
-				ctx, lState, kmd, ptr, file, rtype)
+				ctx, lState, kmd, ptr, file, suppressNotify, rtype, policy)
 		},
 		func(ptr BlockPointer, block Block) error {
 			return fbo.cacheBlockIfNotYetDirtyLocked(
@@ -1792,7 +2950,7 @@ func (fbo *folderBlockOps) newFileDataWithCache(lState *lockState,
 				lState = nil
 			}
 			return fbo.getFileBlockLocked(
-				ctx, lState, kmd, ptr, file, rtype)
+				ctx, lState, kmd, ptr, file, true, rtype, CacheBlocks)
 		},
 		func(ptr BlockPointer, block Block) error {
 			return dirtyBcache.Put(file.Tlf, ptr, file.Branch, block)
@@ -1805,48 +2963,154 @@ func (fbo *folderBlockOps) newFileDataWithCache(lState *lockState,
 func (fbo *folderBlockOps) Read(
 	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
 	dest []byte, off int64) (int64, error) {
+	return fbo.ReadWithCachePolicy(
+		ctx, lState, kmd, file, dest, off, CacheBlocks)
+}
+
+// ReadWithCachePolicy is like Read, but any blocks that need to be
+// fetched from the server are cached according to `policy`.  Blocks
+// that are already cached are used as usual.
+func (fbo *folderBlockOps) ReadWithCachePolicy(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
+	dest []byte, off int64, policy BlockCachePolicy) (int64, error) {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
 
 	filePath := fbo.nodeCache.PathFromNode(file)
+	if err := filePath.checkValid(); err != nil {
+		return 0, err
+	}
 
 	fbo.log.CDebugf(ctx, "Reading from %v", filePath.tailPointer())
 
 	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
-	fd := fbo.newFileData(lState, filePath, id, kmd)
+	fd := fbo.newFileDataWithCachePolicy(
+		lState, filePath, id, kmd, policy, false)
 	return fd.read(ctx, dest, off)
 }
 
-func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
-	ctx context.Context, lState *lockState, file Node,
-	c DirtyPermChan) error {
-	var errListener chan error
-	registerErr := func() error {
-		fbo.blockLock.Lock(lState)
-		defer fbo.blockLock.Unlock(lState)
-		filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
-		if err != nil {
-			return err
-		}
-		df := fbo.getOrCreateDirtyFileLocked(lState, filePath)
-		errListener = make(chan error, 1)
-		df.addErrListener(errListener)
-		return nil
-	}
-	err := registerErr()
-	if err != nil {
-		return err
-	}
+// ReadUntilBadBlock is like Read, but if one of the file's blocks
+// can't be fetched or decrypted (e.g., because it is corrupted), it
+// returns the data read successfully before that block, along with a
+// BadBlockReadError identifying it.  This lets a recovery tool
+// salvage the readable parts of a damaged file; Read itself returns
+// no data at all in that case.
+func (fbo *folderBlockOps) ReadUntilBadBlock(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
+	dest []byte, off int64) (int64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
 
-	logTimer := time.After(100 * time.Millisecond)
-	doLogUnblocked := false
-	for {
-		var err error
-		select {
-		case <-c:
-			if doLogUnblocked {
-				fbo.log.CDebugf(ctx, "Write unblocked")
-			}
+	filePath := fbo.nodeCache.PathFromNode(file)
+
+	fbo.log.CDebugf(ctx, "Reading until a bad block from %v",
+		filePath.tailPointer())
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, filePath, id, kmd)
+	return fd.readUntilBadBlock(ctx, dest, off)
+}
+
+// ReadWithBudget is like Read, but it reads from at most `maxBlocks`
+// leaf blocks of the file, to bound the work done for any one file
+// (e.g., by a tool scanning many files).  If the budget runs out
+// before `dest` is full, it returns the bytes read so far, and
+// `budgetExhausted` is true.
+func (fbo *folderBlockOps) ReadWithBudget(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
+	dest []byte, off int64, maxBlocks int) (
+	n int64, budgetExhausted bool, err error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	filePath := fbo.nodeCache.PathFromNode(file)
+
+	fbo.log.CDebugf(ctx, "Reading from %v with a budget of %d blocks",
+		filePath.tailPointer(), maxBlocks)
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, filePath, id, kmd)
+	return fd.readWithBudget(ctx, dest, off, maxBlocks)
+}
+
+// ReadBlocks returns up to `count` whole blocks of the given file,
+// starting with the block containing `startOff`.  Each returned block
+// is annotated with its starting offset in the file, and whether it
+// is a hole, so that callers can process the file block-aligned.
+func (fbo *folderBlockOps) ReadBlocks(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
+	startOff int64, count int) ([]blockAlignedData, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	filePath := fbo.nodeCache.PathFromNode(file)
+
+	fbo.log.CDebugf(ctx, "Reading blocks from %v", filePath.tailPointer())
+
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := fbo.newFileData(lState, filePath, id, kmd)
+	return fd.readBlocks(ctx, startOff, count)
+}
+
+func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
+	ctx context.Context, lState *lockState, file Node,
+	c DirtyPermChan) (retErr error) {
+	var errListener chan error
+	// createdDf is the dirty file created just to hold our error
+	// listener, if there wasn't one for this file already.
+	var createdDf *dirtyFile
+	registerErr := func() error {
+		fbo.blockLock.Lock(lState)
+		defer fbo.blockLock.Unlock(lState)
+		filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+		if err != nil {
+			return err
+		}
+		df := fbo.dirtyFiles[filePath.tailPointer()]
+		if df == nil {
+			df = fbo.getOrCreateDirtyFileLocked(lState, filePath)
+			createdDf = df
+		}
+		errListener = make(chan error, 1)
+		df.addErrListener(errListener)
+		return nil
+	}
+	// If we fail before being unblocked (e.g., `ctx` is canceled),
+	// don't leave behind any dirty state for the file that only
+	// existed for the sake of this wait.
+	defer func() {
+		if retErr == nil || errListener == nil {
+			return
+		}
+		fbo.blockLock.Lock(lState)
+		defer fbo.blockLock.Unlock(lState)
+		filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+		if err != nil {
+			return
+		}
+		ptr := filePath.tailPointer()
+		df := fbo.dirtyFiles[ptr]
+		if df == nil {
+			return
+		}
+		if df.removeErrListener(errListener) && df == createdDf {
+			delete(fbo.dirtyFiles, ptr)
+		}
+	}()
+	err := registerErr()
+	if err != nil {
+		return err
+	}
+
+	logTimer := time.After(100 * time.Millisecond)
+	doLogUnblocked := false
+	for {
+		var err error
+		select {
+		case <-c:
+			if doLogUnblocked {
+				fbo.log.CDebugf(ctx, "Write unblocked")
+			}
 			// Make sure there aren't any queued errors.
 			select {
 			case err = <-errListener:
@@ -1889,12 +3153,156 @@ func (fbo *folderBlockOps) maybeWaitOnDeferredWrites(
 	}
 }
 
+// unsyncedBytesLocked returns the number of bytes counted against
+// this folder's dirty byte limit: those dirtied but not yet synced,
+// and those reserved by writes in progress.
+func (fbo *folderBlockOps) unsyncedBytesLocked(lState *lockState) int64 {
+	fbo.blockLock.AssertAnyLocked(lState)
+	bytes := fbo.reservedDirtyBytes
+	for _, df := range fbo.dirtyFiles {
+		dirtyBytes, _ := df.getDirtyBytes()
+		bytes += dirtyBytes
+	}
+	return bytes
+}
+
+func (fbo *folderBlockOps) maxDirtyBytes() int64 {
+	if maxBytes := fbo.config.Tunables().MaxFolderDirtyBytes; maxBytes > 0 {
+		return maxBytes
+	}
+	return fbo.config.DirtyBlockCache().MaxUnsyncedBytes(fbo.id()) /
+		defaultMaxDirtyBytesDivisor
+}
+
+func (fbo *folderBlockOps) signalDirtyBytesDecreasedLocked(
+	lState *lockState) {
+	fbo.blockLock.AssertLocked(lState)
+	if fbo.dirtyBytesDecreased != nil {
+		close(fbo.dirtyBytesDecreased)
+		fbo.dirtyBytesDecreased = nil
+	}
+}
+
+// waitForFolderDirtyPermission waits until this folder has room for
+// `bytes` more unsynced bytes under its own dirty byte limit, forcing
+// a sync of the folder while it doesn't.  A folder without any
+// unsynced bytes always has room, so that a single big write can't
+// block forever.  On success, the caller is responsible for calling
+// `releaseFolderDirtyPermission` once it is done.
+func (fbo *folderBlockOps) waitForFolderDirtyPermission(
+	ctx context.Context, lState *lockState, bytes int64) error {
+	doLog := true
+	for {
+		decreased := func() <-chan struct{} {
+			fbo.blockLock.Lock(lState)
+			defer fbo.blockLock.Unlock(lState)
+			maxBytes := fbo.maxDirtyBytes()
+			unsynced := fbo.unsyncedBytesLocked(lState)
+			if maxBytes <= 0 || unsynced == 0 ||
+				unsynced+bytes <= maxBytes {
+				fbo.reservedDirtyBytes += bytes
+				return nil
+			}
+			if doLog {
+				fbo.log.CDebugf(ctx, "Blocking a write because of a full "+
+					"folder dirty buffer (%d unsynced bytes, limit %d)",
+					unsynced, maxBytes)
+				doLog = false
+			}
+			if fbo.dirtyBytesDecreased == nil {
+				fbo.dirtyBytesDecreased = make(chan struct{})
+			}
+			select {
+			// If we can't send on the channel, that means a sync
+			// is already in progress.
+			case fbo.forceSyncChan <- struct{}{}:
+			default:
+			}
+			return fbo.dirtyBytesDecreased
+		}()
+		if decreased == nil {
+			return nil
+		}
+
+		select {
+		case <-decreased:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (fbo *folderBlockOps) releaseFolderDirtyPermission(
+	lState *lockState, bytes int64) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	fbo.reservedDirtyBytes -= bytes
+	fbo.signalDirtyBytesDecreasedLocked(lState)
+}
+
+// waitForDirtyPermission asks for permission to dirty `bytes` more
+// bytes, first from this folder's own dirty byte limit and then from
+// the DirtyBlockCache, and waits until it is granted.  On success,
+// the caller is responsible for releasing those bytes with
+// `releaseDirtyPermission` once it is done.  On failure, the
+// permission is released on the caller's behalf, even if it is
+// granted only after this function returns, so the unsynced byte
+// accounting stays balanced.
+func (fbo *folderBlockOps) waitForDirtyPermission(
+	ctx context.Context, lState *lockState, file Node, bytes int64) (
+	err error) {
+	err = fbo.waitForFolderDirtyPermission(ctx, lState, bytes)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			fbo.releaseFolderDirtyPermission(lState, bytes)
+		}
+	}()
+
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	c, err := dirtyBcache.RequestPermissionToDirty(ctx, fbo.id(), bytes)
+	if err != nil {
+		return err
+	}
+	err = fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
+	if err == nil {
+		return nil
+	}
+
+	// The request might still be queued in the DirtyBlockCache, in
+	// which case its bytes will be counted as soon as it's granted.
+	// Release them only then.
+	release := func() {
+		dirtyBcache.UpdateUnsyncedBytes(fbo.id(), -bytes, false)
+	}
+	select {
+	case <-c:
+		release()
+	default:
+		go func() {
+			<-c
+			release()
+		}()
+	}
+	return err
+}
+
+// releaseDirtyPermission releases the `bytes` granted by a successful
+// call to `waitForDirtyPermission`.
+func (fbo *folderBlockOps) releaseDirtyPermission(
+	lState *lockState, bytes int64) {
+	fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(fbo.id(), -bytes, false)
+	fbo.releaseFolderDirtyPermission(lState, bytes)
+}
+
 func (fbo *folderBlockOps) pathFromNodeForBlockWriteLocked(
 	lState *lockState, n Node) (path, error) {
 	fbo.blockLock.AssertLocked(lState)
 	p := fbo.nodeCache.PathFromNode(n)
-	if !p.isValid() {
-		return path{}, InvalidPathError{p}
+	if err := p.checkValid(); err != nil {
+		return path{}, err
 	}
 	return p, nil
 }
@@ -1932,6 +3340,16 @@ func (fbo *folderBlockOps) writeDataLocked(
 	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
 	data []byte, off int64) (latestWrite WriteRange, dirtyPtrs []BlockPointer,
 	newlyDirtiedChildBytes int64, err error) {
+	return fbo.writeDataWithSplitterLocked(
+		ctx, lState, kmd, file, data, off, fbo.config.BlockSplitter())
+}
+
+// writeDataWithSplitterLocked is writeDataLocked, using the given
+// BlockSplitter to decide where new data is split into blocks.
+func (fbo *folderBlockOps) writeDataWithSplitterLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	data []byte, off int64, bsplit BlockSplitter) (latestWrite WriteRange,
+	dirtyPtrs []BlockPointer, newlyDirtiedChildBytes int64, err error) {
 	if jServer, err := GetJournalServer(fbo.config); err == nil {
 		jServer.dirtyOpStart(fbo.id())
 		defer jServer.dirtyOpEnd(fbo.id())
@@ -1944,6 +3362,11 @@ func (fbo *folderBlockOps) writeDataLocked(
 		fbo.log.CDebugf(ctx, "writeDataLocked done: %v", err)
 	}()
 
+	maxBytes := fbo.maxFileBytesLocked(lState)
+	if newSize := off + int64(len(data)); uint64(newSize) > maxBytes {
+		return WriteRange{}, nil, 0, FileTooBigError{file, newSize, maxBytes}
+	}
+
 	fblock, err := fbo.writeGetFileLocked(ctx, lState, kmd, file)
 	if err != nil {
 		return WriteRange{}, nil, 0, err
@@ -1956,23 +3379,16 @@ func (fbo *folderBlockOps) writeDataLocked(
 	}
 
 	fd := fbo.newFileData(lState, file, chargedTo, kmd)
+	fd.bsplit = bsplit
+	fd.maxBlockPlaintextSize = fbo.maxBlockPlaintextSize()
 
-	dirtyBcache := fbo.config.DirtyBlockCache()
 	df := fbo.getOrCreateDirtyFileLocked(lState, file)
 	defer func() {
 		// Always update unsynced bytes and potentially force a sync,
 		// even on an error, since the previously-dirty bytes stay in
 		// the cache.
 		df.updateNotYetSyncingBytes(newlyDirtiedChildBytes)
-		if dirtyBcache.ShouldForceSync(fbo.id()) {
-			select {
-			// If we can't send on the channel, that means a sync is
-			// already in progress.
-			case fbo.forceSyncChan <- struct{}{}:
-				fbo.log.CDebugf(ctx, "Forcing a sync due to full buffer")
-			default:
-			}
-		}
+		fbo.maybeForceSyncLocked(ctx, lState)
 	}()
 
 	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file, true)
@@ -2003,9 +3419,7 @@ func (fbo *folderBlockOps) writeDataLocked(
 	// files.  TODO: combine `deCache` with `dirtyFiles` and
 	// `unrefCache`.
 	cacheEntry := fbo.deCache[file.tailRef()]
-	now := fbo.nowUnixNano()
-	newDe.Mtime = now
-	newDe.Ctime = now
+	fbo.updateWriteTimes(&newDe)
 	cacheEntry.dirEntry = newDe
 	fbo.deCache[file.tailRef()] = cacheEntry
 
@@ -2018,26 +3432,162 @@ func (fbo *folderBlockOps) writeDataLocked(
 	return latestWrite, dirtyPtrs, newlyDirtiedChildBytes, nil
 }
 
+// writeDataWithLayoutLocked is like writeDataLocked, but if
+// `boundaries` is non-nil, a new block is started at `off` and at
+// each of the file offsets in `boundaries`, instead of letting the
+// configured BlockSplitter decide.  The boundaries must already have
+// been checked by checkBlockLayoutLocked.
+func (fbo *folderBlockOps) writeDataWithLayoutLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	data []byte, off int64, boundaries []int64) (latestWrite WriteRange,
+	dirtyPtrs []BlockPointer, newlyDirtiedChildBytes int64, err error) {
+	if boundaries == nil {
+		return fbo.writeDataLocked(ctx, lState, kmd, file, data, off)
+	}
+
+	bsplit := layoutBlockSplitter{fbo.config.BlockSplitter()}
+	ends := append(append([]int64(nil), boundaries...), off+int64(len(data)))
+	dirtyMap := make(map[BlockPointer]bool)
+	start := off
+	for _, end := range ends {
+		_, ptrs, bytes, err := fbo.writeDataWithSplitterLocked(
+			ctx, lState, kmd, file, data[start-off:end-off], start, bsplit)
+		newlyDirtiedChildBytes += bytes
+		if err != nil {
+			return WriteRange{}, nil, newlyDirtiedChildBytes, err
+		}
+		for _, ptr := range ptrs {
+			dirtyMap[ptr] = true
+		}
+		start = end
+	}
+
+	dirtyPtrs = make([]BlockPointer, 0, len(dirtyMap))
+	for ptr := range dirtyMap {
+		dirtyPtrs = append(dirtyPtrs, ptr)
+	}
+	latestWrite = WriteRange{Off: uint64(off), Len: uint64(len(data))}
+	return latestWrite, dirtyPtrs, newlyDirtiedChildBytes, nil
+}
+
+// checkBlockLayoutLocked makes sure that `boundaries` are strictly
+// increasing file offsets inside the data being written at `off`,
+// and that the write appends to the end of the file, since the
+// layout of existing blocks can't be changed.
+func (fbo *folderBlockOps) checkBlockLayoutLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	data []byte, off int64, boundaries []int64) error {
+	fbo.blockLock.AssertLocked(lState)
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file, true)
+	if err != nil {
+		return err
+	}
+	layoutErr := BlockLayoutError{off, len(data), boundaries, de.Size}
+	if uint64(off) != de.Size {
+		return layoutErr
+	}
+	prev := off
+	for _, b := range boundaries {
+		if b <= prev || b >= off+int64(len(data)) {
+			return layoutErr
+		}
+		prev = b
+	}
+	return nil
+}
+
+// WriteIsUnchanged returns true if writing `data` at `off` in `file`
+// would leave the file's contents byte-for-byte identical.  It only
+// compares against blocks that are already in the clean block cache,
+// and never fetches any; if any of the covered blocks isn't cached,
+// or if the file already has dirty blocks, it returns false and the
+// caller should do a normal write.
+func (fbo *folderBlockOps) WriteIsUnchanged(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file Node,
+	data []byte, off int64) (bool, error) {
+	if len(data) == 0 {
+		return false, nil
+	}
+
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	filePath := fbo.nodeCache.PathFromNode(file)
+	if err := filePath.checkValid(); err != nil {
+		return false, err
+	}
+	if fbo.config.DirtyBlockCache().IsDirty(
+		fbo.id(), filePath.tailPointer(), filePath.Branch) {
+		return false, nil
+	}
+
+	bcache := fbo.config.BlockCache()
+	var id keybase1.UserOrTeamID // Data reads don't depend on the id.
+	fd := newFileData(filePath, id, fbo.config.Crypto(),
+		fbo.config.BlockSplitter(), kmd,
+		func(ctx context.Context, kmd KeyMetadata, ptr BlockPointer,
+			file path, rtype blockReqType) (*FileBlock, bool, error) {
+			block, err := bcache.Get(ptr)
+			if err != nil {
+				return nil, false, err
+			}
+			fblock, ok := block.(*FileBlock)
+			if !ok {
+				return nil, false, NotFileBlockError{ptr, file.Branch, file}
+			}
+			return fblock, false, nil
+		},
+		func(ptr BlockPointer, block Block) error {
+			return nil
+		}, fbo.log)
+	existing := make([]byte, len(data))
+	n, err := fd.read(ctx, existing, off)
+	if err != nil {
+		fbo.log.CDebugf(ctx, "Can't compare write to %v with uncached "+
+			"data: %+v", filePath.tailPointer(), err)
+		return false, nil
+	}
+	return n == int64(len(data)) && bytes.Equal(existing, data), nil
+}
+
 // Write writes the given data to the given file. May block if there
 // is too much unflushed data; in that case, it will be unblocked by a
 // future sync.
 func (fbo *folderBlockOps) Write(
 	ctx context.Context, lState *lockState, kmd KeyMetadata,
 	file Node, data []byte, off int64) error {
+	return fbo.writeWithLayout(ctx, lState, kmd, file, data, off, nil)
+}
+
+// WriteWithLayout appends the given data to the given file, which
+// must currently end at `off`, starting a new block at `off` and at
+// each of the given file offsets, rather than splitting the data with
+// the configured BlockSplitter.  This lets a caller reproduce an
+// exact block layout, e.g. to restore a file so that it dedups
+// against its original blocks.  The layout survives the next sync as
+// long as the configured BlockSplitter's CheckSplit accepts the
+// resulting blocks, as BlockSplitterSimple always does.
+func (fbo *folderBlockOps) WriteWithLayout(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, data []byte, off int64, boundaries []int64) error {
+	if boundaries == nil {
+		boundaries = []int64{}
+	}
+	return fbo.writeWithLayout(
+		ctx, lState, kmd, file, data, off, boundaries)
+}
+
+func (fbo *folderBlockOps) writeWithLayout(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, data []byte, off int64, boundaries []int64) error {
 	// If there is too much unflushed data, we should wait until some
 	// of it gets flush so our memory usage doesn't grow without
 	// bound.
-	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(ctx,
-		fbo.id(), int64(len(data)))
-	if err != nil {
-		return err
-	}
-	defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(fbo.id(),
-		-int64(len(data)), false)
-	err = fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
+	err := fbo.waitForDirtyPermission(ctx, lState, file, int64(len(data)))
 	if err != nil {
 		return err
 	}
+	defer fbo.releaseDirtyPermission(lState, int64(len(data)))
 
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
@@ -2047,12 +3597,29 @@ func (fbo *folderBlockOps) Write(
 		return err
 	}
 
+	if boundaries != nil {
+		err := fbo.checkBlockLayoutLocked(
+			ctx, lState, kmd, filePath, data, off, boundaries)
+		if err != nil {
+			return err
+		}
+	}
+
 	defer func() {
 		fbo.doDeferWrite = false
 	}()
 
-	latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err := fbo.writeDataLocked(
-		ctx, lState, kmd, filePath, data, off)
+	// Remember the size the write saw, in case it needs to be
+	// replayed after a sync.
+	origSize, err := fbo.sizeForDeferredReplayLocked(
+		ctx, lState, kmd, filePath)
+	if err != nil {
+		return err
+	}
+
+	latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err :=
+		fbo.writeDataWithLayoutLocked(
+			ctx, lState, kmd, filePath, data, off, boundaries)
 	if err != nil {
 		return err
 	}
@@ -2070,23 +3637,36 @@ func (fbo *folderBlockOps) Write(
 		// the most obviously correct way.
 		dataCopy := make([]byte, len(data))
 		copy(dataCopy, data)
+		var boundariesCopy []int64
+		if boundaries != nil {
+			boundariesCopy = append([]int64{}, boundaries...)
+		}
 		fbo.log.CDebugf(ctx, "Deferring a write to file %v off=%d len=%d",
 			filePath.tailPointer(), off, len(data))
 		ds := fbo.deferred[filePath.tailRef()]
 		ds.dirtyDeletes = append(ds.dirtyDeletes, dirtyPtrs...)
-		ds.writes = append(ds.writes,
-			func(ctx context.Context, lState *lockState, kmd KeyMetadata, f path) error {
+		ds.writes = append(ds.writes, deferredWrite{
+			off:                    uint64(off),
+			newlyDirtiedChildBytes: newlyDirtiedChildBytes,
+			replay: func(ctx context.Context, lState *lockState, kmd KeyMetadata, f path) error {
 				// We are about to re-dirty these bytes, so mark that
 				// they will no longer be synced via the old file.
 				df := fbo.getOrCreateDirtyFileLocked(lState, filePath)
 				df.updateNotYetSyncingBytes(-newlyDirtiedChildBytes)
 
+				skip, err := fbo.deferredReplayOutOfBoundsLocked(
+					ctx, lState, kmd, f, uint64(off), origSize)
+				if err != nil || skip {
+					return err
+				}
+
 				// Write the data again.  We know this won't be
 				// deferred, so no need to check the new ptrs.
-				_, _, _, err = fbo.writeDataLocked(
-					ctx, lState, kmd, f, dataCopy, off)
+				_, _, _, err = fbo.writeDataWithLayoutLocked(
+					ctx, lState, kmd, f, dataCopy, off, boundariesCopy)
 				return err
-			})
+			},
+		})
 		ds.waitBytes += newlyDirtiedChildBytes
 		fbo.deferred[filePath.tailRef()] = ds
 	}
@@ -2094,12 +3674,45 @@ func (fbo *folderBlockOps) Write(
 	return nil
 }
 
+// SetSyncSplitHint makes the next sync of the given file split its
+// dirty data into leaf blocks of `targetBlockSize` bytes, rather than
+// along the boundaries chosen by the configured BlockSplitter.  For
+// example, bigger blocks reduce the block count of append-only logs.
+// The size is capped at the BlockSplitter's MaxSize.
+// The hint is kept with the file's dirty state, so it only takes
+// effect if the file is currently dirty, and is dropped once the
+// file is fully synced.  A non-positive size clears the hint.
+func (fbo *folderBlockOps) SetSyncSplitHint(
+	lState *lockState, file Node, targetBlockSize int64) error {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+	if err != nil {
+		return err
+	}
+
+	df := fbo.dirtyFiles[filePath.tailPointer()]
+	if df == nil {
+		return nil
+	}
+	if targetBlockSize < 0 {
+		targetBlockSize = 0
+	}
+	df.setSplitHint(targetBlockSize)
+	return nil
+}
+
 // truncateExtendLocked is called by truncateLocked to extend a file and
 // creates a hole.
 func (fbo *folderBlockOps) truncateExtendLocked(
 	ctx context.Context, lState *lockState, kmd KeyMetadata,
 	file path, size uint64, parentBlocks []parentBlockAndChildIndex) (
 	WriteRange, []BlockPointer, error) {
+	if maxBytes := fbo.maxFileBytesLocked(lState); size > maxBytes {
+		return WriteRange{}, nil, FileTooBigError{file, int64(size), maxBytes}
+	}
+
 	fblock, err := fbo.writeGetFileLocked(ctx, lState, kmd, file)
 	if err != nil {
 		return WriteRange{}, nil, err
@@ -2124,9 +3737,7 @@ func (fbo *folderBlockOps) truncateExtendLocked(
 		return WriteRange{}, nil, err
 	}
 	cacheEntry := fbo.deCache[file.tailRef()]
-	now := fbo.nowUnixNano()
-	newDe.Mtime = now
-	newDe.Ctime = now
+	fbo.updateWriteTimes(&newDe)
 	cacheEntry.dirEntry = newDe
 	fbo.deCache[file.tailRef()] = cacheEntry
 
@@ -2136,15 +3747,7 @@ func (fbo *folderBlockOps) truncateExtendLocked(
 	}
 	latestWrite := si.op.addTruncate(size)
 
-	if fbo.config.DirtyBlockCache().ShouldForceSync(fbo.id()) {
-		select {
-		// If we can't send on the channel, that means a sync is
-		// already in progress
-		case fbo.forceSyncChan <- struct{}{}:
-			fbo.log.CDebugf(ctx, "Forcing a sync due to full buffer")
-		default:
-		}
-	}
+	fbo.maybeForceSyncLocked(ctx, lState)
 
 	fbo.log.CDebugf(ctx, "truncateExtendLocked: done")
 	return latestWrite, dirtyPtrs, nil
@@ -2182,7 +3785,7 @@ func (fbo *folderBlockOps) truncateLocked(
 	}
 
 	currLen := int64(startOff) + int64(len(block.Contents))
-	if currLen+truncateExtendCutoffPoint < iSize {
+	if currLen+fbo.config.Tunables().TruncateExtendCutoff < iSize {
 		latestWrite, dirtyPtrs, err := fbo.truncateExtendLocked(
 			ctx, lState, kmd, file, uint64(iSize), parentBlocks)
 		if err != nil {
@@ -2214,8 +3817,23 @@ func (fbo *folderBlockOps) truncateLocked(
 		return nil, nil, 0, err
 	}
 
-	newDe, dirtyPtrs, unrefs, newlyDirtiedChildBytes, err := fd.truncateShrink(
-		ctx, size, fblock, de)
+	df := fbo.getOrCreateDirtyFileLocked(lState, file)
+	var newDe DirEntry
+	var dirtyPtrs []BlockPointer
+	var unrefs []BlockInfo
+	var newlyDirtiedChildBytes int64
+	if size == 0 && fblock.IsInd &&
+		!df.isBlockSyncing(file.tailPointer()) {
+		// Drop the whole indirect structure.  If the file is being
+		// synced, this truncate will be deferred anyway, so just
+		// do a normal shrink now and collapse the file on replay.
+		newDe, dirtyPtrs, unrefs, newlyDirtiedChildBytes, err =
+			fbo.truncateIndirectToZeroLocked(
+				ctx, lState, file, fd, fblock, de, df)
+	} else {
+		newDe, dirtyPtrs, unrefs, newlyDirtiedChildBytes, err =
+			fd.truncateShrink(ctx, size, fblock, de)
+	}
 	// Record the unrefs before checking the error so we remember the
 	// state of newly dirtied blocks.
 	si.unrefs = append(si.unrefs, unrefs...)
@@ -2224,45 +3842,280 @@ func (fbo *folderBlockOps) truncateLocked(
 	}
 
 	// Update dirtied bytes and unrefs regardless of error.
-	df := fbo.getOrCreateDirtyFileLocked(lState, file)
 	df.updateNotYetSyncingBytes(newlyDirtiedChildBytes)
 
 	latestWrite := si.op.addTruncate(size)
 	cacheEntry := fbo.deCache[file.tailRef()]
-	now := fbo.nowUnixNano()
-	newDe.Mtime = now
-	newDe.Ctime = now
+	fbo.updateWriteTimes(&newDe)
 	cacheEntry.dirEntry = newDe
 	fbo.deCache[file.tailRef()] = cacheEntry
 
+	fbo.maybeForceSyncLocked(ctx, lState)
+
 	return &latestWrite, dirtyPtrs, newlyDirtiedChildBytes, nil
 }
 
-// Truncate truncates or extends the given file to the given size.
-// May block if there is too much unflushed data; in that case, it
-// will be unblocked by a future sync.
-func (fbo *folderBlockOps) Truncate(
-	ctx context.Context, lState *lockState, kmd KeyMetadata,
-	file Node, size uint64) error {
-	// If there is too much unflushed data, we should wait until some
-	// of it gets flush so our memory usage doesn't grow without
-	// bound.
-	//
-	// Assume the whole remaining file will be dirty after this
-	// truncate.  TODO: try to figure out how many bytes actually will
-	// be dirtied ahead of time?
-	c, err := fbo.config.DirtyBlockCache().RequestPermissionToDirty(ctx,
-		fbo.id(), int64(size))
+// truncateIndirectToZeroLocked truncates the file with the given
+// indirect top block to zero bytes, turning the top block into an
+// empty direct block.  Every child block of the file is unreferenced
+// (the old top block itself is unreferenced by the next sync, like
+// for any other write), and any dirty child blocks are dropped from
+// the dirty cache.  It returns the same values as
+// fileData.truncateShrink.  The file must not be in the middle of a
+// sync.
+func (fbo *folderBlockOps) truncateIndirectToZeroLocked(
+	ctx context.Context, lState *lockState, file path, fd *fileData,
+	fblock *FileBlock, oldDe DirEntry, df *dirtyFile) (
+	newDe DirEntry, dirtyPtrs []BlockPointer, unrefs []BlockInfo,
+	newlyDirtiedChildBytes int64, err error) {
+	fbo.blockLock.AssertLocked(lState)
+	infos, err := fd.getIndirectFileBlockInfosWithTopBlock(ctx, fblock)
+	if err != nil {
+		return DirEntry{}, nil, nil, 0, err
+	}
+
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	for _, info := range infos {
+		// Blocks dirtied since the last sync were already
+		// unreferenced when they were first dirtied.
+		if info.EncodedSize != 0 {
+			unrefs = append(unrefs, info)
+		}
+		if !dirtyBcache.IsDirty(fbo.id(), info.BlockPointer, fbo.branch()) {
+			continue
+		}
+		if info.DirectType == DirectBlock && df.isBlockDirty(
+			info.BlockPointer) {
+			block, err := dirtyBcache.Get(
+				fbo.id(), info.BlockPointer, fbo.branch())
+			if err != nil {
+				return DirEntry{}, nil, unrefs, newlyDirtiedChildBytes, err
+			}
+			if fb, ok := block.(*FileBlock); ok {
+				newlyDirtiedChildBytes -= int64(len(fb.Contents))
+			}
+		}
+		df.setBlockOrphaned(info.BlockPointer, true)
+		err = dirtyBcache.Delete(fbo.id(), info.BlockPointer, fbo.branch())
+		if err != nil {
+			return DirEntry{}, nil, unrefs, newlyDirtiedChildBytes, err
+		}
+	}
+	fbo.log.CDebugf(ctx, "Truncating %v to zero unrefs %d child blocks",
+		file.tailPointer(), len(unrefs))
+
+	// `fblock` is already a writable copy of the top block.
+	fblock.IsInd = false
+	fblock.IPtrs = nil
+	fblock.Contents = nil
+	if err = fd.cacher(file.tailPointer(), fblock); err != nil {
+		return DirEntry{}, nil, unrefs, newlyDirtiedChildBytes, err
+	}
+
+	newDe = oldDe
+	newDe.EncodedSize = 0
+	newDe.Size = 0
+	return newDe, []BlockPointer{file.tailPointer()}, unrefs,
+		newlyDirtiedChildBytes, nil
+}
+
+// checkImportedBlocksLocked makes sure that `infos` and `offsets`
+// describe a sane layout of direct blocks for an empty file, and
+// returns the size the file will have once they're imported.
+func (fbo *folderBlockOps) checkImportedBlocksLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	de DirEntry, infos []BlockInfo, offsets []int64) (int64, error) {
+	fbo.blockLock.AssertLocked(lState)
+	if len(infos) == 0 || len(infos) != len(offsets) {
+		return 0, FileBlockImportError{file, fmt.Sprintf(
+			"got %d blocks and %d offsets", len(infos), len(offsets))}
+	}
+	if de.Size != 0 || fbo.dirtyFiles[file.tailPointer()] != nil {
+		return 0, FileBlockImportError{file, "file isn't empty"}
+	}
+	maxPtrs := fbo.config.BlockSplitter().MaxPtrsPerBlock()
+	if len(infos) > maxPtrs {
+		return 0, FileBlockImportError{file, fmt.Sprintf(
+			"%d blocks don't fit in one indirect block of %d pointers",
+			len(infos), maxPtrs)}
+	}
+	if offsets[0] != 0 {
+		return 0, FileBlockImportError{file, fmt.Sprintf(
+			"first block starts at offset %d", offsets[0])}
+	}
+	for i, info := range infos {
+		if !info.IsValid() || info.EncodedSize == 0 ||
+			info.DirectType == IndirectBlock {
+			return 0, FileBlockImportError{file, fmt.Sprintf(
+				"%v isn't a synced direct block", info)}
+		}
+		if i == 0 {
+			continue
+		}
+		gap := offsets[i] - offsets[i-1]
+		if gap <= 0 || gap > int64(infos[i-1].EncodedSize) {
+			return 0, FileBlockImportError{file, fmt.Sprintf(
+				"block %v can't hold the %d bytes before offset %d",
+				infos[i-1].BlockPointer, gap, offsets[i])}
+		}
+	}
+
+	// Only the last block's contents determine the file size.
+	last := infos[len(infos)-1]
+	lastBlock, _, err := fbo.getFileBlockLocked(
+		ctx, lState, kmd, last.BlockPointer, file, true, blockWrite,
+		CacheBlocks)
+	if err != nil {
+		return 0, err
+	}
+	if lastBlock.IsInd {
+		return 0, FileBlockImportError{file, fmt.Sprintf(
+			"%v isn't a direct block", last.BlockPointer)}
+	}
+	return offsets[len(offsets)-1] + int64(len(lastBlock.Contents)), nil
+}
+
+// ImportFileBlocks makes the given empty file consist of existing,
+// already-synced blocks, where the block described by `infos[i]`
+// starts at file offset `offsets[i]`.  The offsets must start at 0
+// and be strictly increasing.  No block data is uploaded: the next
+// sync of the file only adds a new reference to each of the blocks,
+// and commits the resulting metadata.
+func (fbo *folderBlockOps) ImportFileBlocks(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, infos []BlockInfo, offsets []int64) error {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
 	if err != nil {
 		return err
 	}
-	defer fbo.config.DirtyBlockCache().UpdateUnsyncedBytes(fbo.id(),
-		-int64(size), false)
-	err = fbo.maybeWaitOnDeferredWrites(ctx, lState, file, c)
+
+	fblock, err := fbo.writeGetFileLocked(ctx, lState, kmd, filePath)
 	if err != nil {
 		return err
 	}
 
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, filePath, true)
+	if err != nil {
+		return err
+	}
+
+	size, err := fbo.checkImportedBlocksLocked(
+		ctx, lState, kmd, filePath, de, infos, offsets)
+	if err != nil {
+		return err
+	}
+
+	si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
+	if err != nil {
+		return err
+	}
+
+	fblock.IsInd = true
+	fblock.Contents = nil
+	fblock.IPtrs = make([]IndirectFilePtr, len(infos))
+	for i, info := range infos {
+		fblock.IPtrs[i] = IndirectFilePtr{BlockInfo: info, Off: offsets[i]}
+	}
+	err = fbo.cacheBlockIfNotYetDirtyLocked(
+		lState, filePath.tailPointer(), filePath, fblock)
+	if err != nil {
+		return err
+	}
+	si.importedRefs = append(si.importedRefs, infos...)
+
+	cacheEntry := fbo.deCache[filePath.tailRef()]
+	newDe := de
+	newDe.Size = uint64(size)
+	fbo.updateWriteTimes(&newDe)
+	cacheEntry.dirEntry = newDe
+	fbo.deCache[filePath.tailRef()] = cacheEntry
+
+	latestWrite := si.op.addWrite(0, uint64(size))
+	fbo.observers.localChange(ctx, file, latestWrite)
+	return nil
+}
+
+// refImportedBlocksLocked gives each block imported into the file
+// by ImportFileBlocks, and still used by its top block, a new
+// reference, so that the file doesn't share its references with the
+// file the blocks came from.  The new references are added to the
+// server as part of `si.bps`, without putting any block data.
+func (fbo *folderBlockOps) refImportedBlocksLocked(
+	lState *lockState, md *RootMetadata, file path, fblock *FileBlock,
+	si *syncInfo, chargedTo keybase1.UserOrTeamID) error {
+	fbo.blockLock.AssertLocked(lState)
+	imported := make(map[BlockPointer]bool, len(si.importedRefs))
+	for _, info := range si.importedRefs {
+		imported[info.BlockPointer] = true
+	}
+
+	for i, iptr := range fblock.IPtrs {
+		if iptr.DirectType == IndirectBlock {
+			// A write added a level to the file since the import,
+			// so the imported pointers may have moved down.
+			return FileBlockImportError{
+				file, "file grew another level before its first sync"}
+		}
+		if !imported[iptr.BlockPointer] {
+			continue
+		}
+		newPtr := iptr.BlockPointer
+		var err error
+		newPtr.RefNonce, err = fbo.config.Crypto().MakeBlockRefNonce()
+		if err != nil {
+			return err
+		}
+		newPtr.SetWriter(chargedTo)
+		newInfo := BlockInfo{BlockPointer: newPtr, EncodedSize: iptr.EncodedSize}
+		fblock.IPtrs[i].BlockInfo = newInfo
+		si.bps.addNewBlock(newPtr, nil, ReadyBlockData{}, nil)
+		md.AddRefBlock(newInfo)
+	}
+
+	// Writes since the import may have replaced some imported
+	// blocks, but those references belong to the original file, so
+	// they must never be unreferenced on behalf of this one.
+	unrefs := si.unrefs[:0]
+	for _, unref := range si.unrefs {
+		if !imported[unref.BlockPointer] {
+			unrefs = append(unrefs, unref)
+		}
+	}
+	si.unrefs = unrefs
+	si.importedRefs = nil
+	return nil
+}
+
+// Truncate truncates or extends the given file to the given size.
+// May block if there is too much unflushed data; in that case, it
+// will be unblocked by a future sync.
+func (fbo *folderBlockOps) Truncate(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, size uint64) error {
+	// Reject a truncate past the max file size before asking for
+	// permission to dirty that many bytes, which might never be
+	// granted.
+	err := fbo.checkTruncateSize(lState, file, size)
+	if err != nil {
+		return err
+	}
+
+	// If there is too much unflushed data, we should wait until some
+	// of it gets flush so our memory usage doesn't grow without
+	// bound.
+	//
+	// Assume the whole remaining file will be dirty after this
+	// truncate.  TODO: try to figure out how many bytes actually will
+	// be dirtied ahead of time?
+	err = fbo.waitForDirtyPermission(ctx, lState, file, int64(size))
+	if err != nil {
+		return err
+	}
+	defer fbo.releaseDirtyPermission(lState, int64(size))
+
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
 
@@ -2275,6 +4128,14 @@ func (fbo *folderBlockOps) Truncate(
 		fbo.doDeferWrite = false
 	}()
 
+	// Remember the size the truncate saw, in case it needs to be
+	// replayed after a sync.
+	origSize, err := fbo.sizeForDeferredReplayLocked(
+		ctx, lState, kmd, filePath)
+	if err != nil {
+		return err
+	}
+
 	latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err := fbo.truncateLocked(
 		ctx, lState, kmd, filePath, size)
 	if err != nil {
@@ -2294,19 +4155,236 @@ func (fbo *folderBlockOps) Truncate(
 			filePath.tailPointer())
 		ds := fbo.deferred[filePath.tailRef()]
 		ds.dirtyDeletes = append(ds.dirtyDeletes, dirtyPtrs...)
-		ds.writes = append(ds.writes,
-			func(ctx context.Context, lState *lockState, kmd KeyMetadata, f path) error {
+		fbo.dropTruncatedDeferredWritesLocked(
+			ctx, lState, filePath, &ds, size)
+		ds.writes = append(ds.writes, deferredWrite{
+			off:                    size,
+			newlyDirtiedChildBytes: newlyDirtiedChildBytes,
+			replay: func(ctx context.Context, lState *lockState, kmd KeyMetadata, f path) error {
 				// We are about to re-dirty these bytes, so mark that
 				// they will no longer be synced via the old file.
 				df := fbo.getOrCreateDirtyFileLocked(lState, filePath)
 				df.updateNotYetSyncingBytes(-newlyDirtiedChildBytes)
 
+				skip, err := fbo.deferredReplayOutOfBoundsLocked(
+					ctx, lState, kmd, f, size, origSize)
+				if err != nil || skip {
+					return err
+				}
+
 				// Truncate the file again.  We know this won't be
 				// deferred, so no need to check the new ptrs.
-				_, _, _, err := fbo.truncateLocked(
+				_, _, _, err = fbo.truncateLocked(
 					ctx, lState, kmd, f, size)
 				return err
-			})
+			},
+		})
+		ds.waitBytes += newlyDirtiedChildBytes
+		fbo.deferred[filePath.tailRef()] = ds
+	}
+
+	return nil
+}
+
+// punchHoleLocked deallocates the part of the byte range
+// `[off, off+length)` that is within the file, leaving the file's
+// size unchanged.  Returns the set of newly-ID'd blocks dirtied
+// during this punch that might need to be cleaned up if the punch is
+// deferred.
+func (fbo *folderBlockOps) punchHoleLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file path, off, length int64) (*WriteRange, []BlockPointer, int64, error) {
+	if jServer, err := GetJournalServer(fbo.config); err == nil {
+		jServer.dirtyOpStart(fbo.id())
+		defer jServer.dirtyOpEnd(fbo.id())
+	}
+
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file, true)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	endOff := int64(de.Size)
+	if length < endOff-off {
+		endOff = off + length
+	}
+	if off >= endOff {
+		// Nothing to punch.
+		return nil, nil, 0, nil
+	}
+
+	fblock, err := fbo.writeGetFileLocked(ctx, lState, kmd, file)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	chargedTo, err := chargedToForTLF(
+		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), kmd.GetTlfHandle())
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	fd := fbo.newFileData(lState, file, chargedTo, kmd)
+
+	si, err := fbo.getOrCreateSyncInfoLocked(lState, de)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	df := fbo.getOrCreateDirtyFileLocked(lState, file)
+	newDe, dirtyPtrs, unrefs, newlyDirtiedChildBytes, dropped, err :=
+		fd.punchHole(ctx, off, endOff-off, fblock, de)
+	// Record the unrefs before checking the error so we remember the
+	// state of newly dirtied blocks.
+	si.unrefs = append(si.unrefs, unrefs...)
+	if err != nil {
+		return nil, nil, newlyDirtiedChildBytes, err
+	}
+
+	// The dropped blocks are no longer part of the file, so any dirty
+	// data they hold must not be synced.  Blocks in the middle of a
+	// sync are left to it; the deferred punch will drop them again.
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	for _, ptr := range dropped {
+		if df.isBlockSyncing(ptr) ||
+			!dirtyBcache.IsDirty(fbo.id(), ptr, fbo.branch()) {
+			continue
+		}
+		if df.isBlockDirty(ptr) {
+			block, err := dirtyBcache.Get(fbo.id(), ptr, fbo.branch())
+			if err != nil {
+				return nil, nil, newlyDirtiedChildBytes, err
+			}
+			if fb, ok := block.(*FileBlock); ok {
+				newlyDirtiedChildBytes -= int64(len(fb.Contents))
+			}
+		}
+		df.setBlockOrphaned(ptr, true)
+		err = dirtyBcache.Delete(fbo.id(), ptr, fbo.branch())
+		if err != nil {
+			return nil, nil, newlyDirtiedChildBytes, err
+		}
+	}
+
+	df.updateNotYetSyncingBytes(newlyDirtiedChildBytes)
+
+	latestWrite := si.op.addWrite(uint64(off), uint64(endOff-off))
+	cacheEntry := fbo.deCache[file.tailRef()]
+	fbo.updateWriteTimes(&newDe)
+	cacheEntry.dirEntry = newDe
+	fbo.deCache[file.tailRef()] = cacheEntry
+
+	fbo.maybeForceSyncLocked(ctx, lState)
+
+	return &latestWrite, dirtyPtrs, newlyDirtiedChildBytes, nil
+}
+
+// punchHoleDirtyBytes estimates how many bytes punching the given
+// hole could dirty: only the leaf blocks that the hole covers
+// partially get zeroed, so that's at most two blocks' worth, and
+// never more than the part of the hole within the file.
+func (fbo *folderBlockOps) punchHoleDirtyBytes(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, off, length int64) (int64, error) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	filePath := fbo.nodeCache.PathFromNode(file)
+	if err := filePath.checkValid(); err != nil {
+		return 0, err
+	}
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, filePath, true)
+	if err != nil {
+		return 0, err
+	}
+
+	bytes := int64(de.Size) - off
+	if bytes < 0 {
+		return 0, nil
+	}
+	if length < bytes {
+		bytes = length
+	}
+	maxBytes := 2 * fbo.maxBlockPlaintextSize()
+	if maxBytes < bytes {
+		bytes = maxBytes
+	}
+	return bytes, nil
+}
+
+// PunchHole deallocates the byte range `[off, off+length)` of the
+// given file, like fallocate's FALLOC_FL_PUNCH_HOLE: the range reads
+// back as zeroes, the leaf blocks that were entirely inside it are
+// unreferenced on the next sync, and the file's size doesn't change.
+// The part of the range past the end of the file is ignored.  May
+// block if there is too much unflushed data; in that case, it will
+// be unblocked by a future sync.
+func (fbo *folderBlockOps) PunchHole(
+	ctx context.Context, lState *lockState, kmd KeyMetadata,
+	file Node, off, length int64) error {
+	if off < 0 || length < 0 {
+		return fmt.Errorf("Invalid hole off=%d len=%d", off, length)
+	}
+
+	dirtyBytes, err := fbo.punchHoleDirtyBytes(
+		ctx, lState, kmd, file, off, length)
+	if err != nil {
+		return err
+	}
+	err = fbo.waitForDirtyPermission(ctx, lState, file, dirtyBytes)
+	if err != nil {
+		return err
+	}
+	defer fbo.releaseDirtyPermission(lState, dirtyBytes)
+
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		fbo.doDeferWrite = false
+	}()
+
+	latestWrite, dirtyPtrs, newlyDirtiedChildBytes, err :=
+		fbo.punchHoleLocked(ctx, lState, kmd, filePath, off, length)
+	if err != nil {
+		return err
+	}
+
+	if latestWrite != nil {
+		fbo.observers.localChange(ctx, file, *latestWrite)
+	}
+
+	if fbo.doDeferWrite {
+		// There's an ongoing sync, and this punch altered dirty
+		// blocks that are in the process of syncing.  So, we have
+		// to redo it once the sync is complete, using the new file
+		// path.
+		fbo.log.CDebugf(ctx, "Deferring a hole punch to file %v "+
+			"off=%d len=%d", filePath.tailPointer(), off, length)
+		ds := fbo.deferred[filePath.tailRef()]
+		ds.dirtyDeletes = append(ds.dirtyDeletes, dirtyPtrs...)
+		ds.writes = append(ds.writes, deferredWrite{
+			off:                    uint64(off),
+			newlyDirtiedChildBytes: newlyDirtiedChildBytes,
+			replay: func(ctx context.Context, lState *lockState, kmd KeyMetadata, f path) error {
+				// We are about to re-dirty these bytes, so mark that
+				// they will no longer be synced via the old file.
+				df := fbo.getOrCreateDirtyFileLocked(lState, filePath)
+				df.updateNotYetSyncingBytes(-newlyDirtiedChildBytes)
+
+				// Punch the hole again; any part of it that has been
+				// truncated away in the meantime is skipped.  We
+				// know this won't be deferred, so no need to check
+				// the new ptrs.
+				_, _, _, err := fbo.punchHoleLocked(
+					ctx, lState, kmd, f, off, length)
+				return err
+			},
+		})
 		ds.waitBytes += newlyDirtiedChildBytes
 		fbo.deferred[filePath.tailRef()] = ds
 	}
@@ -2319,6 +4397,11 @@ func (fbo *folderBlockOps) Truncate(
 func (fbo *folderBlockOps) IsDirty(lState *lockState, file path) bool {
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
+	return fbo.isDirtyLocked(lState, file)
+}
+
+func (fbo *folderBlockOps) isDirtyLocked(lState *lockState, file path) bool {
+	fbo.blockLock.AssertAnyLocked(lState)
 	// Definitely dirty if a block is dirty.
 	if fbo.config.DirtyBlockCache().IsDirty(
 		fbo.id(), file.tailPointer(), file.Branch) {
@@ -2340,6 +4423,7 @@ func (fbo *folderBlockOps) clearCacheInfoLocked(lState *lockState,
 	ref := file.tailRef()
 	delete(fbo.deCache, ref)
 	delete(fbo.unrefCache, ref)
+	fbo.clearDirListingsLocked(lState)
 	df := fbo.dirtyFiles[file.tailPointer()]
 	if df != nil {
 		err := df.finishSync()
@@ -2347,10 +4431,48 @@ func (fbo *folderBlockOps) clearCacheInfoLocked(lState *lockState,
 			return err
 		}
 		delete(fbo.dirtyFiles, file.tailPointer())
+		fbo.signalDirtyBytesDecreasedLocked(lState)
 	}
 	return nil
 }
 
+// EstimateSyncCost returns a cheap estimate of how much data a sync
+// of the given file would write, by counting its dirty leaf blocks
+// and summing their plaintext sizes from the DirtyBlockCache.
+// Nothing is fetched or readied.  Deferred writes are applied to the
+// dirty copies of their blocks, so any deferred bytes that the sync
+// will assimilate are already included in the sum.
+func (fbo *folderBlockOps) EstimateSyncCost(
+	lState *lockState, file path) (blocks int, bytes int64) {
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
+
+	// All dirty blocks are local, and any dirty block's parents are
+	// dirty too, so only dirty blocks need to be walked.
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	var estimate func(ptr BlockPointer)
+	estimate = func(ptr BlockPointer) {
+		block, err := dirtyBcache.Get(fbo.id(), ptr, file.Branch)
+		if err != nil {
+			return
+		}
+		fblock, ok := block.(*FileBlock)
+		if !ok {
+			return
+		}
+		if !fblock.IsInd {
+			blocks++
+			bytes += int64(len(fblock.Contents))
+			return
+		}
+		for _, iptr := range fblock.IPtrs {
+			estimate(iptr.BlockPointer)
+		}
+	}
+	estimate(file.tailPointer())
+	return blocks, bytes
+}
+
 // ClearCacheInfo removes any cached info for the the given file.
 func (fbo *folderBlockOps) ClearCacheInfo(lState *lockState, file path) error {
 	fbo.blockLock.Lock(lState)
@@ -2358,6 +4480,208 @@ func (fbo *folderBlockOps) ClearCacheInfo(lState *lockState, file path) error {
 	return fbo.clearCacheInfoLocked(lState, file)
 }
 
+// ClearCacheInfoIfClean removes any cached info for the given file,
+// but only if the file isn't dirty.  It returns whether the file was
+// clean.  Checking and clearing happen under the same lock, so no
+// concurrent write can be dropped in between.
+func (fbo *folderBlockOps) ClearCacheInfoIfClean(
+	lState *lockState, file path) (bool, error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	if fbo.isDirtyLocked(lState, file) {
+		return false, nil
+	}
+	return true, fbo.clearCacheInfoLocked(lState, file)
+}
+
+// ReconcileDirEntries drops the cached dirty entries for the children
+// of `dir` that already match the entries committed in `dir`'s
+// directory block as of `kmd`.  Such stale entries can outlive the
+// sync that committed them, and would otherwise keep masking the
+// committed state (and keep the file looking dirty).  Entries for
+// files with dirty blocks, files in the middle of a sync, and
+// directories with pending changes are left alone.  It returns the
+// names of the children whose entries were cleared.
+func (fbo *folderBlockOps) ReconcileDirEntries(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, dir path) (
+	reconciled []string, err error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	dblock, err := fbo.getDirLocked(
+		ctx, lState, kmd, dir, blockRead, defaultOnDemandRequestPriority)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, committedDe := range dblock.Children {
+		ref := committedDe.Ref()
+		cacheEntry, ok := fbo.deCache[ref]
+		if !ok || len(cacheEntry.adds) > 0 || len(cacheEntry.dels) > 0 ||
+			len(cacheEntry.addedSyms) > 0 {
+			continue
+		}
+		if fbo.dirtyFiles[committedDe.BlockPointer] != nil ||
+			fbo.unrefCache[ref] != nil ||
+			fbo.config.DirtyBlockCache().IsDirty(
+				fbo.id(), committedDe.BlockPointer, dir.Branch) {
+			continue
+		}
+		cachedDe := cacheEntry.dirEntry
+		if cachedDe.BlockInfo != committedDe.BlockInfo ||
+			cachedDe.EntryInfo != committedDe.EntryInfo {
+			continue
+		}
+		fbo.log.CDebugf(ctx, "Clearing committed cached entry for %s "+
+			"in %v", name, dir.tailPointer())
+		delete(fbo.deCache, ref)
+		reconciled = append(reconciled, name)
+	}
+	if len(reconciled) > 0 {
+		fbo.clearDirListingsLocked(lState)
+	}
+	return reconciled, nil
+}
+
+// DiscardAllDirtyState throws away all of the local, unsynced changes
+// in this TLF: the cached info for every dirty file and directory,
+// any deferred writes, and the dirty blocks backing them in the
+// DirtyBlockCache.  Nodes for new entries that were never synced are
+// unlinked.  It returns the changes that observers must be notified
+// about for the nodes whose dirty state was dropped.  The caller
+// must ensure no sync is in progress, e.g. by holding mdWriterLock.
+func (fbo *folderBlockOps) DiscardAllDirtyState(
+	ctx context.Context, lState *lockState) (changes []NodeChange, err error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	changes = fbo.discardChangesLocked(ctx, lState)
+
+	dirtyBcache := fbo.config.DirtyBlockCache()
+	deleteDirty := func(ptr BlockPointer) {
+		if err := dirtyBcache.Delete(fbo.id(), ptr, fbo.branch()); err != nil {
+			fbo.log.CDebugf(ctx, "Couldn't delete dirty block %v: %+v",
+				ptr, err)
+		}
+	}
+
+	for _, df := range fbo.dirtyFiles {
+		for _, ptr := range df.getBlockPtrs() {
+			deleteDirty(ptr)
+		}
+		err := fbo.clearCacheInfoLocked(lState, df.path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, ds := range fbo.deferred {
+		for _, ptr := range ds.dirtyDeletes {
+			deleteDirty(ptr)
+		}
+	}
+	// Newly-created entries may have dirty blocks that were never
+	// written to as files, like new directories.
+	for _, dece := range fbo.deCache {
+		if dece.dirEntry.IsInitialized() {
+			deleteDirty(dece.dirEntry.BlockPointer)
+		}
+		for _, ptr := range dece.adds {
+			deleteDirty(ptr)
+		}
+	}
+
+	fbo.dirtyFiles = make(map[BlockPointer]*dirtyFile)
+	fbo.deferred = make(map[BlockRef]deferredState)
+	fbo.unrefCache = make(map[BlockRef]*syncInfo)
+	fbo.deCache = make(map[BlockRef]deCacheEntry)
+	fbo.doDeferWrite = false
+	fbo.clearDirListingsLocked(lState)
+	return changes, nil
+}
+
+// discardChangesLocked unlinks the nodes of all new entries that were
+// never synced, and returns the changes for all the other nodes
+// whose dirty state is about to be dropped: directories with added or
+// removed entries, and files with unsynced writes or attributes.
+func (fbo *folderBlockOps) discardChangesLocked(
+	ctx context.Context, lState *lockState) (changes []NodeChange) {
+	fbo.blockLock.AssertLocked(lState)
+	if fbo.nodeCache == nil {
+		return nil
+	}
+
+	newRefs := make(map[BlockRef]bool)
+	for _, dece := range fbo.deCache {
+		for _, ptr := range dece.adds {
+			newRefs[ptr.Ref()] = true
+		}
+	}
+
+	changed := make(map[BlockRef]int)
+	addChange := func(ref BlockRef) *NodeChange {
+		if newRefs[ref] {
+			return nil
+		}
+		if i, ok := changed[ref]; ok {
+			return &changes[i]
+		}
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			return nil
+		}
+		changed[ref] = len(changes)
+		changes = append(changes, NodeChange{Node: node})
+		return &changes[len(changes)-1]
+	}
+	addFileChange := func(ref BlockRef) {
+		change := addChange(ref)
+		if change != nil && len(change.FileUpdated) == 0 {
+			change.FileUpdated = []WriteRange{{Len: 0, Off: 0}}
+		}
+	}
+
+	for ref, dece := range fbo.deCache {
+		if len(dece.adds) == 0 && len(dece.dels) == 0 &&
+			len(dece.addedSyms) == 0 {
+			if !dece.dirEntry.IsInitialized() {
+				continue
+			} else if dece.dirEntry.Type == Dir {
+				addChange(ref)
+			} else {
+				addFileChange(ref)
+			}
+			continue
+		}
+		change := addChange(ref)
+		if change == nil {
+			continue
+		}
+		for name := range dece.adds {
+			change.DirUpdated = append(change.DirUpdated, name)
+		}
+		for name := range dece.dels {
+			change.DirUpdated = append(change.DirUpdated, name)
+		}
+		for name := range dece.addedSyms {
+			change.DirUpdated = append(change.DirUpdated, name)
+		}
+	}
+	for _, df := range fbo.dirtyFiles {
+		addFileChange(df.path.tailRef())
+	}
+
+	for ref := range newRefs {
+		node := fbo.nodeCache.Get(ref)
+		if node == nil {
+			continue
+		}
+		p := fbo.nodeCache.PathFromNode(node)
+		fbo.log.CDebugf(ctx, "Unlinking never-synced node %s", p)
+		fbo.nodeCache.Unlink(ref, p, fbo.deCache[ref].dirEntry)
+	}
+	return changes
+}
+
 // revertSyncInfoAfterRecoverableError updates the saved sync info to
 // include all the blocks from before the error, except for those that
 // have encountered recoverable block errors themselves.
@@ -2410,33 +4734,78 @@ func (fbo *folderBlockOps) revertSyncInfoAfterRecoverableError(
 	}
 }
 
+// checkEncodedBlockSize makes sure a readied block's encoded size can
+// be recorded in a BlockInfo, which only has room for a uint32, so
+// that a huge size doesn't get silently truncated.
+func checkEncodedBlockSize(
+	id kbfsblock.ID, encodedSize int64, plainSize int) error {
+	if encodedSize < 0 || encodedSize > math.MaxUint32 {
+		return BlockEncodedSizeError{id, encodedSize, plainSize}
+	}
+	return nil
+}
+
 // ReadyBlock is a thin wrapper around BlockOps.Ready() that handles
-// checking for duplicates.
+// checking for duplicates.  For public TLFs, a duplicate of a known
+// block isn't encrypted again, and so the returned plainSize is 0 and
+// the returned ReadyBlockData is empty (only a new reference to the
+// known block needs to be put).
 func ReadyBlock(ctx context.Context, bcache BlockCache, bops BlockOps,
 	crypto cryptoPure, kmd KeyMetadata, block Block,
 	chargedTo keybase1.UserOrTeamID, bType keybase1.BlockType) (
 	info BlockInfo, plainSize int, readyBlockData ReadyBlockData, err error) {
 	var ptr BlockPointer
-	directType := IndirectBlock
 	if fBlock, ok := block.(*FileBlock); ok && !fBlock.IsInd {
-		directType = DirectBlock
 		// first see if we are duplicating any known blocks in this folder
 		ptr, err = bcache.CheckForKnownPtr(kmd.TlfID(), fBlock)
 		if err != nil {
 			return
 		}
-	} else if dBlock, ok := block.(*DirBlock); ok {
-		if dBlock.IsInd {
-			panic("Indirect directory blocks aren't supported yet")
-		}
-		// TODO: support indirect directory blocks.
+	}
+	return readyBlockWithKnownPtr(
+		ctx, bcache, bops, crypto, kmd, block, chargedTo, bType, ptr)
+}
+
+// readyBlockWithKnownPtr is like ReadyBlock, but takes the result of
+// a previous duplicate check for the block.  `ptr` should be
+// uninitialized if the block isn't a known duplicate.
+func readyBlockWithKnownPtr(ctx context.Context, bcache BlockCache,
+	bops BlockOps, crypto cryptoPure, kmd KeyMetadata, block Block,
+	chargedTo keybase1.UserOrTeamID, bType keybase1.BlockType,
+	ptr BlockPointer) (
+	info BlockInfo, plainSize int, readyBlockData ReadyBlockData, err error) {
+	directType := IndirectBlock
+	if fBlock, ok := block.(*FileBlock); ok && !fBlock.IsInd {
 		directType = DirectBlock
+	} else if dBlock, ok := block.(*DirBlock); ok && !dBlock.IsInd {
+		directType = DirectBlock
+	}
+
+	// Public TLF blocks are always encrypted with the same key, so a
+	// duplicate of a known block will have exactly the same encoded
+	// size as the original, and we can skip encrypting it again.
+	var encodedSize int
+	if ptr.IsInitialized() && kmd.TlfID().Type() == tlf.Public {
+		if known, err := bcache.Get(ptr); err == nil {
+			encodedSize = int(known.GetEncodedSize())
+		}
 	}
 
-	// Ready the block, even in the case where we can reuse an
-	// existing block, just so that we know what the size of the
-	// encrypted data will be.
-	bid, plainSize, readyBlockData, err := bops.Ready(ctx, kmd, block)
+	var bid kbfsblock.ID
+	if encodedSize > 0 {
+		block.SetEncodedSize(uint32(encodedSize))
+	} else {
+		// Ready the block, even in the case where we can reuse an
+		// existing block, just so that we know what the size of the
+		// encrypted data will be.
+		bid, plainSize, readyBlockData, err = bops.Ready(ctx, kmd, block)
+		if err != nil {
+			return
+		}
+		encodedSize = readyBlockData.GetEncodedSize()
+	}
+
+	err = checkEncodedBlockSize(bid, int64(encodedSize), plainSize)
 	if err != nil {
 		return
 	}
@@ -2450,10 +4819,16 @@ func ReadyBlock(ctx context.Context, bcache BlockCache, bops BlockOps,
 		// In case we're deduping an old pointer with an unknown block type.
 		ptr.DirectType = directType
 	} else {
+		// The block's encoding may need a newer data version than
+		// its structure does.
+		dataVer := block.DataVersion()
+		if readyBlockData.dataVer > dataVer {
+			dataVer = readyBlockData.dataVer
+		}
 		ptr = BlockPointer{
 			ID:         bid,
 			KeyGen:     kmd.LatestKeyGeneration(),
-			DataVer:    block.DataVersion(),
+			DataVer:    dataVer,
 			DirectType: directType,
 			Context:    kbfsblock.MakeFirstContext(chargedTo, bType),
 		}
@@ -2461,7 +4836,7 @@ func ReadyBlock(ctx context.Context, bcache BlockCache, bops BlockOps,
 
 	info = BlockInfo{
 		BlockPointer: ptr,
-		EncodedSize:  uint32(readyBlockData.GetEncodedSize()),
+		EncodedSize:  uint32(encodedSize),
 	}
 	return
 }
@@ -2503,6 +4878,72 @@ type fileSyncState struct {
 	//
 	// TODO: This can be a list of IDs instead.
 	newIndirectFileBlockPtrs []BlockPointer
+
+	// pinnedPtrs is a list of clean blocks in the file's parent
+	// path that are pinned in the block cache until the sync
+	// finishes, successfully or not.
+	pinnedPtrs []BlockPointer
+
+	// syncID tags the log lines for every phase of this sync.  It
+	// may be empty if no ID could be generated.
+	syncID string
+}
+
+// CtxSyncTagKey is the type used for unique context tags within a
+// single file sync.
+type CtxSyncTagKey int
+
+const (
+	// CtxSyncIDKey is the type of the tag for unique file sync IDs.
+	CtxSyncIDKey CtxSyncTagKey = iota
+)
+
+// CtxSyncOpID is the display name for the unique file sync ID tag.
+const CtxSyncOpID = "SYNCID"
+
+// ctxWithSyncID returns a context tagged with the given sync ID, so
+// that all the log lines from one file sync can be correlated.
+func ctxWithSyncID(ctx context.Context, syncID string) context.Context {
+	if syncID == "" {
+		return ctx
+	}
+	if id, ok := ctx.Value(CtxSyncIDKey).(string); ok && id == syncID {
+		return ctx
+	}
+	return NewContextReplayable(ctx, func(ctx context.Context) context.Context {
+		logTags := make(logger.CtxLogTags)
+		logTags[CtxSyncIDKey] = CtxSyncOpID
+		newCtx := logger.NewContextWithLogTags(ctx, logTags)
+		return context.WithValue(newCtx, CtxSyncIDKey, syncID)
+	})
+}
+
+// checkSyncTopBlockTypeLocked makes sure that the IsInd flag of the
+// top block of a file about to be synced agrees with the file's dirty
+// state: an indirect block must have children, and a direct block
+// can't have any dirty child blocks tracked for it.
+func (fbo *folderBlockOps) checkSyncTopBlockTypeLocked(ctx context.Context,
+	lState *lockState, file path, fblock *FileBlock) error {
+	fbo.blockLock.AssertLocked(lState)
+
+	var expectedIndirect bool
+	if fblock.IsInd {
+		if len(fblock.IPtrs) > 0 {
+			return nil
+		}
+		expectedIndirect = false
+	} else {
+		df := fbo.dirtyFiles[file.tailPointer()]
+		if df == nil || !df.hasChildBlocks() {
+			return nil
+		}
+		expectedIndirect = true
+	}
+
+	fbo.log.CErrorf(ctx, "Top block for %v has the wrong type "+
+		"(indirect=%t)", file.tailPointer(), fblock.IsInd)
+	return FileBlockTypeMismatchError{
+		file.tailPointer(), file, expectedIndirect}
 }
 
 // startSyncWrite contains the portion of StartSync() that's done
@@ -2512,8 +4953,13 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 	lState *lockState, md *RootMetadata, file path) (
 	fblock *FileBlock, bps *blockPutState, syncState fileSyncState,
 	dirtyDe *DirEntry, err error) {
+	if err := file.checkValid(); err != nil {
+		return nil, nil, syncState, nil, err
+	}
+
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
+	fbo.writesSinceSync = 0
 
 	// update the parent directories, and write all the new blocks out
 	// to disk
@@ -2529,6 +4975,21 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 			fmt.Errorf("No syncOp found for file ref %v", fileRef)
 	}
 
+	// A file with a sync op must have a dirty top block; if it
+	// doesn't, syncing now would silently drop its dirty data.
+	if !fbo.config.DirtyBlockCache().IsDirty(
+		fbo.id(), file.tailPointer(), fbo.branch()) {
+		fbo.log.CErrorf(ctx, "Dirty top block for %v is missing",
+			file.tailPointer())
+		return nil, nil, syncState, nil,
+			DirtyBlockMissingError{file.tailPointer(), file}
+	}
+
+	err = fbo.checkSyncTopBlockTypeLocked(ctx, lState, file, fblock)
+	if err != nil {
+		return nil, nil, syncState, nil, err
+	}
+
 	// Collapse the write range to reduce the size of the sync op.
 	si.op.Writes = si.op.collapseWriteRange(nil)
 	// If this function returns a success, we need to make sure the op
@@ -2553,6 +5014,12 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 		return nil, nil, syncState, nil, err
 	}
 
+	// The parent directories will be read again once the new file
+	// pointers are ready, so don't let cache pressure from the
+	// block puts evict them in the meantime.
+	syncState.pinnedPtrs = fbo.pinCleanBlocksLocked(
+		lState, *file.parentPath())
+
 	if si.bps == nil {
 		si.bps = newBlockPutState(1)
 	} else {
@@ -2570,15 +5037,74 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 		si.unrefBytes = md.UnrefBytes()
 	}()
 
+	df := fbo.getOrCreateDirtyFileLocked(lState, file)
+	if !fblock.IsInd && len(fblock.Contents) == 0 &&
+		len(si.importedRefs) == 0 {
+		// An empty direct file has no child blocks to split, ready
+		// or import, so only its top block needs to be synced.
+		atomic.AddInt64(&fbo.emptyFileSyncs, 1)
+	} else {
+		err = fbo.startSyncWriteChildrenLocked(
+			ctx, lState, md, file, fblock, si, df, &syncState)
+		if err != nil {
+			return nil, nil, syncState, nil, err
+		}
+	}
+
+	err = df.setBlockSyncing(file.tailPointer())
+	if err != nil {
+		return nil, nil, syncState, nil, err
+	}
+	syncState.oldFileBlockPtrs = append(
+		syncState.oldFileBlockPtrs, file.tailPointer())
+
+	// Capture the current de before we release the block lock, so
+	// other deferred writes don't slip in.
+	if de, ok := fbo.deCache[fileRef]; ok {
+		dirtyDe = &de.dirEntry
+	}
+
+	// Leave a copy of the syncOp in `unrefCache`, since it may be
+	// modified by future local writes while the syncOp in `md` should
+	// only be modified by the rest of this sync process.
+	var syncOpCopy *syncOp
+	err = kbfscodec.Update(fbo.config.Codec(), &syncOpCopy, si.op)
+	if err != nil {
+		return nil, nil, syncState, nil, err
+	}
+	fbo.unrefCache[fileRef].op = syncOpCopy
+
+	// If there are any deferred bytes, it must be because this is
+	// a retried sync and some blocks snuck in between sync. Those
+	// blocks will get transferred now, but they are also on the
+	// deferred list and will be retried on the next sync as well.
+	df.assimilateDeferredNewBytes()
+
+	// TODO: Returning si.bps in this way is racy, since si is a
+	// member of unrefCache.
+	return fblock, si.bps, syncState, dirtyDe, nil
+}
+
+// startSyncWriteChildrenLocked splits and readies the child blocks
+// of the file being synced by startSyncWrite, and records their new
+// and old pointers in `syncState`.
+func (fbo *folderBlockOps) startSyncWriteChildrenLocked(
+	ctx context.Context, lState *lockState, md *RootMetadata, file path,
+	fblock *FileBlock, si *syncInfo, df *dirtyFile,
+	syncState *fileSyncState) error {
+	fbo.blockLock.AssertLocked(lState)
+
 	chargedTo, err := chargedToForTLF(
 		ctx, fbo.config.KBPKI(), fbo.config.KBPKI(), md.GetTlfHandle())
 	if err != nil {
-		return nil, nil, syncState, nil, err
+		return err
 	}
 
 	dirtyBcache := fbo.config.DirtyBlockCache()
-	df := fbo.getOrCreateDirtyFileLocked(lState, file)
-	fd := fbo.newFileData(lState, file, chargedTo, md.ReadOnly())
+	fd := fbo.newInternalFileData(lState, file, chargedTo, md.ReadOnly())
+	if hint := df.getSplitHint(); hint > 0 {
+		fd.bsplit = newSplitHintBlockSplitter(fd.bsplit, hint)
+	}
 
 	// Note: below we add possibly updated file blocks as "unref" and
 	// "ref" blocks.  This is fine, since conflict resolution or
@@ -2592,14 +5118,23 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 		md.AddUnrefBlock(unref)
 	}
 	if err != nil {
-		return nil, nil, syncState, nil, err
+		return err
 	}
 
 	// Ready all children blocks, if any.
 	oldPtrs, err := fd.ready(ctx, fbo.id(), fbo.config.BlockCache(),
 		fbo.config.DirtyBlockCache(), fbo.config.BlockOps(), si.bps, fblock, df)
 	if err != nil {
-		return nil, nil, syncState, nil, err
+		return err
+	}
+	fbo.recordBlockSizesLocked(lState, si.bps, oldPtrs)
+
+	if len(si.importedRefs) > 0 {
+		err = fbo.refImportedBlocksLocked(
+			lState, md, file, fblock, si, chargedTo)
+		if err != nil {
+			return err
+		}
 	}
 
 	for newInfo, oldPtr := range oldPtrs {
@@ -2621,43 +5156,11 @@ func (fbo *folderBlockOps) startSyncWrite(ctx context.Context,
 
 		err = df.setBlockSyncing(oldPtr)
 		if err != nil {
-			return nil, nil, syncState, nil, err
+			return err
 		}
 		syncState.redirtyOnRecoverableError[newInfo.BlockPointer] = oldPtr
 	}
-
-	err = df.setBlockSyncing(file.tailPointer())
-	if err != nil {
-		return nil, nil, syncState, nil, err
-	}
-	syncState.oldFileBlockPtrs = append(
-		syncState.oldFileBlockPtrs, file.tailPointer())
-
-	// Capture the current de before we release the block lock, so
-	// other deferred writes don't slip in.
-	if de, ok := fbo.deCache[fileRef]; ok {
-		dirtyDe = &de.dirEntry
-	}
-
-	// Leave a copy of the syncOp in `unrefCache`, since it may be
-	// modified by future local writes while the syncOp in `md` should
-	// only be modified by the rest of this sync process.
-	var syncOpCopy *syncOp
-	err = kbfscodec.Update(fbo.config.Codec(), &syncOpCopy, si.op)
-	if err != nil {
-		return nil, nil, syncState, nil, err
-	}
-	fbo.unrefCache[fileRef].op = syncOpCopy
-
-	// If there are any deferred bytes, it must be because this is
-	// a retried sync and some blocks snuck in between sync. Those
-	// blocks will get transferred now, but they are also on the
-	// deferred list and will be retried on the next sync as well.
-	df.assimilateDeferredNewBytes()
-
-	// TODO: Returning si.bps in this way is racy, since si is a
-	// member of unrefCache.
-	return fblock, si.bps, syncState, dirtyDe, nil
+	return nil
 }
 
 func (fbo *folderBlockOps) makeLocalBcache(ctx context.Context,
@@ -2669,7 +5172,8 @@ func (fbo *folderBlockOps) makeLocalBcache(ctx context.Context,
 	parentPath := file.parentPath()
 
 	dblock, err := fbo.getDirLocked(
-		ctx, lState, md.ReadOnly(), *parentPath, blockWrite)
+		ctx, lState, md.ReadOnly(), *parentPath, blockWrite,
+		defaultOnDemandRequestPriority)
 	if err != nil {
 		return nil, err
 	}
@@ -2717,11 +5221,28 @@ func (fbo *folderBlockOps) StartSync(ctx context.Context,
 		jServer.dirtyOpStart(fbo.id())
 	}
 
+	syncID, idErr := MakeRandomRequestID()
+	if idErr != nil {
+		fbo.log.CWarningf(ctx, "Couldn't generate a sync ID: %v", idErr)
+	}
+	ctx = ctxWithSyncID(ctx, syncID)
+
 	fblock, bps, syncState, dirtyDe, err := fbo.startSyncWrite(
 		ctx, lState, md, file)
+	syncState.syncID = syncID
 	if err != nil {
+		fbo.log.CDebugf(ctx, "Couldn't start sync of %v: %+v",
+			file.tailPointer(), err)
 		return nil, nil, nil, syncState, err
 	}
+	if bps != nil {
+		var bytes int
+		for _, bs := range bps.blockStates {
+			bytes += bs.readyBlockData.GetEncodedSize()
+		}
+		fbo.log.CDebugf(ctx, "Started sync of %v: %d blocks, %d bytes",
+			file.tailPointer(), len(bps.blockStates), bytes)
+	}
 
 	lbc, err = fbo.makeLocalBcache(ctx, lState, md, file, syncState.si,
 		dirtyDe)
@@ -2742,16 +5263,31 @@ func (fbo *folderBlockOps) CleanupSyncState(
 		defer jServer.dirtyOpEnd(fbo.id())
 	}
 
+	fbo.unpinBlocks(result.pinnedPtrs)
 	if err == nil {
 		return
 	}
 
+	ctx = ctxWithSyncID(ctx, result.syncID)
+	fbo.log.CDebugf(ctx, "Cleaning up failed sync of %v: %+v",
+		file.tailPointer(), err)
+	if isRecoverableBlockError(err) {
+		atomic.AddInt64(&fbo.recoverableSyncErrors, 1)
+	} else {
+		atomic.AddInt64(&fbo.fatalSyncErrors, 1)
+	}
+
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
 
 	// Notify error listeners before we reset the dirty blocks and
-	// permissions to be granted.
-	fbo.notifyErrListenersLocked(lState, file.tailPointer(), err)
+	// permissions to be granted.  Recoverable errors are hidden from
+	// them, unless this file's syncs keep hitting them.
+	notifyErr := err
+	if isRecoverableBlockError(err) {
+		notifyErr = fbo.checkSyncErrorBudgetLocked(ctx, lState, file, err)
+	}
+	fbo.notifyErrListenersLocked(lState, file.tailPointer(), notifyErr)
 
 	// If there was an error, we need to back out any changes that
 	// might have been filled into the sync op, because it could
@@ -2770,9 +5306,16 @@ func (fbo *folderBlockOps) CleanupSyncState(
 		}
 		if result.fblock != nil {
 			result.fblock.Set(result.savedFblock)
-			fbo.fixChildBlocksAfterRecoverableErrorLocked(
+			fixErr := fbo.fixChildBlocksAfterRecoverableErrorLocked(
 				ctx, lState, file, md,
 				result.redirtyOnRecoverableError)
+			if fixErr != nil {
+				// The file can't be recovered, so make sure any
+				// blocked writers hear about it, even though the
+				// original error was recoverable.
+				fbo.notifyErrListenersLocked(
+					lState, file.tailPointer(), fixErr)
+			}
 		}
 	} else {
 		// Since the sync has errored out unrecoverably, the deferred
@@ -2811,6 +5354,162 @@ func (fbo *folderBlockOps) CleanupSyncState(
 	}
 }
 
+// SetSyncRecoverableErrorBudget sets the number of recoverable errors
+// that syncs of a single dirty file may hit before they are surfaced
+// to the file's blocked writers as a SyncErrorBudgetExceededError.
+// A non-positive budget restores the default.
+func (fbo *folderBlockOps) SetSyncRecoverableErrorBudget(
+	lState *lockState, budget int) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	if budget < 0 {
+		budget = 0
+	}
+	fbo.syncRecoverableErrorBudget = budget
+}
+
+// SetMaxFileBytes limits the plaintext size of the files in this
+// folder to `maxBytes`, e.g. for a folder shared with users who have
+// little quota.  Writes and truncates past the limit fail with
+// FileTooBigError.  A limit of 0 restores the config's MaxFileBytes.
+func (fbo *folderBlockOps) SetMaxFileBytes(
+	lState *lockState, maxBytes uint64) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	fbo.maxFileBytes = maxBytes
+}
+
+// SetMaxSearchDepth bounds how many directory levels below the root
+// SearchForNodes and SearchForPaths descend into, so that a search
+// through a deeply-nested set of updates can't hold blockLock for
+// too long.  Pointers that live deeper than that are left unresolved.
+// A depth of 0 removes the bound.
+func (fbo *folderBlockOps) SetMaxSearchDepth(lState *lockState, depth int) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	if depth < 0 {
+		depth = 0
+	}
+	fbo.maxSearchDepth = depth
+}
+
+// SetForceSyncPolicy sets the conditions under which this folder
+// forces a sync of its dirty files, on top of the global heuristic
+// of the dirty block cache.  The zero policy leaves it up to the
+// dirty block cache alone.
+func (fbo *folderBlockOps) SetForceSyncPolicy(
+	lState *lockState, policy ForceSyncPolicy) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	fbo.forceSyncPolicy = policy
+}
+
+// forceSyncReasonLocked returns a description of why a sync should
+// be forced, if either the dirty block cache or this folder's
+// force-sync policy says it's time for one, or "" otherwise.
+func (fbo *folderBlockOps) forceSyncReasonLocked(lState *lockState) string {
+	fbo.blockLock.AssertAnyLocked(lState)
+	if fbo.config.DirtyBlockCache().ShouldForceSync(fbo.id()) {
+		return "full dirty buffer"
+	}
+
+	policy := fbo.forceSyncPolicy
+	if policy.Writes > 0 && fbo.writesSinceSync >= policy.Writes {
+		return fmt.Sprintf("%d writes since the last sync (policy: %d)",
+			fbo.writesSinceSync, policy.Writes)
+	}
+	if policy.DirtyBytes > 0 {
+		var dirtyBytes int64
+		for _, df := range fbo.dirtyFiles {
+			dirtyBytes += df.getNotYetSyncingBytes()
+		}
+		if dirtyBytes >= policy.DirtyBytes {
+			return fmt.Sprintf("%d dirty bytes (policy: %d)",
+				dirtyBytes, policy.DirtyBytes)
+		}
+	}
+	return ""
+}
+
+// maybeForceSyncLocked should be called after every write or
+// truncate, and kicks off a sync if one is needed.
+func (fbo *folderBlockOps) maybeForceSyncLocked(
+	ctx context.Context, lState *lockState) {
+	fbo.blockLock.AssertLocked(lState)
+	fbo.writesSinceSync++
+	reason := fbo.forceSyncReasonLocked(lState)
+	if reason == "" {
+		return
+	}
+	select {
+	// If we can't send on the channel, that means a sync is
+	// already in progress.
+	case fbo.forceSyncChan <- struct{}{}:
+		fbo.log.CDebugf(ctx, "Forcing a sync due to %s", reason)
+	default:
+	}
+}
+
+// checkTruncateSize returns a FileTooBigError if `size` is bigger
+// than the max file size.
+func (fbo *folderBlockOps) checkTruncateSize(
+	lState *lockState, file Node, size uint64) error {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+	maxBytes := fbo.maxFileBytesLocked(lState)
+	if size <= maxBytes {
+		return nil
+	}
+	filePath, err := fbo.pathFromNodeForBlockWriteLocked(lState, file)
+	if err != nil {
+		return err
+	}
+	return FileTooBigError{filePath, int64(size), maxBytes}
+}
+
+func (fbo *folderBlockOps) maxFileBytesLocked(lState *lockState) uint64 {
+	fbo.blockLock.AssertAnyLocked(lState)
+	if fbo.maxFileBytes > 0 {
+		return fbo.maxFileBytes
+	}
+	return fbo.config.MaxFileBytes()
+}
+
+// maxBlockPlaintextSize returns the largest plaintext size of any
+// file block written in this folder.  Writes fail with
+// BlockPlaintextTooBigError if a block would end up bigger, instead
+// of failing later when the block is put.
+func (fbo *folderBlockOps) maxBlockPlaintextSize() int64 {
+	if n := fbo.config.Tunables().MaxBlockPlaintextSize; n > 0 {
+		return n
+	}
+	return fbo.config.BlockSplitter().MaxSize()
+}
+
+// checkSyncErrorBudgetLocked counts a recoverable sync error `err`
+// against the given file's budget.  It returns `err` if the file is
+// still within its budget, and otherwise returns a non-recoverable
+// error wrapping it.
+func (fbo *folderBlockOps) checkSyncErrorBudgetLocked(
+	ctx context.Context, lState *lockState, file path, err error) error {
+	fbo.blockLock.AssertLocked(lState)
+	df := fbo.dirtyFiles[file.tailPointer()]
+	if df == nil {
+		return err
+	}
+	budget := fbo.syncRecoverableErrorBudget
+	if budget == 0 {
+		budget = defaultSyncRecoverableErrorBudget
+	}
+	numErrors := df.incRecoverableSyncErrors()
+	if numErrors <= budget {
+		return err
+	}
+	fbo.log.CWarningf(ctx, "Sync of %v has hit %d recoverable errors",
+		file.tailPointer(), numErrors)
+	return SyncErrorBudgetExceededError{file.tailPointer(), numErrors, err}
+}
+
 // cleanUpUnusedBlocks cleans up the blocks from any previous failed
 // sync attempts.
 func (fbo *folderBlockOps) cleanUpUnusedBlocks(ctx context.Context,
@@ -2879,6 +5578,88 @@ func (fbo *folderBlockOps) cleanUpUnusedBlocks(ctx context.Context,
 	return nil
 }
 
+// dropTruncatedDeferredWritesLocked removes any deferred writes and
+// truncates in `ds` for `file` that are made moot by a truncate of
+// the file to `size`, because they only touch bytes at or beyond
+// `size`.  Without this, they would be replayed after the sync only
+// to be truncated away again, and could end up pointing at blocks
+// that no longer exist by then.  The dirty block deletes queued by
+// those operations are kept, since the blocks they dirtied are
+// stale either way, and might be shared with other operations.
+func (fbo *folderBlockOps) dropTruncatedDeferredWritesLocked(
+	ctx context.Context, lState *lockState, file path,
+	ds *deferredState, size uint64) {
+	fbo.blockLock.AssertLocked(lState)
+	writes := ds.writes[:0]
+	for _, dw := range ds.writes {
+		if dw.off < size {
+			writes = append(writes, dw)
+			continue
+		}
+		fbo.log.CDebugf(ctx, "Dropping deferred write at off=%d on %v, "+
+			"which is being truncated to size %d",
+			dw.off, file.tailPointer(), size)
+		// The replay would have un-counted these bytes before
+		// re-dirtying them, so do that now instead.
+		df := fbo.getOrCreateDirtyFileLocked(lState, file)
+		df.updateNotYetSyncingBytes(-dw.newlyDirtiedChildBytes)
+		ds.waitBytes -= dw.newlyDirtiedChildBytes
+	}
+	ds.writes = writes
+}
+
+// sizeForDeferredReplayLocked returns the current size of `file`, to
+// be passed to deferredReplayOutOfBoundsLocked if the write or
+// truncate about to be applied gets deferred.  That can only happen
+// while the file is being synced, so otherwise it returns 0 without
+// looking up the file's entry, which could mean fetching its parent
+// directory block.
+func (fbo *folderBlockOps) sizeForDeferredReplayLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path) (
+	uint64, error) {
+	fbo.blockLock.AssertLocked(lState)
+	df := fbo.dirtyFiles[file.tailPointer()]
+	if df == nil {
+		return 0, nil
+	}
+	if !df.isSyncing() {
+		return 0, nil
+	}
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file, true)
+	if err != nil {
+		return 0, err
+	}
+	return de.Size, nil
+}
+
+// deferredReplayOutOfBoundsLocked returns true if a deferred write
+// or truncate targeting `off` shouldn't be replayed on `file`,
+// because `off` was within the file when the operation was first
+// applied (when the file had size `origSize`), but is now past the
+// end of the file.  That can only happen if the region was truncated
+// away in the meantime, and replaying the operation would bring it
+// back as a hole.
+func (fbo *folderBlockOps) deferredReplayOutOfBoundsLocked(
+	ctx context.Context, lState *lockState, kmd KeyMetadata, file path,
+	off, origSize uint64) (bool, error) {
+	fbo.blockLock.AssertLocked(lState)
+	if off > origSize {
+		// The operation extended the file with a hole to begin with.
+		return false, nil
+	}
+	de, err := fbo.getDirtyEntryLocked(ctx, lState, kmd, file, true)
+	if err != nil {
+		return false, err
+	}
+	if off <= de.Size {
+		return false, nil
+	}
+	fbo.log.CWarningf(ctx, "Skipping deferred replay at off=%d on %v, "+
+		"which was truncated to size %d (from %d)",
+		off, file.tailPointer(), de.Size, origSize)
+	return true, nil
+}
+
 func (fbo *folderBlockOps) doDeferredWritesLocked(ctx context.Context,
 	lState *lockState, kmd KeyMetadata, oldPath, newPath path) (
 	stillDirty bool, err error) {
@@ -2900,8 +5681,8 @@ func (fbo *folderBlockOps) doDeferredWritesLocked(ctx context.Context,
 		}
 	}
 
-	for _, f := range ds.writes {
-		err = f(ctx, lState, kmd, newPath)
+	for _, dw := range ds.writes {
+		err = dw.replay(ctx, lState, kmd, newPath)
 		if err != nil {
 			// It's a little weird to return an error from a deferred
 			// write here. Hopefully that will never happen.
@@ -2911,6 +5692,27 @@ func (fbo *folderBlockOps) doDeferredWritesLocked(ctx context.Context,
 	return stillDirty, nil
 }
 
+// ReplayDeferredWrites re-applies any writes and truncates that were
+// deferred for `file` while it was being synced, this time directly
+// on top of `file`, and forgets them.  It's meant for when that sync
+// was abandoned, but the local edits made during it should be kept
+// against the current head, so `file` should be valid in `md` and its
+// dirty state should already have been reset to match `md`.  Dirty
+// blocks created by the deferred operations are removed from the
+// dirty block cache before the operations are replayed.  It returns
+// true if any operations were replayed, in which case the file is
+// now dirty.
+func (fbo *folderBlockOps) ReplayDeferredWrites(
+	ctx context.Context, lState *lockState, md KeyMetadata, file path) (
+	stillDirty bool, err error) {
+	fbo.blockLock.Lock(lState)
+	defer fbo.blockLock.Unlock(lState)
+
+	fbo.log.CDebugf(ctx, "Replaying deferred writes for %v",
+		file.tailPointer())
+	return fbo.doDeferredWritesLocked(ctx, lState, md, file, file)
+}
+
 // FinishSyncLocked finishes the sync process for a file, given the
 // state from StartSync. Specifically, it re-applies any writes that
 // happened since the call to StartSync.
@@ -2921,6 +5723,10 @@ func (fbo *folderBlockOps) FinishSyncLocked(
 	stillDirty bool, err error) {
 	fbo.blockLock.AssertLocked(lState)
 
+	ctx = ctxWithSyncID(ctx, syncState.syncID)
+	fbo.log.CDebugf(ctx, "Finishing sync of %v (now %v)",
+		oldPath.tailPointer(), newPath.tailPointer())
+
 	dirtyBcache := fbo.config.DirtyBlockCache()
 	for _, ptr := range syncState.oldFileBlockPtrs {
 		fbo.log.CDebugf(ctx, "Deleting dirty ptr %v", ptr)
@@ -2997,19 +5803,27 @@ func (e searchWithOutOfDateCacheError) Error() string {
 // set of BlockPointers that are being searched for, and nodeMap is
 // updated in place to include the corresponding discovered nodes.
 //
-// Returns the number of nodes found by this invocation.  If the error
-// it returns is searchWithOutOfDateCache, the search should be
-// retried by the caller with a clean cache.
+// `depth` is the number of levels currDir is below the root.  If
+// maxDepth is positive, the search doesn't descend into directories
+// more than maxDepth levels below the root.
+//
+// Returns the number of nodes found by this invocation, and whether
+// the search skipped any updated directory because of maxDepth.  If
+// the error it returns is searchWithOutOfDateCache, the search should
+// be retried by the caller with a clean cache.
 func (fbo *folderBlockOps) searchForNodesInDirLocked(ctx context.Context,
 	lState *lockState, cache NodeCache, newPtrs map[BlockPointer]bool,
 	kmd KeyMetadata, rootNode Node, currDir path, nodeMap map[BlockPointer]Node,
-	numNodesFoundSoFar int) (int, error) {
+	numNodesFoundSoFar int, depth int, maxDepth int) (
+	numNodesFound int, depthExceeded bool, err error) {
 	fbo.blockLock.AssertAnyLocked(lState)
 
+	// This is a background traversal, so don't let it delay
+	// interactive directory fetches.
 	dirBlock, err := fbo.getDirLocked(
-		ctx, lState, kmd, currDir, blockRead)
+		ctx, lState, kmd, currDir, blockRead, backgroundRequestPriority)
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
 
 	// getDirLocked may have unlocked blockLock, which means the cache
@@ -3019,14 +5833,13 @@ func (fbo *folderBlockOps) searchForNodesInDirLocked(ctx context.Context,
 	// the caller know they should retry with a fresh cache.
 	if currDir.path[0].BlockPointer !=
 		cache.PathFromNode(rootNode).tailPointer() {
-		return 0, searchWithOutOfDateCacheError{}
+		return 0, false, searchWithOutOfDateCacheError{}
 	}
 
 	if numNodesFoundSoFar >= len(nodeMap) {
-		return 0, nil
+		return 0, false, nil
 	}
 
-	numNodesFound := 0
 	for name, de := range dirBlock.Children {
 		if _, ok := nodeMap[de.BlockPointer]; ok {
 			childPath := currDir.ChildPath(name, de.BlockPointer)
@@ -3044,39 +5857,44 @@ func (fbo *folderBlockOps) searchForNodesInDirLocked(ctx context.Context,
 				}
 				n, err = cache.GetOrCreate(pn.BlockPointer, pn.Name, n)
 				if err != nil {
-					return 0, err
+					return 0, false, err
 				}
 			}
 			nodeMap[de.BlockPointer] = n
 			numNodesFound++
 			if numNodesFoundSoFar+numNodesFound >= len(nodeMap) {
-				return numNodesFound, nil
+				return numNodesFound, depthExceeded, nil
 			}
 		}
 
 		// otherwise, recurse if this represents an updated block
 		if _, ok := newPtrs[de.BlockPointer]; de.Type == Dir && ok {
+			if maxDepth > 0 && depth >= maxDepth {
+				depthExceeded = true
+				continue
+			}
 			childPath := currDir.ChildPath(name, de.BlockPointer)
-			n, err := fbo.searchForNodesInDirLocked(ctx, lState, cache,
-				newPtrs, kmd, rootNode, childPath, nodeMap,
-				numNodesFoundSoFar+numNodesFound)
+			n, exceeded, err := fbo.searchForNodesInDirLocked(ctx, lState,
+				cache, newPtrs, kmd, rootNode, childPath, nodeMap,
+				numNodesFoundSoFar+numNodesFound, depth+1, maxDepth)
 			if err != nil {
-				return 0, err
+				return 0, false, err
 			}
 			numNodesFound += n
+			depthExceeded = depthExceeded || exceeded
 			if numNodesFoundSoFar+numNodesFound >= len(nodeMap) {
-				return numNodesFound, nil
+				return numNodesFound, depthExceeded, nil
 			}
 		}
 	}
 
-	return numNodesFound, nil
+	return numNodesFound, depthExceeded, nil
 }
 
 func (fbo *folderBlockOps) trySearchWithCacheLocked(ctx context.Context,
 	lState *lockState, cache NodeCache, ptrs []BlockPointer,
-	newPtrs map[BlockPointer]bool, kmd KeyMetadata, rootPtr BlockPointer) (
-	map[BlockPointer]Node, error) {
+	newPtrs map[BlockPointer]bool, kmd KeyMetadata, rootPtr BlockPointer,
+	maxDepth int) (map[BlockPointer]Node, bool, error) {
 	fbo.blockLock.AssertAnyLocked(lState)
 
 	nodeMap := make(map[BlockPointer]Node)
@@ -3085,7 +5903,7 @@ func (fbo *folderBlockOps) trySearchWithCacheLocked(ctx context.Context,
 	}
 
 	if len(ptrs) == 0 {
-		return nodeMap, nil
+		return nodeMap, false, nil
 	}
 
 	var node Node
@@ -3122,7 +5940,7 @@ func (fbo *folderBlockOps) trySearchWithCacheLocked(ctx context.Context,
 		// Root node should already exist if we have an up-to-date md.
 		node = cache.Get(rootPtr.Ref())
 		if node == nil {
-			return nil, searchWithOutOfDateCacheError{}
+			return nil, false, searchWithOutOfDateCacheError{}
 		}
 	} else {
 		// Root node may or may not exist.
@@ -3130,12 +5948,12 @@ func (fbo *folderBlockOps) trySearchWithCacheLocked(ctx context.Context,
 		node, err = cache.GetOrCreate(rootPtr,
 			string(kmd.GetTlfHandle().GetCanonicalName()), nil)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 	}
 	if node == nil {
-		return nil, fmt.Errorf("Cannot find root node corresponding to %v",
-			rootPtr)
+		return nil, false, fmt.Errorf(
+			"Cannot find root node corresponding to %v", rootPtr)
 	}
 
 	// are they looking for the root directory?
@@ -3144,39 +5962,40 @@ func (fbo *folderBlockOps) trySearchWithCacheLocked(ctx context.Context,
 		nodeMap[rootPtr] = node
 		numNodesFound++
 		if numNodesFound >= len(nodeMap) {
-			return nodeMap, nil
+			return nodeMap, false, nil
 		}
 	}
 
 	rootPath := cache.PathFromNode(node)
 	if len(rootPath.path) != 1 {
-		return nil, fmt.Errorf("Invalid root path for %v: %s",
+		return nil, false, fmt.Errorf("Invalid root path for %v: %s",
 			rootPtr, rootPath)
 	}
 
-	_, err := fbo.searchForNodesInDirLocked(ctx, lState, cache, newPtrs,
-		kmd, node, rootPath, nodeMap, numNodesFound)
+	_, depthExceeded, err := fbo.searchForNodesInDirLocked(ctx, lState,
+		cache, newPtrs, kmd, node, rootPath, nodeMap, numNodesFound, 0,
+		maxDepth)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	if rootPtr != cache.PathFromNode(node).tailPointer() {
-		return nil, searchWithOutOfDateCacheError{}
+		return nil, false, searchWithOutOfDateCacheError{}
 	}
 
-	return nodeMap, nil
+	return nodeMap, depthExceeded, nil
 }
 
 func (fbo *folderBlockOps) searchForNodesLocked(ctx context.Context,
 	lState *lockState, cache NodeCache, ptrs []BlockPointer,
-	newPtrs map[BlockPointer]bool, kmd KeyMetadata, rootPtr BlockPointer) (
-	map[BlockPointer]Node, NodeCache, error) {
+	newPtrs map[BlockPointer]bool, kmd KeyMetadata, rootPtr BlockPointer,
+	maxDepth int) (map[BlockPointer]Node, NodeCache, bool, error) {
 	fbo.blockLock.AssertAnyLocked(lState)
 
 	// First try the passed-in cache.  If it doesn't work because the
 	// cache is out of date, try again with a clean cache.
-	nodeMap, err := fbo.trySearchWithCacheLocked(ctx, lState, cache, ptrs,
-		newPtrs, kmd, rootPtr)
+	nodeMap, depthExceeded, err := fbo.trySearchWithCacheLocked(
+		ctx, lState, cache, ptrs, newPtrs, kmd, rootPtr, maxDepth)
 	if _, ok := err.(searchWithOutOfDateCacheError); ok {
 		// The md is out-of-date, so use a throwaway cache so we
 		// don't pollute the real node cache with stale nodes.
@@ -3184,16 +6003,21 @@ func (fbo *folderBlockOps) searchForNodesLocked(ctx context.Context,
 			"cache; using a throwaway node cache instead",
 			rootPtr)
 		cache = newNodeCacheStandard(fbo.folderBranch)
-		nodeMap, err = fbo.trySearchWithCacheLocked(ctx, lState, cache, ptrs,
-			newPtrs, kmd, rootPtr)
+		nodeMap, depthExceeded, err = fbo.trySearchWithCacheLocked(
+			ctx, lState, cache, ptrs, newPtrs, kmd, rootPtr, maxDepth)
 	}
 
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, false, err
+	}
+
+	if depthExceeded {
+		fbo.log.CDebugf(ctx, "Search for %d pointers stopped at the max "+
+			"depth of %d", len(ptrs), maxDepth)
 	}
 
 	// Return the whole map even if some nodes weren't found.
-	return nodeMap, cache, nil
+	return nodeMap, cache, depthExceeded, nil
 }
 
 // SearchForNodes tries to resolve all the given pointers to a Node
@@ -3203,7 +6027,8 @@ func (fbo *folderBlockOps) searchForNodesLocked(ctx context.Context,
 // unresolved nodes.  It also returns the cache that ultimately
 // contains the nodes -- this might differ from the passed-in cache if
 // another goroutine updated that cache and it no longer contains the
-// root pointer specified in md.
+// root pointer specified in md.  The search is bounded by the
+// folder's max search depth (see SetMaxSearchDepth).
 func (fbo *folderBlockOps) SearchForNodes(ctx context.Context,
 	cache NodeCache, ptrs []BlockPointer, newPtrs map[BlockPointer]bool,
 	kmd KeyMetadata, rootPtr BlockPointer) (
@@ -3211,8 +6036,27 @@ func (fbo *folderBlockOps) SearchForNodes(ctx context.Context,
 	lState := makeFBOLockState()
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
+	nodeMap, cache, _, err := fbo.searchForNodesLocked(
+		ctx, lState, cache, ptrs, newPtrs, kmd, rootPtr, fbo.maxSearchDepth)
+	return nodeMap, cache, err
+}
+
+// SearchForNodesWithMaxDepth is like SearchForNodes, except that if
+// `maxDepth` is positive, it doesn't descend into directories more
+// than `maxDepth` levels below the root; a `maxDepth` of 0 means the
+// search is unbounded.  Pointers found below the limit are left
+// unresolved in the returned map, and the returned bool is true if
+// any updated directory was skipped because of the limit.
+func (fbo *folderBlockOps) SearchForNodesWithMaxDepth(ctx context.Context,
+	cache NodeCache, ptrs []BlockPointer, newPtrs map[BlockPointer]bool,
+	kmd KeyMetadata, rootPtr BlockPointer, maxDepth int) (
+	nodeMap map[BlockPointer]Node, nodeCache NodeCache,
+	depthExceeded bool, err error) {
+	lState := makeFBOLockState()
+	fbo.blockLock.RLock(lState)
+	defer fbo.blockLock.RUnlock(lState)
 	return fbo.searchForNodesLocked(
-		ctx, lState, cache, ptrs, newPtrs, kmd, rootPtr)
+		ctx, lState, cache, ptrs, newPtrs, kmd, rootPtr, maxDepth)
 }
 
 // SearchForPaths is like SearchForNodes, except it returns a
@@ -3224,9 +6068,9 @@ func (fbo *folderBlockOps) SearchForPaths(ctx context.Context,
 	// Hold the lock while processing the paths so they can't be changed.
 	fbo.blockLock.RLock(lState)
 	defer fbo.blockLock.RUnlock(lState)
-	nodeMap, cache, err :=
-		fbo.searchForNodesLocked(
-			ctx, lState, cache, ptrs, newPtrs, kmd, rootPtr)
+	nodeMap, cache, _, err :=
+		fbo.searchForNodesLocked(ctx, lState, cache, ptrs, newPtrs, kmd,
+			rootPtr, fbo.maxSearchDepth)
 	if err != nil {
 		return nil, err
 	}
@@ -3264,7 +6108,8 @@ func (fbo *folderBlockOps) getUndirtiedEntry(
 
 	// Get the undirtied dir block.
 	dblock, err := fbo.getDirLocked(
-		ctx, lState, kmd, *file.parentPath(), blockRead)
+		ctx, lState, kmd, *file.parentPath(), blockRead,
+		defaultOnDemandRequestPriority)
 	if err != nil {
 		return nil, err
 	}
@@ -3384,6 +6229,7 @@ func (fbo *folderBlockOps) UpdatePointers(kmd KeyMetadata, lState *lockState,
 	op op, shouldPrefetch bool, afterUpdateFn func() error) error {
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
+	fbo.clearDirListingsLocked(lState)
 	for _, update := range op.allUpdates() {
 		fbo.updatePointer(kmd, update.Unref, update.Ref, shouldPrefetch)
 	}
@@ -3417,7 +6263,9 @@ func (fbo *folderBlockOps) fastForwardDirAndChildrenLocked(ctx context.Context,
 	lState *lockState, currDir path, children map[string]map[pathNode]bool,
 	kmd KeyMetadata) ([]NodeChange, error) {
 	fbo.blockLock.AssertLocked(lState)
-	dirBlock, err := fbo.getDirLocked(ctx, lState, kmd, currDir, blockRead)
+	dirBlock, err := fbo.getDirLocked(
+		ctx, lState, kmd, currDir, blockRead,
+		defaultOnDemandRequestPriority)
 	if err != nil {
 		return nil, err
 	}
@@ -3486,6 +6334,7 @@ func (fbo *folderBlockOps) FastForwardAllNodes(ctx context.Context,
 	// timeouts, even on reads, if we hold it too long.
 	fbo.blockLock.Lock(lState)
 	defer fbo.blockLock.Unlock(lState)
+	fbo.clearDirListingsLocked(lState)
 
 	nodes := fbo.nodeCache.AllNodes()
 	if len(nodes) == 0 {
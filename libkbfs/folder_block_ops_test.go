@@ -0,0 +1,3078 @@
+// Copyright 2026 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/keybase/client/go/logger"
+	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfscodec"
+	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func makeFolderBlockOpsForLockTest() *folderBlockOps {
+	return &folderBlockOps{
+		blockLock: blockLock{
+			leveledRWMutex: makeLeveledRWMutex(
+				mutexLevel(fboBlock), &sync.RWMutex{}),
+		},
+	}
+}
+
+func TestFolderBlockOpsLockStats(t *testing.T) {
+	fbo := makeFolderBlockOpsForLockTest()
+
+	// Nothing is recorded before stats are enabled.
+	lState := makeFBOLockState()
+	fbo.blockLock.RLock(lState)
+	fbo.blockLock.RUnlock(lState)
+	require.Equal(t, blockLockStats{}, fbo.LockStats())
+
+	fbo.EnableLockStats()
+
+	// Hold the write lock while a bunch of readers pile up behind it.
+	const numReaders = 20
+	writerLState := makeFBOLockState()
+	fbo.blockLock.Lock(writerLState)
+	var wg sync.WaitGroup
+	wg.Add(numReaders)
+	for i := 0; i < numReaders; i++ {
+		go func() {
+			defer wg.Done()
+			lState := makeFBOLockState()
+			fbo.blockLock.RLock(lState)
+			defer fbo.blockLock.RUnlock(lState)
+			fbo.blockLock.DoRUnlockedIfPossible(lState, func(*lockState) {})
+		}()
+	}
+	for fbo.LockStats().Blocked < numReaders {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	fbo.blockLock.Unlock(writerLState)
+	wg.Wait()
+
+	stats := fbo.LockStats()
+	require.Equal(t, int64(1), stats.Locks)
+	// Each reader locks once initially, and once more after
+	// DoRUnlockedIfPossible.
+	require.Equal(t, int64(2*numReaders), stats.RLocks)
+	require.Equal(t, int64(numReaders), stats.RUnlockedRuns)
+	require.Equal(t, int64(0), stats.Blocked)
+	require.True(t, stats.MaxBlocked >= numReaders)
+	require.True(t, stats.MaxRLockWait >= 10*time.Millisecond)
+	require.True(t, stats.RLockWait >= stats.MaxRLockWait)
+	t.Logf("Lock stats: %+v", stats)
+}
+
+func BenchmarkFolderBlockOpsConcurrentReads(b *testing.B) {
+	fbo := makeFolderBlockOpsForLockTest()
+	fbo.EnableLockStats()
+	b.RunParallel(func(pb *testing.PB) {
+		lState := makeFBOLockState()
+		for pb.Next() {
+			fbo.blockLock.RLock(lState)
+			fbo.blockLock.DoRUnlockedIfPossible(lState, func(*lockState) {})
+			fbo.blockLock.RUnlock(lState)
+		}
+	})
+	b.StopTimer()
+	stats := fbo.LockStats()
+	b.Logf("Lock stats: %+v", stats)
+}
+
+func makeSyncInfoForMergeTest(t *testing.T, unrefID byte,
+	refBytes, unrefBytes uint64, writes ...WriteRange) *syncInfo {
+	so, err := newSyncOp(BlockPointer{ID: kbfsblock.FakeID(1)})
+	require.NoError(t, err)
+	for _, w := range writes {
+		if w.isTruncate() {
+			so.addTruncate(w.Off)
+		} else {
+			so.addWrite(w.Off, w.Len)
+		}
+	}
+	return &syncInfo{
+		op: so,
+		unrefs: []BlockInfo{{
+			BlockPointer: BlockPointer{ID: kbfsblock.FakeID(unrefID)},
+		}},
+		refBytes:   refBytes,
+		unrefBytes: unrefBytes,
+	}
+}
+
+func TestSyncInfoMergeDisjointWrites(t *testing.T) {
+	si := makeSyncInfoForMergeTest(
+		t, 2, 100, 10, WriteRange{Off: 0, Len: 10})
+	other := makeSyncInfoForMergeTest(
+		t, 3, 50, 20, WriteRange{Off: 20, Len: 5})
+	si.Merge(other)
+
+	require.Equal(t, uint64(150), si.refBytes)
+	require.Equal(t, uint64(30), si.unrefBytes)
+	require.Len(t, si.unrefs, 2)
+	require.Equal(t, kbfsblock.FakeID(2), si.unrefs[0].ID)
+	require.Equal(t, kbfsblock.FakeID(3), si.unrefs[1].ID)
+	require.Equal(t, []WriteRange{
+		{Off: 0, Len: 10},
+		{Off: 20, Len: 5},
+	}, si.op.Writes)
+
+	// Merging into a syncInfo without an op copies other's op.
+	empty := &syncInfo{}
+	empty.Merge(other)
+	require.Equal(t, other.op.Writes, empty.op.Writes)
+	empty.op.addWrite(40, 5)
+	require.Equal(t, []WriteRange{{Off: 20, Len: 5}}, other.op.Writes)
+}
+
+func TestSyncInfoMergeOverlappingWrites(t *testing.T) {
+	si := makeSyncInfoForMergeTest(
+		t, 2, 100, 10, WriteRange{Off: 0, Len: 10},
+		WriteRange{Off: 30, Len: 10})
+	other := makeSyncInfoForMergeTest(
+		t, 3, 50, 20, WriteRange{Off: 5, Len: 10})
+	si.Merge(other)
+
+	require.Equal(t, uint64(150), si.refBytes)
+	require.Equal(t, uint64(30), si.unrefBytes)
+	require.Len(t, si.unrefs, 2)
+	require.Equal(t, []WriteRange{
+		{Off: 0, Len: 15},
+		{Off: 30, Len: 10},
+	}, si.op.Writes)
+
+	// A merged truncate erases any writes past it.
+	truncate := makeSyncInfoForMergeTest(
+		t, 4, 0, 5, WriteRange{Off: 12, Len: 0})
+	si.Merge(truncate)
+	require.Equal(t, uint64(35), si.unrefBytes)
+	require.Len(t, si.unrefs, 3)
+	require.Equal(t, []WriteRange{
+		{Off: 0, Len: 12},
+		{Off: 12, Len: 0},
+	}, si.op.Writes)
+}
+
+type dirFetchCountingBlockCache struct {
+	BlockCache
+
+	lock  sync.Mutex
+	ptr   BlockPointer
+	count int
+}
+
+func (bc *dirFetchCountingBlockCache) GetWithPrefetch(ptr BlockPointer) (
+	Block, PrefetchStatus, BlockCacheLifetime, error) {
+	bc.lock.Lock()
+	if ptr == bc.ptr {
+		bc.count++
+	}
+	bc.lock.Unlock()
+	return bc.BlockCache.GetWithPrefetch(ptr)
+}
+
+func (bc *dirFetchCountingBlockCache) getCount() int {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+	return bc.count
+}
+
+func TestFolderBlockOpsWarmDirCache(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	const numChildren = 20
+	for i := 0; i < numChildren; i++ {
+		_, _, err := kbfsOps.CreateFile(
+			ctx, dirNode, fmt.Sprintf("f%d", i), false, NoExcl)
+		require.NoError(t, err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	dirPath := ops.nodeCache.PathFromNode(dirNode)
+	bcache := &dirFetchCountingBlockCache{
+		BlockCache: config.BlockCache(),
+		ptr:        dirPath.tailPointer(),
+	}
+	config.SetBlockCache(bcache)
+
+	err = ops.blocks.WarmDirCache(ctx, lState, head, dirPath)
+	require.NoError(t, err)
+	for i := 0; i < numChildren; i++ {
+		name := fmt.Sprintf("f%d", i)
+		de, err := ops.blocks.GetDirtyEntry(
+			ctx, lState, head, dirPath.ChildPathNoPtr(name))
+		require.NoError(t, err)
+		require.Equal(t, File, de.Type)
+	}
+	require.Equal(t, 1, bcache.getCount())
+
+	// A write to the directory drops the cached listing.
+	undoFn := ops.blocks.AddDirEntryInCache(
+		lState, dirPath, "sym", DirEntry{EntryInfo: EntryInfo{Type: Sym}})
+	de, err := ops.blocks.GetDirtyEntry(
+		ctx, lState, head, dirPath.ChildPathNoPtr("sym"))
+	require.NoError(t, err)
+	require.Equal(t, Sym, de.Type)
+	require.Equal(t, 2, bcache.getCount())
+	undoFn(lState)
+}
+
+type priorityRecordingBlockOps struct {
+	BlockOps
+
+	lock       sync.Mutex
+	priorities map[BlockPointer]int
+}
+
+func (bops *priorityRecordingBlockOps) Get(ctx context.Context,
+	kmd KeyMetadata, ptr BlockPointer, block Block,
+	lifetime BlockCacheLifetime) error {
+	return bops.GetWithPriority(
+		ctx, kmd, ptr, block, lifetime, defaultOnDemandRequestPriority)
+}
+
+func (bops *priorityRecordingBlockOps) GetWithPriority(ctx context.Context,
+	kmd KeyMetadata, ptr BlockPointer, block Block,
+	lifetime BlockCacheLifetime, priority int) error {
+	bops.lock.Lock()
+	bops.priorities[ptr] = priority
+	bops.lock.Unlock()
+	return bops.BlockOps.GetWithPriority(
+		ctx, kmd, ptr, block, lifetime, priority)
+}
+
+func (bops *priorityRecordingBlockOps) getPriority(
+	ptr BlockPointer) (int, bool) {
+	bops.lock.Lock()
+	defer bops.lock.Unlock()
+	priority, ok := bops.priorities[ptr]
+	return priority, ok
+}
+
+func TestFolderBlockOpsGetDirPriority(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	aPath := ops.nodeCache.PathFromNode(aNode)
+	bPath := ops.nodeCache.PathFromNode(bNode)
+
+	// Start with an empty cache so the directories must be fetched.
+	config.SetBlockCache(NewBlockCacheStandard(
+		10, getDefaultCleanBlockCacheCapacity()))
+	bops := config.BlockOps()
+	recorder := &priorityRecordingBlockOps{
+		BlockOps:   bops,
+		priorities: make(map[BlockPointer]int),
+	}
+	config.SetBlockOps(recorder)
+	defer config.SetBlockOps(bops)
+
+	t.Log("A background fetch goes through BlockOps with a lower priority.")
+	_, err = ops.blocks.GetDir(
+		ctx, lState, head, aPath, blockRead, backgroundRequestPriority)
+	require.NoError(t, err)
+	priority, ok := recorder.getPriority(aPath.tailPointer())
+	require.True(t, ok)
+	require.Equal(t, backgroundRequestPriority, priority)
+	require.True(t, priority < defaultOnDemandRequestPriority)
+
+	t.Log("A foreground listing uses the default on-demand priority.")
+	children, err := ops.blocks.GetDirtyDirChildren(
+		ctx, lState, head, bPath, defaultOnDemandRequestPriority)
+	require.NoError(t, err)
+	require.Len(t, children, 0)
+	priority, ok = recorder.getPriority(bPath.tailPointer())
+	require.True(t, ok)
+	require.Equal(t, defaultOnDemandRequestPriority, priority)
+}
+
+func TestFolderBlockOpsBlockSizeHistogram(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make the blocks small, so a short write makes several of them.
+	bsplit := &BlockSplitterSimple{5, 2, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	require.Len(t, ops.blocks.BlockSizeHistogram(lState), 0)
+
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Two full 5-byte blocks, and one 3-byte block.
+	require.Equal(t, BlockSizeHistogram{4: 2, 2: 1},
+		ops.blocks.BlockSizeHistogram(lState))
+}
+
+func TestFolderBlockOpsEstimateSyncCost(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make the blocks small, so a short write makes several of them.
+	bsplit := &BlockSplitterSimple{5, 2, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	blocks, bytes := ops.blocks.EstimateSyncCost(lState, filePath)
+	require.Equal(t, int64(len(data)), bytes)
+
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	// The estimate should match the blocks actually readied.
+	synced := 0
+	for _, count := range ops.blocks.BlockSizeHistogram(lState) {
+		synced += int(count)
+	}
+	require.Equal(t, synced, blocks)
+
+	// Nothing is left to sync.
+	filePath = ops.nodeCache.PathFromNode(fileNode)
+	blocks, bytes = ops.blocks.EstimateSyncCost(lState, filePath)
+	require.Equal(t, 0, blocks)
+	require.Equal(t, int64(0), bytes)
+}
+
+func dirEntryNames(entries dirEntries) []string {
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.entryName)
+	}
+	return names
+}
+
+func TestFolderBlockOpsGetDirtyDirChildrenSorted(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	for _, name := range []string{"e", "b", "d", "a", "c"} {
+		_, _, err := kbfsOps.CreateFile(ctx, dirNode, name, false, NoExcl)
+		require.NoError(t, err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	// Dirty entries are included too.
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "bb", false, NoExcl)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	dirPath := ops.nodeCache.PathFromNode(dirNode)
+
+	children, err := ops.blocks.GetDirtyDirChildren(
+		ctx, lState, head, dirPath, defaultOnDemandRequestPriority)
+	require.NoError(t, err)
+
+	var prevSorted []NamedEntryInfo
+	for i := 0; i < 5; i++ {
+		sorted, err := ops.blocks.GetDirtyDirChildrenSorted(
+			ctx, lState, head, dirPath, defaultOnDemandRequestPriority)
+		require.NoError(t, err)
+		names := make([]string, 0, len(sorted))
+		for _, child := range sorted {
+			names = append(names, child.Name)
+			require.Equal(t, children[child.Name], child.EntryInfo)
+		}
+		require.Equal(t,
+			[]string{"a", "b", "bb", "c", "d", "e"}, names)
+		if prevSorted != nil {
+			require.Equal(t, prevSorted, sorted)
+		}
+		prevSorted = sorted
+	}
+}
+
+func TestFolderBlockOpsGetDirtyDirChildrenPaged(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	for _, name := range []string{"e", "b", "d", "a", "c"} {
+		_, _, err := kbfsOps.CreateFile(ctx, dirNode, name, false, NoExcl)
+		require.NoError(t, err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	dirPath := ops.nodeCache.PathFromNode(dirNode)
+
+	t.Log("An empty cursor starts at the beginning.")
+	page, next, err := ops.blocks.GetDirtyDirChildrenPaged(
+		ctx, lState, head, dirPath, "", 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, dirEntryNames(page))
+	require.Equal(t, "b", next)
+
+	t.Log("A non-positive limit returns everything remaining.")
+	page, next, err = ops.blocks.GetDirtyDirChildrenPaged(
+		ctx, lState, head, dirPath, "b", 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"c", "d", "e"}, dirEntryNames(page))
+	require.Equal(t, "", next)
+
+	t.Log("A page that exactly reaches the end has no next cursor.")
+	page, next, err = ops.blocks.GetDirtyDirChildrenPaged(
+		ctx, lState, head, dirPath, "b", 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"c", "d", "e"}, dirEntryNames(page))
+	require.Equal(t, "", next)
+	page, next, err = ops.blocks.GetDirtyDirChildrenPaged(
+		ctx, lState, head, dirPath, "e", 3)
+	require.NoError(t, err)
+	require.Len(t, page, 0)
+	require.Equal(t, "", next)
+
+	t.Log("Modify the directory in the middle of paginating.")
+	page, next, err = ops.blocks.GetDirtyDirChildrenPaged(
+		ctx, lState, head, dirPath, "", 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, dirEntryNames(page))
+	require.Equal(t, "c", next)
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "aa", false, NoExcl)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "cc", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.RemoveEntry(ctx, dirNode, "d")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.Lookup(ctx, dirNode, "e")
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+
+	// Entries before the cursor aren't seen again, but the rest of
+	// the listing, including dirty entries, is up to date.
+	page, next, err = ops.blocks.GetDirtyDirChildrenPaged(
+		ctx, lState, head, dirPath, next, 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"cc", "e"}, dirEntryNames(page))
+	require.Equal(t, "", next)
+	require.Equal(t, uint64(len(data)), page[1].Size)
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+type readyCountingBlockOps struct {
+	BlockOps
+	readies int
+}
+
+func (bops *readyCountingBlockOps) Ready(ctx context.Context,
+	kmd KeyMetadata, block Block) (kbfsblock.ID, int, ReadyBlockData,
+	error) {
+	bops.readies++
+	return bops.BlockOps.Ready(ctx, kmd, block)
+}
+
+func testReadyBlockDuplicate(t *testing.T, ty tlf.Type) (
+	origInfo, dupInfo BlockInfo, dupReadyBlockData ReadyBlockData,
+	readies int) {
+	config := makeTestBlockOpsConfig(t)
+	bops := NewBlockOpsStandard(config, testBlockRetrievalWorkerQueueSize,
+		testPrefetchWorkerQueueSize)
+	defer bops.Shutdown()
+	countingBops := &readyCountingBlockOps{BlockOps: bops}
+
+	tlfID := tlf.FakeID(1, ty)
+	kmd := makeFakeKeyMetadata(tlfID, kbfsmd.FirstValidKeyGen)
+	crypto := MakeCryptoCommon(kbfscodec.NewMsgpack())
+	uid := keybase1.MakeTestUID(1).AsUserOrTeam()
+	ctx := context.Background()
+
+	block := &FileBlock{Contents: []byte{1, 2, 3, 4, 5}}
+	origInfo, _, _, err := ReadyBlock(
+		ctx, config.BlockCache(), countingBops, crypto, kmd, block, uid,
+		keybase1.BlockType_DATA)
+	require.NoError(t, err)
+	err = config.BlockCache().Put(
+		origInfo.BlockPointer, tlfID, block, TransientEntry)
+	require.NoError(t, err)
+
+	dup := &FileBlock{Contents: []byte{1, 2, 3, 4, 5}}
+	dupInfo, _, dupReadyBlockData, err = ReadyBlock(
+		ctx, config.BlockCache(), countingBops, crypto, kmd, dup, uid,
+		keybase1.BlockType_DATA)
+	require.NoError(t, err)
+	return origInfo, dupInfo, dupReadyBlockData, countingBops.readies
+}
+
+func TestReadyBlockPublicVsPrivateDuplicate(t *testing.T) {
+	for _, ty := range []tlf.Type{tlf.Private, tlf.Public} {
+		origInfo, dupInfo, dupReadyBlockData, readies :=
+			testReadyBlockDuplicate(t, ty)
+
+		// Either way, the duplicate is a new reference to the
+		// original block, with the same encoded size.
+		require.Equal(t, origInfo.ID, dupInfo.ID, "type=%s", ty)
+		require.NotEqual(t, kbfsblock.ZeroRefNonce, dupInfo.RefNonce,
+			"type=%s", ty)
+		require.Equal(t, origInfo.EncodedSize, dupInfo.EncodedSize,
+			"type=%s", ty)
+
+		if ty == tlf.Public {
+			// The public duplicate isn't encrypted again.
+			require.Equal(t, 1, readies)
+			require.Equal(t, 0, dupReadyBlockData.GetEncodedSize())
+		} else {
+			require.Equal(t, 2, readies)
+			require.Equal(t, int(origInfo.EncodedSize),
+				dupReadyBlockData.GetEncodedSize())
+		}
+	}
+}
+
+func TestCheckEncodedBlockSize(t *testing.T) {
+	id := kbfsblock.FakeID(1)
+	require.NoError(t, checkEncodedBlockSize(id, 64, 5))
+	require.NoError(t, checkEncodedBlockSize(id, math.MaxUint32, 5))
+
+	// Sizes that don't fit in a BlockInfo are rejected.
+	require.IsType(t, BlockEncodedSizeError{},
+		checkEncodedBlockSize(id, math.MaxUint32+1, 5))
+	require.IsType(t, BlockEncodedSizeError{},
+		checkEncodedBlockSize(id, -1, 5))
+}
+
+func TestCheckReadiedFileBlockSize(t *testing.T) {
+	info := BlockInfo{EncodedSize: 64}
+	require.NoError(t, checkReadiedFileBlockSize(info, 5))
+
+	info.EncodedSize = 0
+	require.IsType(t, BlockEncodedSizeError{},
+		checkReadiedFileBlockSize(info, 5))
+
+	// An encoded block can't be smaller than its plaintext.
+	info.EncodedSize = 3
+	require.IsType(t, BlockEncodedSizeError{},
+		checkReadiedFileBlockSize(info, 5))
+
+	// Blocks that weren't encrypted again only need a non-zero size.
+	require.NoError(t, checkReadiedFileBlockSize(info, 0))
+}
+
+// Make sure a multi-block file syncs when its folder compresses file
+// blocks, since the encoded blocks can then be smaller than their
+// contents.
+func TestFolderBlockOpsSyncCompressedMultiBlockFile(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make blocks of 1000 bytes.
+	bsplit := &BlockSplitterSimple{1000, 100, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	tlfID := rootNode.GetFolderBranch().Tlf
+	config.BlockOps().SetBlockCodec(
+		tlfID, CompressedFileBlockCodec{config.Codec()})
+
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := bytes.Repeat(
+		[]byte("INFO: handled request for /a/b/c in 5ms\n"), 100)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, tlfID)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	file := ops.nodeCache.PathFromNode(fileNode)
+	infos, err := ops.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, head, file)
+	require.NoError(t, err)
+	require.True(t, len(infos) > 1, "Only %d blocks", len(infos))
+	for _, info := range infos {
+		require.True(t, info.EncodedSize < 1000,
+			"Block %v wasn't compressed: %d bytes", info.BlockPointer,
+			info.EncodedSize)
+	}
+
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf[:n])
+}
+
+type archivedRefusingBlockServer struct {
+	BlockServer
+}
+
+func (b archivedRefusingBlockServer) Get(ctx context.Context, tlfID tlf.ID,
+	id kbfsblock.ID, context kbfsblock.Context) (
+	[]byte, kbfscrypto.BlockCryptKeyServerHalf, error) {
+	return nil, kbfscrypto.BlockCryptKeyServerHalf{},
+		kbfsblock.ServerErrorBlockArchived{Msg: "refused"}
+}
+
+func TestFolderBlockOpsGetArchivedBlockForReading(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	ptr := ops.nodeCache.PathFromNode(fileNode).tailPointer()
+
+	// Overwrite the file so that its old block gets archived, and
+	// make sure the old block isn't served from the cache.
+	err = kbfsOps.Write(ctx, fileNode, []byte{4, 5, 6}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	err = ops.fbm.waitForArchives(ctx)
+	require.NoError(t, err)
+	config.SetBlockCache(NewBlockCacheStandard(
+		10, getDefaultCleanBlockCacheCapacity()))
+	head, _ := ops.getHead(lState)
+
+	t.Log("An archived block can still be read.")
+	block, err := ops.blocks.GetArchivedBlockForReading(
+		ctx, lState, head, ptr, MasterBranch)
+	require.NoError(t, err)
+	require.NotNil(t, block)
+	_, err = config.BlockCache().Get(ptr)
+	require.IsType(t, NoSuchBlockError{}, err)
+
+	t.Log("A server refusal surfaces as a BlockArchivedError.")
+	bserver := config.BlockServer()
+	config.SetBlockServer(archivedRefusingBlockServer{bserver})
+	defer config.SetBlockServer(bserver)
+	_, err = ops.blocks.GetArchivedBlockForReading(
+		ctx, lState, head, ptr, MasterBranch)
+	require.Equal(t, BlockArchivedError{ptr}, err)
+}
+
+type syncIDRecordingLogger struct {
+	logger.Logger
+
+	lock    sync.Mutex
+	syncIDs map[string][]string
+}
+
+func (l *syncIDRecordingLogger) CDebugf(ctx context.Context, format string,
+	args ...interface{}) {
+	if id, ok := ctx.Value(CtxSyncIDKey).(string); ok {
+		l.lock.Lock()
+		l.syncIDs[id] = append(l.syncIDs[id], fmt.Sprintf(format, args...))
+		l.lock.Unlock()
+	}
+	l.Logger.CDebugf(ctx, format, args...)
+}
+
+func (l *syncIDRecordingLogger) getSyncIDs() map[string][]string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	syncIDs := make(map[string][]string, len(l.syncIDs))
+	for id, msgs := range l.syncIDs {
+		syncIDs[id] = append([]string(nil), msgs...)
+	}
+	return syncIDs
+}
+
+func TestFolderBlockOpsSyncIDLogging(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	log := &syncIDRecordingLogger{
+		Logger:  ops.blocks.log,
+		syncIDs: make(map[string][]string),
+	}
+	ops.blocks.log = log
+
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, int64(i*3))
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+	}
+
+	// Each sync gets its own ID, shared by its start and finish.
+	syncIDs := log.getSyncIDs()
+	require.Len(t, syncIDs, 2)
+	for id, msgs := range syncIDs {
+		require.NotEqual(t, "", id)
+		var started, finished bool
+		for _, msg := range msgs {
+			if strings.HasPrefix(msg, "Started sync of") {
+				started = true
+			} else if strings.HasPrefix(msg, "Finishing sync of") {
+				finished = true
+			}
+		}
+		require.True(t, started, "id=%s, msgs=%v", id, msgs)
+		require.True(t, finished, "id=%s, msgs=%v", id, msgs)
+	}
+}
+
+func TestFolderBlockOpsReadWithCachePolicy(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make the blocks small, so the file is made of many of them.
+	bsplit := &BlockSplitterSimple{5, 2, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Start from an empty cache, so all blocks come from the server.
+	bcache := NewBlockCacheStandard(1000, 1<<20)
+	config.SetBlockCache(bcache)
+
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.ReadWithCachePolicy(
+		ctx, fileNode, buf, 0, NoCacheBlocks)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+	require.Equal(t, 0, bcache.cleanTransient.Len())
+
+	// Low-priority caching fills the cache only up to its capacity.
+	const capacity = 3
+	bcache = NewBlockCacheStandard(capacity, 1<<20)
+	config.SetBlockCache(bcache)
+	buf = make([]byte, len(data))
+	n, err = kbfsOps.ReadWithCachePolicy(
+		ctx, fileNode, buf, 0, CacheBlocksLowPriority)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, buf)
+	require.Equal(t, capacity, bcache.cleanTransient.Len())
+
+	// A normal read caches as usual.
+	bcache = NewBlockCacheStandard(1000, 1<<20)
+	config.SetBlockCache(bcache)
+	buf = make([]byte, len(data))
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+	require.True(t, bcache.cleanTransient.Len() > capacity)
+}
+
+func TestFolderBlockOpsCacheStats(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+
+	// Start from an empty cache, so the first read goes to the
+	// server.
+	config.SetBlockCache(NewBlockCacheStandard(10, 1<<20))
+	read := func() {
+		buf := make([]byte, len(data))
+		_, err := ops.blocks.Read(ctx, lState, head, fileNode, buf, 0)
+		require.NoError(t, err)
+	}
+
+	before := ops.blocks.CacheStats()
+	read()
+	stats := ops.blocks.CacheStats()
+	require.Equal(t, before.NetworkFetches+1, stats.NetworkFetches)
+	require.Equal(t, before.CleanHits, stats.CleanHits)
+	require.Equal(t, before.DirtyHits, stats.DirtyHits)
+
+	// Now it's cached.
+	before = stats
+	read()
+	stats = ops.blocks.CacheStats()
+	require.Equal(t, before.NetworkFetches, stats.NetworkFetches)
+	require.Equal(t, before.CleanHits+1, stats.CleanHits)
+	require.Equal(t, before.DirtyHits, stats.DirtyHits)
+
+	// A dirty block comes from the dirty cache instead.
+	err = kbfsOps.Write(ctx, fileNode, []byte{4}, 0)
+	require.NoError(t, err)
+	before = ops.blocks.CacheStats()
+	read()
+	stats = ops.blocks.CacheStats()
+	require.Equal(t, before.NetworkFetches, stats.NetworkFetches)
+	require.Equal(t, before.CleanHits, stats.CleanHits)
+	require.Equal(t, before.DirtyHits+1, stats.DirtyHits)
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestFolderBlockOpsCollectAllBlockRefs(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make blocks of 5 bytes.
+	bsplit := &BlockSplitterSimple{5, 100, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateDir(ctx, aNode, "b")
+	require.NoError(t, err)
+	_, err = kbfsOps.CreateLink(ctx, aNode, "c", "b")
+	require.NoError(t, err)
+
+	// One 8-block file, and one single-block file.
+	data := make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	fNode, _, err := kbfsOps.CreateFile(ctx, aNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fNode, data, 0)
+	require.NoError(t, err)
+	gNode, _, err := kbfsOps.CreateFile(ctx, bNode, "g", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, gNode, data[:3], 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	infos, err := ops.blocks.CollectAllBlockRefs(ctx, lState, head.ReadOnly())
+	require.NoError(t, err)
+
+	// The root, a, a/b, a/f, the 8 blocks of a/f, and a/b/g.
+	require.Len(t, infos, 13)
+	require.Equal(t, head.data.Dir.BlockInfo, infos[0])
+	expected := map[BlockPointer]bool{head.data.Dir.BlockPointer: true}
+	for _, n := range []Node{aNode, bNode, fNode, gNode} {
+		expected[ops.nodeCache.PathFromNode(n).tailPointer()] = true
+	}
+	fPath := ops.nodeCache.PathFromNode(fNode)
+	fInfos, err := ops.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, head, fPath)
+	require.NoError(t, err)
+	require.Len(t, fInfos, 8)
+	for _, info := range fInfos {
+		expected[info.BlockPointer] = true
+	}
+	actual := make(map[BlockPointer]bool, len(infos))
+	for _, info := range infos {
+		actual[info.BlockPointer] = true
+	}
+	require.Equal(t, expected, actual)
+
+	// Every collected block is live on the block server.
+	bserverLocal, ok := config.BlockServer().(blockServerLocal)
+	require.True(t, ok)
+	refs, err := bserverLocal.getAllRefsForTest(
+		ctx, rootNode.GetFolderBranch().Tlf)
+	require.NoError(t, err)
+	for _, info := range infos {
+		require.Contains(t, refs, info.ID)
+	}
+}
+
+func TestFolderBlockOpsReconstructPath(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateDir(ctx, aNode, "b")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, aNode, "e", false, NoExcl)
+	require.NoError(t, err)
+	fNode, _, err := kbfsOps.CreateFile(ctx, bNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	fPath := ops.nodeCache.PathFromNode(fNode)
+
+	// Forget the node for f.
+	ncs, ok := ops.nodeCache.(*nodeCacheStandard)
+	require.True(t, ok)
+	fCore := fNode.(*nodeStandard).core
+	for ops.nodeCache.Get(fPath.tailRef()) != nil {
+		ncs.forget(fCore)
+	}
+
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	p, err := ops.blocks.ReconstructPath(
+		ctx, lState, head.ReadOnly(), fPath.tailRef())
+	require.NoError(t, err)
+	require.Equal(t, fPath, p)
+
+	// The root resolves to itself.
+	rootPath := ops.nodeCache.PathFromNode(rootNode)
+	p, err = ops.blocks.ReconstructPath(
+		ctx, lState, head.ReadOnly(), rootPath.tailRef())
+	require.NoError(t, err)
+	require.Equal(t, rootPath, p)
+
+	// An unknown ref isn't found.
+	_, err = ops.blocks.ReconstructPath(
+		ctx, lState, head.ReadOnly(),
+		BlockRef{ID: kbfsblock.FakeID(42)})
+	require.Equal(t, PathNotFoundError{BlockRef{ID: kbfsblock.FakeID(42)}},
+		err)
+}
+
+// Make sure a dirty file whose node has been forgotten is still
+// reported in the status, and still gets synced.
+func TestFolderBlockOpsSyncDirtyFileWithNoNode(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fNode, _, err := kbfsOps.CreateFile(ctx, aNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	data := []byte{1, 2, 3, 4}
+	err = kbfsOps.Write(ctx, fNode, data, 0)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	fPath := ops.nodeCache.PathFromNode(fNode)
+
+	// Forget the node for f, including the status's reference.
+	ops.status.rmDirtyNode(fNode)
+	ncs, ok := ops.nodeCache.(*nodeCacheStandard)
+	require.True(t, ok)
+	fCore := fNode.(*nodeStandard).core
+	for ops.nodeCache.Get(fPath.tailRef()) != nil {
+		ncs.forget(fCore)
+	}
+
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, []string{fPath.String()}, status.DirtyPaths)
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	lState := makeFBOLockState()
+	require.Len(t, ops.blocks.GetDirtyFileBlockRefs(lState), 0)
+	status, _, err = kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Len(t, status.DirtyPaths, 0)
+
+	fNode, _, err = kbfsOps.Lookup(ctx, aNode, "f")
+	require.NoError(t, err)
+	got := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fNode, got, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), n)
+	require.Equal(t, data, got)
+}
+
+func TestFolderBlockOpsForceSyncPolicy(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make blocks of 5 bytes.
+	bsplit := &BlockSplitterSimple{5, 100, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Catch the forced syncs ourselves.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	forceSyncChan := make(chan struct{}, 1)
+	func() {
+		ops.blocks.blockLock.Lock(lState)
+		defer ops.blocks.blockLock.Unlock(lState)
+		ops.blocks.forceSyncChan = forceSyncChan
+	}()
+	checkForced := func(expected bool) {
+		select {
+		case <-forceSyncChan:
+			require.True(t, expected, "Unexpected forced sync")
+		default:
+			require.False(t, expected, "No forced sync")
+		}
+	}
+
+	t.Log("Without a policy, a few small writes don't force a sync.")
+	for i := 0; i < 3; i++ {
+		err = kbfsOps.Write(ctx, fileNode, []byte{byte(100 + i)}, int64(i))
+		require.NoError(t, err)
+		checkForced(false)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Force a sync every third write.")
+	ops.blocks.SetForceSyncPolicy(lState, ForceSyncPolicy{Writes: 3})
+	err = kbfsOps.Write(ctx, fileNode, []byte{110}, 0)
+	require.NoError(t, err)
+	checkForced(false)
+	err = kbfsOps.Truncate(ctx, fileNode, 41)
+	require.NoError(t, err)
+	checkForced(false)
+	err = kbfsOps.Write(ctx, fileNode, []byte{111}, 1)
+	require.NoError(t, err)
+	checkForced(true)
+	// The channel is full now, but writes still mustn't block on it.
+	forceSyncChan <- struct{}{}
+	err = kbfsOps.Write(ctx, fileNode, []byte{112}, 2)
+	require.NoError(t, err)
+	checkForced(true)
+	checkForced(false)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Shrinking truncates count as writes too.")
+	err = kbfsOps.Truncate(ctx, fileNode, 30)
+	require.NoError(t, err)
+	checkForced(false)
+	err = kbfsOps.Truncate(ctx, fileNode, 20)
+	require.NoError(t, err)
+	checkForced(false)
+	err = kbfsOps.Write(ctx, fileNode, []byte{113}, 3)
+	require.NoError(t, err)
+	checkForced(true)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("So do hole punches.")
+	err = kbfsOps.PunchHole(ctx, fileNode, 10, 5)
+	require.NoError(t, err)
+	checkForced(false)
+	err = kbfsOps.PunchHole(ctx, fileNode, 16, 2)
+	require.NoError(t, err)
+	checkForced(false)
+	err = kbfsOps.PunchHole(ctx, fileNode, 0, 1)
+	require.NoError(t, err)
+	checkForced(true)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Force a sync once two 5-byte blocks are dirty.")
+	ops.blocks.SetForceSyncPolicy(lState, ForceSyncPolicy{DirtyBytes: 10})
+	err = kbfsOps.Write(ctx, fileNode, []byte{120}, 0)
+	require.NoError(t, err)
+	checkForced(false)
+	err = kbfsOps.Write(ctx, fileNode, []byte{121}, 1)
+	require.NoError(t, err)
+	checkForced(false)
+	err = kbfsOps.Write(ctx, fileNode, []byte{122}, 5)
+	require.NoError(t, err)
+	checkForced(true)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestFolderBlockOpsDumpFileTree(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make blocks of 5 bytes, with 2 pointers per indirect block, so
+	// even a small file needs a few levels of indirection.
+	bsplit := &BlockSplitterSimple{5, 2, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+	// Always extend with a hole, rather than by writing zeroes.
+	tunables := config.Tunables()
+	tunables.TruncateExtendCutoff = 0
+	require.NoError(t, config.SetTunables(tunables))
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	// Make a sparse file, with data at the start and the end.
+	err = kbfsOps.Write(ctx, fileNode, make([]byte, 15), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Truncate(ctx, fileNode, 40)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{6, 7, 8, 9, 10}, 40)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	file := ops.nodeCache.PathFromNode(fileNode)
+	entries, err := ops.blocks.DumpFileTree(ctx, lState, head, file)
+	require.NoError(t, err)
+	for _, e := range entries {
+		t.Log(e)
+	}
+
+	// The dump covers exactly the file's indirect pointers.
+	infos, err := ops.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, head, file)
+	require.NoError(t, err)
+	var dumpedInfos []BlockInfo
+	for _, e := range entries {
+		dumpedInfos = append(dumpedInfos, e.BlockInfo)
+	}
+	require.Len(t, dumpedInfos, len(infos))
+	for _, info := range infos {
+		require.Contains(t, dumpedInfos, info)
+	}
+
+	// Each level starts at the offset of its parent pointer, and
+	// offsets increase within a level.
+	require.Equal(t, 1, entries[0].Depth)
+	require.Equal(t, int64(0), entries[0].Off)
+	maxDepth := 0
+	var lastLeaf FileTreeEntry
+	holes := false
+	for i, e := range entries {
+		require.False(t, e.Dirty)
+		require.False(t, e.Syncing)
+		require.NotZero(t, e.EncodedSize)
+		holes = holes || e.Holes
+		if e.Depth > maxDepth {
+			maxDepth = e.Depth
+		}
+		if e.DirectType == DirectBlock {
+			lastLeaf = e
+		}
+		if i == 0 {
+			continue
+		}
+		prev := entries[i-1]
+		switch {
+		case e.Depth == prev.Depth+1:
+			require.Equal(t, IndirectBlock, prev.DirectType)
+			require.Equal(t, prev.Off, e.Off)
+		case e.Depth == prev.Depth:
+			require.True(t, e.Off > prev.Off)
+		default:
+			require.True(t, e.Depth < prev.Depth)
+		}
+	}
+	require.True(t, maxDepth >= 2)
+	require.True(t, holes)
+	require.Equal(t, int64(40), lastLeaf.Off)
+
+	// A new local write shows up as dirty, without a size yet.
+	err = kbfsOps.Write(ctx, fileNode, []byte{11}, 0)
+	require.NoError(t, err)
+	file = ops.nodeCache.PathFromNode(fileNode)
+	entries, err = ops.blocks.DumpFileTree(ctx, lState, head, file)
+	require.NoError(t, err)
+	var dirty []FileTreeEntry
+	for _, e := range entries {
+		if e.Dirty {
+			dirty = append(dirty, e)
+		}
+	}
+	require.NotEmpty(t, dirty)
+	for _, e := range dirty {
+		require.Zero(t, e.EncodedSize)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestFolderBlockOpsMaxDirtyBytes(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	kbfsOps := config.KBFSOps()
+	lState := makeFBOLockState()
+	rootNodeA := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	fileNodeA, _, err := kbfsOps.CreateFile(
+		ctx, rootNodeA, "a", false, NoExcl)
+	require.NoError(t, err)
+	rootNodeB := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Public)
+	fileNodeB, _, err := kbfsOps.CreateFile(
+		ctx, rootNodeB, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNodeA.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNodeB.GetFolderBranch())
+	require.NoError(t, err)
+
+	// Catch folder A's forced syncs ourselves, so its dirty bytes
+	// stay around until we sync explicitly.
+	opsA := getOps(config, rootNodeA.GetFolderBranch().Tlf)
+	forceSyncChan := make(chan struct{}, 1)
+	func() {
+		opsA.blocks.blockLock.Lock(lState)
+		defer opsA.blocks.blockLock.Unlock(lState)
+		opsA.blocks.forceSyncChan = forceSyncChan
+	}()
+	tunables := config.Tunables()
+	tunables.MaxFolderDirtyBytes = 10
+	err = config.SetTunables(tunables)
+	require.NoError(t, err)
+
+	t.Log("Fill up folder A's dirty buffer.")
+	data := make([]byte, 10)
+	err = kbfsOps.Write(ctx, fileNodeA, data, 0)
+	require.NoError(t, err)
+
+	t.Log("The next write to folder A blocks and forces a sync.")
+	func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		err := kbfsOps.Write(ctx, fileNodeA, []byte{1}, 10)
+		require.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	}()
+	select {
+	case <-forceSyncChan:
+	default:
+		t.Fatal("No forced sync")
+	}
+
+	t.Log("Folder B can still write while folder A's buffer is full.")
+	err = kbfsOps.Write(ctx, fileNodeB, make([]byte, 20), 0)
+	require.NoError(t, err)
+
+	t.Log("Once folder A is synced, it can write again.")
+	err = kbfsOps.SyncAll(ctx, rootNodeA.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNodeA, []byte{1}, 10)
+	require.NoError(t, err)
+
+	err = kbfsOps.SyncAll(ctx, rootNodeA.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNodeB.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestFolderBlockOpsIndirectDirBlocks(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	fb := rootNode.GetFolderBranch()
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, fb.Tlf)
+	lState := makeFBOLockState()
+	tunables := config.Tunables()
+	tunables.MaxDirBlockBytes = 1024
+	err := config.SetTunables(tunables)
+	require.NoError(t, err)
+
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	const numEntries = 100
+	for i := 0; i < numEntries; i++ {
+		_, _, err := kbfsOps.CreateFile(
+			ctx, dirNode, fmt.Sprintf("file%d", i), false, NoExcl)
+		require.NoError(t, err)
+	}
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+
+	getTopBlock := func() (BlockPointer, *DirBlock) {
+		head, _ := ops.getHead(lState)
+		ptr := ops.nodeCache.PathFromNode(dirNode).tailPointer()
+		dblock := NewDirBlock().(*DirBlock)
+		err := config.BlockOps().Get(ctx, head, ptr, dblock, TransientEntry)
+		require.NoError(t, err)
+		return ptr, dblock
+	}
+	checkChildren := func(expected int) {
+		children, err := kbfsOps.GetDirChildren(ctx, dirNode)
+		require.NoError(t, err)
+		require.Len(t, children, expected)
+		for name := range children {
+			_, _, err := kbfsOps.Lookup(ctx, dirNode, name)
+			require.NoError(t, err)
+		}
+	}
+
+	t.Log("The directory is split, and everything is still visible.")
+	ptr, top := getTopBlock()
+	require.True(t, top.IsInd)
+	require.True(t, len(top.IPtrs) > 1)
+	require.Equal(t, IndirectDirsDataVer, ptr.DataVer)
+	require.Equal(t, "", top.IPtrs[0].Off)
+	for i := 1; i < len(top.IPtrs); i++ {
+		require.True(t, top.IPtrs[i-1].Off < top.IPtrs[i].Off)
+	}
+	checkChildren(numEntries)
+
+	t.Log("Changing one entry rewrites only one child block.")
+	oldIPtrs := top.IPtrs
+	fileNode, _, err := kbfsOps.Lookup(ctx, dirNode, "file0")
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	_, top = getTopBlock()
+	require.Len(t, top.IPtrs, len(oldIPtrs))
+	changed := 0
+	for i := range top.IPtrs {
+		require.Equal(t, oldIPtrs[i].Off, top.IPtrs[i].Off)
+		if top.IPtrs[i].BlockPointer != oldIPtrs[i].BlockPointer {
+			changed++
+		}
+	}
+	require.Equal(t, 1, changed)
+
+	t.Log("Renames within and out of the directory work.")
+	err = kbfsOps.Rename(ctx, dirNode, "file1", dirNode, "renamed")
+	require.NoError(t, err)
+	err = kbfsOps.Rename(ctx, dirNode, "file2", rootNode, "moved")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	checkChildren(numEntries - 1)
+	_, _, err = kbfsOps.Lookup(ctx, dirNode, "renamed")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.Lookup(ctx, dirNode, "file1")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	_, _, err = kbfsOps.Lookup(ctx, rootNode, "moved")
+	require.NoError(t, err)
+
+	t.Log("Another device can read the split directory.")
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	dirNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "d")
+	require.NoError(t, err)
+	ops2 := getOps(config2, fb.Tlf)
+
+	t.Log("Looking up one entry doesn't assemble the whole directory.")
+	_, _, err = kbfsOps2.Lookup(ctx, dirNode2, "renamed")
+	require.NoError(t, err)
+	_, _, err = kbfsOps2.Lookup(ctx, dirNode2, "file1")
+	require.IsType(t, NoSuchNameError{}, errors.Cause(err))
+	require.Equal(t, 0, ops2.blocks.assembledDirs.Len())
+
+	t.Log("Listing it does, once.")
+	children2, err := kbfsOps2.GetDirChildren(ctx, dirNode2)
+	require.NoError(t, err)
+	require.Len(t, children2, numEntries-1)
+	require.Equal(t, 1, ops2.blocks.assembledDirs.Len())
+	fetches := ops2.blocks.CacheStats().NetworkFetches
+	children2, err = kbfsOps2.GetDirChildren(ctx, dirNode2)
+	require.NoError(t, err)
+	require.Len(t, children2, numEntries-1)
+	require.Equal(t, fetches, ops2.blocks.CacheStats().NetworkFetches)
+
+	t.Log("Without a limit, the directory is stored in one block again.")
+	tunables.MaxDirBlockBytes = 0
+	err = config.SetTunables(tunables)
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, dirNode, "new", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fb)
+	require.NoError(t, err)
+	_, top = getTopBlock()
+	require.False(t, top.IsInd)
+	require.Len(t, top.Children, numEntries)
+}
+
+func TestFolderBlockOpsDirSize(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	makeDir := func(parent Node, name string) Node {
+		n, _, err := kbfsOps.CreateDir(ctx, parent, name)
+		require.NoError(t, err)
+		return n
+	}
+	makeFile := func(parent Node, name string, size int) Node {
+		n, _, err := kbfsOps.CreateFile(ctx, parent, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, n, make([]byte, size), 0)
+		require.NoError(t, err)
+		return n
+	}
+
+	dNode := makeDir(rootNode, "d")
+	makeFile(dNode, "a", 5)
+	makeFile(dNode, "b", 10)
+	subNode := makeDir(dNode, "sub")
+	cNode := makeFile(subNode, "c", 7)
+	sub2Node := makeDir(subNode, "sub2")
+	makeFile(sub2Node, "e", 3)
+	_, err := kbfsOps.CreateLink(ctx, dNode, "link", "a")
+	require.NoError(t, err)
+	makeFile(rootNode, "outside", 100)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	// An unsynced write counts too.
+	err = kbfsOps.Write(ctx, cNode, make([]byte, 3), 7)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	dPath := ops.nodeCache.PathFromNode(dNode)
+	totalBytes, fileCount, err := ops.blocks.DirSize(ctx, lState, head, dPath)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5+10+10+3), totalBytes)
+	require.Equal(t, 4, fileCount)
+
+	t.Log("Trees deeper than the max depth are rejected.")
+	_, _, err = ops.blocks.dirSizeWithMaxDepth(ctx, lState, head, dPath, 1)
+	require.IsType(t, DirTooDeepError{}, errors.Cause(err))
+
+	t.Log("A canceled walk fails.")
+	canceledCtx, cancel2 := context.WithCancel(ctx)
+	cancel2()
+	_, _, err = ops.blocks.DirSize(canceledCtx, lState, head, dPath)
+	require.Equal(t, context.Canceled, errors.Cause(err))
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestFolderBlockOpsWriterByteStats(t *testing.T) {
+	config, uid1, ctx, cancel := kbfsOpsInitNoMocks(t, "u1")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	// A simulated second writer.
+	uid2 := keybase1.MakeTestUID(1000)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "u1", tlf.Private)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	before := ops.blocks.WriterByteStats()
+
+	t.Log("A sync counts the bytes of its new blocks.")
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	after := ops.blocks.WriterByteStats()
+	require.True(t, after[uid1.AsUserOrTeam()] > before[uid1.AsUserOrTeam()])
+
+	t.Log("New blocks are attributed to their creators, and new " +
+		"references to existing blocks aren't counted.")
+	bType := keybase1.BlockType_DATA
+	makeBlock := func(id byte, ctx kbfsblock.Context) BlockPointer {
+		return BlockPointer{
+			ID:         kbfsblock.FakeID(id),
+			DataVer:    FirstValidDataVer,
+			DirectType: DirectBlock,
+			Context:    ctx,
+		}
+	}
+	bps := newBlockPutState(4)
+	bps.addNewBlock(
+		makeBlock(101, kbfsblock.MakeFirstContext(uid1.AsUserOrTeam(), bType)),
+		NewFileBlock(), ReadyBlockData{buf: make([]byte, 100)}, nil)
+	bps.addNewBlock(
+		makeBlock(102, kbfsblock.MakeFirstContext(uid2.AsUserOrTeam(), bType)),
+		NewFileBlock(), ReadyBlockData{buf: make([]byte, 200)}, nil)
+	bps.addNewBlock(
+		makeBlock(103, kbfsblock.MakeFirstContext(uid2.AsUserOrTeam(), bType)),
+		NewFileBlock(), ReadyBlockData{buf: make([]byte, 300)}, nil)
+	bps.addNewBlock(
+		makeBlock(101, kbfsblock.MakeContext(uid1.AsUserOrTeam(),
+			uid2.AsUserOrTeam(), kbfsblock.RefNonce{1}, bType)),
+		NewFileBlock(), ReadyBlockData{}, nil)
+	err = ops.finalizeBlocks(bps)
+	require.NoError(t, err)
+
+	stats := ops.blocks.WriterByteStats()
+	require.Equal(t, after[uid1.AsUserOrTeam()]+100, stats[uid1.AsUserOrTeam()])
+	require.Equal(t, after[uid2.AsUserOrTeam()]+500, stats[uid2.AsUserOrTeam()])
+}
+
+func TestFolderBlockOpsWriteWithLayout(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13}
+
+	// Bad layouts are rejected.
+	for _, boundaries := range [][]int64{
+		{0, 3}, {3, 3}, {7, 3}, {3, 13}, {3, 20},
+	} {
+		err = ops.blocks.WriteWithLayout(
+			ctx, lState, head, fileNode, data, 0, boundaries)
+		require.IsType(t, BlockLayoutError{}, err, "%v", boundaries)
+	}
+	// Only appends are allowed.
+	err = ops.blocks.WriteWithLayout(
+		ctx, lState, head, fileNode, data, 1, []int64{3})
+	require.IsType(t, BlockLayoutError{}, err)
+
+	boundaries := []int64{3, 7, 12}
+	err = ops.blocks.WriteWithLayout(
+		ctx, lState, head, fileNode, data, 0, boundaries)
+	require.NoError(t, err)
+
+	checkOffs := func(fblock *FileBlock) {
+		require.True(t, fblock.IsInd)
+		offs := make([]int64, 0, len(fblock.IPtrs))
+		for _, iptr := range fblock.IPtrs {
+			offs = append(offs, iptr.Off)
+		}
+		require.Equal(t, append([]int64{0}, boundaries...), offs)
+	}
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	block, err := config.DirtyBlockCache().Get(
+		filePath.Tlf, filePath.tailPointer(), filePath.Branch)
+	require.NoError(t, err)
+	checkOffs(block.(*FileBlock))
+
+	buf := make([]byte, len(data))
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	// The layout survives the sync.
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	head, _ = ops.getHead(lState)
+	filePath = ops.nodeCache.PathFromNode(fileNode)
+	fblock, err := ops.blocks.GetFileBlockForReading(
+		ctx, lState, head, filePath.tailPointer(), filePath.Branch, filePath)
+	require.NoError(t, err)
+	checkOffs(fblock)
+
+	// A range bigger than the splitter's max block size spills into
+	// more blocks.
+	config.SetBlockSplitter(&BlockSplitterSimple{5, 100, 100 * 1024})
+	fileNode2, _, err := kbfsOps.CreateFile(
+		ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	head, _ = ops.getHead(lState)
+	err = ops.blocks.WriteWithLayout(
+		ctx, lState, head, fileNode2, data, 0, []int64{3})
+	require.NoError(t, err)
+	boundaries = []int64{3, 8}
+	filePath = ops.nodeCache.PathFromNode(fileNode2)
+	block, err = config.DirtyBlockCache().Get(
+		filePath.Tlf, filePath.tailPointer(), filePath.Branch)
+	require.NoError(t, err)
+	checkOffs(block.(*FileBlock))
+	for _, iptr := range block.(*FileBlock).IPtrs {
+		child, err := config.DirtyBlockCache().Get(
+			filePath.Tlf, iptr.BlockPointer, filePath.Branch)
+		require.NoError(t, err)
+		require.True(t, len(child.(*FileBlock).Contents) <= 5)
+	}
+	_, err = kbfsOps.Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+// Make sure that writing bytes identical to the ones already in the
+// file doesn't dirty any of its blocks, but still updates its times,
+// and that a write that changes a byte dirties the file as usual.
+func TestFolderBlockOpsWriteUnchangedBytes(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+
+	// Make blocks of 5 bytes.
+	bsplit := &BlockSplitterSimple{5, 100, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	require.Equal(t, cleanState, ops.blocks.GetState(lState))
+	oldDe, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+
+	t.Log("Rewrite a region spanning several blocks with the same bytes.")
+	clock.Add(time.Minute)
+	err = kbfsOps.Write(ctx, fileNode, data[3:12], 3)
+	require.NoError(t, err)
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	require.False(t, config.DirtyBlockCache().IsAnyDirty(filePath.Tlf))
+	checkTimes := func() {
+		de, err := kbfsOps.Stat(ctx, fileNode)
+		require.NoError(t, err)
+		require.Equal(t, clock.Now().UnixNano(), de.Mtime)
+		require.Equal(t, clock.Now().UnixNano(), de.Ctime)
+		require.Equal(t, oldDe.Size, de.Size)
+	}
+	checkTimes()
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, cleanState, ops.blocks.GetState(lState))
+	checkTimes()
+
+	t.Log("Changing a single byte dirties the file.")
+	err = kbfsOps.Write(ctx, fileNode, []byte{100}, 7)
+	require.NoError(t, err)
+	require.Equal(t, dirtyState, ops.blocks.GetState(lState))
+	filePath = ops.nodeCache.PathFromNode(fileNode)
+	require.True(t, ops.blocks.IsDirty(lState, filePath))
+
+	expected := append([]byte(nil), data...)
+	expected[7] = 100
+	buf := make([]byte, len(data))
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, expected, buf)
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+// Make sure that a split hint changes the block layout that a file
+// gets at sync time, that files without a hint keep their layout, and
+// that a hint can't make blocks bigger than the splitter's max size.
+func TestFolderBlockOpsSyncSplitHint(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Allow blocks of up to 20 bytes.
+	bsplit := &BlockSplitterSimple{20, 100, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+
+	data := make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	// Start every file out with 5-byte blocks, so the hints have
+	// to merge them.
+	var boundaries []int64
+	for off := int64(5); off < int64(len(data)); off += 5 {
+		boundaries = append(boundaries, off)
+	}
+
+	hints := map[string]int64{"a": 0, "b": 10, "c": 20, "d": 40}
+	nodes := make(map[string]Node, len(hints))
+	for name, hint := range hints {
+		n, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+		head, _ := ops.getHead(lState)
+		err = ops.blocks.WriteWithLayout(
+			ctx, lState, head, n, data, 0, boundaries)
+		require.NoError(t, err)
+		err = ops.blocks.SetSyncSplitHint(lState, n, hint)
+		require.NoError(t, err)
+		nodes[name] = n
+	}
+
+	err := kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	head, _ := ops.getHead(lState)
+	expectedBlocks := map[string]int{"a": 8, "b": 4, "c": 2, "d": 2}
+	for name, n := range nodes {
+		filePath := ops.nodeCache.PathFromNode(n)
+		fblock, err := ops.blocks.GetFileBlockForReading(
+			ctx, lState, head, filePath.tailPointer(), filePath.Branch,
+			filePath)
+		require.NoError(t, err)
+		require.True(t, fblock.IsInd)
+		require.Len(t, fblock.IPtrs, expectedBlocks[name], name)
+
+		buf := make([]byte, len(data))
+		nr, err := kbfsOps.Read(ctx, n, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), nr)
+		require.Equal(t, data, buf)
+	}
+}
+
+func TestFolderBlockOpsSyncRecoverableErrorBudget(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	const budget = 2
+	ops.blocks.SetSyncRecoverableErrorBudget(lState, budget)
+
+	errChan := make(chan error, 1)
+	func() {
+		ops.blocks.blockLock.Lock(lState)
+		defer ops.blocks.blockLock.Unlock(lState)
+		df := ops.blocks.dirtyFiles[filePath.tailPointer()]
+		require.NotNil(t, df)
+		df.addErrListener(errChan)
+	}()
+
+	t.Log("Recoverable errors within the budget aren't surfaced.")
+	recoverableErr := kbfsblock.ServerErrorBlockNonExistent{}
+	for i := 0; i < budget; i++ {
+		ops.blocks.CleanupSyncState(ctx, lState, head.ReadOnly(), filePath,
+			nil, fileSyncState{}, recoverableErr)
+		select {
+		case err := <-errChan:
+			t.Fatalf("Unexpected error after %d failures: %+v", i+1, err)
+		default:
+		}
+	}
+
+	t.Log("The next one is surfaced as a non-recoverable error.")
+	ops.blocks.CleanupSyncState(ctx, lState, head.ReadOnly(), filePath,
+		nil, fileSyncState{}, recoverableErr)
+	select {
+	case err := <-errChan:
+		require.IsType(t, SyncErrorBudgetExceededError{}, err)
+		require.False(t, isRecoverableBlockError(err))
+	default:
+		t.Fatal("Budget error wasn't surfaced")
+	}
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestFolderBlockOpsSyncErrorStats(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	require.Equal(t, syncErrorStats{}, ops.blocks.SyncErrorStats())
+
+	t.Log("Successful syncs aren't counted.")
+	ops.blocks.CleanupSyncState(ctx, lState, head.ReadOnly(), filePath,
+		nil, fileSyncState{}, nil)
+	require.Equal(t, syncErrorStats{}, ops.blocks.SyncErrorStats())
+
+	t.Log("Recoverable errors are counted separately from fatal ones.")
+	recoverableErr := kbfsblock.ServerErrorBlockNonExistent{}
+	for i := 0; i < 2; i++ {
+		ops.blocks.CleanupSyncState(ctx, lState, head.ReadOnly(), filePath,
+			nil, fileSyncState{}, recoverableErr)
+	}
+	ops.blocks.CleanupSyncState(ctx, lState, head.ReadOnly(), filePath,
+		nil, fileSyncState{}, errPutFailedForTest)
+	require.Equal(t, syncErrorStats{Recoverable: 2, Fatal: 1},
+		ops.blocks.SyncErrorStats())
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, syncErrorStats{Recoverable: 2, Fatal: 1},
+		ops.blocks.SyncErrorStats())
+}
+
+func TestFolderBlockOpsSearchForNodesMaxDepth(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make root/a/b/c, with a file in a and another in c.
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateDir(ctx, aNode, "b")
+	require.NoError(t, err)
+	cNode, _, err := kbfsOps.CreateDir(ctx, bNode, "c")
+	require.NoError(t, err)
+	faNode, _, err := kbfsOps.CreateFile(ctx, aNode, "fa", false, NoExcl)
+	require.NoError(t, err)
+	fcNode, _, err := kbfsOps.CreateFile(ctx, cNode, "fc", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	faPath := ops.nodeCache.PathFromNode(faNode)
+	fcPath := ops.nodeCache.PathFromNode(fcNode)
+	newPtrs := make(map[BlockPointer]bool)
+	for _, pn := range fcPath.path {
+		newPtrs[pn.BlockPointer] = true
+	}
+	ptrs := []BlockPointer{faPath.tailPointer(), fcPath.tailPointer()}
+	search := func(maxDepth int) (map[BlockPointer]Node, bool) {
+		nodeMap, _, depthExceeded, err := ops.blocks.SearchForNodesWithMaxDepth(
+			ctx, ops.nodeCache, ptrs, newPtrs, head,
+			head.data.Dir.BlockPointer, maxDepth)
+		require.NoError(t, err)
+		require.Len(t, nodeMap, len(ptrs))
+		return nodeMap, depthExceeded
+	}
+
+	t.Log("An unbounded search finds both files.")
+	nodeMap, depthExceeded := search(0)
+	require.False(t, depthExceeded)
+	require.Equal(t, faNode.GetID(), nodeMap[faPath.tailPointer()].GetID())
+	require.Equal(t, fcNode.GetID(), nodeMap[fcPath.tailPointer()].GetID())
+
+	t.Log("A search that only descends into a misses the file in c.")
+	nodeMap, depthExceeded = search(1)
+	require.True(t, depthExceeded)
+	require.Equal(t, faNode.GetID(), nodeMap[faPath.tailPointer()].GetID())
+	require.Nil(t, nodeMap[fcPath.tailPointer()])
+
+	t.Log("A deep enough limit isn't exceeded.")
+	nodeMap, depthExceeded = search(3)
+	require.False(t, depthExceeded)
+	require.Equal(t, fcNode.GetID(), nodeMap[fcPath.tailPointer()].GetID())
+
+	t.Log("The folder's limit applies to SearchForNodes.")
+	ops.blocks.SetMaxSearchDepth(lState, 1)
+	nodeMap, _, err = ops.blocks.SearchForNodes(ctx, ops.nodeCache, ptrs,
+		newPtrs, head, head.data.Dir.BlockPointer)
+	require.NoError(t, err)
+	require.Equal(t, faNode.GetID(), nodeMap[faPath.tailPointer()].GetID())
+	require.Nil(t, nodeMap[fcPath.tailPointer()])
+}
+
+func TestFolderBlockOpsPunchHole(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make blocks of 5 bytes.
+	bsplit := &BlockSplitterSimple{5, 100, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 30)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	getInfos := func() []BlockInfo {
+		head, _ := ops.getHead(lState)
+		infos, err := ops.blocks.GetIndirectFileBlockInfos(
+			ctx, lState, head, ops.nodeCache.PathFromNode(fileNode))
+		require.NoError(t, err)
+		return infos
+	}
+	checkContents := func() {
+		buf := make([]byte, len(data))
+		nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), nr)
+		require.Equal(t, data, buf)
+		ei, err := kbfsOps.Stat(ctx, fileNode)
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(data)), ei.Size)
+	}
+	punchNoSync := func(off, length int64) {
+		err := kbfsOps.PunchHole(ctx, fileNode, off, length)
+		require.NoError(t, err)
+		for i := off; i < off+length && i < int64(len(data)); i++ {
+			data[i] = 0
+		}
+		checkContents()
+	}
+	punch := func(off, length int64) {
+		punchNoSync(off, length)
+		err := kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+		checkContents()
+	}
+	infos := getInfos()
+	require.Len(t, infos, 6)
+
+	t.Log("An aligned hole removes the blocks it covers.")
+	punch(10, 10)
+	newInfos := getInfos()
+	require.Len(t, newInfos, 4)
+	for _, info := range newInfos {
+		require.NotEqual(t, infos[2].BlockPointer, info.BlockPointer)
+		require.NotEqual(t, infos[3].BlockPointer, info.BlockPointer)
+	}
+
+	t.Log("An unaligned hole zeroes the bytes it covers.")
+	punch(2, 6)
+	require.Len(t, getInfos(), 4)
+
+	t.Log("A hole at the end of the file keeps the file size.")
+	punch(25, 100)
+	require.Len(t, getInfos(), 4)
+
+	t.Log("A hole can cover blocks that are still dirty, and a huge " +
+		"length only reserves what the hole can actually dirty.")
+	newData := []byte{7, 8, 9, 10, 11, 12}
+	err = kbfsOps.Write(ctx, fileNode, newData, 22)
+	require.NoError(t, err)
+	copy(data[22:], newData)
+	punch(24, 1<<40)
+	require.Len(t, getInfos(), 4)
+
+	t.Log("Dirty blocks dropped by a hole leave the dirty cache.")
+	infos = getInfos()
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3, 4, 5, 6, 7, 8}, 1)
+	require.NoError(t, err)
+	copy(data[1:], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	dirtyBcache := config.DirtyBlockCache()
+	file := ops.nodeCache.PathFromNode(fileNode)
+	require.True(t, dirtyBcache.IsDirty(
+		ops.id(), infos[1].BlockPointer, file.Branch))
+	punchNoSync(5, 15)
+	require.False(t, dirtyBcache.IsDirty(
+		ops.id(), infos[1].BlockPointer, file.Branch))
+	require.True(t, dirtyBcache.IsDirty(
+		ops.id(), infos[0].BlockPointer, file.Branch))
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	checkContents()
+	require.Len(t, getInfos(), 3)
+
+	t.Log("Writes can fill the holes again.")
+	err = kbfsOps.Write(ctx, fileNode, []byte{42, 43}, 12)
+	require.NoError(t, err)
+	data[12], data[13] = 42, 43
+	checkContents()
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	checkContents()
+}
+
+func TestFolderBlockOpsGetDirtyRefsWithBytes(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	sizes := map[string]int{"a": 10, "b": 20, "c": 30}
+	nodes := make(map[string]Node, len(sizes))
+	for name := range sizes {
+		n, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+		nodes[name] = n
+	}
+	err := kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	require.Len(t, ops.blocks.GetDirtyRefsWithBytes(lState), 0)
+
+	for name, size := range sizes {
+		err = kbfsOps.Write(ctx, nodes[name], make([]byte, size), 0)
+		require.NoError(t, err)
+	}
+
+	infos := ops.blocks.GetDirtyRefsWithBytes(lState)
+	byRef := make(map[BlockRef]DirtyRefInfo, len(infos))
+	for _, info := range infos {
+		byRef[info.Ref] = info
+	}
+	for name, size := range sizes {
+		ref := ops.nodeCache.PathFromNode(nodes[name]).tailRef()
+		info, ok := byRef[ref]
+		require.True(t, ok, name)
+		require.Equal(t, int64(size), info.DirtyBytes, name)
+		require.False(t, info.Syncing, name)
+	}
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Len(t, ops.blocks.GetDirtyRefsWithBytes(lState), 0)
+}
+
+func TestFolderBlockOpsImportFileBlocks(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make blocks of 5 bytes.
+	bsplit := &BlockSplitterSimple{5, 100, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+
+	data := make([]byte, 23)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	srcNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, srcNode, data, 0)
+	require.NoError(t, err)
+	dstNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	head, _ := ops.getHead(lState)
+	srcPath := ops.nodeCache.PathFromNode(srcNode)
+	srcBlock, err := ops.blocks.GetFileBlockForReading(
+		ctx, lState, head, srcPath.tailPointer(), srcPath.Branch, srcPath)
+	require.NoError(t, err)
+	require.True(t, srcBlock.IsInd)
+	var infos []BlockInfo
+	var offsets []int64
+	for _, iptr := range srcBlock.IPtrs {
+		infos = append(infos, iptr.BlockInfo)
+		offsets = append(offsets, iptr.Off)
+	}
+
+	t.Log("Offsets that don't match the blocks are rejected.")
+	badOffsets := append([]int64(nil), offsets...)
+	badOffsets[1] = badOffsets[2]
+	err = ops.blocks.ImportFileBlocks(
+		ctx, lState, head, dstNode, infos, badOffsets)
+	require.IsType(t, FileBlockImportError{}, err)
+	err = ops.blocks.ImportFileBlocks(
+		ctx, lState, head, dstNode, infos, offsets[1:])
+	require.IsType(t, FileBlockImportError{}, err)
+
+	err = ops.blocks.ImportFileBlocks(
+		ctx, lState, head, dstNode, infos, offsets)
+	require.NoError(t, err)
+
+	checkRead := func() {
+		buf := make([]byte, len(data))
+		nr, err := kbfsOps.Read(ctx, dstNode, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(data)), nr)
+		require.Equal(t, data, buf)
+	}
+	checkRead()
+
+	t.Log("The sync adds new references to the imported blocks.")
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	checkRead()
+
+	head, _ = ops.getHead(lState)
+	dstPath := ops.nodeCache.PathFromNode(dstNode)
+	dstBlock, err := ops.blocks.GetFileBlockForReading(
+		ctx, lState, head, dstPath.tailPointer(), dstPath.Branch, dstPath)
+	require.NoError(t, err)
+	require.True(t, dstBlock.IsInd)
+	require.Len(t, dstBlock.IPtrs, len(infos))
+	for i, iptr := range dstBlock.IPtrs {
+		require.Equal(t, infos[i].ID, iptr.ID)
+		require.NotEqual(t, infos[i].RefNonce, iptr.RefNonce)
+		require.Equal(t, offsets[i], iptr.Off)
+	}
+
+	t.Log("Importing into a non-empty file fails.")
+	err = ops.blocks.ImportFileBlocks(
+		ctx, lState, head, dstNode, infos, offsets)
+	require.IsType(t, FileBlockImportError{}, err)
+}
+
+type readNotifyCountingReporter struct {
+	Reporter
+
+	lock  sync.Mutex
+	reads int
+}
+
+func (r *readNotifyCountingReporter) Notify(
+	ctx context.Context, notification *keybase1.FSNotification) {
+	switch notification.NotificationType {
+	case keybase1.FSNotificationType_DECRYPTING,
+		keybase1.FSNotificationType_VERIFYING:
+		r.lock.Lock()
+		r.reads++
+		r.lock.Unlock()
+	}
+	r.Reporter.Notify(ctx, notification)
+}
+
+func (r *readNotifyCountingReporter) numReads() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.reads
+}
+
+func TestFolderBlockOpsInternalReadsDontNotify(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make blocks of 5 bytes.
+	bsplit := &BlockSplitterSimple{5, 100, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 20)
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	rep := &readNotifyCountingReporter{Reporter: config.Reporter()}
+	config.SetReporter(rep)
+	defer config.SetReporter(rep.Reporter)
+	config.ResetCaches()
+
+	t.Log("Internal traversals of a valid path don't notify.")
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	require.True(t, filePath.isValidForNotification())
+	fblock, err := ops.blocks.GetFileBlockForReading(
+		ctx, lState, head, filePath.tailPointer(), filePath.Branch, filePath)
+	require.NoError(t, err)
+	require.True(t, fblock.IsInd)
+	_, err = ops.blocks.GetFileBlockForReading(
+		ctx, lState, head, fblock.IPtrs[0].BlockPointer, filePath.Branch,
+		filePath)
+	require.NoError(t, err)
+	config.ResetCaches()
+	_, err = ops.blocks.GetIndirectFileBlockInfos(ctx, lState, head, filePath)
+	require.NoError(t, err)
+	require.Equal(t, 0, rep.numReads())
+
+	t.Log("A user read of uncached blocks does notify.")
+	config.ResetCaches()
+	buf := make([]byte, len(data))
+	_, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.NotEqual(t, 0, rep.numReads())
+}
+
+func TestFolderBlockOpsPinParentBlocksDuringSync(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	fileNode, _, err := kbfsOps.CreateFile(ctx, dirNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	dirPtr := ops.nodeCache.PathFromNode(dirNode).tailPointer()
+	bcache := config.BlockCache().(*BlockCacheStandard)
+	_, err = bcache.Get(dirPtr)
+	require.NoError(t, err)
+
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+
+	oldBServer := config.BlockServer()
+	defer config.SetBlockServer(oldBServer)
+	onSyncStalledCh, syncUnstallCh, ctxStallSync :=
+		StallBlockOp(ctx, config, StallableBlockPut, 1)
+	syncErrCh := make(chan error, 1)
+	go func() {
+		syncErrCh <- kbfsOps.SyncAll(
+			ctxStallSync, rootNode.GetFolderBranch())
+	}()
+	<-onSyncStalledCh
+
+	t.Log("Cache pressure evicts all transient entries, but not the " +
+		"pinned parent directory.")
+	require.NotEqual(t, 0, bcache.numPinned())
+	oldCapacity := bcache.GetCleanBytesCapacity()
+	bcache.SetCleanBytesCapacity(1)
+	otherPtr := BlockPointer{ID: kbfsblock.FakeID(100)}
+	_ = bcache.Put(otherPtr, ops.id(), NewDirBlock(), TransientEntry)
+	require.Equal(t, 0, bcache.cleanTransient.Len())
+	_, err = bcache.Get(dirPtr)
+	require.NoError(t, err)
+	bcache.SetCleanBytesCapacity(oldCapacity)
+
+	close(syncUnstallCh)
+	require.NoError(t, <-syncErrCh)
+
+	t.Log("Everything is unpinned once the sync completes.")
+	require.Equal(t, 0, bcache.numPinned())
+}
+
+// Make sure that a truncate that lands on a block that's in the
+// middle of being synced is deferred, and that its replay leaves the
+// file at the truncated size.
+func TestFolderBlockOpsDeferredTruncateReplay(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+
+	oldBServer := config.BlockServer()
+	defer config.SetBlockServer(oldBServer)
+	onSyncStalledCh, syncUnstallCh, ctxStallSync :=
+		StallBlockOp(ctx, config, StallableBlockPut, 1)
+	syncErrCh := make(chan error, 1)
+	go func() {
+		syncErrCh <- kbfsOps.SyncAll(
+			ctxStallSync, rootNode.GetFolderBranch())
+	}()
+	<-onSyncStalledCh
+
+	t.Log("Truncate the file while its block is being synced.")
+	err = kbfsOps.Truncate(ctx, fileNode, 5)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	func() {
+		ops.blocks.blockLock.Lock(lState)
+		defer ops.blocks.blockLock.Unlock(lState)
+		filePath := ops.nodeCache.PathFromNode(fileNode)
+		ds := ops.blocks.deferred[filePath.tailRef()]
+		require.Len(t, ds.writes, 1)
+		require.Equal(t, uint64(5), ds.writes[0].off)
+	}()
+
+	close(syncUnstallCh)
+	require.NoError(t, <-syncErrCh)
+
+	t.Log("The replayed truncate is reflected before the next sync.")
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), ei.Size)
+	func() {
+		ops.blocks.blockLock.Lock(lState)
+		defer ops.blocks.blockLock.Unlock(lState)
+		require.Len(t, ops.blocks.deferred, 0)
+	}()
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	ei, err = kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), ei.Size)
+	buf := make([]byte, 10)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data[:5], buf[:n])
+}
+
+// Make sure that a truncate during a sync drops any deferred writes
+// to the region it removes, so they're never replayed.
+func TestFolderBlockOpsTruncateDropsDeferredWrites(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+
+	oldBServer := config.BlockServer()
+	defer config.SetBlockServer(oldBServer)
+	onSyncStalledCh, syncUnstallCh, ctxStallSync :=
+		StallBlockOp(ctx, config, StallableBlockPut, 1)
+	syncErrCh := make(chan error, 1)
+	go func() {
+		syncErrCh <- kbfsOps.SyncAll(
+			ctxStallSync, rootNode.GetFolderBranch())
+	}()
+	<-onSyncStalledCh
+
+	t.Log("Write on both sides of the truncation point, and then " +
+		"truncate, while the sync is in progress.")
+	err = kbfsOps.Write(ctx, fileNode, []byte{11}, 2)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{12, 13}, 7)
+	require.NoError(t, err)
+	err = kbfsOps.Truncate(ctx, fileNode, 5)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	ops.blocks.blockLock.Lock(lState)
+	ds := ops.blocks.deferred[filePath.tailRef()]
+	offs := make([]uint64, 0, len(ds.writes))
+	for _, dw := range ds.writes {
+		offs = append(offs, dw.off)
+	}
+	ops.blocks.blockLock.Unlock(lState)
+	require.Equal(t, []uint64{2, 5}, offs)
+
+	close(syncUnstallCh)
+	require.NoError(t, <-syncErrCh)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), ei.Size)
+	buf := make([]byte, 10)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 11, 4, 5}, buf[:n])
+}
+
+// Make sure that writes deferred by a sync that's then abandoned can
+// be replayed on top of the current head.
+func TestFolderBlockOpsReplayDeferredWrites(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	ptr := filePath.tailPointer()
+
+	t.Log("Dirty the file and pretend a sync of it has started.")
+	err = kbfsOps.Write(ctx, fileNode, []byte{20, 21}, 0)
+	require.NoError(t, err)
+	ops.blocks.blockLock.Lock(lState)
+	df := ops.blocks.dirtyFiles[ptr]
+	require.NotNil(t, df)
+	err = df.setBlockSyncing(ptr)
+	ops.blocks.blockLock.Unlock(lState)
+	require.NoError(t, err)
+
+	t.Log("A write during the sync is deferred.")
+	err = kbfsOps.Write(ctx, fileNode, []byte{30, 31}, 5)
+	require.NoError(t, err)
+	ops.blocks.blockLock.Lock(lState)
+	require.Len(t, ops.blocks.deferred[filePath.tailRef()].writes, 1)
+
+	t.Log("Abandon the sync, and reset the file to the current head.")
+	for _, p := range df.getBlockPtrs() {
+		err = config.DirtyBlockCache().Delete(ops.id(), p, filePath.Branch)
+		require.NoError(t, err)
+	}
+	err = ops.blocks.clearCacheInfoLocked(lState, filePath)
+	ops.blocks.blockLock.Unlock(lState)
+	require.NoError(t, err)
+
+	head, _ := ops.getHead(lState)
+	stillDirty, err := ops.blocks.ReplayDeferredWrites(
+		ctx, lState, head, filePath)
+	require.NoError(t, err)
+	require.True(t, stillDirty)
+	require.Len(t, ops.blocks.deferred, 0)
+	require.True(t, ops.blocks.IsDirty(lState, filePath))
+
+	expected := append([]byte(nil), data...)
+	expected[5], expected[6] = 30, 31
+	buf := make([]byte, len(data))
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, expected, buf[:n])
+
+	t.Log("The replayed data survives a sync.")
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	buf = make([]byte, len(data))
+	n, err = kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, expected, buf[:n])
+}
+
+// Make sure that extending truncates fill in zeroes up to the
+// configured cutoff, and leave a hole beyond it.
+func TestFolderBlockOpsTruncateExtendCutoff(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	tunables := config.Tunables()
+	tunables.TruncateExtendCutoff = 100
+	require.NoError(t, config.SetTunables(tunables))
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	truncate := func(name string, size uint64) *FileBlock {
+		n, _, err := kbfsOps.CreateFile(ctx, rootNode, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, n, data, 0)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+
+		err = kbfsOps.Truncate(ctx, n, size)
+		require.NoError(t, err)
+		filePath := ops.nodeCache.PathFromNode(n)
+		block, err := config.DirtyBlockCache().Get(
+			filePath.Tlf, filePath.tailPointer(), filePath.Branch)
+		require.NoError(t, err)
+
+		buf := make([]byte, size)
+		nr, err := kbfsOps.Read(ctx, n, buf, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(size), nr)
+		require.Equal(t, data, buf[:len(data)])
+		require.Equal(t, make([]byte, int(size)-len(data)), buf[len(data):])
+		return block.(*FileBlock)
+	}
+
+	t.Log("Extending by exactly the cutoff fills in zeroes.")
+	fblock := truncate("a", uint64(len(data))+100)
+	require.False(t, fblock.IsInd)
+	require.Len(t, fblock.Contents, len(data)+100)
+
+	t.Log("Extending by more than the cutoff leaves a hole.")
+	fblock = truncate("b", uint64(len(data))+101)
+	require.True(t, fblock.IsInd)
+}
+
+func TestFolderBlockOpsMaxFileBytesOverride(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	privateRoot := GetRootNodeOrBust(
+		ctx, t, config, "test_user", tlf.Private)
+	publicRoot := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Public)
+	kbfsOps := config.KBFSOps()
+	privateFile, _, err := kbfsOps.CreateFile(
+		ctx, privateRoot, "a", false, NoExcl)
+	require.NoError(t, err)
+	publicFile, _, err := kbfsOps.CreateFile(
+		ctx, publicRoot, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	const override = 10
+	err = kbfsOps.SetFolderMaxFileBytes(
+		ctx, privateRoot.GetFolderBranch(), override)
+	require.NoError(t, err)
+	ops := getOps(config, privateRoot.GetFolderBranch().Tlf)
+	privatePath := ops.nodeCache.PathFromNode(privateFile)
+
+	t.Log("Writes and truncates past the override are rejected.")
+	err = kbfsOps.Write(ctx, privateFile, make([]byte, override), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, privateFile, []byte{1}, override)
+	require.Equal(t, FileTooBigError{privatePath, override + 1, override}, err)
+	err = kbfsOps.Truncate(ctx, privateFile, 15)
+	require.Equal(t, FileTooBigError{privatePath, 15, override}, err)
+
+	t.Log("Other folders are only limited by the global limit.")
+	publicOps := getOps(config, publicRoot.GetFolderBranch().Tlf)
+	publicPath := publicOps.nodeCache.PathFromNode(publicFile)
+	err = kbfsOps.Write(ctx, publicFile, make([]byte, 15), 0)
+	require.NoError(t, err)
+	maxBytes := config.MaxFileBytes()
+	err = kbfsOps.Truncate(ctx, publicFile, maxBytes+1)
+	require.Equal(t, FileTooBigError{publicPath, int64(maxBytes) + 1,
+		maxBytes}, err)
+
+	t.Log("Clearing the override restores the global limit.")
+	err = kbfsOps.SetFolderMaxFileBytes(ctx, privateRoot.GetFolderBranch(), 0)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, privateFile, []byte{1}, override)
+	require.NoError(t, err)
+
+	err = kbfsOps.SyncAll(ctx, privateRoot.GetFolderBranch())
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, publicRoot.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestFolderBlockOpsTruncateIndirectToZero(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make the blocks small, so a short write makes several levels
+	// of them.
+	bsplit := &BlockSplitterSimple{5, 2, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 40)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	oldTopPtr := filePath.tailPointer()
+	infos, err := ops.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, head, filePath)
+	require.NoError(t, err)
+	require.True(t, len(infos) > 8)
+
+	t.Log("Dirty one leaf block first, which unrefs it right away.")
+	err = kbfsOps.Write(ctx, fileNode, []byte{100}, 12)
+	require.NoError(t, err)
+	err = kbfsOps.Truncate(ctx, fileNode, 0)
+	require.NoError(t, err)
+
+	unrefs := make(map[BlockPointer]bool)
+	func() {
+		ops.blocks.blockLock.Lock(lState)
+		defer ops.blocks.blockLock.Unlock(lState)
+		si := ops.blocks.unrefCache[filePath.tailRef()]
+		require.NotNil(t, si)
+		for _, info := range si.unrefs {
+			require.False(t, unrefs[info.BlockPointer])
+			unrefs[info.BlockPointer] = true
+		}
+		df := ops.blocks.dirtyFiles[filePath.tailPointer()]
+		require.NotNil(t, df)
+		require.False(t, df.hasChildBlocks())
+	}()
+	for _, info := range infos {
+		require.True(t, unrefs[info.BlockPointer],
+			"Missing unref for %v", info.BlockPointer)
+	}
+	require.Len(t, unrefs, len(infos))
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("The sync unrefs all the old blocks, including the top one.")
+	head, _ = ops.getHead(lState)
+	synced := make(map[BlockPointer]bool)
+	for _, op := range head.data.Changes.Ops {
+		for _, ptr := range op.Unrefs() {
+			synced[ptr] = true
+		}
+		for _, update := range op.allUpdates() {
+			synced[update.Unref] = true
+		}
+	}
+	require.True(t, synced[oldTopPtr])
+	for _, info := range infos {
+		require.True(t, synced[info.BlockPointer],
+			"Missing synced unref for %v", info.BlockPointer)
+	}
+
+	filePath = ops.nodeCache.PathFromNode(fileNode)
+	require.Equal(t, DirectBlock, filePath.tailPointer().DirectType)
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), ei.Size)
+	buf := make([]byte, 10)
+	n, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), n)
+}
+
+func TestFolderBlockOpsEncodedFileSize(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	bsplit := &BlockSplitterSimple{5, 2, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+
+	t.Log("Make a sparse file, with data only at the start and the end.")
+	const logicalSize = 1 << 20
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3, 4, 5, 6, 7}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.Truncate(ctx, fileNode, logicalSize-3)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{8, 9, 10}, logicalSize-3)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	encodedSize, err := ops.blocks.EncodedFileSize(
+		ctx, lState, head, filePath)
+	require.NoError(t, err)
+
+	// Add up the sizes of the blocks the server actually has.
+	infos, err := ops.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, head, filePath)
+	require.NoError(t, err)
+	require.NotEmpty(t, infos)
+	ptrs := []BlockPointer{filePath.tailPointer()}
+	for _, info := range infos {
+		ptrs = append(ptrs, info.BlockPointer)
+	}
+	var expectedSize uint64
+	for _, ptr := range ptrs {
+		buf, _, err := config.BlockServer().Get(
+			ctx, head.TlfID(), ptr.ID, ptr.Context)
+		require.NoError(t, err)
+		expectedSize += uint64(len(buf))
+	}
+	require.Equal(t, expectedSize, encodedSize)
+	require.True(t, encodedSize < logicalSize,
+		"Encoded size %d not smaller than logical size %d",
+		encodedSize, logicalSize)
+
+	t.Log("Dirtying a block doesn't change the on-server size.")
+	err = kbfsOps.Write(ctx, fileNode, []byte{11}, 0)
+	require.NoError(t, err)
+	dirtySize, err := ops.blocks.EncodedFileSize(
+		ctx, lState, head, filePath)
+	require.NoError(t, err)
+	require.Equal(t, encodedSize, dirtySize)
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestFolderBlockOpsCancelDuringDirtyPermissionWait(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	dirtyBcache := config.DirtyBlockCache().(*DirtyBlockCacheStandard)
+	blockedChan := make(chan int64, 1)
+	dirtyBcache.blockedChanForTesting = blockedChan
+	waitBufBytes := func() int64 {
+		dirtyBcache.lock.RLock()
+		defer dirtyBcache.lock.RUnlock()
+		return dirtyBcache.waitBufBytes
+	}
+
+	t.Log("Fill up the dirty buffer, so the next request blocks.")
+	tlfID := rootNode.GetFolderBranch().Tlf
+	fillBytes := dirtyBcache.maxSyncBufCap * 2
+	c, err := dirtyBcache.RequestPermissionToDirty(ctx, tlfID, fillBytes)
+	require.NoError(t, err)
+	<-c
+	require.Equal(t, int64(-1), <-blockedChan)
+	before := waitBufBytes()
+
+	t.Log("Cancel a truncate while it waits for permission.")
+	// Call folderBlockOps directly, since KBFSOps returns as soon as
+	// the context is canceled, before the truncate has cleaned up.
+	ops := getOps(config, tlfID)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	truncCtx, truncCancel := context.WithCancel(ctx)
+	defer truncCancel()
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- ops.blocks.Truncate(
+			truncCtx, makeFBOLockState(), head, fileNode, 10)
+	}()
+	require.Equal(t, int64(10), <-blockedChan)
+	truncCancel()
+	err = <-errChan
+	require.Equal(t, context.Canceled, errors.Cause(err))
+	require.Equal(t, before, waitBufBytes())
+
+	ops.blocks.blockLock.Lock(lState)
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	df := ops.blocks.dirtyFiles[filePath.tailPointer()]
+	isDirty := ops.blocks.isDirtyLocked(lState, filePath)
+	ops.blocks.blockLock.Unlock(lState)
+	require.Nil(t, df)
+	require.False(t, isDirty)
+
+	t.Log("Once the buffer drains, the canceled request is granted " +
+		"and then fully released.")
+	dirtyBcache.UpdateUnsyncedBytes(tlfID, -fillBytes, false)
+	require.Equal(t, int64(-1), <-blockedChan)
+	for waitBufBytes() != 0 {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	}
+}
+
+func TestFolderBlockOpsRenameCycle(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateDir(ctx, aNode, "b")
+	require.NoError(t, err)
+	cNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "c")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Moving a directory into a sibling is fine.")
+	err = kbfsOps.Rename(ctx, rootNode, "a", cNode, "a")
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Moving a directory into its own child, or into itself, " +
+		"is rejected.")
+	err = kbfsOps.Rename(ctx, cNode, "a", bNode, "a")
+	require.IsType(t, ErrRenameCycle{}, errors.Cause(err))
+	err = kbfsOps.Rename(ctx, cNode, "a", aNode, "a")
+	require.IsType(t, ErrRenameCycle{}, errors.Cause(err))
+	err = kbfsOps.Rename(ctx, rootNode, "c", bNode, "c")
+	require.IsType(t, ErrRenameCycle{}, errors.Cause(err))
+
+	children, err := kbfsOps.GetDirChildren(ctx, cNode)
+	require.NoError(t, err)
+	require.Contains(t, children, "a")
+	children, err = kbfsOps.GetDirChildren(ctx, bNode)
+	require.NoError(t, err)
+	require.Len(t, children, 0)
+}
+
+// Make sure that after syncing a file, reconciling its directory drops
+// the stale cached entries of its siblings, without disturbing the
+// ones that are still dirty.
+func TestFolderBlockOpsReconcileDirEntries(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	dirNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "d")
+	require.NoError(t, err)
+	nodes := make(map[string]Node)
+	for _, name := range []string{"a", "b", "c"} {
+		n, _, err := kbfsOps.CreateFile(ctx, dirNode, name, false, NoExcl)
+		require.NoError(t, err)
+		err = kbfsOps.Write(ctx, n, []byte{1, 2, 3}, 0)
+		require.NoError(t, err)
+		nodes[name] = n
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	t.Log("Dirty b and c again, and leave a stale entry behind for " +
+		"the already-synced a.")
+	err = kbfsOps.Write(ctx, nodes["b"], []byte{4}, 3)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, nodes["c"], []byte{4}, 3)
+	require.NoError(t, err)
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	head, _ := ops.getHead(lState)
+	dirPath := ops.nodeCache.PathFromNode(dirNode)
+	aPath := ops.nodeCache.PathFromNode(nodes["a"])
+	cPath := ops.nodeCache.PathFromNode(nodes["c"])
+	dblock, err := ops.blocks.GetDirBlockForReading(
+		ctx, lState, head, dirPath.tailPointer(), dirPath.Branch, dirPath)
+	require.NoError(t, err)
+	func() {
+		ops.blocks.blockLock.Lock(lState)
+		defer ops.blocks.blockLock.Unlock(lState)
+		require.NotContains(t, ops.blocks.deCache, aPath.tailRef())
+		ops.blocks.deCache[aPath.tailRef()] = deCacheEntry{
+			dirEntry: dblock.Children["a"],
+		}
+	}()
+
+	t.Log("Sync just b, then reconcile the entries in d.")
+	err = kbfsOps.FinalizeFile(ctx, nodes["b"])
+	require.NoError(t, err)
+	head, _ = ops.getHead(lState)
+	dirPath = ops.nodeCache.PathFromNode(dirNode)
+	reconciled, err := ops.blocks.ReconcileDirEntries(
+		ctx, lState, head, dirPath)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, reconciled)
+
+	func() {
+		ops.blocks.blockLock.Lock(lState)
+		defer ops.blocks.blockLock.Unlock(lState)
+		require.NotContains(t, ops.blocks.deCache, aPath.tailRef())
+		require.Contains(t, ops.blocks.deCache, cPath.tailRef())
+	}()
+	for name, n := range nodes {
+		de, err := kbfsOps.Stat(ctx, n)
+		require.NoError(t, err)
+		expectedSize := uint64(4)
+		if name == "a" {
+			expectedSize = 3
+		}
+		require.Equal(t, expectedSize, de.Size, name)
+	}
+
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+}
+
+func TestFolderBlockOpsMaxBlockPlaintextSize(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// A splitter that makes blocks much bigger than the limit.
+	bsplit := &BlockSplitterSimple{100, 100, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+
+	t.Log("Write a file before the limit is lowered.")
+	bigNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "big", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, bigNode, make([]byte, 35), 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	require.Equal(t, bsplit.MaxSize(), ops.blocks.maxBlockPlaintextSize())
+	tunables := config.Tunables()
+	tunables.MaxBlockPlaintextSize = 10
+	err = config.SetTunables(tunables)
+	require.NoError(t, err)
+
+	t.Log("New writes are split at the limit.")
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := make([]byte, 35)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	head, _ := ops.getHead(lState)
+	infos, err := ops.blocks.GetIndirectFileBlockInfos(
+		ctx, lState, head, ops.nodeCache.PathFromNode(fileNode))
+	require.NoError(t, err)
+	require.Len(t, infos, 4)
+	buf := make([]byte, len(data))
+	nr, err := kbfsOps.Read(ctx, fileNode, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), nr)
+	require.Equal(t, data, buf)
+
+	t.Log("A write to a block that's already too big fails right away.")
+	err = kbfsOps.Write(ctx, bigNode, []byte{1, 2, 3}, 2)
+	require.IsType(t, BlockPlaintextTooBigError{}, err)
+}
+
+func TestFolderBlockOpsEmptyFileSyncs(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+
+	t.Log("Syncs of new, empty files take the fast path.")
+	const numFiles = 20
+	for i := 0; i < numFiles; i++ {
+		_, _, err := kbfsOps.CreateFile(
+			ctx, rootNode, fmt.Sprintf("file%d", i), false, NoExcl)
+		require.NoError(t, err)
+	}
+	err := kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, int64(numFiles), ops.blocks.EmptyFileSyncs())
+
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, numFiles)
+	for _, ei := range children {
+		require.Equal(t, uint64(0), ei.Size)
+	}
+
+	t.Log("Syncs of files with data don't.")
+	fileNode, _, err := kbfsOps.Lookup(ctx, rootNode, "file0")
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1, 2, 3}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, int64(numFiles), ops.blocks.EmptyFileSyncs())
+
+	ei, err := kbfsOps.Stat(ctx, fileNode)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), ei.Size)
+}
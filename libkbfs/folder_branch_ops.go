@@ -10,8 +10,10 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/keybase/backoff"
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
@@ -74,7 +76,7 @@ const (
 	// Total history size for 2097152-byte blocks: 1134341128192 bytes
 	// Total history size for 4194304-byte blocks: 2216672886784 bytes
 	MaxBlockSizeBytesDefault = 512 << 10
-	// Maximum number of blocks that can be sent in parallel
+	// Default maximum number of blocks that can be sent in parallel
 	maxParallelBlockPuts = 100
 	// Maximum number of blocks that can be fetched in parallel
 	maxParallelBlockGets = 10
@@ -82,6 +84,9 @@ const (
 	maxMDsAtATime = 10
 	// Cap the number of times we retry after a recoverable error
 	maxRetriesOnRecoverableErrors = 10
+	// Cap the number of syncs FinalizeFile does before giving up on
+	// a file that keeps getting dirtied.
+	maxFinalizeFileSyncs = 10
 	// When the number of dirty bytes exceeds this level, force a sync.
 	dirtyBytesThreshold = maxParallelBlockPuts * MaxBlockSizeBytesDefault
 	// The timeout for any background task.
@@ -139,14 +144,100 @@ func makeFBOLockState() *lockState {
 	return makeLevelState(fboMutexLevelToString)
 }
 
+// blockLockStats summarizes the contention seen on a blockLock since
+// stats collection was enabled.  All wait times are wall-clock
+// durations spent waiting to acquire the lock.
+type blockLockStats struct {
+	// Number of times the lock was acquired, by exclusion type.
+	RLocks int64
+	Locks  int64
+	// Total and maximum time spent waiting, by exclusion type.
+	RLockWait    time.Duration
+	LockWait     time.Duration
+	MaxRLockWait time.Duration
+	MaxLockWait  time.Duration
+	// Number of times DoRUnlockedIfPossible actually released the
+	// read lock while running its function.
+	RUnlockedRuns int64
+	// Number of goroutines currently blocked waiting for the lock,
+	// and the maximum ever seen blocked at once.
+	Blocked    int64
+	MaxBlocked int64
+}
+
+// blockLockStatsKeeper collects blockLockStats.  Collection is
+// disabled by default, since it adds a couple of clock reads to every
+// lock acquisition.
+type blockLockStatsKeeper struct {
+	enabled int32 // must be accessed atomically
+
+	lock  sync.Mutex
+	stats blockLockStats
+}
+
+func (k *blockLockStatsKeeper) isEnabled() bool {
+	return atomic.LoadInt32(&k.enabled) != 0
+}
+
+func (k *blockLockStatsKeeper) enable() {
+	atomic.StoreInt32(&k.enabled, 1)
+}
+
+func (k *blockLockStatsKeeper) startWait() time.Time {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.stats.Blocked++
+	if k.stats.Blocked > k.stats.MaxBlocked {
+		k.stats.MaxBlocked = k.stats.Blocked
+	}
+	return time.Now()
+}
+
+func (k *blockLockStatsKeeper) endWait(start time.Time, et exclusionType) {
+	wait := time.Since(start)
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.stats.Blocked--
+	if et == writeExclusion {
+		k.stats.Locks++
+		k.stats.LockWait += wait
+		if wait > k.stats.MaxLockWait {
+			k.stats.MaxLockWait = wait
+		}
+	} else {
+		k.stats.RLocks++
+		k.stats.RLockWait += wait
+		if wait > k.stats.MaxRLockWait {
+			k.stats.MaxRLockWait = wait
+		}
+	}
+}
+
+func (k *blockLockStatsKeeper) recordRUnlockedRun() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.stats.RUnlockedRuns++
+}
+
+func (k *blockLockStatsKeeper) get() blockLockStats {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.stats
+}
+
 // blockLock is just like a sync.RWMutex, but with an extra operation
-// (DoRUnlockedIfPossible).
+// (DoRUnlockedIfPossible), and optional contention stats.
 type blockLock struct {
 	leveledRWMutex
 	locked bool
+	stats  blockLockStatsKeeper
 }
 
 func (bl *blockLock) Lock(lState *lockState) {
+	if bl.stats.isEnabled() {
+		start := bl.stats.startWait()
+		defer bl.stats.endWait(start, writeExclusion)
+	}
 	bl.leveledRWMutex.Lock(lState)
 	bl.locked = true
 }
@@ -156,11 +247,22 @@ func (bl *blockLock) Unlock(lState *lockState) {
 	bl.leveledRWMutex.Unlock(lState)
 }
 
+func (bl *blockLock) RLock(lState *lockState) {
+	if bl.stats.isEnabled() {
+		start := bl.stats.startWait()
+		defer bl.stats.endWait(start, readExclusion)
+	}
+	bl.leveledRWMutex.RLock(lState)
+}
+
 // DoRUnlockedIfPossible must be called when r- or w-locked. If
 // r-locked, r-unlocks, runs the given function, and r-locks after
 // it's done. Otherwise, just runs the given function.
 func (bl *blockLock) DoRUnlockedIfPossible(lState *lockState, f func(*lockState)) {
 	if !bl.locked {
+		if bl.stats.isEnabled() {
+			bl.stats.recordRUnlockedRun()
+		}
 		bl.RUnlock(lState)
 		defer bl.RLock(lState)
 	}
@@ -359,6 +461,14 @@ func newFolderBranchOps(ctx context.Context, config Config, fb FolderBranch,
 	} else {
 		nodeCache = newNodeCacheStandard(fb)
 	}
+	assembledDirs, err := lru.New(maxAssembledDirs)
+	if err != nil {
+		panic(err.Error())
+	}
+	dirListings, err := lru.New(maxDirListings)
+	if err != nil {
+		panic(err.Error())
+	}
 
 	// make logger
 	branchSuffix := ""
@@ -399,11 +509,13 @@ func newFolderBranchOps(ctx context.Context, config Config, fb FolderBranch,
 			blockLock: blockLock{
 				leveledRWMutex: blockLockMu,
 			},
-			dirtyFiles: make(map[BlockPointer]*dirtyFile),
-			deferred:   make(map[BlockRef]deferredState),
-			unrefCache: make(map[BlockRef]*syncInfo),
-			deCache:    make(map[BlockRef]deCacheEntry),
-			nodeCache:  nodeCache,
+			dirtyFiles:    make(map[BlockPointer]*dirtyFile),
+			deferred:      make(map[BlockRef]deferredState),
+			unrefCache:    make(map[BlockRef]*syncInfo),
+			deCache:       make(map[BlockRef]deCacheEntry),
+			nodeCache:     nodeCache,
+			assembledDirs: assembledDirs,
+			dirListings:   dirListings,
 		},
 		nodeCache:       nodeCache,
 		log:             traceLogger{log},
@@ -1347,7 +1459,8 @@ func (fbo *folderBranchOps) maybeUnembedAndPutBlocks(ctx context.Context,
 
 	ptrsToDelete, err := doBlockPuts(ctx, fbo.config.BlockServer(),
 		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, fbo.deferLog, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+		md.GetTlfHandle().GetCanonicalName(), *bps,
+		fbo.config.Tunables().MaxParallelBlockPuts)
 	if err != nil {
 		return nil, err
 	}
@@ -1761,8 +1874,8 @@ type makeNewBlock func() Block
 // functions below.
 func (fbo *folderBranchOps) pathFromNodeHelper(n Node) (path, error) {
 	p := fbo.nodeCache.PathFromNode(n)
-	if !p.isValid() {
-		return path{}, InvalidPathError{p}
+	if err := p.checkValid(); err != nil {
+		return path{}, err
 	}
 	return p, nil
 }
@@ -1814,7 +1927,8 @@ func (fbo *folderBranchOps) GetDirChildren(ctx context.Context, dir Node) (
 		}
 
 		children, err = fbo.blocks.GetDirtyDirChildren(
-			ctx, lState, md.ReadOnly(), dirPath)
+			ctx, lState, md.ReadOnly(), dirPath,
+			defaultOnDemandRequestPriority)
 		if err != nil {
 			return err
 		}
@@ -2067,6 +2181,7 @@ func (fbo *folderBranchOps) finalizeBlocks(bps *blockPutState) error {
 	if bps == nil {
 		return nil
 	}
+	fbo.blocks.recordWriterBytes(bps)
 	bcache := fbo.config.BlockCache()
 	for _, blockState := range bps.blockStates {
 		newPtr := blockState.blockPtr
@@ -3132,12 +3247,19 @@ func (fbo *folderBranchOps) unrefEntryLocked(ctx context.Context,
 	childPath := dir.ChildPath(name, de.BlockPointer)
 
 	// If this is an indirect block, we need to delete all of its
-	// children as well. NOTE: non-empty directories can't be
-	// removed, so no need to check for indirect directory blocks
-	// here.
-	if de.Type == File || de.Type == Exec {
-		blockInfos, err := fbo.blocks.GetIndirectFileBlockInfos(
-			ctx, lState, kmd, childPath)
+	// children as well.  Non-empty directories can't be removed,
+	// but one that was emptied since its last sync may still be
+	// stored as an indirect dir block.
+	if de.Type == File || de.Type == Exec || de.Type == Dir {
+		var blockInfos []BlockInfo
+		var err error
+		if de.Type == Dir {
+			blockInfos, err = fbo.blocks.GetIndirectDirBlockInfos(
+				ctx, lState, kmd, childPath)
+		} else {
+			blockInfos, err = fbo.blocks.GetIndirectFileBlockInfos(
+				ctx, lState, kmd, childPath)
+		}
 		if isRecoverableBlockErrorForRemoval(err) {
 			msg := fmt.Sprintf("Recoverable block error encountered for unrefEntry(%v); continuing", childPath)
 			fbo.log.CWarningf(ctx, "%s", msg)
@@ -3462,8 +3584,14 @@ func (fbo *folderBranchOps) Rename(
 func (fbo *folderBranchOps) Read(
 	ctx context.Context, file Node, dest []byte, off int64) (
 	n int64, err error) {
-	fbo.log.CDebugf(ctx, "Read %s %d %d", getNodeIDStr(file),
-		len(dest), off)
+	return fbo.ReadWithCachePolicy(ctx, file, dest, off, CacheBlocks)
+}
+
+func (fbo *folderBranchOps) ReadWithCachePolicy(
+	ctx context.Context, file Node, dest []byte, off int64,
+	policy BlockCachePolicy) (n int64, err error) {
+	fbo.log.CDebugf(ctx, "Read %s %d %d (policy=%d)", getNodeIDStr(file),
+		len(dest), off, policy)
 	defer func() {
 		fbo.deferLog.CDebugf(ctx, "Read %s %d %d (n=%d) done: %+v",
 			getNodeIDStr(file), len(dest), off, n, err)
@@ -3516,8 +3644,8 @@ func (fbo *folderBranchOps) Read(
 
 		// Read using the `file` Node, not `filePath`, since the path
 		// could change until we take `blockLock` for reading.
-		bytesRead, err = fbo.blocks.Read(
-			ctx, lState, md.ReadOnly(), file, dest, off)
+		bytesRead, err = fbo.blocks.ReadWithCachePolicy(
+			ctx, lState, md.ReadOnly(), file, dest, off, policy)
 		return err
 	})
 	if err != nil {
@@ -3551,6 +3679,24 @@ func (fbo *folderBranchOps) Write(
 			return err
 		}
 
+		unchanged, err := fbo.blocks.WriteIsUnchanged(
+			ctx, lState, md.ReadOnly(), file, data, off)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			// Don't copy or dirty any blocks for a write that
+			// wouldn't change any bytes, but still update the
+			// file's times like any other write would.
+			fbo.log.CDebugf(ctx, "Only updating the times of %s for a "+
+				"write of %d unchanged bytes", getNodeIDStr(file), len(data))
+			now := time.Unix(0, fbo.nowUnixNano())
+			return fbo.doMDWriteWithRetry(ctx, lState,
+				func(lState *lockState) error {
+					return fbo.setMtimeLocked(ctx, lState, file, &now)
+				})
+		}
+
 		err = fbo.blocks.Write(
 			ctx, lState, md.ReadOnly(), file, data, off)
 		if err != nil {
@@ -3599,6 +3745,42 @@ func (fbo *folderBranchOps) Truncate(
 	})
 }
 
+func (fbo *folderBranchOps) PunchHole(
+	ctx context.Context, file Node, off, length int64) (err error) {
+	fbo.log.CDebugf(ctx, "PunchHole %s %d %d", getNodeIDStr(file), off,
+		length)
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "PunchHole %s %d %d done: %+v",
+			getNodeIDStr(file), off, length, err)
+	}()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		// As with Truncate, the unrefs are tracked on the side and
+		// only put into the MD during the sync.
+		md, err := fbo.getMDForRead(ctx, lState, mdReadNeedIdentify)
+		if err != nil {
+			return err
+		}
+
+		err = fbo.blocks.PunchHole(
+			ctx, lState, md.ReadOnly(), file, off, length)
+		if err != nil {
+			return err
+		}
+
+		fbo.status.addDirtyNode(file)
+		fbo.signalWrite()
+		return nil
+	})
+}
+
 func (fbo *folderBranchOps) setExLocked(
 	ctx context.Context, lState *lockState, file Node, ex bool) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
@@ -3854,11 +4036,86 @@ func addSelfUpdatesAndParent(
 	}
 }
 
+// dirtyFilePathString returns a printable path for the dirty file
+// with the given ref, for error reporting.  If the node cache has
+// forgotten the file's node, the path is reconstructed from the
+// current head, which walks the whole tree, so this shouldn't be
+// used on hot paths.
+func (fbo *folderBranchOps) dirtyFilePathString(
+	ctx context.Context, lState *lockState, ref BlockRef) string {
+	if node := fbo.nodeCache.Get(ref); node != nil {
+		return fbo.nodeCache.PathFromNode(node).String()
+	}
+
+	md := fbo.getTrustedHead(lState)
+	if md == (ImmutableRootMetadata{}) {
+		return "<no head>"
+	}
+	p, err := fbo.blocks.ReconstructPath(ctx, lState, md.ReadOnly(), ref)
+	if err != nil {
+		return fmt.Sprintf("<unknown: %v>", err)
+	}
+	return p.String()
+}
+
+// nodeForDirtyFile returns the node for the dirty file with the
+// given ref.  If the node cache has forgotten the file's node, its
+// path is reconstructed from `md`, and nodes are made for it again,
+// so that the file's dirty data can still be synced and reported.
+// That walks the whole tree, so it should be rare.
+func (fbo *folderBranchOps) nodeForDirtyFile(ctx context.Context,
+	lState *lockState, md ReadOnlyRootMetadata, ref BlockRef) (Node, error) {
+	if node := fbo.nodeCache.Get(ref); node != nil {
+		return node, nil
+	}
+
+	p, err := fbo.blocks.ReconstructPath(ctx, lState, md, ref)
+	if err != nil {
+		return nil, err
+	}
+	fbo.log.CDebugf(ctx, "Reconstructed path %s for dirty file %v "+
+		"with no node", p, ref)
+	var node Node
+	for _, pn := range p.path {
+		node, err = fbo.nodeCache.GetOrCreate(pn.BlockPointer, pn.Name, node)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
 func (fbo *folderBranchOps) syncAllLocked(
-	ctx context.Context, lState *lockState, excl Excl) (err error) {
+	ctx context.Context, lState *lockState, excl Excl) error {
+	return fbo.syncDirtyLocked(ctx, lState, excl, BlockRef{})
+}
+
+// syncDirtyLocked syncs all buffered directory changes, and the
+// dirty files.  If `onlyFile` is valid, the only dirty files that get
+// synced are that one and any touched by the buffered directory
+// changes (e.g., newly-created files, which can't be synced without
+// their contents); the others stay dirty until the next sync.
+func (fbo *folderBranchOps) syncDirtyLocked(ctx context.Context,
+	lState *lockState, excl Excl, onlyFile BlockRef) (err error) {
 	fbo.mdWriterLock.AssertLocked(lState)
 
 	dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
+	if onlyFile.IsValid() {
+		keep := map[BlockRef]bool{onlyFile: true}
+		for _, dop := range fbo.dirOps {
+			for _, n := range dop.nodes {
+				keep[fbo.nodeCache.PathFromNode(n).tailPointer().Ref()] =
+					true
+			}
+		}
+		var fileRefs []BlockRef
+		for _, ref := range dirtyFiles {
+			if keep[ref] {
+				fileRefs = append(fileRefs, ref)
+			}
+		}
+		dirtyFiles = fileRefs
+	}
 	dirtyDirs := fbo.blocks.GetDirtyDirBlockRefs(lState)
 	if len(dirtyFiles) == 0 && len(dirtyDirs) == 0 {
 		return nil
@@ -4043,8 +4300,10 @@ func (fbo *folderBranchOps) syncAllLocked(
 	fbo.log.CDebugf(ctx, "Syncing %d file(s)", len(dirtyFiles))
 	fileSyncBlocks := newBlockPutState(1)
 	for _, ref := range dirtyFiles {
-		node := fbo.nodeCache.Get(ref)
-		if node == nil {
+		node, err := fbo.nodeForDirtyFile(ctx, lState, md.ReadOnly(), ref)
+		if err != nil {
+			fbo.log.CWarningf(ctx, "Skipping dirty file %v with no "+
+				"path: %+v", ref, err)
 			continue
 		}
 		file := fbo.nodeCache.PathFromNode(node)
@@ -4176,7 +4435,8 @@ func (fbo *folderBranchOps) syncAllLocked(
 	// Put all the blocks.
 	blocksToRemove, err = doBlockPuts(ctx, fbo.config.BlockServer(),
 		fbo.config.BlockCache(), fbo.config.Reporter(), fbo.log, fbo.deferLog, md.TlfID(),
-		md.GetTlfHandle().GetCanonicalName(), *bps)
+		md.GetTlfHandle().GetCanonicalName(), *bps,
+		fbo.config.Tunables().MaxParallelBlockPuts)
 	if err != nil {
 		return err
 	}
@@ -4251,6 +4511,86 @@ func (fbo *folderBranchOps) SyncAll(
 		})
 }
 
+// FinalizeFile makes sure that the given file has no dirty state
+// left, for example when the last handle to it is closed.  It syncs
+// the file, along with any buffered directory changes, until the file
+// is clean -- writes deferred during one sync leave the file dirty,
+// so that may take more than one round -- and then clears the file's
+// cached info.  It gives up after maxFinalizeFileSyncs rounds.
+func (fbo *folderBranchOps) FinalizeFile(
+	ctx context.Context, file Node) (err error) {
+	fbo.log.CDebugf(ctx, "FinalizeFile %s", getNodeIDStr(file))
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "FinalizeFile %s done: %+v",
+			getNodeIDStr(file), err)
+	}()
+
+	err = fbo.checkNode(file)
+	if err != nil {
+		return err
+	}
+
+	lState := makeFBOLockState()
+	for i := 1; ; i++ {
+		filePath := fbo.nodeCache.PathFromNode(file)
+		clean, err := fbo.blocks.ClearCacheInfoIfClean(lState, filePath)
+		if err != nil {
+			return err
+		}
+		if clean {
+			return nil
+		}
+		if i > maxFinalizeFileSyncs {
+			return errors.Errorf("File %s still dirty after %d syncs",
+				getNodeIDStr(file), maxFinalizeFileSyncs)
+		}
+
+		fbo.log.CDebugf(ctx, "Syncing dirty file %s (attempt %d)",
+			getNodeIDStr(file), i)
+		err = fbo.doMDWriteWithRetryUnlessCanceled(ctx,
+			func(lState *lockState) error {
+				// Look up the file's ref again under the lock, in
+				// case a previous sync changed it.
+				fileRef := fbo.nodeCache.PathFromNode(file).
+					tailPointer().Ref()
+				return fbo.syncDirtyLocked(ctx, lState, NoExcl, fileRef)
+			})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (fbo *folderBranchOps) RegisterBlockManagerObserver(
+	ctx context.Context, folderBranch FolderBranch,
+	obs BlockManagerObserver) error {
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	fbo.fbm.registerObserver(obs)
+	return nil
+}
+
+func (fbo *folderBranchOps) UnregisterBlockManagerObserver(
+	ctx context.Context, folderBranch FolderBranch,
+	obs BlockManagerObserver) error {
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	fbo.fbm.unregisterObserver(obs)
+	return nil
+}
+
+func (fbo *folderBranchOps) SetFolderMaxFileBytes(
+	ctx context.Context, folderBranch FolderBranch, maxBytes uint64) error {
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+	lState := makeFBOLockState()
+	fbo.blocks.SetMaxFileBytes(lState, maxBytes)
+	return nil
+}
+
 func (fbo *folderBranchOps) FolderStatus(
 	ctx context.Context, folderBranch FolderBranch) (
 	fbs FolderBranchStatus, updateChan <-chan StatusUpdate, err error) {
@@ -4262,6 +4602,25 @@ func (fbo *folderBranchOps) FolderStatus(
 			WrongOpsError{fbo.folderBranch, folderBranch}
 	}
 
+	// Make sure any dirty files whose nodes have been forgotten are
+	// still reported.
+	lState := makeFBOLockState()
+	if md := fbo.getTrustedHead(lState); md != (ImmutableRootMetadata{}) {
+		for _, ref := range fbo.blocks.GetDirtyFileBlockRefs(lState) {
+			if fbo.nodeCache.Get(ref) != nil {
+				continue
+			}
+			node, err := fbo.nodeForDirtyFile(
+				ctx, lState, md.ReadOnly(), ref)
+			if err != nil {
+				fbo.log.CDebugf(ctx, "Couldn't find the path of dirty "+
+					"file %v: %+v", ref, err)
+				continue
+			}
+			fbo.status.addDirtyNode(node)
+		}
+	}
+
 	return fbo.status.getStatus(ctx, &fbo.blocks)
 }
 
@@ -4410,7 +4769,8 @@ func (fbo *folderBranchOps) getUnlinkPathBeforeUpdatingPointers(
 	// If the original (clean) parent block is already GC'd from the
 	// server, this might not work, but hopefully we'd be
 	// fast-forwarding in that case anyway.
-	dblock, err := fbo.blocks.GetDir(ctx, lState, md, p, blockRead)
+	dblock, err := fbo.blocks.GetDir(
+		ctx, lState, md, p, blockRead, defaultOnDemandRequestPriority)
 	if err != nil {
 		fbo.log.CDebugf(ctx, "Couldn't get the dir entry for %s in %v: %+v",
 			childName, p.tailPointer(), err)
@@ -5056,11 +5416,21 @@ func (fbo *folderBranchOps) unstageLocked(ctx context.Context,
 	}
 
 	// let the server know we no longer have need
+	var prunedPtrs []BlockPointer
 	if !wasMasterBranch {
 		err = fbo.config.MDOps().PruneBranch(ctx, fbo.id(), bid)
 		if err != nil {
 			return err
 		}
+
+		// Clean up the blocks that only the pruned branch used.
+		// If that fails, the resolutionOp below still unrefs them,
+		// so quota reclamation deletes them later instead.
+		prunedPtrs, err = fbo.fbm.OnBranchPruned(ctx, bid)
+		if err != nil {
+			fbo.log.CWarningf(ctx, "Couldn't clean up the blocks of "+
+				"pruned branch %s: %+v", bid, err)
+		}
 	}
 
 	// now go forward in time, if possible
@@ -5075,9 +5445,19 @@ func (fbo *folderBranchOps) unstageLocked(ctx context.Context,
 		return err
 	}
 
-	// Finally, create a resolutionOp with the newly-unref'd pointers.
+	// Finally, create a resolutionOp with the newly-unref'd
+	// pointers.  The blocks that the block server confirmed were
+	// deleted along with the pruned branch are already gone, so
+	// leave those out.
+	pruned := make(map[BlockPointer]bool, len(prunedPtrs))
+	for _, ptr := range prunedPtrs {
+		pruned[ptr] = true
+	}
 	resOp := newResolutionOp()
 	for _, ptr := range unmergedPtrs {
+		if pruned[ptr] {
+			continue
+		}
 		resOp.AddUnrefBlock(ptr)
 	}
 	md.AddOp(resOp)
@@ -5142,6 +5522,82 @@ func (fbo *folderBranchOps) UnstageForTesting(
 	})
 }
 
+func (fbo *folderBranchOps) abandonBranchLocked(ctx context.Context,
+	lState *lockState) error {
+	fbo.mdWriterLock.AssertLocked(lState)
+
+	// Only writers can have made local changes to discard.
+	_, err := fbo.getMDForWriteLockedForFilename(ctx, lState, "")
+	if err != nil {
+		return err
+	}
+
+	// Throw away everything that hasn't been synced yet, including
+	// any batched directory operations.
+	changes, err := fbo.blocks.DiscardAllDirtyState(ctx, lState)
+	if err != nil {
+		return err
+	}
+	fbo.dirOps = nil
+	fbo.status.clearDirtyNodes()
+	if len(changes) > 0 {
+		fbo.observers.batchChanges(ctx, changes)
+	}
+
+	if fbo.isMasterBranchLocked(lState) {
+		return nil
+	}
+	return fbo.unstageLocked(ctx, lState)
+}
+
+// AbandonBranch discards all of this device's local changes to the
+// folder-branch: any unsynced dirty state is dropped, and any
+// unmerged branch is pruned on the server, after which the TLF is
+// fast-forwarded to the current merged head.  It is a no-op if there
+// are no local changes.
+func (fbo *folderBranchOps) AbandonBranch(
+	ctx context.Context, folderBranch FolderBranch) (err error) {
+	fbo.log.CDebugf(ctx, "AbandonBranch")
+	defer func() {
+		fbo.deferLog.CDebugf(ctx, "AbandonBranch done: %+v", err)
+	}()
+
+	if folderBranch != fbo.folderBranch {
+		return WrongOpsError{fbo.folderBranch, folderBranch}
+	}
+
+	return runUnlessCanceled(ctx, func() error {
+		lState := makeFBOLockState()
+
+		if fbo.isMasterBranch(lState) &&
+			fbo.blocks.GetState(lState) == cleanState {
+			// no-op
+			return nil
+		}
+
+		// Like with unstaging, use a fresh context so upper layers
+		// don't ignore the resulting notifications.
+		c := make(chan error, 1)
+		freshCtx, cancel := fbo.newCtxWithFBOID()
+		defer cancel()
+		fbo.log.CDebugf(freshCtx, "Launching new context for AbandonBranch")
+		go func() {
+			lState := makeFBOLockState()
+			c <- fbo.doMDWriteWithRetry(ctx, lState,
+				func(lState *lockState) error {
+					return fbo.abandonBranchLocked(freshCtx, lState)
+				})
+		}()
+
+		select {
+		case err := <-c:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
 // mdWriterLock must be taken by the caller.
 func (fbo *folderBranchOps) rekeyLocked(ctx context.Context,
 	lState *lockState, promptPaper bool) (res RekeyResult, err error) {
@@ -5360,7 +5816,8 @@ func (fbo *folderBranchOps) SyncFromServerForTesting(ctx context.Context,
 		dirtyFiles := fbo.blocks.GetDirtyFileBlockRefs(lState)
 		if len(dirtyFiles) > 0 {
 			for _, ref := range dirtyFiles {
-				fbo.log.CDebugf(ctx, "DeCache entry left: %v", ref)
+				fbo.log.CDebugf(ctx, "DeCache entry left: %v (%s)",
+					ref, fbo.dirtyFilePathString(ctx, lState, ref))
 			}
 			return errors.New("can't sync from server while dirty")
 		}
@@ -171,6 +171,16 @@ func (fbsk *folderBranchStatusKeeper) rmDirtyNode(n Node) bool {
 	return fbsk.rmNode(fbsk.dirtyNodes, n)
 }
 
+func (fbsk *folderBranchStatusKeeper) clearDirtyNodes() {
+	fbsk.dataMutex.Lock()
+	defer fbsk.dataMutex.Unlock()
+	if len(fbsk.dirtyNodes) == 0 {
+		return
+	}
+	fbsk.dirtyNodes = make(map[NodeID]Node)
+	fbsk.signalChangeLocked()
+}
+
 // dataMutex should be taken by the caller
 func (fbsk *folderBranchStatusKeeper) convertNodesToPathsLocked(
 	m map[NodeID]Node) []string {
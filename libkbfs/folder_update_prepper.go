@@ -57,6 +57,161 @@ func (fup *folderUpdatePrepper) readyBlockMultiple(ctx context.Context,
 	return
 }
 
+// readyDirBlockMultiple readies the given directory block, first
+// splitting it into an indirect dir block if it's bigger than the
+// configured max dir block size.  If the directory was assembled from
+// an indirect dir block, the old child blocks whose entries haven't
+// changed are reused without being encoded again, and the rest are
+// unreferenced in `md`.  It returns the info of the top block, and
+// the size of the whole directory: for an indirect dir block, that's
+// the plaintext size of the top block plus the encoded sizes of its
+// children.
+func (fup *folderUpdatePrepper) readyDirBlockMultiple(ctx context.Context,
+	lState *lockState, md *RootMetadata, dblock *DirBlock,
+	chargedTo keybase1.UserOrTeamID, bps *blockPutState,
+	bType keybase1.BlockType) (info BlockInfo, plainSize int, err error) {
+	maxSize := fup.config.Tunables().MaxDirBlockBytes
+	codec := fup.config.Codec()
+	if len(dblock.assembledFrom) == 0 {
+		if maxSize == 0 {
+			return fup.readyBlockMultiple(
+				ctx, md.ReadOnly(), dblock, chargedTo, bps, bType)
+		}
+		buf, err := codec.Encode(dblock)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		if len(buf) <= maxSize {
+			return fup.readyBlockMultiple(
+				ctx, md.ReadOnly(), dblock, chargedTo, bps, bType)
+		}
+	}
+
+	var ranges []*dirEntryRange
+	if maxSize > 0 {
+		offs := make([]string, 0, len(dblock.assembledFrom))
+		oldChildren := make(
+			map[string]IndirectDirPtr, len(dblock.assembledFrom))
+		for _, iptr := range dblock.assembledFrom {
+			offs = append(offs, iptr.Off)
+			oldChildren[iptr.Off] = iptr
+		}
+		reusable := func(r *dirEntryRange) bool {
+			old, ok := oldChildren[r.off]
+			if !ok {
+				return false
+			}
+			r.oldPtr = old
+			return fup.isUnchangedDirChild(
+				ctx, lState, md, old.BlockPointer, r.names, dblock.Children)
+		}
+		ranges, err = splitDirEntries(
+			codec, dblock.Children, offs, maxSize, reusable)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+	}
+
+	if len(ranges) <= 1 {
+		// Store it as a single block again.  Don't cache the
+		// copy with the old child pointers, or the next sync
+		// would unreference them again.
+		flat := dblock.DeepCopy()
+		flat.assembledFrom = nil
+		info, plainSize, err = fup.readyBlockMultiple(
+			ctx, md.ReadOnly(), flat, chargedTo, bps, bType)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		for _, iptr := range dblock.assembledFrom {
+			md.AddUnrefBlock(iptr.BlockInfo)
+		}
+		return info, plainSize, nil
+	}
+
+	top := &DirBlock{
+		Children: make(map[string]DirEntry),
+		IPtrs:    make([]IndirectDirPtr, 0, len(ranges)),
+	}
+	top.IsInd = true
+	reused := make(map[BlockPointer]bool)
+	for _, r := range ranges {
+		if r.reused {
+			top.IPtrs = append(top.IPtrs, IndirectDirPtr{
+				BlockInfo: r.oldPtr.BlockInfo,
+				Off:       r.off,
+			})
+			reused[r.oldPtr.BlockPointer] = true
+			plainSize += int(r.oldPtr.EncodedSize)
+			continue
+		}
+
+		childInfo, _, err := fup.readyBlockMultiple(
+			ctx, md.ReadOnly(), r.block, chargedTo, bps, bType)
+		if err != nil {
+			return BlockInfo{}, 0, err
+		}
+		md.AddRefBlock(childInfo)
+		top.IPtrs = append(top.IPtrs, IndirectDirPtr{
+			BlockInfo: childInfo,
+			Off:       r.off,
+		})
+		plainSize += int(childInfo.EncodedSize)
+	}
+	for _, iptr := range dblock.assembledFrom {
+		if !reused[iptr.BlockPointer] {
+			md.AddUnrefBlock(iptr.BlockInfo)
+		}
+	}
+	fup.log.CDebugf(ctx, "Split a directory of %d entries into %d "+
+		"child blocks (%d reused)", len(dblock.Children), len(ranges),
+		len(reused))
+
+	// The top block must be readied last, since the caller expects
+	// it to be the most recent block in `bps`.
+	info, topSize, err := fup.readyBlockMultiple(
+		ctx, md.ReadOnly(), top, chargedTo, bps, bType)
+	if err != nil {
+		return BlockInfo{}, 0, err
+	}
+	return info, plainSize + topSize, nil
+}
+
+// isUnchangedDirChild returns true if the given existing child block
+// of an indirect dir block holds exactly the entries of `children`
+// with the given names, so that it can be reused without encoding
+// those entries again.
+func (fup *folderUpdatePrepper) isUnchangedDirChild(ctx context.Context,
+	lState *lockState, md *RootMetadata, ptr BlockPointer,
+	names hashedDirEntryNames, children map[string]DirEntry) bool {
+	child, err := fup.blocks.GetDirBlockForReading(
+		ctx, lState, md.ReadOnly(), ptr, fup.branch(), path{})
+	if err != nil {
+		// Just write a new child block, rather than failing the
+		// whole sync.
+		fup.log.CDebugf(ctx, "Couldn't get old dir child block %v: %+v",
+			ptr, err)
+		return false
+	}
+	if len(child.Children) != len(names) {
+		return false
+	}
+	for _, n := range names {
+		oldDe, ok := child.Children[n.name]
+		if !ok {
+			return false
+		}
+		// Unknown fields are carried over from the old entries
+		// as-is, so only the known fields can have changed.
+		newDe := children[n.name]
+		if oldDe.BlockInfo != newDe.BlockInfo ||
+			oldDe.EntryInfo != newDe.EntryInfo {
+			return false
+		}
+	}
+	return true
+}
+
 func (fup *folderUpdatePrepper) unembedBlockChanges(
 	ctx context.Context, bps *blockPutState, md *RootMetadata,
 	changes *BlockChanges, chargedTo keybase1.UserOrTeamID) error {
@@ -194,9 +349,18 @@ func (fup *folderUpdatePrepper) prepUpdateForPath(
 	now := fup.nowUnixNano()
 	var uid keybase1.UID
 	for len(newPath.path) < len(dir.path)+1 {
-		info, plainSize, err := fup.readyBlockMultiple(
-			ctx, md.ReadOnly(), currBlock, chargedTo, bps,
-			fup.config.DefaultBlockType())
+		var info BlockInfo
+		var plainSize int
+		var err error
+		if dblock, ok := currBlock.(*DirBlock); ok {
+			info, plainSize, err = fup.readyDirBlockMultiple(
+				ctx, lState, md, dblock, chargedTo, bps,
+				fup.config.DefaultBlockType())
+		} else {
+			info, plainSize, err = fup.readyBlockMultiple(
+				ctx, md.ReadOnly(), currBlock, chargedTo, bps,
+				fup.config.DefaultBlockType())
+		}
 		if err != nil {
 			return path{}, DirEntry{}, nil, err
 		}
@@ -232,7 +396,8 @@ func (fup *folderUpdatePrepper) prepUpdateForPath(
 				// modified while holding mdWriterLock, so it's
 				// safe to fetch them one at a time.
 				prevDblock, err = fup.blocks.GetDir(
-					ctx, lState, md.ReadOnly(), prevDir, blockWrite)
+					ctx, lState, md.ReadOnly(), prevDir, blockWrite,
+					defaultOnDemandRequestPriority)
 				if err != nil {
 					return path{}, DirEntry{}, nil, err
 				}
@@ -272,9 +437,8 @@ func (fup *folderUpdatePrepper) prepUpdateForPath(
 		}
 
 		if de.Type == Dir {
-			// TODO: When we use indirect dir blocks,
-			// we'll have to calculate the size some other
-			// way.
+			// For indirect dir blocks, this includes the sizes of
+			// all the child blocks.
 			de.Size = uint64(plainSize)
 		}
 
@@ -13,6 +13,7 @@ import (
 	"github.com/keybase/kbfs/kbfsblock"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
+	"github.com/keybase/kbfs/kbfshash"
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
 	metrics "github.com/rcrowley/go-metrics"
@@ -60,6 +61,12 @@ type signerGetter interface {
 	Signer() kbfscrypto.Signer
 }
 
+type tunablesGetter interface {
+	// Tunables returns the current numeric settings that tune how
+	// KBFS uses its resources.
+	Tunables() Tunables
+}
+
 type diskBlockCacheGetter interface {
 	DiskBlockCache() DiskBlockCache
 }
@@ -267,6 +274,11 @@ type KBFSOps interface {
 	// that means EOF has been reached. This is a remote-access
 	// operation.
 	Read(ctx context.Context, file Node, dest []byte, off int64) (int64, error)
+	// ReadWithCachePolicy is like Read, but any blocks that need to
+	// be fetched from the server are put into the BlockCache
+	// according to `policy`.
+	ReadWithCachePolicy(ctx context.Context, file Node, dest []byte,
+		off int64, policy BlockCachePolicy) (int64, error)
 	// Write modifies the file at the given node, by writing the given
 	// buffer at the given offset within the file, if the logged-in
 	// user has write permission to the top-level folder.  It
@@ -285,6 +297,12 @@ type KBFSOps interface {
 	// on whether or not the necessary blocks have been locally
 	// cached.  This is a remote-access operation.
 	Truncate(ctx context.Context, file Node, size uint64) error
+	// PunchHole deallocates the byte range `[off, off+length)` of the
+	// file at the given node, if the logged-in user has write
+	// permission to the top-level folder.  The range reads back as
+	// 0s, and the file's size doesn't change.  This is a
+	// remote-access operation.
+	PunchHole(ctx context.Context, file Node, off, length int64) error
 	// SetEx turns on or off the executable bit on the file
 	// represented by a given node, if the logged-in user has write
 	// permissions to the top-level folder.  This is a remote-sync
@@ -302,6 +320,26 @@ type KBFSOps interface {
 	// modifications done via multiple file handles.  This is a
 	// remote-sync operation.
 	SyncAll(ctx context.Context, folderBranch FolderBranch) error
+	// FinalizeFile syncs the given file, along with any buffered
+	// directory changes in its folder, until it has no dirty state
+	// left, for example when the last handle to it is closed.  Other
+	// dirty files in the folder aren't synced.
+	FinalizeFile(ctx context.Context, file Node) error
+	// RegisterBlockManagerObserver declares that the given observer
+	// wants to hear about the background block archiving and quota
+	// reclamation done for the given folder/branch.
+	RegisterBlockManagerObserver(ctx context.Context,
+		folderBranch FolderBranch, obs BlockManagerObserver) error
+	// UnregisterBlockManagerObserver undoes a previous call to
+	// RegisterBlockManagerObserver.
+	UnregisterBlockManagerObserver(ctx context.Context,
+		folderBranch FolderBranch, obs BlockManagerObserver) error
+	// SetFolderMaxFileBytes limits the plaintext size of the files in
+	// the given folder/branch to `maxBytes`, below the config's
+	// MaxFileBytes, e.g. for a folder shared with users who have
+	// little quota.  A limit of 0 restores the config's MaxFileBytes.
+	SetFolderMaxFileBytes(ctx context.Context, folderBranch FolderBranch,
+		maxBytes uint64) error
 	// FolderStatus returns the status of a particular folder/branch, along
 	// with a channel that will be closed when the status has been
 	// updated (to eliminate the need for polling this method).
@@ -319,6 +357,11 @@ type KBFSOps interface {
 	// any, and fast-forwards to the current head of this
 	// folder-branch.
 	UnstageForTesting(ctx context.Context, folderBranch FolderBranch) error
+	// AbandonBranch discards all of this device's local changes to
+	// the given folder-branch, including unsynced dirty state and
+	// any unmerged branch on the server, and fast-forwards to the
+	// current merged head.  The logged-in user must be a writer.
+	AbandonBranch(ctx context.Context, folderBranch FolderBranch) error
 	// RequestRekey requests to rekey this folder. Note that this asynchronously
 	// requests a rekey, so canceling ctx doesn't cancel the rekey.
 	RequestRekey(ctx context.Context, id tlf.ID)
@@ -837,6 +880,23 @@ const (
 	PermanentEntry
 )
 
+// BlockCachePolicy indicates how file blocks fetched from the server
+// for reading should be put into the BlockCache.
+type BlockCachePolicy int
+
+const (
+	// CacheBlocks caches fetched blocks as transient entries.
+	CacheBlocks BlockCachePolicy = iota
+	// NoCacheBlocks doesn't cache fetched blocks at all, e.g. for a
+	// one-shot scan of a large file that would otherwise evict more
+	// useful entries.
+	NoCacheBlocks
+	// CacheBlocksLowPriority caches fetched blocks as transient
+	// entries only if the cache has room for them without evicting
+	// any other entries.
+	CacheBlocksLowPriority
+)
+
 // BlockCacheSimple gets and puts plaintext dir blocks and file blocks into
 // a cache.  These blocks are immutable and identified by their
 // content hash.
@@ -858,6 +918,29 @@ type BlockCacheSimple interface {
 		lifetime BlockCacheLifetime) error
 }
 
+// BlockDedupIndex maps the plaintext hashes of direct file blocks to
+// pointers of known blocks with the same contents, for a given TLF.
+// Unlike the known-pointer tracking in BlockCache, an index can
+// outlive cache evictions, so a BlockCache wrapped with one (see
+// Config.SetBlockDedupIndex) lets ReadyBlock dedup against blocks
+// that are no longer cached.
+type BlockDedupIndex interface {
+	// Lookup returns the pointer of a known block in the given TLF
+	// whose plaintext has the given hash, if there is one.
+	Lookup(tlf tlf.ID, contentHash kbfshash.RawDefaultHash) (
+		BlockPointer, bool)
+	// Record remembers that the block at `ptr` in the given TLF has
+	// plaintext with the given hash.
+	Record(tlf tlf.ID, contentHash kbfshash.RawDefaultHash, ptr BlockPointer)
+	// Forget removes any known block for the given hash in the
+	// given TLF, e.g. because that block can't be referenced
+	// anymore.
+	Forget(tlf tlf.ID, contentHash kbfshash.RawDefaultHash)
+	// ForgetID is like Forget, but for the known block with the
+	// given ID, whatever its hash.
+	ForgetID(tlf tlf.ID, id kbfsblock.ID)
+}
+
 // BlockCache specifies the interface of BlockCacheSimple, and also more
 // advanced and internal methods.
 type BlockCache interface {
@@ -869,6 +952,11 @@ type BlockCache interface {
 	// If no ID is known, return an uninitialized BlockPointer and
 	// a nil error.
 	CheckForKnownPtr(tlf tlf.ID, block *FileBlock) (BlockPointer, error)
+	// CheckForKnownPtrs is like CheckForKnownPtr, but checks a
+	// whole batch of direct file blocks at once.  The returned map
+	// only contains entries for the blocks with a known ID.
+	CheckForKnownPtrs(tlf tlf.ID, blocks []*FileBlock) (
+		map[*FileBlock]BlockPointer, error)
 	// DeleteTransient removes the transient entry for the given
 	// pointer from the cache, as well as any cached IDs so the block
 	// won't be reused.
@@ -896,6 +984,24 @@ type BlockCache interface {
 	// GetCleanBytesCapacity atomically gets clean bytes capacity for block
 	// cache.
 	GetCleanBytesCapacity() (capacity uint64)
+
+	// HasRoomForTransient returns whether the given block could be
+	// put into the transient cache without evicting any other
+	// entries.  It's only a hint, since another goroutine may fill
+	// the cache concurrently.
+	HasRoomForTransient(block Block) bool
+	// Pin keeps the cached block for the given pointer readable from
+	// this cache, even if the transient cache evicts it, until a
+	// matching call to Unpin.  Pins nest, so a block pinned twice
+	// must be unpinned twice.  It returns false, and pins nothing,
+	// if the block isn't cached; the caller must not call Unpin in
+	// that case.  Deleting the block from the cache drops all of its
+	// pins.
+	Pin(ptr BlockPointer) bool
+	// Unpin undoes one successful call to Pin for the given pointer.
+	// Once a block has no pins left, it is only readable again if
+	// it's still in the transient or permanent cache.
+	Unpin(ptr BlockPointer)
 }
 
 // DirtyPermChan is a channel that gets closed when the holder has
@@ -972,6 +1078,11 @@ type DirtyBlockCache interface {
 	// ShouldForceSync returns true if the sync buffer is full enough
 	// to force all callers to sync their data immediately.
 	ShouldForceSync(tlfID tlf.ID) bool
+	// MaxUnsyncedBytes returns the number of unsynced bytes past
+	// which the cache stops granting permission to dirty more data,
+	// or 0 if it doesn't track unsynced bytes.  tlfID may be
+	// ignored.
+	MaxUnsyncedBytes(tlfID tlf.ID) int64
 
 	// Shutdown frees any resources associated with this instance.  It
 	// returns an error if there are any unsynced blocks.
@@ -1057,6 +1168,16 @@ type cryptoPure interface {
 	// block) <= len(encryptedBlock).
 	DecryptBlock(encryptedBlock kbfscrypto.EncryptedBlock,
 		key kbfscrypto.BlockCryptKey, block Block) error
+
+	// EncryptEncodedBlock is like EncryptBlock, but for a block
+	// that has already been encoded, e.g. by a BlockCodec.
+	EncryptEncodedBlock(encodedBlock []byte, key kbfscrypto.BlockCryptKey) (
+		plainSize int, encryptedBlock kbfscrypto.EncryptedBlock, err error)
+
+	// DecryptEncodedBlock is like DecryptBlock, but returns the
+	// decrypted block without decoding it.
+	DecryptEncodedBlock(encryptedBlock kbfscrypto.EncryptedBlock,
+		key kbfscrypto.BlockCryptKey) ([]byte, error)
 }
 
 // Crypto signs, verifies, encrypts, and decrypts stuff.
@@ -1243,6 +1364,13 @@ type BlockOps interface {
 	Get(ctx context.Context, kmd KeyMetadata, blockPtr BlockPointer,
 		block Block, cacheLifetime BlockCacheLifetime) error
 
+	// GetWithPriority is like Get, but if the block must be fetched
+	// from the server, the request is queued with the given
+	// priority rather than the default on-demand one.
+	GetWithPriority(ctx context.Context, kmd KeyMetadata,
+		blockPtr BlockPointer, block Block,
+		cacheLifetime BlockCacheLifetime, priority int) error
+
 	// GetEncodedSize gets the encoded size of the block associated
 	// with the given block pointer (which belongs to the TLF with the
 	// given key metadata).
@@ -1269,6 +1397,12 @@ type BlockOps interface {
 	// than folder writers.
 	Archive(ctx context.Context, tlfID tlf.ID, ptrs []BlockPointer) error
 
+	// SetBlockCodec makes Ready encode the blocks of the given
+	// folder with `codec`.  A nil codec goes back to the crypto
+	// layer's encoding.  Blocks are always decoded according to
+	// their pointers, regardless of the folder's codec.
+	SetBlockCodec(tlfID tlf.ID, codec BlockCodec)
+
 	// TogglePrefetcher activates or deactivates the prefetcher.
 	TogglePrefetcher(enable bool) <-chan struct{}
 
@@ -1449,6 +1583,12 @@ type mdServerLocal interface {
 		uid keybase1.UID, newAssertion keybase1.SocialAssertion) error
 	getCurrentMergedHeadRevision(ctx context.Context, id tlf.ID) (
 		rev kbfsmd.Revision, err error)
+	// registerForUpdateOrRekey is like RegisterForUpdate, except the
+	// returned channel also fires, with a distinct rekey-needed
+	// notification, when a rekey-only MD is put, and with the new
+	// handle when the TLF's handle changes.
+	registerForUpdateOrRekey(ctx context.Context, id tlf.ID,
+		currHead kbfsmd.Revision) (<-chan mdServerLocalUpdate, error)
 	isShutdown() bool
 	copy(config mdServerLocalConfig) mdServerLocal
 }
@@ -1574,6 +1714,9 @@ type BlockSplitter interface {
 	// bytes from the next block should be appended.
 	CheckSplit(block *FileBlock) int64
 
+	// MaxSize returns the largest number of bytes of file data this
+	// splitter will put into a single leaf block.
+	MaxSize() int64
 	// MaxPtrsPerBlock describes the number of indirect pointers we
 	// can fit into one indirect block.
 	MaxPtrsPerBlock() int
@@ -1640,6 +1783,30 @@ type Observer interface {
 	TlfHandleChange(ctx context.Context, newHandle *TlfHandle)
 }
 
+// BlockManagerObserver can be notified about the background block
+// archiving and quota reclamation done for a folder.  The callbacks
+// are made without holding any internal locks, but they should still
+// return quickly, since they delay the work being reported on.
+type BlockManagerObserver interface {
+	// OnArchiveStarted announces that the blocks unreferenced by the
+	// given revision are about to be archived.
+	OnArchiveStarted(ctx context.Context, tlfID tlf.ID,
+		rev kbfsmd.Revision, numPtrs int)
+	// OnArchiveCompleted announces that archiving the blocks
+	// unreferenced by the given revision is done.  If err is
+	// non-nil, some of the blocks may not have been archived.
+	OnArchiveCompleted(ctx context.Context, tlfID tlf.ID,
+		rev kbfsmd.Revision, numPtrs int, err error)
+	// OnReclamationStarted announces that a quota reclamation has
+	// found revisions that are old enough to reclaim.
+	OnReclamationStarted(ctx context.Context, tlfID tlf.ID)
+	// OnReclamationCompleted announces the end of a quota
+	// reclamation that was announced by OnReclamationStarted, along
+	// with the number of block pointers it deleted.
+	OnReclamationCompleted(ctx context.Context, tlfID tlf.ID,
+		numPtrs int, err error)
+}
+
 // Notifier notifies registrants of directory changes
 type Notifier interface {
 	// RegisterForChanges declares that the given Observer wants to
@@ -1704,6 +1871,7 @@ type Config interface {
 	diskLimiterGetter
 	syncedTlfGetterSetter
 	initModeGetter
+	tunablesGetter
 	Tracer
 	KBFSOps() KBFSOps
 	SetKBFSOps(KBFSOps)
@@ -1756,6 +1924,10 @@ type Config interface {
 	// MaxNameBytes indicates the maximum supported size of a
 	// directory entry name in bytes.
 	MaxNameBytes() uint32
+	// MaxFileBytes indicates the maximum supported plaintext size of
+	// a file in bytes.  Individual folders may enforce a smaller
+	// limit.
+	MaxFileBytes() uint64
 	// MaxDirBytes indicates the maximum supported plaintext size of a
 	// directory in bytes.
 	MaxDirBytes() uint64
@@ -1834,6 +2006,20 @@ type Config interface {
 	// before syncing a set of changes to the servers.
 	SetBGFlushPeriod(p time.Duration)
 
+	// SetTunables replaces the settings returned by Tunables.  It
+	// returns an error, and keeps the current settings, if any of
+	// the new ones is out of range.
+	SetTunables(t Tunables) error
+
+	// BlockDedupIndex returns the index that the BlockCache falls back
+	// to when looking for duplicates of new blocks, or nil if there
+	// isn't one.
+	BlockDedupIndex() BlockDedupIndex
+	// SetBlockDedupIndex wraps the current BlockCache so that it
+	// consults and maintains the given index, which lets ReadyBlock
+	// dedup against blocks that have been evicted from the cache.
+	// Caches set later with SetBlockCache aren't wrapped.
+	SetBlockDedupIndex(index BlockDedupIndex)
 	// Shutdown is called to free config resources.
 	Shutdown(context.Context) error
 	// CheckStateOnShutdown tells the caller whether or not it is safe
@@ -26,3 +26,17 @@ func (j journalBlockCache) CheckForKnownPtr(
 	// journalBlockServer.AddReference.)
 	return BlockPointer{}, nil
 }
+
+// CheckForKnownPtrs implements BlockCache.
+func (j journalBlockCache) CheckForKnownPtrs(
+	tlfID tlf.ID, blocks []*FileBlock) (map[*FileBlock]BlockPointer, error) {
+	_, ok := j.jServer.getTLFJournal(tlfID, nil)
+	if !ok {
+		return j.BlockCache.CheckForKnownPtrs(tlfID, blocks)
+	}
+
+	// Temporarily disable de-duping for the journal server until
+	// KBFS-1149 is fixed. (See also
+	// journalBlockServer.AddReference.)
+	return make(map[*FileBlock]BlockPointer), nil
+}
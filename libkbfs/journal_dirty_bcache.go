@@ -111,6 +111,14 @@ func (j journalDirtyBlockCache) ShouldForceSync(tlfID tlf.ID) bool {
 	return j.syncCache.ShouldForceSync(tlfID)
 }
 
+func (j journalDirtyBlockCache) MaxUnsyncedBytes(tlfID tlf.ID) int64 {
+	if j.jServer.hasTLFJournal(tlfID) {
+		return j.journalCache.MaxUnsyncedBytes(tlfID)
+	}
+
+	return j.syncCache.MaxUnsyncedBytes(tlfID)
+}
+
 func (j journalDirtyBlockCache) Shutdown() error {
 	journalErr := j.journalCache.Shutdown()
 	syncErr := j.syncCache.Shutdown()
@@ -404,6 +404,167 @@ func TestUnmergedAfterRestart(t *testing.T) {
 		rootNode2.GetFolderBranch(), "Node 2 (after unstage)")
 }
 
+// Tests that abandoning an unmerged branch with dirty local changes
+// prunes the branch on the server, throws away the dirty state, and
+// leaves the device on the merged head.
+func TestAbandonBranch(t *testing.T) {
+	// simulate two users
+	var userName1, userName2 libkb.NormalizedUsername = "u1", "u2"
+	config1, _, ctx, cancel := kbfsOpsConcurInit(t, userName1, userName2)
+	defer kbfsConcurTestShutdown(t, config1, ctx, cancel)
+
+	config2 := ConfigAsUser(config1, userName2)
+	defer CheckConfigAndShutdown(ctx, t, config2)
+
+	name := userName1.String() + "," + userName2.String()
+
+	// user1 creates a file in a shared dir
+	rootNode1 := GetRootNodeOrBust(ctx, t, config1, name, tlf.Private)
+
+	kbfsOps1 := config1.KBFSOps()
+	fileNode1, _, err := kbfsOps1.CreateFile(ctx, rootNode1, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	_, err = DisableUpdatesForTesting(config1, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	DisableCRForTesting(config1, rootNode1.GetFolderBranch())
+
+	// then user2 write to the file
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, name, tlf.Private)
+
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	data2 := []byte{2}
+	err = kbfsOps2.Write(ctx, fileNode2, data2, 0)
+	require.NoError(t, err)
+	err = kbfsOps2.SyncAll(ctx, fileNode2.GetFolderBranch())
+	require.NoError(t, err)
+
+	// user1's conflicting write makes it unmerged.
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps1.SyncAll(ctx, fileNode1.GetFolderBranch())
+	require.NoError(t, err)
+	checkStatus(t, ctx, kbfsOps1, true, userName1, nil,
+		rootNode1.GetFolderBranch(), "Node 1 (unmerged)")
+
+	// Now dirty an existing file and a new file on top of the
+	// unmerged branch.
+	err = kbfsOps1.Write(ctx, fileNode1, []byte{3, 3}, 0)
+	require.NoError(t, err)
+	newNode1, _, err := kbfsOps1.CreateFile(
+		ctx, rootNode1, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps1.Write(ctx, newNode1, []byte{4}, 0)
+	require.NoError(t, err)
+
+	ops1 := getOps(config1, rootNode1.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	require.Equal(t, dirtyState, ops1.blocks.GetState(lState))
+	require.False(t, ops1.isMasterBranch(lState))
+	head, err := config1.MDServer().GetForTLF(
+		ctx, ops1.id(), kbfsmd.NullBranchID, kbfsmd.Unmerged, nil)
+	require.NoError(t, err)
+	require.NotNil(t, head)
+
+	err = kbfsOps1.AbandonBranch(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+
+	// The server no longer has the branch.
+	head, err = config1.MDServer().GetForTLF(
+		ctx, ops1.id(), kbfsmd.NullBranchID, kbfsmd.Unmerged, nil)
+	require.NoError(t, err)
+	require.Nil(t, head)
+
+	// And all the local dirty state is gone.
+	require.True(t, ops1.isMasterBranch(lState))
+	require.Equal(t, cleanState, ops1.blocks.GetState(lState))
+	require.Len(t, ops1.blocks.GetDirtyFileBlockRefs(lState), 0)
+	require.Equal(t, 0, ops1.getCachedDirOpsCount(lState))
+	// Unstaging puts in a resolutionOp as user1 on top of user2's
+	// write.
+	checkStatus(t, ctx, kbfsOps1, false, userName1, nil,
+		rootNode1.GetFolderBranch(), "Node 1 (after abandon)")
+
+	readAndCompareData(t, config1, ctx, name, data2, userName2)
+	children, err := kbfsOps1.GetDirChildren(ctx, rootNode1)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Contains(t, children, "a")
+
+	// A second abandon has nothing to do.
+	err = kbfsOps1.AbandonBranch(ctx, rootNode1.GetFolderBranch())
+	require.NoError(t, err)
+	require.True(t, ops1.isMasterBranch(lState))
+}
+
+// Tests that abandoning local changes on the master branch notifies
+// observers about the affected nodes, and unlinks the nodes of new
+// files that were never synced.
+func TestAbandonBranchNotifiesObservers(t *testing.T) {
+	var userName libkb.NormalizedUsername = "u1"
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, userName)
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, userName.String(),
+		tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, fileNode, []byte{1}, 0)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	err = kbfsOps.Write(ctx, fileNode, []byte{2, 2}, 0)
+	require.NoError(t, err)
+	newNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.Write(ctx, newNode, []byte{3}, 0)
+	require.NoError(t, err)
+
+	c := make(chan struct{}, 1)
+	cro := &testCRObserver{c, nil}
+	err = config.Notifier().RegisterForChanges(
+		[]FolderBranch{rootNode.GetFolderBranch()}, cro)
+	require.NoError(t, err)
+	defer func() {
+		err := config.Notifier().UnregisterFromChanges(
+			[]FolderBranch{rootNode.GetFolderBranch()}, cro)
+		require.NoError(t, err)
+	}()
+
+	err = kbfsOps.AbandonBranch(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	<-c
+
+	changed := make(map[NodeID]NodeChange)
+	for _, change := range cro.changes {
+		changed[change.Node.GetID()] = change
+	}
+	require.Contains(t, changed, rootNode.GetID())
+	require.Contains(t, changed[rootNode.GetID()].DirUpdated, "b")
+	require.Contains(t, changed, fileNode.GetID())
+	require.Len(t, changed[fileNode.GetID()].FileUpdated, 1)
+	require.NotContains(t, changed, newNode.GetID())
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	require.True(t, ops.nodeCache.IsUnlinked(newNode))
+	require.False(t, ops.nodeCache.IsUnlinked(fileNode))
+
+	data := make([]byte, 2)
+	n, err := kbfsOps.Read(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, data[:n])
+	children, err := kbfsOps.GetDirChildren(ctx, rootNode)
+	require.NoError(t, err)
+	require.Len(t, children, 1)
+	require.Contains(t, children, "a")
+}
+
 // Tests that multiple users can write to the same file sequentially
 // without any problems.
 func TestMultiUserWrite(t *testing.T) {
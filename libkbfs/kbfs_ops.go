@@ -724,6 +724,18 @@ func (fs *KBFSOpsStandard) Read(
 	return ops.Read(ctx, file, dest, off)
 }
 
+// ReadWithCachePolicy implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) ReadWithCachePolicy(
+	ctx context.Context, file Node, dest []byte, off int64,
+	policy BlockCachePolicy) (numRead int64, err error) {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.ReadWithCachePolicy(ctx, file, dest, off, policy)
+}
+
 // Write implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) Write(
 	ctx context.Context, file Node, data []byte, off int64) error {
@@ -744,6 +756,16 @@ func (fs *KBFSOpsStandard) Truncate(
 	return ops.Truncate(ctx, file, size)
 }
 
+// PunchHole implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) PunchHole(
+	ctx context.Context, file Node, off, length int64) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.PunchHole(ctx, file, off, length)
+}
+
 // SetEx implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) SetEx(
 	ctx context.Context, file Node, ex bool) error {
@@ -774,6 +796,40 @@ func (fs *KBFSOpsStandard) SyncAll(
 	return ops.SyncAll(ctx, folderBranch)
 }
 
+// FinalizeFile implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) FinalizeFile(ctx context.Context, file Node) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOpsByNode(ctx, file)
+	return ops.FinalizeFile(ctx, file)
+}
+
+// RegisterBlockManagerObserver implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) RegisterBlockManagerObserver(ctx context.Context,
+	folderBranch FolderBranch, obs BlockManagerObserver) error {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.RegisterBlockManagerObserver(ctx, folderBranch, obs)
+}
+
+// UnregisterBlockManagerObserver implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) UnregisterBlockManagerObserver(
+	ctx context.Context, folderBranch FolderBranch,
+	obs BlockManagerObserver) error {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.UnregisterBlockManagerObserver(ctx, folderBranch, obs)
+}
+
+// SetFolderMaxFileBytes implements the KBFSOps interface for
+// KBFSOpsStandard
+func (fs *KBFSOpsStandard) SetFolderMaxFileBytes(ctx context.Context,
+	folderBranch FolderBranch, maxBytes uint64) error {
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpNoChange)
+	return ops.SetFolderMaxFileBytes(ctx, folderBranch, maxBytes)
+}
+
 // FolderStatus implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) FolderStatus(
 	ctx context.Context, folderBranch FolderBranch) (
@@ -857,6 +913,16 @@ func (fs *KBFSOpsStandard) UnstageForTesting(
 	return ops.UnstageForTesting(ctx, folderBranch)
 }
 
+// AbandonBranch implements the KBFSOps interface for KBFSOpsStandard
+func (fs *KBFSOpsStandard) AbandonBranch(
+	ctx context.Context, folderBranch FolderBranch) error {
+	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
+	defer timeTrackerDone()
+
+	ops := fs.getOps(ctx, folderBranch, FavoritesOpAdd)
+	return ops.AbandonBranch(ctx, folderBranch)
+}
+
 // RequestRekey implements the KBFSOps interface for KBFSOpsStandard
 func (fs *KBFSOpsStandard) RequestRekey(ctx context.Context, id tlf.ID) {
 	timeTrackerDone := fs.longOperationDebugDumper.Begin(ctx)
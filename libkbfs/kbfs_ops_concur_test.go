@@ -313,6 +313,114 @@ func testKBFSOpsConcurWritesDuringSync(t *testing.T,
 	}
 }
 
+// Test that FinalizeFile keeps syncing a file until writes deferred
+// during a slow sync have also been flushed.
+func TestKBFSOpsConcurFinalizeFileWithDeferredWrites(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsConcurInit(t, "test_user")
+	defer kbfsConcurTestShutdown(t, config, ctx, cancel)
+
+	onPutStalledCh, putUnstallCh, putCtx :=
+		StallMDOp(ctx, config, StallableMDAfterPut, 1)
+
+	// create and write to a file
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	// Another file that was already synced, and then written to.
+	otherNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	if err != nil {
+		t.Fatalf("Couldn't create file: %v", err)
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	err = kbfsOps.Write(ctx, otherNode, []byte{9}, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	data := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	if err != nil {
+		t.Fatalf("Couldn't write file: %v", err)
+	}
+
+	// start finalizing the file
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- kbfsOps.FinalizeFile(putCtx, fileNode)
+	}()
+
+	// wait until the first sync gets stuck at MDOps.Put()
+	select {
+	case <-onPutStalledCh:
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for stall")
+	}
+
+	// This write gets deferred until the stalled sync finishes.
+	newData := []byte{6, 7, 8}
+	err = kbfsOps.Write(ctx, fileNode, newData, int64(len(data)))
+	if err != nil {
+		t.Fatalf("Couldn't write data: %v", err)
+	}
+	data = append(data, newData...)
+
+	close(putUnstallCh)
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatalf("FinalizeFile got an error: %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Timeout waiting for FinalizeFile")
+	}
+
+	// The deferred write must have been flushed too.
+	lState := makeFBOLockState()
+	filePath := ops.nodeCache.PathFromNode(fileNode)
+	if ops.blocks.IsDirty(lState, filePath) {
+		t.Fatalf("File still dirty after FinalizeFile")
+	}
+
+	// Only the finalized file gets synced.
+	otherPath := ops.nodeCache.PathFromNode(otherNode)
+	if !ops.blocks.IsDirty(lState, otherPath) {
+		t.Fatalf("Other file was synced by FinalizeFile")
+	}
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	if err != nil {
+		t.Fatalf("Couldn't sync all: %v", err)
+	}
+	dbcs := config.DirtyBlockCache().(*DirtyBlockCacheStandard)
+	if numDirtyBlocks := len(dbcs.cache); numDirtyBlocks != 0 {
+		t.Fatalf("%d dirty blocks left after SyncAll", numDirtyBlocks)
+	}
+
+	// Another device should see all of the data.
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", tlf.Private)
+	kbfsOps2 := config2.KBFSOps()
+	fileNode2, _, err := kbfsOps2.Lookup(ctx, rootNode2, "a")
+	if err != nil {
+		t.Fatalf("Couldn't lookup file: %v", err)
+	}
+	buf := make([]byte, len(data))
+	nr, err := kbfsOps2.Read(ctx, fileNode2, buf, 0)
+	if err != nil {
+		t.Fatalf("Couldn't read data: %v", err)
+	}
+	if nr != int64(len(data)) || !bytes.Equal(data, buf) {
+		t.Fatalf("Got wrong data %v; expected %v", buf[:nr], data)
+	}
+}
+
 // Test that a write can happen concurrently with a sync
 func TestKBFSOpsConcurWriteDuringSync(t *testing.T) {
 	testKBFSOpsConcurWritesDuringSync(t, 1, 1, 1)
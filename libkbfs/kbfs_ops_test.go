@@ -102,6 +102,8 @@ func kbfsOpsInit(t *testing.T) (mockCtrl *gomock.Controller,
 	// Max out MaxPtrsPerBlock
 	config.mockBsplit.EXPECT().MaxPtrsPerBlock().
 		Return(int((^uint(0)) >> 1)).AnyTimes()
+	config.mockBsplit.EXPECT().MaxSize().
+		Return(int64(MaxBlockSizeBytesDefault)).AnyTimes()
 
 	// Ignore Archive calls for now
 	config.mockBops.EXPECT().Archive(gomock.Any(), gomock.Any(),
@@ -112,7 +114,8 @@ func kbfsOpsInit(t *testing.T) (mockCtrl *gomock.Controller,
 	// Ignore BlockRetriever calls
 	brc := &testBlockRetrievalConfig{nil, newTestLogMaker(t),
 		config.BlockCache(), nil, newTestDiskBlockCacheGetter(t, nil),
-		newTestSyncedTlfGetterSetter(), testInitModeGetter{InitDefault}}
+		newTestSyncedTlfGetterSetter(), testInitModeGetter{InitDefault},
+		DefaultTunables()}
 	brq := newBlockRetrievalQueue(0, 0, brc)
 	config.mockBops.EXPECT().BlockRetriever().AnyTimes().Return(brq)
 	// Ignore Prefetcher calls
@@ -3610,3 +3613,217 @@ func TestKBFSOpsBasicTeamTLF(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, u1, ei.LastWriterUnverified)
 }
+
+func TestKBFSOpsSyncFailsOnMissingDirtyBlock(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// create a file.
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	data := []byte{1, 2, 3, 4, 5}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+
+	// Evict the dirty top block out from under the sync.
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	p := ops.nodeCache.PathFromNode(fileNode)
+	err = config.DirtyBlockCache().Delete(p.Tlf, p.tailPointer(), p.Branch)
+	require.NoError(t, err)
+
+	err = kbfsOps.SyncAll(ctx, fileNode.GetFolderBranch())
+	require.IsType(t, DirtyBlockMissingError{}, errors.Cause(err))
+
+	// Clear out the broken dirty state so shutdown succeeds.
+	lState := makeFBOLockState()
+	err = ops.blocks.ClearCacheInfo(lState, p)
+	require.NoError(t, err)
+	ops.status.rmDirtyNode(fileNode)
+}
+
+func TestKBFSOpsSyncFailsOnTopBlockTypeMismatch(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	// Make the blocks small, so "b" becomes indirect.
+	bsplit := &BlockSplitterSimple{5, 2, 100 * 1024}
+	config.SetBlockSplitter(bsplit)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNodeA, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	fileNodeB, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	checkMismatch := func(node Node, data []byte, block *FileBlock,
+		expectedIndirect bool) {
+		err := kbfsOps.Write(ctx, node, data, 0)
+		require.NoError(t, err)
+
+		// Swap in a top block of the wrong type.
+		p := ops.nodeCache.PathFromNode(node)
+		err = config.DirtyBlockCache().Put(
+			p.Tlf, p.tailPointer(), p.Branch, block)
+		require.NoError(t, err)
+
+		err = kbfsOps.SyncAll(ctx, node.GetFolderBranch())
+		require.IsType(t, FileBlockTypeMismatchError{}, errors.Cause(err))
+		require.Equal(t, expectedIndirect,
+			errors.Cause(err).(FileBlockTypeMismatchError).expectedIndirect)
+
+		// Clear out the broken dirty state so shutdown succeeds.
+		err = kbfsOps.AbandonBranch(ctx, node.GetFolderBranch())
+		require.NoError(t, err)
+		require.Equal(t, cleanState, ops.blocks.GetState(lState))
+	}
+
+	// A direct file whose top block claims to be indirect.
+	checkMismatch(fileNodeA, []byte{1, 2, 3},
+		&FileBlock{CommonBlock: CommonBlock{IsInd: true}}, false)
+
+	// An indirect file whose top block claims to be direct.
+	checkMismatch(fileNodeB, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+		&FileBlock{Contents: []byte{1, 2, 3}}, true)
+}
+
+type putFailingBlockServer struct {
+	BlockServer
+}
+
+var errPutFailedForTest = errors.New("put failed for test")
+
+func (b putFailingBlockServer) Put(ctx context.Context, tlfID tlf.ID,
+	id kbfsblock.ID, context kbfsblock.Context, buf []byte,
+	serverHalf kbfscrypto.BlockCryptKeyServerHalf) error {
+	return errPutFailedForTest
+}
+
+// Make sure that a rename whose block puts fail leaves both the old
+// and new parent directories as they were before the rename.
+func TestKBFSOpsRenameRollbackOnPutFailure(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "a")
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateDir(ctx, rootNode, "b")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.CreateFile(ctx, aNode, "f", false, NoExcl)
+	require.NoError(t, err)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+
+	getState := func() (aEI, bEI EntryInfo,
+		aChildren, bChildren map[string]EntryInfo) {
+		aEI, err := kbfsOps.Stat(ctx, aNode)
+		require.NoError(t, err)
+		bEI, err = kbfsOps.Stat(ctx, bNode)
+		require.NoError(t, err)
+		aChildren, err = kbfsOps.GetDirChildren(ctx, aNode)
+		require.NoError(t, err)
+		bChildren, err = kbfsOps.GetDirChildren(ctx, bNode)
+		require.NoError(t, err)
+		return aEI, bEI, aChildren, bChildren
+	}
+	aEI, bEI, aChildren, bChildren := getState()
+
+	// Sync each directory op right away, so the rename's block puts
+	// happen during the rename itself.
+	config.SetBGFlushDirOpBatchSize(1)
+	bserver := config.BlockServer()
+	config.SetBlockServer(putFailingBlockServer{bserver})
+	err = kbfsOps.Rename(ctx, aNode, "f", bNode, "g")
+	require.Equal(t, errPutFailedForTest, errors.Cause(err))
+	config.SetBlockServer(bserver)
+
+	newAEI, newBEI, newAChildren, newBChildren := getState()
+	require.Equal(t, aEI, newAEI)
+	require.Equal(t, bEI, newBEI)
+	require.Equal(t, aChildren, newAChildren)
+	require.Equal(t, bChildren, newBChildren)
+	status, _, err := kbfsOps.FolderStatus(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Len(t, status.DirtyPaths, 0)
+
+	// The rename works once puts succeed again.
+	err = kbfsOps.Rename(ctx, aNode, "f", bNode, "g")
+	require.NoError(t, err)
+	_, _, err = kbfsOps.Lookup(ctx, bNode, "g")
+	require.NoError(t, err)
+}
+
+// Test how clients see the faults injected into an MDServerMemory.
+func TestKBFSOpsMDServerFaults(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+	mdServer, ok := config.MDServer().(*MDServerMemory)
+	require.True(t, ok)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	fileNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	data := []byte{1, 2, 3}
+	err = kbfsOps.Write(ctx, fileNode, data, 0)
+	require.NoError(t, err)
+
+	t.Log("A failed MD put fails the sync, but leaves the changes " +
+		"dirty so the next sync can retry them.")
+	mdServer.SetFaultInjection(&MDServerMemoryFaults{
+		Methods: map[string]MDServerMemoryFault{
+			"Put": {ErrorProbability: 1},
+		},
+	})
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.IsType(t, kbfsmd.ServerError{}, errors.Cause(err))
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	require.NotEqual(t, cleanState, ops.blocks.GetState(lState))
+
+	mdServer.SetFaultInjection(nil)
+	err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+	require.NoError(t, err)
+	require.Equal(t, cleanState, ops.blocks.GetState(lState))
+
+	config2 := ConfigAsUser(config, "test_user")
+	defer CheckConfigAndShutdown(ctx, t, config2)
+	rootNode2 := GetRootNodeOrBust(ctx, t, config2, "test_user", tlf.Private)
+	fileNode2, _, err := config2.KBFSOps().Lookup(ctx, rootNode2, "a")
+	require.NoError(t, err)
+	buf := make([]byte, len(data))
+	_, err = config2.KBFSOps().Read(ctx, fileNode2, buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, data, buf)
+
+	t.Log("Injected latency counts against the deadline of a client " +
+		"fetching new updates.")
+	head, _ := ops.getHead(lState)
+	mdServer.SetFaultInjection(&MDServerMemoryFaults{
+		Methods: map[string]MDServerMemoryFault{
+			"GetRange": {MinLatency: time.Minute, MaxLatency: time.Minute},
+		},
+	})
+	ctxTimeout, cancelTimeout := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelTimeout()
+	_, err = getMergedMDUpdates(
+		ctxTimeout, config, head.TlfID(), head.Revision()+1, nil)
+	require.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+
+	mdServer.SetFaultInjection(nil)
+	rmds, err := getMergedMDUpdates(
+		ctx, config, head.TlfID(), head.Revision()+1, nil)
+	require.NoError(t, err)
+	require.Len(t, rmds, 0)
+}
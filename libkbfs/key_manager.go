@@ -24,6 +24,8 @@ type KeyManagerStandard struct {
 	deferLog logger.Logger
 }
 
+var _ blockDecryptionKeyRefetcher = (*KeyManagerStandard)(nil)
+
 // NewKeyManagerStandard returns a new KeyManagerStandard
 func NewKeyManagerStandard(config Config) *KeyManagerStandard {
 	log := config.MakeLogger("")
@@ -55,6 +57,30 @@ func (km *KeyManagerStandard) GetTLFCryptKeyForBlockDecryption(
 	return km.getTLFCryptKeyUsingCurrentDevice(ctx, kmd, blockPtr.KeyGen, true)
 }
 
+// refetchTLFCryptKeyForBlockDecryption implements the
+// blockDecryptionKeyRefetcher interface for KeyManagerStandard.
+func (km *KeyManagerStandard) refetchTLFCryptKeyForBlockDecryption(
+	ctx context.Context, kmd KeyMetadata, blockPtr BlockPointer) (
+	tlfCryptKey kbfscrypto.TLFCryptKey, changed bool, err error) {
+	cachedKey, err := km.config.KeyCache().GetTLFCryptKey(
+		kmd.TlfID(), blockPtr.KeyGen)
+	switch err.(type) {
+	case nil:
+	case KeyCacheMissError:
+		// The key that was used was just resolved from scratch.
+		return kbfscrypto.TLFCryptKey{}, false, nil
+	default:
+		return kbfscrypto.TLFCryptKey{}, false, err
+	}
+
+	tlfCryptKey, err = km.getTLFCryptKey(ctx, kmd, blockPtr.KeyGen,
+		getTLFCryptKeyDoCache|getTLFCryptKeySkipCache)
+	if err != nil {
+		return kbfscrypto.TLFCryptKey{}, false, err
+	}
+	return tlfCryptKey, tlfCryptKey != cachedKey, nil
+}
+
 // GetTLFCryptKeyOfAllGenerations implements the KeyManager interface for
 // KeyManagerStandard.
 func (km *KeyManagerStandard) GetTLFCryptKeyOfAllGenerations(
@@ -87,6 +113,7 @@ const (
 	getTLFCryptKeyAnyDevice getTLFCryptKeyFlags = 1 << iota
 	getTLFCryptKeyDoCache
 	getTLFCryptKeyPromptPaper
+	getTLFCryptKeySkipCache
 )
 
 func (km *KeyManagerStandard) getTLFCryptKey(ctx context.Context,
@@ -108,16 +135,21 @@ func (km *KeyManagerStandard) getTLFCryptKey(ctx context.Context,
 		return kbfscrypto.TLFCryptKey{}, kbfsmd.NewKeyGenerationError{TlfID: tlfID, KeyGen: keyGen}
 	}
 
-	// look in the cache first
+	// look in the cache first, unless the caller wants the key
+	// resolved from scratch
 	kcache := km.config.KeyCache()
-	tlfCryptKey, err := kcache.GetTLFCryptKey(tlfID, keyGen)
-	switch err := err.(type) {
-	case nil:
-		return tlfCryptKey, nil
-	case KeyCacheMissError:
-		break
-	default:
-		return kbfscrypto.TLFCryptKey{}, err
+	var tlfCryptKey kbfscrypto.TLFCryptKey
+	if flags&getTLFCryptKeySkipCache == 0 {
+		var err error
+		tlfCryptKey, err = kcache.GetTLFCryptKey(tlfID, keyGen)
+		switch err := err.(type) {
+		case nil:
+			return tlfCryptKey, nil
+		case KeyCacheMissError:
+			break
+		default:
+			return kbfscrypto.TLFCryptKey{}, err
+		}
 	}
 
 	// Team TLF keys come from the service.
@@ -5,6 +5,9 @@
 package libkbfs
 
 import (
+	"sort"
+	"sync"
+
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
@@ -14,6 +17,11 @@ import (
 // KeyCacheStandard is an LRU-based implementation of the KeyCache interface.
 type KeyCacheStandard struct {
 	lru *lru.Cache
+
+	// Protects fetches.
+	fetchLock sync.Mutex
+	// Outstanding calls from GetOrFetchTLFCryptKey, by key.
+	fetches map[keyCacheKey]*keyCacheFetch
 }
 
 type keyCacheKey struct {
@@ -21,6 +29,14 @@ type keyCacheKey struct {
 	keyGen kbfsmd.KeyGen
 }
 
+// keyCacheFetch is an in-progress fetch of a missing key.  `key` and
+// `err` must only be read after `done` is closed.
+type keyCacheFetch struct {
+	done chan struct{}
+	key  kbfscrypto.TLFCryptKey
+	err  error
+}
+
 var _ KeyCache = (*KeyCacheStandard)(nil)
 
 // NewKeyCacheStandard constructs a new KeyCacheStandard with the given
@@ -30,7 +46,10 @@ func NewKeyCacheStandard(capacity int) *KeyCacheStandard {
 	if err != nil {
 		panic(err.Error())
 	}
-	return &KeyCacheStandard{head}
+	return &KeyCacheStandard{
+		lru:     head,
+		fetches: make(map[keyCacheKey]*keyCacheFetch),
+	}
 }
 
 // GetTLFCryptKey implements the KeyCache interface for KeyCacheStandard.
@@ -54,3 +73,70 @@ func (k *KeyCacheStandard) PutTLFCryptKey(
 	k.lru.Add(cacheKey, key)
 	return nil
 }
+
+type keyGensAsc []kbfsmd.KeyGen
+
+func (k keyGensAsc) Len() int           { return len(k) }
+func (k keyGensAsc) Less(i, j int) bool { return k[i] < k[j] }
+func (k keyGensAsc) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+
+// CachedKeyGens returns the key generations currently cached for the
+// given TLF, in ascending order.
+func (k *KeyCacheStandard) CachedKeyGens(tlfID tlf.ID) []kbfsmd.KeyGen {
+	var keyGens []kbfsmd.KeyGen
+	for _, key := range k.lru.Keys() {
+		cacheKey, ok := key.(keyCacheKey)
+		if !ok || cacheKey.tlf != tlfID {
+			continue
+		}
+		keyGens = append(keyGens, cacheKey.keyGen)
+	}
+	sort.Sort(keyGensAsc(keyGens))
+	return keyGens
+}
+
+// GetOrFetchTLFCryptKey is like GetTLFCryptKey, but on a cache miss
+// it calls `fetch` to get the key, and caches the result.  Concurrent
+// misses for the same TLF and key generation share a single call to
+// `fetch`, and all return its result.  Errors from `fetch` aren't
+// cached, so the next miss after a failed fetch tries again.
+func (k *KeyCacheStandard) GetOrFetchTLFCryptKey(
+	tlfID tlf.ID, keyGen kbfsmd.KeyGen,
+	fetch func() (kbfscrypto.TLFCryptKey, error)) (
+	kbfscrypto.TLFCryptKey, error) {
+	key, err := k.GetTLFCryptKey(tlfID, keyGen)
+	if _, isMiss := err.(KeyCacheMissError); !isMiss {
+		return key, err
+	}
+
+	cacheKey := keyCacheKey{tlfID, keyGen}
+	k.fetchLock.Lock()
+	// Check again, in case another fetch finished since the miss
+	// above.
+	key, err = k.GetTLFCryptKey(tlfID, keyGen)
+	if _, isMiss := err.(KeyCacheMissError); !isMiss {
+		k.fetchLock.Unlock()
+		return key, err
+	}
+	if f, ok := k.fetches[cacheKey]; ok {
+		k.fetchLock.Unlock()
+		<-f.done
+		return f.key, f.err
+	}
+	f := &keyCacheFetch{done: make(chan struct{})}
+	k.fetches[cacheKey] = f
+	k.fetchLock.Unlock()
+
+	f.key, f.err = fetch()
+	if f.err == nil {
+		f.err = k.PutTLFCryptKey(tlfID, keyGen, f.key)
+	}
+
+	// Only forget the fetch after the key is cached, so that later
+	// callers either wait on this fetch or hit the cache.
+	k.fetchLock.Lock()
+	delete(k.fetches, cacheKey)
+	k.fetchLock.Unlock()
+	close(f.done)
+	return f.key, f.err
+}
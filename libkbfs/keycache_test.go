@@ -6,11 +6,14 @@ package libkbfs
 
 import (
 	"errors"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
 )
 
 func TestKeyCacheBasic(t *testing.T) {
@@ -57,3 +60,85 @@ func TestKeyCacheBasic(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyCacheGetOrFetchConcurrentMisses(t *testing.T) {
+	cache := NewKeyCacheStandard(10)
+	id := tlf.FakeID(1, tlf.Private)
+	key := kbfscrypto.MakeTLFCryptKey([32]byte{0x1})
+	keyGen := kbfsmd.FirstValidKeyGen
+
+	var fetchCount int32
+	release := make(chan struct{})
+	fetch := func() (kbfscrypto.TLFCryptKey, error) {
+		atomic.AddInt32(&fetchCount, 1)
+		<-release
+		return key, nil
+	}
+
+	const numGetters = 10
+	var wg sync.WaitGroup
+	keys := make([]kbfscrypto.TLFCryptKey, numGetters)
+	errs := make([]error, numGetters)
+	for i := 0; i < numGetters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			keys[i], errs[i] = cache.GetOrFetchTLFCryptKey(
+				id, keyGen, fetch)
+		}(i)
+	}
+	close(release)
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&fetchCount))
+	for i := 0; i < numGetters; i++ {
+		require.NoError(t, errs[i])
+		require.Equal(t, key, keys[i])
+	}
+	cachedKey, err := cache.GetTLFCryptKey(id, keyGen)
+	require.NoError(t, err)
+	require.Equal(t, key, cachedKey)
+}
+
+func TestKeyCacheGetOrFetchError(t *testing.T) {
+	cache := NewKeyCacheStandard(10)
+	id := tlf.FakeID(1, tlf.Private)
+	key := kbfscrypto.MakeTLFCryptKey([32]byte{0x1})
+	keyGen := kbfsmd.FirstValidKeyGen
+
+	fetchErr := errors.New("fetch failed")
+	_, err := cache.GetOrFetchTLFCryptKey(id, keyGen,
+		func() (kbfscrypto.TLFCryptKey, error) {
+			return kbfscrypto.TLFCryptKey{}, fetchErr
+		})
+	require.Equal(t, fetchErr, err)
+	_, err = cache.GetTLFCryptKey(id, keyGen)
+	require.IsType(t, KeyCacheMissError{}, err)
+
+	// The failure isn't cached, so the next miss fetches again.
+	gotKey, err := cache.GetOrFetchTLFCryptKey(id, keyGen,
+		func() (kbfscrypto.TLFCryptKey, error) {
+			return key, nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, key, gotKey)
+}
+
+func TestKeyCacheCachedKeyGens(t *testing.T) {
+	cache := NewKeyCacheStandard(10)
+	id := tlf.FakeID(1, tlf.Private)
+	otherID := tlf.FakeID(2, tlf.Private)
+	require.Len(t, cache.CachedKeyGens(id), 0)
+
+	for _, keyGen := range []kbfsmd.KeyGen{3, 1, 4} {
+		err := cache.PutTLFCryptKey(
+			id, keyGen, kbfscrypto.MakeTLFCryptKey([32]byte{byte(keyGen)}))
+		require.NoError(t, err)
+	}
+	err := cache.PutTLFCryptKey(
+		otherID, 2, kbfscrypto.MakeTLFCryptKey([32]byte{0x2}))
+	require.NoError(t, err)
+
+	require.Equal(t, []kbfsmd.KeyGen{1, 3, 4}, cache.CachedKeyGens(id))
+	require.Equal(t, []kbfsmd.KeyGen{2}, cache.CachedKeyGens(otherID))
+}
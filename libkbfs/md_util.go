@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/logger"
@@ -19,6 +20,10 @@ import (
 	"golang.org/x/net/context"
 )
 
+// maxRevisionsForLastModified is the most revisions that
+// LastModifiedRevision will inspect before giving up.
+const maxRevisionsForLastModified = 1000
+
 type mdRange struct {
 	start kbfsmd.Revision
 	end   kbfsmd.Revision
@@ -270,6 +275,81 @@ func getMergedMDUpdates(ctx context.Context, config Config, id tlf.ID,
 	return mergedRmds, nil
 }
 
+func opReferencesPtr(o op, ptr BlockPointer) bool {
+	for _, update := range o.allUpdates() {
+		if update.Ref == ptr || update.Unref == ptr {
+			return true
+		}
+	}
+	for _, ref := range o.Refs() {
+		if ref == ptr {
+			return true
+		}
+	}
+	for _, unref := range o.Unrefs() {
+		if unref == ptr {
+			return true
+		}
+	}
+	return false
+}
+
+// LastModifiedRevision returns the most recent merged revision of the
+// given TLF whose ops reference `file`, the current block pointer of
+// a file, along with that revision's timestamp.  It walks backwards
+// from the merged head, and gives up with a
+// LastModifiedRevisionNotFoundError after
+// maxRevisionsForLastModified revisions.
+func LastModifiedRevision(ctx context.Context, config Config, id tlf.ID,
+	file BlockPointer) (kbfsmd.Revision, time.Time, error) {
+	head, err := config.MDOps().GetForTLF(ctx, id, nil)
+	if err != nil {
+		return kbfsmd.RevisionUninitialized, time.Time{}, err
+	}
+	if head == (ImmutableRootMetadata{}) {
+		return kbfsmd.RevisionUninitialized, time.Time{},
+			LastModifiedRevisionNotFoundError{file, 0}
+	}
+
+	currHead := head.Revision()
+	numInspected := 0
+	for currHead >= kbfsmd.RevisionInitial &&
+		numInspected < maxRevisionsForLastModified {
+		startRev := currHead - maxMDsAtATime + 1 // (kbfsmd.Revision is signed)
+		if startRev < kbfsmd.RevisionInitial {
+			startRev = kbfsmd.RevisionInitial
+		}
+		// Don't fetch more MDs than we're allowed to inspect.
+		left := kbfsmd.Revision(maxRevisionsForLastModified - numInspected)
+		if currHead-startRev+1 > left {
+			startRev = currHead - left + 1
+		}
+
+		rmds, err := getMDRange(ctx, config, id, kbfsmd.NullBranchID,
+			startRev, currHead, kbfsmd.Merged, nil)
+		if err != nil {
+			return kbfsmd.RevisionUninitialized, time.Time{}, err
+		}
+		if len(rmds) == 0 {
+			break
+		}
+
+		for i := len(rmds) - 1; i >= 0; i-- {
+			rmd := rmds[i]
+			for _, o := range rmd.data.Changes.Ops {
+				if opReferencesPtr(o, file) {
+					return rmd.Revision(), rmd.localTimestamp, nil
+				}
+			}
+		}
+
+		numInspected += len(rmds)
+		currHead = rmds[0].Revision() - 1
+	}
+	return kbfsmd.RevisionUninitialized, time.Time{},
+		LastModifiedRevisionNotFoundError{file, numInspected}
+}
+
 // getUnmergedMDUpdates returns a slice of the unmerged MDs for a TLF
 // and unmerged branch, between the merge point for that branch and
 // startRev (inclusive).  The returned MDs are the same instances that
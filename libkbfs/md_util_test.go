@@ -0,0 +1,69 @@
+// Copyright 2026 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/keybase/kbfs/kbfsblock"
+	"github.com/keybase/kbfs/kbfsmd"
+	"github.com/keybase/kbfs/tlf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLastModifiedRevision(t *testing.T) {
+	config, _, ctx, cancel := kbfsOpsInitNoMocks(t, "test_user")
+	defer kbfsTestShutdownNoMocks(t, config, ctx, cancel)
+
+	rootNode := GetRootNodeOrBust(ctx, t, config, "test_user", tlf.Private)
+	kbfsOps := config.KBFSOps()
+	aNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "a", false, NoExcl)
+	require.NoError(t, err)
+	bNode, _, err := kbfsOps.CreateFile(ctx, rootNode, "b", false, NoExcl)
+	require.NoError(t, err)
+
+	ops := getOps(config, rootNode.GetFolderBranch().Tlf)
+	lState := makeFBOLockState()
+	writeAndSync := func(n Node, b byte) ImmutableRootMetadata {
+		err := kbfsOps.Write(ctx, n, []byte{b}, 0)
+		require.NoError(t, err)
+		err = kbfsOps.SyncAll(ctx, rootNode.GetFolderBranch())
+		require.NoError(t, err)
+		head, _ := ops.getHead(lState)
+		return head
+	}
+
+	// Write to each file a couple of times, interleaved, so that the
+	// last modification of a isn't at the head.
+	writeAndSync(aNode, 1)
+	writeAndSync(bNode, 2)
+	aMD := writeAndSync(aNode, 3)
+	for i := 0; i < maxMDsAtATime; i++ {
+		writeAndSync(bNode, byte(4+i))
+	}
+	head, _ := ops.getHead(lState)
+	require.True(t, head.Revision() > aMD.Revision()+maxMDsAtATime-1)
+
+	id := rootNode.GetFolderBranch().Tlf
+	aPtr := ops.nodeCache.PathFromNode(aNode).tailPointer()
+	rev, mtime, err := LastModifiedRevision(ctx, config, id, aPtr)
+	require.NoError(t, err)
+	require.Equal(t, aMD.Revision(), rev)
+	require.Equal(t, aMD.localTimestamp, mtime)
+
+	bPtr := ops.nodeCache.PathFromNode(bNode).tailPointer()
+	rev, mtime, err = LastModifiedRevision(ctx, config, id, bPtr)
+	require.NoError(t, err)
+	require.Equal(t, head.Revision(), rev)
+	require.Equal(t, head.localTimestamp, mtime)
+
+	// A pointer that was never part of the TLF isn't found in any
+	// revision.
+	unknownPtr := BlockPointer{ID: kbfsblock.FakeID(42)}
+	rev, _, err = LastModifiedRevision(ctx, config, id, unknownPtr)
+	require.Equal(t, kbfsmd.RevisionUninitialized, rev)
+	require.Equal(t, LastModifiedRevisionNotFoundError{
+		unknownPtr, int(head.Revision())}, err)
+}
@@ -5,6 +5,7 @@
 package libkbfs
 
 import (
+	"fmt"
 	"sync"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -13,13 +14,58 @@ import (
 	"github.com/pkg/errors"
 )
 
+// MDCachePolicy determines how MDCacheStandard chooses which
+// metadata objects to evict once it is full.
+type MDCachePolicy int
+
+const (
+	// MDCachePolicyLRU evicts the least-recently used metadata
+	// object.  This is the default.
+	MDCachePolicyLRU MDCachePolicy = iota
+	// MDCachePolicyScanResistant tracks recently-added and
+	// frequently-used metadata objects separately (a 2Q cache), so
+	// that a one-shot scan over many old revisions can't evict
+	// revisions, like the current head, that are accessed
+	// repeatedly.
+	MDCachePolicyScanResistant
+)
+
+func (p MDCachePolicy) String() string {
+	switch p {
+	case MDCachePolicyLRU:
+		return "LRU"
+	case MDCachePolicyScanResistant:
+		return "ScanResistant"
+	default:
+		return fmt.Sprintf("MDCachePolicy(%d)", int(p))
+	}
+}
+
+// mdCacheLRU is the subset of the hashicorp LRU cache methods needed
+// by MDCacheStandard, so that it can be backed by either a plain LRU
+// or a 2Q cache.
+type mdCacheLRU interface {
+	Get(key interface{}) (interface{}, bool)
+	Add(key, value interface{})
+	Remove(key interface{})
+}
+
+// plainMDCacheLRU adapts lru.Cache to the mdCacheLRU interface.
+type plainMDCacheLRU struct {
+	*lru.Cache
+}
+
+func (c plainMDCacheLRU) Add(key, value interface{}) {
+	c.Cache.Add(key, value)
+}
+
 // MDCacheStandard implements a simple LRU cache for per-folder
 // metadata objects.
 type MDCacheStandard struct {
 	// lock protects `lru` from atomic operations that need atomicity
 	// across multiple `lru` calls.
 	lock  sync.RWMutex
-	lru   *lru.Cache
+	lru   mdCacheLRU
 	idLRU *lru.Cache
 }
 
@@ -32,10 +78,30 @@ type mdCacheKey struct {
 const defaultMDCacheCapacity = 5000
 
 // NewMDCacheStandard constructs a new MDCacheStandard using the given
-// cache capacity.
+// cache capacity and the default LRU eviction policy.
 func NewMDCacheStandard(capacity int) *MDCacheStandard {
-	mdLRU, err := lru.New(capacity)
-	if err != nil {
+	return NewMDCacheStandardWithPolicy(capacity, MDCachePolicyLRU)
+}
+
+// NewMDCacheStandardWithPolicy constructs a new MDCacheStandard using
+// the given cache capacity and eviction policy.
+func NewMDCacheStandardWithPolicy(
+	capacity int, policy MDCachePolicy) *MDCacheStandard {
+	var mdLRU mdCacheLRU
+	switch policy {
+	case MDCachePolicyLRU:
+		plain, err := lru.New(capacity)
+		if err != nil {
+			return nil
+		}
+		mdLRU = plainMDCacheLRU{plain}
+	case MDCachePolicyScanResistant:
+		twoQ, err := lru.New2Q(capacity)
+		if err != nil {
+			return nil
+		}
+		mdLRU = twoQ
+	default:
 		return nil
 	}
 	idLRU, err := lru.New(capacity)
@@ -34,8 +34,8 @@ func testMdcacheMakeHandle(t *testing.T, n uint32) *TlfHandle {
 	return h
 }
 
-func testMdcachePut(t *testing.T, tlfID tlf.ID, rev kbfsmd.Revision,
-	bid kbfsmd.BranchID, h *TlfHandle, mdcache *MDCacheStandard) {
+func testMdcacheMakeIRMD(t *testing.T, tlfID tlf.ID, rev kbfsmd.Revision,
+	bid kbfsmd.BranchID, h *TlfHandle) ImmutableRootMetadata {
 	rmd, err := makeInitialRootMetadata(defaultClientMetadataVer, tlfID, h)
 	require.NoError(t, err)
 	rmd.SetRevision(rev)
@@ -50,9 +50,14 @@ func testMdcachePut(t *testing.T, tlfID tlf.ID, rev kbfsmd.Revision,
 		kbfscrypto.SigningKeySigner{Key: signingKey})
 	require.NoError(t, err)
 
-	// put the md
-	irmd := MakeImmutableRootMetadata(
+	return MakeImmutableRootMetadata(
 		rmd, signingKey.GetVerifyingKey(), kbfsmd.FakeID(1), time.Now(), true)
+}
+
+func testMdcachePut(t *testing.T, tlfID tlf.ID, rev kbfsmd.Revision,
+	bid kbfsmd.BranchID, h *TlfHandle, mdcache *MDCacheStandard) {
+	// put the md
+	irmd := testMdcacheMakeIRMD(t, tlfID, rev, bid, h)
 	if err := mdcache.Put(irmd); err != nil {
 		t.Errorf("Got error on put on md %v: %v", tlfID, err)
 	}
@@ -118,3 +123,45 @@ func TestMdcacheReplace(t *testing.T) {
 	_, err = mdcache.Get(id, 1, bid)
 	require.NoError(t, err)
 }
+
+func testMdcacheScanWithHeadAccesses(
+	t *testing.T, mdcache *MDCacheStandard) error {
+	id := tlf.FakeID(1, tlf.Private)
+	h := testMdcacheMakeHandle(t, 1)
+
+	// The head is put once and then accessed repeatedly.
+	head := kbfsmd.Revision(1000)
+	testMdcachePut(t, id, head, kbfsmd.NullBranchID, h, mdcache)
+
+	// Scan through many old revisions, each of which is only put
+	// once after a cache miss, accessing the head between chunks
+	// that are each larger than the cache.
+	rev := kbfsmd.Revision(1)
+	for chunk := 0; chunk < 5; chunk++ {
+		for i := 0; i < 30; i++ {
+			_, err := mdcache.Get(id, rev, kbfsmd.NullBranchID)
+			require.IsType(t, NoSuchMDError{}, err)
+			err = mdcache.Put(
+				testMdcacheMakeIRMD(t, id, rev, kbfsmd.NullBranchID, h))
+			require.NoError(t, err)
+			rev++
+		}
+		if _, err := mdcache.Get(id, head, kbfsmd.NullBranchID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestMdcacheLRUScanEvictsHead(t *testing.T) {
+	mdcache := NewMDCacheStandard(20)
+	err := testMdcacheScanWithHeadAccesses(t, mdcache)
+	require.IsType(t, NoSuchMDError{}, err)
+}
+
+func TestMdcacheScanResistantKeepsHead(t *testing.T) {
+	mdcache := NewMDCacheStandardWithPolicy(20, MDCachePolicyScanResistant)
+	require.NotNil(t, mdcache)
+	err := testMdcacheScanWithHeadAccesses(t, mdcache)
+	require.NoError(t, err)
+}
@@ -434,6 +434,8 @@ func (md *MDServerDisk) Put(ctx context.Context, rmds *RootMetadataSigned,
 		// sends a "folder needs rekey" notification in this case).
 		!(rmds.MD.IsRekeySet() && rmds.MD.IsWriterMetadataCopiedSet()) {
 		md.updateManager.setHead(rmds.MD.TlfID(), md)
+	} else if mStatus == kbfsmd.Merged {
+		md.updateManager.rekeyNeeded(rmds.MD.TlfID(), md)
 	}
 
 	return nil
@@ -505,6 +507,22 @@ func (md *MDServerDisk) RegisterForUpdate(ctx context.Context, id tlf.ID,
 	return c, nil
 }
 
+func (md *MDServerDisk) registerForUpdateOrRekey(ctx context.Context,
+	id tlf.ID, currHead kbfsmd.Revision) (<-chan mdServerLocalUpdate, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	currMergedHeadRev, err := md.getCurrentMergedHeadRevision(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c := md.updateManager.registerForUpdateOrRekey(
+		id, currHead, currMergedHeadRev, md)
+	return c, nil
+}
+
 // CancelRegistration implements the MDServer interface for MDServerDisk.
 func (md *MDServerDisk) CancelRegistration(_ context.Context, id tlf.ID) {
 	md.updateManager.cancel(id, md)
@@ -631,6 +649,7 @@ func (md *MDServerDisk) addNewAssertionForTest(uid keybase1.UID,
 
 	// Iterate through all the handles, and add handles for ones
 	// containing newAssertion to now include the uid.
+	changed := make(map[tlf.ID]tlf.Handle)
 	iter := md.handleDb.NewIterator(nil, nil)
 	defer iter.Release()
 	for iter.Next() {
@@ -651,12 +670,24 @@ func (md *MDServerDisk) addNewAssertionForTest(uid keybase1.UID,
 		if err != nil {
 			return err
 		}
-		id := iter.Value()
-		if err := md.handleDb.Put(newHandleBytes, id, nil); err != nil {
+		idBytes := iter.Value()
+		if err := md.handleDb.Put(newHandleBytes, idBytes, nil); err != nil {
+			return err
+		}
+		var id tlf.ID
+		if err := id.UnmarshalBinary(idBytes); err != nil {
 			return err
 		}
+		changed[id] = newHandle
 	}
-	return iter.Error()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	for id, h := range changed {
+		md.updateManager.handleChanged(id, h)
+	}
+	return nil
 }
 
 // GetLatestHandleForTLF implements the MDServer interface for MDServerDisk.
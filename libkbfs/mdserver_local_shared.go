@@ -6,6 +6,7 @@ package libkbfs
 
 import (
 	"sync"
+	"time"
 
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscodec"
@@ -28,7 +29,14 @@ func isReader(ctx context.Context, teamMemChecker kbfsmd.TeamMembershipChecker,
 	if err != nil {
 		return false, err
 	}
+	return isReaderForHandle(ctx, teamMemChecker, currentUID, h)
+}
 
+// isReaderForHandle is like isReader, but takes the bare handle of
+// the merged master head instead of the head itself.
+func isReaderForHandle(ctx context.Context,
+	teamMemChecker kbfsmd.TeamMembershipChecker, currentUID keybase1.UID,
+	h tlf.Handle) (bool, error) {
 	if h.Type() == tlf.SingleTeam {
 		isReader, err := teamMemChecker.IsTeamReader(
 			ctx, h.Writers[0].AsTeamOrBust(), currentUID)
@@ -54,20 +62,16 @@ func isWriterOrValidRekey(ctx context.Context,
 		return false, err
 	}
 
-	if h.Type() == tlf.SingleTeam {
-		isWriter, err := teamMemChecker.IsTeamWriter(
-			ctx, h.Writers[0].AsTeamOrBust(), currentUID, verifyingKey)
-		if err != nil {
-			return false, kbfsmd.ServerError{Err: err}
-		}
+	isWriter, err := isWriterForHandle(
+		ctx, teamMemChecker, currentUID, verifyingKey, h)
+	if err != nil {
+		return false, err
+	}
+	if isWriter || h.Type() == tlf.SingleTeam {
 		// Team TLFs can't be rekeyed, so readers aren't ever valid.
 		return isWriter, nil
 	}
 
-	if h.IsWriter(currentUID.AsUserOrTeam()) {
-		return true, nil
-	}
-
 	if h.IsReader(currentUID.AsUserOrTeam()) {
 		// if this is a reader, are they acting within their
 		// restrictions?
@@ -78,6 +82,24 @@ func isWriterOrValidRekey(ctx context.Context,
 	return false, nil
 }
 
+// isWriterForHandle returns whether the current user can write to
+// the TLF whose merged master head has the bare handle `h`.  Readers
+// aren't writers, though their puts may still be valid rekeys; see
+// isWriterOrValidRekey.
+func isWriterForHandle(ctx context.Context,
+	teamMemChecker kbfsmd.TeamMembershipChecker, currentUID keybase1.UID,
+	verifyingKey kbfscrypto.VerifyingKey, h tlf.Handle) (bool, error) {
+	if h.Type() == tlf.SingleTeam {
+		isWriter, err := teamMemChecker.IsTeamWriter(
+			ctx, h.Writers[0].AsTeamOrBust(), currentUID, verifyingKey)
+		if err != nil {
+			return false, kbfsmd.ServerError{Err: err}
+		}
+		return isWriter, nil
+	}
+	return h.IsWriter(currentUID.AsUserOrTeam()), nil
+}
+
 // mdServerLocalTruncateLockManager manages the truncate locks for a
 // set of TLFs. Note that it is not goroutine-safe.
 type mdServerLocalTruncateLockManager struct {
@@ -125,39 +147,198 @@ func (m mdServerLocalTruncateLockManager) truncateUnlock(
 	return false, kbfsmd.ServerErrorLocked{}
 }
 
+// mdServerLocalUpdate is a notification sent to observers registered
+// via registerForUpdateOrRekey.  Unlike the plain error channel
+// returned by RegisterForUpdate, it lets the observer distinguish a
+// new merged head from a rekey-only put.
+type mdServerLocalUpdate struct {
+	// rekeyNeeded is true if the update was a pure rekey (the real
+	// mdserver sends a "folder needs rekey" notification in this
+	// case, rather than a normal update).
+	rekeyNeeded bool
+	// newHandle is non-nil if the TLF's handle changed (e.g., because
+	// a social assertion resolved), and holds the new handle.
+	newHandle *tlf.Handle
+	// err is non-nil if the registration was canceled.
+	err error
+}
+
 // mdServerLocalUpdateManager manages the observers for a set of TLFs
 // referenced by multiple mdServerLocal instances sharing the same
 // data. It is goroutine-safe.
 type mdServerLocalUpdateManager struct {
-	// Protects observers and sessionHeads.
-	lock         sync.Mutex
-	observers    map[tlf.ID]map[mdServerLocal]chan<- error
-	sessionHeads map[tlf.ID]mdServerLocal
+	// Protects observers, observerRevs, rekeyObservers,
+	// sessionHeads, clock, debounce, pendingWriters, pendingStops
+	// and shutdownCh.
+	lock      sync.Mutex
+	observers map[tlf.ID]map[mdServerLocal]chan<- error
+	// The head revision each observer in `observers` registered at.
+	observerRevs   map[tlf.ID]map[mdServerLocal]kbfsmd.Revision
+	rekeyObservers map[tlf.ID]map[mdServerLocal]chan<- mdServerLocalUpdate
+	sessionHeads   map[tlf.ID]mdServerLocal
+	// If positive, new heads set within this long of the first one,
+	// according to `clock`, are coalesced into a single notification.
+	clock    Clock
+	debounce time.Duration
+	// The sessions that set new heads for each TLF with a pending
+	// coalesced notification.
+	pendingWriters map[tlf.ID]map[mdServerLocal]bool
+	// Stops the timer of each pending coalesced notification.
+	pendingStops map[tlf.ID]func() bool
+	// Closed on shutdown, to end the wait for any pending timers.
+	shutdownCh chan struct{}
 }
 
 func newMDServerLocalUpdateManager() *mdServerLocalUpdateManager {
 	return &mdServerLocalUpdateManager{
 		observers:    make(map[tlf.ID]map[mdServerLocal]chan<- error),
-		sessionHeads: make(map[tlf.ID]mdServerLocal),
+		observerRevs: make(map[tlf.ID]map[mdServerLocal]kbfsmd.Revision),
+		rekeyObservers: make(
+			map[tlf.ID]map[mdServerLocal]chan<- mdServerLocalUpdate),
+		sessionHeads:   make(map[tlf.ID]mdServerLocal),
+		pendingWriters: make(map[tlf.ID]map[mdServerLocal]bool),
+		pendingStops:   make(map[tlf.ID]func() bool),
+		shutdownCh:     make(chan struct{}),
 	}
 }
 
+// setDebounce sets the window, timed by `clock`, within which new
+// heads for a TLF are coalesced into a single notification of its
+// observers.  A non-positive window turns coalescing off.
+// Notifications that are already pending are still delivered at the
+// end of their window.
+func (m *mdServerLocalUpdateManager) setDebounce(
+	clock Clock, debounce time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.clock = clock
+	m.debounce = debounce
+}
+
 func (m *mdServerLocalUpdateManager) setHead(id tlf.ID, server mdServerLocal) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
 	m.sessionHeads[id] = server
 
-	// now fire all the observers that aren't from this session
+	if m.debounce <= 0 {
+		m.fireUpdateObserversLocked(
+			id, map[mdServerLocal]bool{server: true})
+		return
+	}
+
+	// Coalesce this head with any others set during the current
+	// window.  The observers are fired once the window ends, according
+	// to the clock, after which they'll fetch whatever the latest
+	// head is by then.
+	writers, ok := m.pendingWriters[id]
+	if !ok {
+		writers = make(map[mdServerLocal]bool)
+		m.pendingWriters[id] = writers
+		c, stop := newClockTimer(m.clock, m.debounce)
+		m.pendingStops[id] = stop
+		shutdownCh := m.shutdownCh
+		go func() {
+			select {
+			case <-c:
+			case <-shutdownCh:
+				return
+			}
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			writers, ok := m.pendingWriters[id]
+			if !ok {
+				// Shut down after the timer fired.
+				return
+			}
+			delete(m.pendingWriters, id)
+			delete(m.pendingStops, id)
+			m.fireUpdateObserversLocked(id, writers)
+		}()
+	}
+	writers[server] = true
+}
+
+// shutdown stops the timers of all pending coalesced notifications,
+// which are then never delivered.
+func (m *mdServerLocalUpdateManager) shutdown() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	select {
+	case <-m.shutdownCh:
+		return
+	default:
+	}
+	for id, stop := range m.pendingStops {
+		stop()
+		delete(m.pendingStops, id)
+		delete(m.pendingWriters, id)
+	}
+	close(m.shutdownCh)
+}
+
+// fireUpdateObserversLocked fires the observers of new heads for
+// `id`, except for those from a session that was the only one to set
+// the new heads, since it already knows about them.
+func (m *mdServerLocalUpdateManager) fireUpdateObserversLocked(
+	id tlf.ID, writers map[mdServerLocal]bool) {
+	var onlyWriter mdServerLocal
+	if len(writers) == 1 {
+		for server := range writers {
+			onlyWriter = server
+		}
+	}
+
 	for k, v := range m.observers[id] {
-		if k != server {
+		if k != onlyWriter {
 			v <- nil
 			close(v)
 			delete(m.observers[id], k)
+			delete(m.observerRevs[id], k)
 		}
 	}
 	if len(m.observers[id]) == 0 {
 		delete(m.observers, id)
+		delete(m.observerRevs, id)
+	}
+	m.fireRekeyObserversLocked(id, onlyWriter, mdServerLocalUpdate{})
+}
+
+// rekeyNeeded fires all the observers registered via
+// registerForUpdateOrRekey that aren't from this session with a
+// rekey-needed notification.  Observers registered via
+// registerForUpdate aren't notified, since a pure rekey doesn't
+// change the merged head from their point of view.
+func (m *mdServerLocalUpdateManager) rekeyNeeded(
+	id tlf.ID, server mdServerLocal) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.fireRekeyObserversLocked(
+		id, server, mdServerLocalUpdate{rekeyNeeded: true})
+}
+
+// handleChanged fires all the observers registered via
+// registerForUpdateOrRekey, from every session, with a notification
+// carrying the TLF's new handle.
+func (m *mdServerLocalUpdateManager) handleChanged(
+	id tlf.ID, newHandle tlf.Handle) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.fireRekeyObserversLocked(
+		id, nil, mdServerLocalUpdate{newHandle: &newHandle})
+}
+
+func (m *mdServerLocalUpdateManager) fireRekeyObserversLocked(
+	id tlf.ID, server mdServerLocal, update mdServerLocalUpdate) {
+	for k, v := range m.rekeyObservers[id] {
+		if k != server {
+			v <- update
+			close(v)
+			delete(m.rekeyObservers[id], k)
+		}
+	}
+	if len(m.rekeyObservers[id]) == 0 {
+		delete(m.rekeyObservers, id)
 	}
 }
 
@@ -176,6 +357,7 @@ func (m *mdServerLocalUpdateManager) registerForUpdate(
 
 	if _, ok := m.observers[id]; !ok {
 		m.observers[id] = make(map[mdServerLocal]chan<- error)
+		m.observerRevs[id] = make(map[mdServerLocal]kbfsmd.Revision)
 	}
 
 	// Otherwise, this is a legit observer.  This assumes that each
@@ -189,6 +371,33 @@ func (m *mdServerLocalUpdateManager) registerForUpdate(
 			server))
 	}
 	m.observers[id][server] = c
+	m.observerRevs[id][server] = currHead
+	return c
+}
+
+func (m *mdServerLocalUpdateManager) registerForUpdateOrRekey(
+	id tlf.ID, currHead, currMergedHeadRev kbfsmd.Revision,
+	server mdServerLocal) <-chan mdServerLocalUpdate {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	c := make(chan mdServerLocalUpdate, 1)
+	if currMergedHeadRev > currHead && server != m.sessionHeads[id] {
+		c <- mdServerLocalUpdate{}
+		close(c)
+		return c
+	}
+
+	if _, ok := m.rekeyObservers[id]; !ok {
+		m.rekeyObservers[id] = make(
+			map[mdServerLocal]chan<- mdServerLocalUpdate)
+	}
+
+	if _, ok := m.rekeyObservers[id][server]; ok {
+		panic(errors.Errorf("Attempted double-registration for "+
+			"MDServerLocal %v", server))
+	}
+	m.rekeyObservers[id][server] = c
 	return c
 }
 
@@ -202,11 +411,44 @@ func (m *mdServerLocalUpdateManager) cancel(id tlf.ID, server mdServerLocal) {
 			v <- errors.New("Registration canceled")
 			close(v)
 			delete(m.observers[id], k)
+			delete(m.observerRevs[id], k)
 		}
 	}
 	if len(m.observers[id]) == 0 {
 		delete(m.observers, id)
+		delete(m.observerRevs, id)
+	}
+	for k, v := range m.rekeyObservers[id] {
+		if k == server {
+			v <- mdServerLocalUpdate{
+				err: errors.New("Registration canceled"),
+			}
+			close(v)
+			delete(m.rekeyObservers[id], k)
+		}
+	}
+	if len(m.rekeyObservers[id]) == 0 {
+		delete(m.rekeyObservers, id)
+	}
+}
+
+// countObservers returns the number of registered update observers,
+// and how many of them are stuck: registered at a revision older than
+// their TLF's merged head in `headRevs`, even though that head was
+// put by a different session and so should already have fired them.
+func (m *mdServerLocalUpdateManager) countObservers(
+	headRevs map[tlf.ID]kbfsmd.Revision) (observers, stuck int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, revs := range m.observerRevs {
+		for server, rev := range revs {
+			observers++
+			if headRevs[id] > rev && m.sessionHeads[id] != server {
+				stuck++
+			}
+		}
 	}
+	return observers, stuck
 }
 
 type keyBundleGetter func(tlf.ID, kbfsmd.TLFWriterKeyBundleID, kbfsmd.TLFReaderKeyBundleID) (
@@ -6,12 +6,15 @@ package libkbfs
 
 import (
 	"bytes"
+	"fmt"
+	"math/rand"
 	"reflect"
 	"sync"
 	"time"
 
 	"github.com/keybase/client/go/logger"
 	"github.com/keybase/client/go/protocol/keybase1"
+	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
 	"github.com/keybase/kbfs/kbfsmd"
 	"github.com/keybase/kbfs/tlf"
@@ -47,6 +50,9 @@ type mdBlockMem struct {
 	encodedMd []byte
 	timestamp time.Time
 	version   kbfsmd.MetadataVer
+	// The header fields of encodedMd, so that checks that only
+	// need them don't have to decode it.
+	header kbfsmd.RootMetadataHeader
 }
 
 type mdBlockMemList struct {
@@ -76,6 +82,9 @@ type mdServerMemShared struct {
 	handleDb map[mdHandleKey]tlf.ID
 	// TLF ID -> latest bare TLF handle
 	latestHandleDb map[tlf.ID]tlf.Handle
+	// TLF ID -> bare TLF handle of the merged master head, so that
+	// permissions can be checked without decoding the head
+	headHandleDb map[tlf.ID]tlf.Handle
 	// (TLF ID, branch ID) -> list of MDs
 	mdDb map[mdBlockKey]mdBlockMemList
 	// Writer key bundle ID -> writer key bundles
@@ -89,12 +98,54 @@ type mdServerMemShared struct {
 	lockIDs map[mdLockMemKey]mdLockMemVal
 
 	updateManager *mdServerLocalUpdateManager
+
+	// The maximum number of revisions allowed on a single unmerged
+	// branch, or 0 if there is no limit.  Protected by lock.
+	maxUnmergedRevisionsPerBranch int
+
+	// Whether GetRange verifies the signatures of the MDs it
+	// returns.  Protected by lock.
+	verifyGetRange bool
+
+	// Protects faults and faultRand, which are nil unless fault
+	// injection is enabled.
+	faultLock sync.Mutex
+	faults    map[string]MDServerMemoryFault
+	faultRand *rand.Rand
+}
+
+// MDServerMemoryFault describes the faults to inject into calls of
+// one MDServerMemory method.
+type MDServerMemoryFault struct {
+	// MinLatency and MaxLatency bound the uniformly-distributed
+	// delay added before each call is processed.
+	MinLatency time.Duration
+	MaxLatency time.Duration
+	// ErrorProbability is the chance, between 0 and 1, that a call
+	// fails with a kbfsmd.ServerError without being processed.
+	ErrorProbability float64
+}
+
+// MDServerMemoryFaults configures fault injection for an
+// MDServerMemory.
+type MDServerMemoryFaults struct {
+	// Seed seeds the random number generator used to pick latencies
+	// and errors, so that a test sees the same faults on every run.
+	Seed int64
+	// Methods maps the name of a method ("GetForTLF", "GetRange",
+	// "Put" or "PutRange") to the faults to inject into it.  The
+	// GetForTLF faults also apply to GetForHandle calls for
+	// existing TLFs.
+	Methods map[string]MDServerMemoryFault
 }
 
 // MDServerMemory just stores metadata objects in memory.
 type MDServerMemory struct {
 	config mdServerLocalConfig
 	log    logger.Logger
+	// codecOverride, if non-nil, is used instead of config.Codec()
+	// to encode and decode the stored MD objects.
+	codecOverride kbfscodec.Codec
 
 	*mdServerMemShared
 }
@@ -104,8 +155,18 @@ var _ mdServerLocal = (*MDServerMemory)(nil)
 // NewMDServerMemory constructs a new MDServerMemory object that stores
 // all data in-memory.
 func NewMDServerMemory(config mdServerLocalConfig) (*MDServerMemory, error) {
+	return NewMDServerMemoryWithCodec(config, nil)
+}
+
+// NewMDServerMemoryWithCodec is like NewMDServerMemory, but stores
+// and loads MD objects using the given codec instead of
+// config.Codec(), if it is non-nil.  This is useful for simulating a
+// server running an older or newer version of the MD structures.
+func NewMDServerMemoryWithCodec(config mdServerLocalConfig,
+	codec kbfscodec.Codec) (*MDServerMemory, error) {
 	handleDb := make(map[mdHandleKey]tlf.ID)
 	latestHandleDb := make(map[tlf.ID]tlf.Handle)
+	headHandleDb := make(map[tlf.ID]tlf.Handle)
 	mdDb := make(map[mdBlockKey]mdBlockMemList)
 	branchDb := make(map[mdBranchKey]kbfsmd.BranchID)
 	writerKeyBundleDb := make(map[mdExtraWriterKey]kbfsmd.TLFWriterKeyBundleV3)
@@ -115,6 +176,7 @@ func NewMDServerMemory(config mdServerLocalConfig) (*MDServerMemory, error) {
 	shared := mdServerMemShared{
 		handleDb:            handleDb,
 		latestHandleDb:      latestHandleDb,
+		headHandleDb:        headHandleDb,
 		mdDb:                mdDb,
 		branchDb:            branchDb,
 		writerKeyBundleDb:   writerKeyBundleDb,
@@ -123,16 +185,113 @@ func NewMDServerMemory(config mdServerLocalConfig) (*MDServerMemory, error) {
 		lockIDs:             make(map[mdLockMemKey]mdLockMemVal),
 		updateManager:       newMDServerLocalUpdateManager(),
 	}
-	mdserv := &MDServerMemory{config, log, &shared}
+	mdserv := &MDServerMemory{config, log, codec, &shared}
 	return mdserv, nil
 }
 
+// SetMaxUnmergedRevisionsPerBranch sets the maximum number of
+// revisions that can be put to a single unmerged branch.  Once a
+// branch reaches that limit, further unmerged puts to it fail with
+// kbfsmd.ServerErrorTooManyUnmergedRevisions, until the client
+// resolves its conflicts.  Merged puts are never limited.  A limit of
+// 0 means no limit.
+func (md *MDServerMemory) SetMaxUnmergedRevisionsPerBranch(max int) {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	md.maxUnmergedRevisionsPerBranch = max
+}
+
+// SetVerifyGetRange makes GetRange check that each MD it returns is
+// valid and signed by its writer, the way the client checks the MDs
+// it fetches, and fail with an MDMismatchError if one isn't.  This
+// is useful for testing how tampered-with MDs are handled.  It's off
+// by default, to keep GetRange fast.
+func (md *MDServerMemory) SetVerifyGetRange(verify bool) {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+	md.verifyGetRange = verify
+}
+
+// SetUpdateDebounce makes the merged heads put to a TLF within
+// `debounce` of each other result in a single notification of the
+// TLF's update observers, delivered once that window ends, rather
+// than one notification per head.  This cuts down on the churn of
+// observers re-registering while a writer pushes many revisions in
+// quick succession.  The observers then fetch the latest head, so
+// the final head is never missed.  A non-positive `debounce`, the
+// default, notifies observers immediately.  The window is timed by
+// the config's clock.
+func (md *MDServerMemory) SetUpdateDebounce(debounce time.Duration) {
+	md.updateManager.setDebounce(md.config.Clock(), debounce)
+}
+
+// SetFaultInjection makes future calls to the methods named in
+// `faults` slow down or fail, to test how clients handle a
+// misbehaving server.  A nil `faults` turns fault injection off,
+// which is the default.
+func (md *MDServerMemory) SetFaultInjection(faults *MDServerMemoryFaults) {
+	md.faultLock.Lock()
+	defer md.faultLock.Unlock()
+	if faults == nil {
+		md.faults = nil
+		md.faultRand = nil
+		return
+	}
+	md.faults = make(map[string]MDServerMemoryFault, len(faults.Methods))
+	for method, fault := range faults.Methods {
+		md.faults[method] = fault
+	}
+	md.faultRand = rand.New(rand.NewSource(faults.Seed))
+}
+
+// injectFault applies the configured faults, if any, to a call of
+// the given method.  It returns a non-nil error if the call should
+// fail.
+func (md *MDServerMemory) injectFault(
+	ctx context.Context, method string) error {
+	latency, fail := func() (time.Duration, bool) {
+		md.faultLock.Lock()
+		defer md.faultLock.Unlock()
+		fault, ok := md.faults[method]
+		if !ok {
+			return 0, false
+		}
+		latency := fault.MinLatency
+		if fault.MaxLatency > fault.MinLatency {
+			latency += time.Duration(md.faultRand.Int63n(
+				int64(fault.MaxLatency - fault.MinLatency)))
+		}
+		return latency, md.faultRand.Float64() < fault.ErrorProbability
+	}()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fail {
+		return kbfsmd.ServerError{
+			Err: errors.Errorf("Injected fault in %s", method)}
+	}
+	return nil
+}
+
 type errMDServerMemoryShutdown struct{}
 
 func (e errMDServerMemoryShutdown) Error() string {
 	return "MDServerMemory is shutdown"
 }
 
+// mdCodec returns the codec used for the stored MD objects.
+func (md *MDServerMemory) mdCodec() kbfscodec.Codec {
+	if md.codecOverride != nil {
+		return md.codecOverride
+	}
+	return md.config.Codec()
+}
+
 func (md *MDServerMemory) checkShutdownRLocked() error {
 	if md.handleDb == nil {
 		return errors.WithStack(errMDServerMemoryShutdown{})
@@ -159,6 +318,16 @@ func (md *MDServerMemory) getHandleID(ctx context.Context, handle tlf.Handle,
 		return id, false, nil
 	}
 
+	// A finalized TLF must not be silently recreated as a new, empty
+	// TLF when it's looked up by its original name.
+	id, ok, err = md.getFinalizedHandleIDRLocked(handle)
+	if err != nil {
+		return tlf.NullID, false, kbfsmd.ServerError{Err: err}
+	}
+	if ok {
+		return id, false, nil
+	}
+
 	// Non-readers shouldn't be able to create the dir.
 	session, err := md.config.currentSessionGetter().GetCurrentSession(ctx)
 	if err != nil {
@@ -188,6 +357,38 @@ func (md *MDServerMemory) getHandleID(ctx context.Context, handle tlf.Handle,
 	return id, true, nil
 }
 
+// getFinalizedHandleIDRLocked returns the ID of the most recently
+// finalized TLF whose handle, ignoring any finalized info, matches
+// the given handle.
+func (md *MDServerMemory) getFinalizedHandleIDRLocked(handle tlf.Handle) (
+	tlfID tlf.ID, found bool, err error) {
+	handle.FinalizedInfo = nil
+	handleBytes, err := md.config.Codec().Encode(handle)
+	if err != nil {
+		return tlf.NullID, false, err
+	}
+
+	var latestDate int64
+	for id, h := range md.latestHandleDb {
+		if !h.IsFinal() {
+			continue
+		}
+		date := h.FinalizedInfo.Date
+		h.FinalizedInfo = nil
+		hBytes, err := md.config.Codec().Encode(h)
+		if err != nil {
+			return tlf.NullID, false, err
+		}
+		if !bytes.Equal(hBytes, handleBytes) {
+			continue
+		}
+		if !found || date > latestDate {
+			tlfID, found, latestDate = id, true, date
+		}
+	}
+	return tlfID, found, nil
+}
+
 // GetForHandle implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) GetForHandle(ctx context.Context, handle tlf.Handle,
 	mStatus kbfsmd.MergeStatus, _ *keybase1.LockID) (
@@ -219,10 +420,9 @@ func (md *MDServerMemory) checkGetParamsRLocked(
 		return kbfsmd.NullBranchID, kbfsmd.ServerErrorBadRequest{Reason: "Invalid branch ID"}
 	}
 
-	// Check permissions
-
-	mergedMasterHead, err :=
-		md.getHeadForTLFRLocked(ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged)
+	// Check permissions, which only needs the handle of the merged
+	// master head, not the head itself.
+	err = md.checkShutdownRLocked()
 	if err != nil {
 		return kbfsmd.NullBranchID, kbfsmd.ServerError{Err: err}
 	}
@@ -233,14 +433,9 @@ func (md *MDServerMemory) checkGetParamsRLocked(
 	}
 
 	// TODO: Figure out nil case.
-	if mergedMasterHead != nil {
-		extra, err := getExtraMetadata(
-			md.getKeyBundlesRLocked, mergedMasterHead.MD)
-		if err != nil {
-			return kbfsmd.NullBranchID, kbfsmd.ServerError{Err: err}
-		}
-		ok, err := isReader(ctx, md.config.teamMembershipChecker(), session.UID,
-			mergedMasterHead.MD, extra)
+	if h, ok := md.headHandleDb[id]; ok {
+		ok, err := isReaderForHandle(
+			ctx, md.config.teamMembershipChecker(), session.UID, h)
 		if err != nil {
 			return kbfsmd.NullBranchID, kbfsmd.ServerError{Err: err}
 		}
@@ -264,6 +459,9 @@ func (md *MDServerMemory) GetForTLF(ctx context.Context, id tlf.ID,
 	if err := checkContext(ctx); err != nil {
 		return nil, err
 	}
+	if err := md.injectFault(ctx, "GetForTLF"); err != nil {
+		return nil, err
+	}
 
 	md.lock.RLock()
 	defer md.lock.RUnlock()
@@ -283,6 +481,25 @@ func (md *MDServerMemory) GetForTLF(ctx context.Context, id tlf.ID,
 	return rmds, nil
 }
 
+// HasUnmergedBranch returns whether the current device has an
+// unmerged branch for the given TLF.
+func (md *MDServerMemory) HasUnmergedBranch(
+	ctx context.Context, id tlf.ID) (bool, error) {
+	if err := checkContext(ctx); err != nil {
+		return false, err
+	}
+
+	md.lock.RLock()
+	defer md.lock.RUnlock()
+
+	bid, err := md.checkGetParamsRLocked(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Unmerged)
+	if err != nil {
+		return false, err
+	}
+	return bid != kbfsmd.NullBranchID, nil
+}
+
 func (md *MDServerMemory) getHeadForTLFRLocked(ctx context.Context, id tlf.ID,
 	bid kbfsmd.BranchID, mStatus kbfsmd.MergeStatus) (*RootMetadataSigned, error) {
 	key, err := md.getMDKey(id, bid, mStatus)
@@ -304,13 +521,44 @@ func (md *MDServerMemory) getHeadForTLFRLocked(ctx context.Context, id tlf.ID,
 	buf := blocks[len(blocks)-1].encodedMd
 	timestamp := blocks[len(blocks)-1].timestamp
 	rmds, err := DecodeRootMetadataSigned(
-		md.config.Codec(), id, ver, max, buf, timestamp)
+		md.mdCodec(), id, ver, max, buf, timestamp)
 	if err != nil {
 		return nil, err
 	}
 	return rmds, nil
 }
 
+// getHeadHeaderRLocked is like getHeadForTLFRLocked, but only
+// returns the header fields of the head, which were recorded when it
+// was put, so nothing needs to be decoded.
+func (md *MDServerMemory) getHeadHeaderRLocked(id tlf.ID,
+	bid kbfsmd.BranchID, mStatus kbfsmd.MergeStatus) (
+	*kbfsmd.RootMetadataHeader, error) {
+	key, err := md.getMDKey(id, bid, mStatus)
+	if err != nil {
+		return nil, err
+	}
+	err = md.checkShutdownRLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	blockList, ok := md.mdDb[key]
+	if !ok {
+		return nil, nil
+	}
+	block := blockList.blocks[len(blockList.blocks)-1]
+	// Fail the same way a full decode of a too-new head would.
+	if block.version > md.config.MetadataVersion() {
+		return nil, kbfsmd.NewMetadataVersionError{
+			Tlf:         id,
+			MetadataVer: block.version,
+		}
+	}
+	header := block.header
+	return &header, nil
+}
+
 func (md *MDServerMemory) getMDKey(
 	id tlf.ID, bid kbfsmd.BranchID, mStatus kbfsmd.MergeStatus) (mdBlockKey, error) {
 	if (mStatus == kbfsmd.Merged) != (bid == kbfsmd.NullBranchID) {
@@ -398,7 +646,7 @@ func (md *MDServerMemory) getRangeLocked(ctx context.Context, id tlf.ID,
 		ver := blocks[i].version
 		buf := blocks[i].encodedMd
 		rmds, err := DecodeRootMetadataSigned(
-			md.config.Codec(), id, ver, max, buf,
+			md.mdCodec(), id, ver, max, buf,
 			blocks[i].timestamp)
 		if err != nil {
 			return nil, nil, kbfsmd.ServerError{Err: err}
@@ -408,12 +656,46 @@ func (md *MDServerMemory) getRangeLocked(ctx context.Context, id tlf.ID,
 			panic(errors.Errorf("expected revision %v, got %v",
 				expectedRevision, rmds.MD.RevisionNumber()))
 		}
+		if md.verifyGetRange {
+			err = md.verifyMDRLocked(ctx, id, rmds)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
 		rmdses = append(rmdses, rmds)
 	}
 
 	return rmdses, nil, nil
 }
 
+// verifyMDRLocked checks the validity and signatures of the given
+// stored MD, using the key bundles stored with it if needed.  Like
+// MDOpsStandard, it doesn't check team membership, since the writer
+// may have left the team after writing the MD.
+func (md *MDServerMemory) verifyMDRLocked(ctx context.Context, id tlf.ID,
+	rmds *RootMetadataSigned) error {
+	var extra kbfsmd.ExtraMetadata
+	wkbID := rmds.MD.GetTLFWriterKeyBundleID()
+	rkbID := rmds.MD.GetTLFReaderKeyBundleID()
+	if (wkbID != kbfsmd.TLFWriterKeyBundleID{}) &&
+		(rkbID != kbfsmd.TLFReaderKeyBundleID{}) {
+		wkb, rkb, err := md.getKeyBundlesRLocked(id, wkbID, rkbID)
+		if err != nil {
+			return kbfsmd.ServerError{Err: err}
+		}
+		extra = kbfsmd.NewExtraMetadataV3(*wkb, *rkb, false, false)
+	}
+
+	err := rmds.IsValidAndSigned(
+		ctx, md.config.Codec(), everyoneOnEveryTeamChecker{}, extra)
+	if err != nil {
+		return MDMismatchError{
+			rmds.MD.RevisionNumber(), id.String(), id, err,
+		}
+	}
+	return nil
+}
+
 func (md *MDServerMemory) doGetRange(ctx context.Context, id tlf.ID,
 	bid kbfsmd.BranchID, mStatus kbfsmd.MergeStatus, start, stop kbfsmd.Revision,
 	lockBeforeGet *keybase1.LockID) (
@@ -430,6 +712,9 @@ func (md *MDServerMemory) GetRange(ctx context.Context, id tlf.ID,
 	if err := checkContext(ctx); err != nil {
 		return nil, err
 	}
+	if err := md.injectFault(ctx, "GetRange"); err != nil {
+		return nil, err
+	}
 
 	// An RPC-based client would receive a throttle message from the
 	// server and retry with backoff, but here we need to implement
@@ -454,12 +739,241 @@ func (md *MDServerMemory) GetRange(ctx context.Context, id tlf.ID,
 	}
 }
 
+// VerifyConsistency checks that the stored MD list for the given TLF,
+// branch and merge status is internally consistent: each block's
+// revision must equal the list's initial revision plus its index (so
+// there are no gaps), and each block's PrevRoot must point to the
+// block before it.  Unlike GetRange, it returns a descriptive error
+// rather than panicking, so it can be used to validate restored or
+// snapshotted data.
+func (md *MDServerMemory) VerifyConsistency(ctx context.Context,
+	id tlf.ID, bid kbfsmd.BranchID, mStatus kbfsmd.MergeStatus) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	md.lock.RLock()
+	defer md.lock.RUnlock()
+
+	err := md.checkShutdownRLocked()
+	if err != nil {
+		return err
+	}
+
+	key, err := md.getMDKey(id, bid, mStatus)
+	if err != nil {
+		return kbfsmd.ServerError{Err: err}
+	}
+
+	blockList, ok := md.mdDb[key]
+	if !ok {
+		return nil
+	}
+
+	max := md.config.MetadataVersion()
+	var prev *RootMetadataSigned
+	for i, block := range blockList.blocks {
+		rmds, err := DecodeRootMetadataSigned(
+			md.mdCodec(), id, block.version, max, block.encodedMd,
+			block.timestamp)
+		if err != nil {
+			return errors.Errorf(
+				"couldn't decode MD at index %d of %s/%s/%s: %+v",
+				i, id, bid, mStatus, err)
+		}
+
+		expectedRevision := blockList.initialRevision + kbfsmd.Revision(i)
+		if expectedRevision != rmds.MD.RevisionNumber() {
+			return errors.Errorf(
+				"MD at index %d of %s/%s/%s has revision %v; expected %v "+
+					"(initial revision %v)", i, id, bid, mStatus,
+				rmds.MD.RevisionNumber(), expectedRevision,
+				blockList.initialRevision)
+		}
+
+		if prev != nil {
+			prevID, err := kbfsmd.MakeID(md.config.Codec(), prev.MD)
+			if err != nil {
+				return err
+			}
+			expectedPrevRoot := prevID
+			if rmds.MD.IsFinal() {
+				expectedPrevRoot = prev.MD.GetPrevRoot()
+			}
+			if rmds.MD.GetPrevRoot() != expectedPrevRoot {
+				return errors.Errorf(
+					"MD revision %v of %s/%s/%s has PrevRoot %s; "+
+						"expected %s", rmds.MD.RevisionNumber(), id, bid,
+					mStatus, rmds.MD.GetPrevRoot(), expectedPrevRoot)
+			}
+		}
+		prev = rmds
+	}
+
+	return nil
+}
+
+// getHeadForPutLocked returns the current head that `rmds` must be a
+// valid successor of, and whether `rmds` starts a new unmerged branch
+// (in which case the head is on the merged master branch).
+func (md *MDServerMemory) getHeadForPutLocked(
+	ctx context.Context, id tlf.ID, rmds *RootMetadataSigned) (
+	head *RootMetadataSigned, recordBranchID bool, err error) {
+	bid := rmds.MD.BID()
+	mStatus := rmds.MD.MergedStatus()
+
+	head, err = md.getHeadForTLFRLocked(ctx, id, bid, mStatus)
+	if err != nil {
+		return nil, false, kbfsmd.ServerError{Err: err}
+	}
+
+	if mStatus == kbfsmd.Unmerged && head == nil {
+		// currHead for unmerged history might be on the main branch
+		prevRev := rmds.MD.RevisionNumber() - 1
+		rmdses, ch, err := md.getRangeLocked(
+			ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, prevRev, prevRev, nil)
+		if err != nil {
+			return nil, false, kbfsmd.ServerError{Err: err}
+		}
+		if ch != nil {
+			panic("Got non-nil lock channel with a nil lock context")
+		}
+		if len(rmdses) != 1 {
+			return nil, false, kbfsmd.ServerError{
+				Err: errors.Errorf("Expected 1 MD block got %d", len(rmdses)),
+			}
+		}
+		head = rmdses[0]
+		recordBranchID = true
+	}
+	return head, recordBranchID, nil
+}
+
+// checkReplayLocked checks whether the revision in `rmds` is already
+// stored.  It returns true if the stored revision is identical, in
+// which case the put is just a replay that can succeed without doing
+// anything, and a kbfsmd.ServerErrorConflictRevision if the stored
+// revision differs.  It returns false if the revision isn't stored
+// yet.
+func (md *MDServerMemory) checkReplayLocked(
+	id tlf.ID, rmds *RootMetadataSigned) (isReplay bool, err error) {
+	revKey, err := md.getMDKey(id, rmds.MD.BID(), rmds.MD.MergedStatus())
+	if err != nil {
+		return false, kbfsmd.ServerError{Err: err}
+	}
+	blockList, ok := md.mdDb[revKey]
+	rev := rmds.MD.RevisionNumber()
+	if !ok || rev < blockList.initialRevision {
+		return false, nil
+	}
+	i := int(rev - blockList.initialRevision)
+	if i >= len(blockList.blocks) {
+		return false, nil
+	}
+
+	encodedMd, err := kbfsmd.EncodeRootMetadataSigned(
+		md.mdCodec(), &rmds.RootMetadataSigned)
+	if err != nil {
+		return false, kbfsmd.ServerError{Err: err}
+	}
+	if bytes.Equal(encodedMd, blockList.blocks[i].encodedMd) {
+		return true, nil
+	}
+	return false, kbfsmd.ServerErrorConflictRevision{
+		Desc: fmt.Sprintf(
+			"revision %d is already stored with different contents", rev),
+		Expected: blockList.initialRevision +
+			kbfsmd.Revision(len(blockList.blocks)),
+		Actual: rev,
+	}
+}
+
+// checkExpectedHeadLocked returns a
+// kbfsmd.ServerErrorConflictPrevRoot if `head`, the head that a put
+// would go on top of, doesn't have the ID `expectedHead`.
+func (md *MDServerMemory) checkExpectedHeadLocked(
+	head *RootMetadataSigned, expectedHead kbfsmd.ID) error {
+	var headID kbfsmd.ID
+	if head != nil {
+		var err error
+		headID, err = kbfsmd.MakeID(md.config.Codec(), head.MD)
+		if err != nil {
+			return kbfsmd.ServerError{Err: err}
+		}
+	}
+	if headID != expectedHead {
+		return kbfsmd.ServerErrorConflictPrevRoot{
+			Expected: expectedHead,
+			Actual:   headID,
+		}
+	}
+	return nil
+}
+
+// checkRekeyLocked returns kbfsmd.ServerErrorUnauthorized unless
+// `rmds` is a put that the current user is allowed to make as a
+// reader of the TLF, i.e. a valid rekey of the merged master head.
+func (md *MDServerMemory) checkRekeyLocked(ctx context.Context,
+	session SessionInfo, id tlf.ID, rmds *RootMetadataSigned,
+	extra kbfsmd.ExtraMetadata) error {
+	mergedMasterHead, err :=
+		md.getHeadForTLFRLocked(ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged)
+	if err != nil {
+		return kbfsmd.ServerError{Err: err}
+	}
+	prevExtra, err := getExtraMetadata(
+		md.getKeyBundlesRLocked, mergedMasterHead.MD)
+	if err != nil {
+		return kbfsmd.ServerError{Err: err}
+	}
+	ok, err := isWriterOrValidRekey(
+		ctx, md.config.teamMembershipChecker(), md.config.Codec(),
+		session.UID, session.VerifyingKey, mergedMasterHead.MD,
+		rmds.MD, prevExtra, extra)
+	if err != nil {
+		return kbfsmd.ServerError{Err: err}
+	}
+	if !ok {
+		return kbfsmd.ServerErrorUnauthorized{}
+	}
+	return nil
+}
+
 // Put implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 	extra kbfsmd.ExtraMetadata, lc *keybase1.LockContext, _ keybase1.MDPriority) error {
+	return md.put(ctx, rmds, extra, lc, kbfsmd.ID{})
+}
+
+// PutIfHead is like Put, but it only succeeds if the current head of
+// the branch `rmds` is being put to (or, for the first revision of a
+// new unmerged branch, its merged predecessor) has the ID
+// `expectedHead`.  Otherwise it fails with a
+// kbfsmd.ServerErrorConflictPrevRoot, even when `rmds` would have
+// been a valid successor of the actual head.  This lets a client that
+// computed `rmds` from a head it fetched earlier detect precisely
+// whether anyone else has written in the meantime.  A replay of an
+// already-stored `rmds` still succeeds.
+func (md *MDServerMemory) PutIfHead(ctx context.Context,
+	rmds *RootMetadataSigned, extra kbfsmd.ExtraMetadata,
+	lc *keybase1.LockContext, expectedHead kbfsmd.ID) error {
+	if expectedHead == (kbfsmd.ID{}) {
+		return kbfsmd.ServerErrorBadRequest{Reason: "No expected head given"}
+	}
+	return md.put(ctx, rmds, extra, lc, expectedHead)
+}
+
+// put stores `rmds`.  If `expectedHead` is non-zero, the put is
+// rejected unless it matches the ID of the current head.
+func (md *MDServerMemory) put(ctx context.Context, rmds *RootMetadataSigned,
+	extra kbfsmd.ExtraMetadata, lc *keybase1.LockContext,
+	expectedHead kbfsmd.ID) error {
 	if err := checkContext(ctx); err != nil {
 		return err
 	}
+	if err := md.injectFault(ctx, "Put"); err != nil {
+		return err
+	}
 
 	session, err := md.config.currentSessionGetter().GetCurrentSession(ctx)
 	if err != nil {
@@ -488,59 +1002,82 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 		return kbfsmd.ServerErrorRequiredLockIsNotHeld{}
 	}
 
-	mergedMasterHead, err :=
-		md.getHeadForTLFRLocked(ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged)
+	err = md.checkShutdownRLocked()
 	if err != nil {
 		return kbfsmd.ServerError{Err: err}
 	}
 
 	// TODO: Figure out nil case.
-	if mergedMasterHead != nil {
-		prevExtra, err := getExtraMetadata(
-			md.getKeyBundlesRLocked, mergedMasterHead.MD)
+	if h, ok := md.headHandleDb[id]; ok {
+		isWriter, err := isWriterForHandle(
+			ctx, md.config.teamMembershipChecker(), session.UID,
+			session.VerifyingKey, h)
 		if err != nil {
 			return kbfsmd.ServerError{Err: err}
 		}
-		ok, err := isWriterOrValidRekey(
-			ctx, md.config.teamMembershipChecker(), md.config.Codec(),
-			session.UID, session.VerifyingKey, mergedMasterHead.MD,
-			rmds.MD, prevExtra, extra)
-		if err != nil {
-			return kbfsmd.ServerError{Err: err}
+		if !isWriter {
+			// Only checking a reader's rekey needs the rest of the
+			// merged master head.
+			err := md.checkRekeyLocked(ctx, session, id, rmds, extra)
+			if err != nil {
+				return err
+			}
 		}
-		if !ok {
-			return kbfsmd.ServerErrorUnauthorized{}
+	}
+
+	// Tell idempotent replays of already-stored revisions apart from
+	// real conflicts, which would otherwise both just fail the
+	// successor check below.
+	isReplay, replayErr := md.checkReplayLocked(id, rmds)
+	if isReplay {
+		if lc != nil && lc.ReleaseAfterSuccess {
+			md.releaseLockLocked(ctx, id, lc.RequireLockID)
 		}
+		return nil
 	}
 
 	bid := rmds.MD.BID()
 	mStatus := rmds.MD.MergedStatus()
 
-	head, err := md.getHeadForTLFRLocked(ctx, id, bid, mStatus)
-	if err != nil {
-		return kbfsmd.ServerError{Err: err}
-	}
-
+	// The head is decoded at most once, and only when the put might
+	// succeed: the checks that reject it beforehand just need its
+	// recorded header.
+	var head *RootMetadataSigned
 	var recordBranchID bool
+	if expectedHead != (kbfsmd.ID{}) {
+		head, recordBranchID, err = md.getHeadForPutLocked(ctx, id, rmds)
+		if err != nil {
+			return err
+		}
+		err := md.checkExpectedHeadLocked(head, expectedHead)
+		if err != nil {
+			return err
+		}
+	}
+	if replayErr != nil {
+		return replayErr
+	}
 
-	if mStatus == kbfsmd.Unmerged && head == nil {
-		// currHead for unmerged history might be on the main branch
-		prevRev := rmds.MD.RevisionNumber() - 1
-		rmdses, ch, err := md.getRangeLocked(
-			ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, prevRev, prevRev, nil)
+	if expectedHead == (kbfsmd.ID{}) {
+		// Reject puts with the wrong revision number before paying
+		// for a decode of the head.  Final heads are left to
+		// the full check, which reports them differently.
+		headHeader, err := md.getHeadHeaderRLocked(id, bid, mStatus)
 		if err != nil {
 			return kbfsmd.ServerError{Err: err}
 		}
-		if ch != nil {
-			panic("Got non-nil lock channel with a nil lock context")
-		}
-		if len(rmdses) != 1 {
-			return kbfsmd.ServerError{
-				Err: errors.Errorf("Expected 1 MD block got %d", len(rmdses)),
+		if headHeader != nil && !headHeader.IsFinal() &&
+			rmds.MD.RevisionNumber() != headHeader.Revision+1 {
+			return kbfsmd.ServerErrorConflictRevision{
+				Expected: headHeader.Revision + 1,
+				Actual:   rmds.MD.RevisionNumber(),
 			}
 		}
-		head = rmdses[0]
-		recordBranchID = true
+
+		head, recordBranchID, err = md.getHeadForPutLocked(ctx, id, rmds)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Consistency checks
@@ -568,12 +1105,14 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 		md.branchDb[branchKey] = bid
 	}
 
-	encodedMd, err := kbfsmd.EncodeRootMetadataSigned(md.config.Codec(), &rmds.RootMetadataSigned)
+	encodedMd, err := kbfsmd.EncodeRootMetadataSigned(md.mdCodec(), &rmds.RootMetadataSigned)
 	if err != nil {
 		return kbfsmd.ServerError{Err: err}
 	}
 
-	block := mdBlockMem{encodedMd, md.config.Clock().Now(), rmds.MD.Version()}
+	block := mdBlockMem{
+		encodedMd, md.config.Clock().Now(), rmds.MD.Version(),
+		kbfsmd.MakeRootMetadataHeader(rmds.MD)}
 
 	// Add an entry with the revision key.
 	revKey, err := md.getMDKey(id, bid, mStatus)
@@ -587,6 +1126,13 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 	}
 
 	blockList, ok := md.mdDb[revKey]
+	if mStatus == kbfsmd.Unmerged && md.maxUnmergedRevisionsPerBranch > 0 &&
+		len(blockList.blocks) >= md.maxUnmergedRevisionsPerBranch {
+		return kbfsmd.ServerErrorTooManyUnmergedRevisions{
+			Count: uint64(len(blockList.blocks)),
+			Limit: uint64(md.maxUnmergedRevisionsPerBranch),
+		}
+	}
 	if ok {
 		blockList.blocks = append(blockList.blocks, block)
 		md.mdDb[revKey] = blockList
@@ -601,6 +1147,12 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 		return kbfsmd.ServerError{Err: err}
 	}
 
+	if mStatus == kbfsmd.Merged {
+		if err := md.putHeadHandleLocked(id, rmds); err != nil {
+			return kbfsmd.ServerError{Err: err}
+		}
+	}
+
 	if lc != nil && lc.ReleaseAfterSuccess {
 		md.releaseLockLocked(ctx, id, lc.RequireLockID)
 	}
@@ -610,6 +1162,217 @@ func (md *MDServerMemory) Put(ctx context.Context, rmds *RootMetadataSigned,
 		// sends a "folder needs rekey" notification in this case).
 		!(rmds.MD.IsRekeySet() && rmds.MD.IsWriterMetadataCopiedSet()) {
 		md.updateManager.setHead(id, md)
+	} else if mStatus == kbfsmd.Merged {
+		md.updateManager.rekeyNeeded(id, md)
+	}
+
+	return nil
+}
+
+// putHeadHandleLocked records the handle of `rmds`, the new merged
+// master head of the TLF, for checking permissions.  If `rmds`
+// finalizes the TLF, its finalized handle is also recorded, so that
+// the TLF can still be looked up by either its original or its
+// finalized name.
+func (md *MDServerMemory) putHeadHandleLocked(
+	id tlf.ID, rmds *RootMetadataSigned) error {
+	extra, err := getExtraMetadata(md.getKeyBundlesRLocked, rmds.MD)
+	if err != nil {
+		return err
+	}
+	handle, err := rmds.MD.MakeBareTlfHandle(extra)
+	if err != nil {
+		return err
+	}
+	md.headHandleDb[id] = handle
+	if !rmds.MD.IsFinal() {
+		return nil
+	}
+	handleBytes, err := md.config.Codec().Encode(handle)
+	if err != nil {
+		return err
+	}
+	md.handleDb[mdHandleKey(handleBytes)] = id
+	md.latestHandleDb[id] = handle
+	return nil
+}
+
+// PutRange appends a chain of consecutive revisions for a single TLF
+// branch all at once, under a single acquisition of the server lock.
+// It performs the same validation and authorization checks as calling
+// Put on each revision in turn, but if any of them fails, none of the
+// revisions are stored.  It's meant for quickly setting up long
+// histories in tests and migrations, so it doesn't take any extra
+// metadata or lock context.
+func (md *MDServerMemory) PutRange(
+	ctx context.Context, rmdses []*RootMetadataSigned) error {
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+	if err := md.injectFault(ctx, "PutRange"); err != nil {
+		return err
+	}
+	if len(rmdses) == 0 {
+		return nil
+	}
+
+	session, err := md.config.currentSessionGetter().GetCurrentSession(ctx)
+	if err != nil {
+		return kbfsmd.ServerError{Err: err}
+	}
+
+	first := rmdses[0]
+	id := first.MD.TlfID()
+	bid := first.MD.BID()
+	mStatus := first.MD.MergedStatus()
+	blocks := make([]mdBlockMem, 0, len(rmdses))
+	for i, rmds := range rmdses {
+		// MDv3 TODO: accept actual key bundles.
+		err = rmds.IsValidAndSigned(
+			ctx, md.config.Codec(), md.config.teamMembershipChecker(), nil)
+		if err != nil {
+			return kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+		}
+
+		err = rmds.IsLastModifiedBy(session.UID, session.VerifyingKey)
+		if err != nil {
+			return kbfsmd.ServerErrorBadRequest{Reason: err.Error()}
+		}
+
+		if rmds.MD.TlfID() != id || rmds.MD.BID() != bid ||
+			rmds.MD.MergedStatus() != mStatus {
+			return kbfsmd.ServerErrorBadRequest{
+				Reason: fmt.Sprintf("Revision %d is not on the same "+
+					"branch as revision %d", rmds.MD.RevisionNumber(),
+					first.MD.RevisionNumber()),
+			}
+		}
+
+		// Check the links within the batch now; the link to the
+		// current head is checked below, under the lock.
+		if i > 0 {
+			prev := rmdses[i-1]
+			prevID, err := kbfsmd.MakeID(md.config.Codec(), prev.MD)
+			if err != nil {
+				return err
+			}
+			err = prev.MD.CheckValidSuccessorForServer(prevID, rmds.MD)
+			if err != nil {
+				return err
+			}
+		}
+
+		encodedMd, err := kbfsmd.EncodeRootMetadataSigned(
+			md.mdCodec(), &rmds.RootMetadataSigned)
+		if err != nil {
+			return kbfsmd.ServerError{Err: err}
+		}
+		blocks = append(blocks, mdBlockMem{
+			encodedMd, md.config.Clock().Now(), rmds.MD.Version(),
+			kbfsmd.MakeRootMetadataHeader(rmds.MD)})
+	}
+
+	md.lock.Lock()
+	defer md.lock.Unlock()
+
+	// Check permissions for each revision, against the merged head
+	// that will be current when it is appended.
+	mergedMasterHead, err :=
+		md.getHeadForTLFRLocked(ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged)
+	if err != nil {
+		return kbfsmd.ServerError{Err: err}
+	}
+	for _, rmds := range rmdses {
+		// TODO: Figure out nil case.
+		if mergedMasterHead != nil {
+			prevExtra, err := getExtraMetadata(
+				md.getKeyBundlesRLocked, mergedMasterHead.MD)
+			if err != nil {
+				return kbfsmd.ServerError{Err: err}
+			}
+			ok, err := isWriterOrValidRekey(
+				ctx, md.config.teamMembershipChecker(), md.config.Codec(),
+				session.UID, session.VerifyingKey, mergedMasterHead.MD,
+				rmds.MD, prevExtra, nil)
+			if err != nil {
+				return kbfsmd.ServerError{Err: err}
+			}
+			if !ok {
+				return kbfsmd.ServerErrorUnauthorized{}
+			}
+		}
+		if mStatus == kbfsmd.Merged {
+			mergedMasterHead = rmds
+		}
+	}
+
+	head, recordBranchID, err := md.getHeadForPutLocked(ctx, id, first)
+	if err != nil {
+		return err
+	}
+
+	// Consistency checks
+	if head != nil {
+		headID, err := kbfsmd.MakeID(md.config.Codec(), head.MD)
+		if err != nil {
+			return err
+		}
+		err = head.MD.CheckValidSuccessorForServer(headID, first.MD)
+		if err != nil {
+			return err
+		}
+	}
+
+	revKey, err := md.getMDKey(id, bid, mStatus)
+	if err != nil {
+		return kbfsmd.ServerError{Err: err}
+	}
+
+	err = md.checkShutdownRLocked()
+	if err != nil {
+		return err
+	}
+
+	blockList, ok := md.mdDb[revKey]
+	if mStatus == kbfsmd.Unmerged && md.maxUnmergedRevisionsPerBranch > 0 &&
+		len(blockList.blocks)+len(blocks) > md.maxUnmergedRevisionsPerBranch {
+		return kbfsmd.ServerErrorTooManyUnmergedRevisions{
+			Count: uint64(len(blockList.blocks)),
+			Limit: uint64(md.maxUnmergedRevisionsPerBranch),
+		}
+	}
+
+	// Everything checks out, so now it's safe to modify the state.
+	if recordBranchID {
+		branchKey, err := md.getBranchKey(ctx, id)
+		if err != nil {
+			return kbfsmd.ServerError{Err: err}
+		}
+		md.branchDb[branchKey] = bid
+	}
+
+	if ok {
+		blockList.blocks = append(blockList.blocks, blocks...)
+		md.mdDb[revKey] = blockList
+	} else {
+		md.mdDb[revKey] = mdBlockMemList{
+			initialRevision: first.MD.RevisionNumber(),
+			blocks:          blocks,
+		}
+	}
+
+	last := rmdses[len(rmdses)-1]
+	if mStatus == kbfsmd.Merged {
+		if err := md.putHeadHandleLocked(id, last); err != nil {
+			return kbfsmd.ServerError{Err: err}
+		}
+	}
+
+	if mStatus == kbfsmd.Merged &&
+		!(last.MD.IsRekeySet() && last.MD.IsWriterMetadataCopiedSet()) {
+		md.updateManager.setHead(id, md)
+	} else if mStatus == kbfsmd.Merged {
+		md.updateManager.rekeyNeeded(id, md)
 	}
 
 	return nil
@@ -779,6 +1542,22 @@ func (md *MDServerMemory) RegisterForUpdate(ctx context.Context, id tlf.ID,
 	return c, nil
 }
 
+func (md *MDServerMemory) registerForUpdateOrRekey(ctx context.Context,
+	id tlf.ID, currHead kbfsmd.Revision) (<-chan mdServerLocalUpdate, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	currMergedHeadRev, err := md.getCurrentMergedHeadRevision(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	c := md.updateManager.registerForUpdateOrRekey(
+		id, currHead, currMergedHeadRev, md)
+	return c, nil
+}
+
 // CancelRegistration implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) CancelRegistration(_ context.Context, id tlf.ID) {
 	md.updateManager.cancel(id, md)
@@ -848,8 +1627,10 @@ func (md *MDServerMemory) Shutdown() {
 	defer md.lock.Unlock()
 	md.handleDb = nil
 	md.latestHandleDb = nil
+	md.headHandleDb = nil
 	md.branchDb = nil
 	md.truncateLockManager = nil
+	md.updateManager.shutdown()
 }
 
 // IsConnected implements the MDServer interface for MDServerMemory.
@@ -857,6 +1638,60 @@ func (md *MDServerMemory) IsConnected() bool {
 	return !md.isShutdown()
 }
 
+// MDServerMemoryHealth summarizes the state of an MDServerMemory, as
+// returned by MDServerMemory.Health.
+type MDServerMemoryHealth struct {
+	// NumTLFs is the number of TLFs with at least one stored MD.
+	NumTLFs int
+	// NumRevisions is the total number of stored MD revisions,
+	// across all TLFs and branches.
+	NumRevisions int
+	// EncodedMDBytes is the total size of all stored, encoded MDs.
+	EncodedMDBytes int64
+	// NumObservers is the number of registered update observers.
+	NumObservers int
+	// NumStuckObservers is the number of update observers that are
+	// behind their TLF's merged head, but haven't been fired.
+	NumStuckObservers int
+}
+
+// Health returns a summary of the contents of this server, computed
+// without decoding any MDs.  Unlike IsConnected, it returns an error
+// if the server has been shut down.
+func (md *MDServerMemory) Health() (MDServerMemoryHealth, error) {
+	md.lock.RLock()
+	defer md.lock.RUnlock()
+	err := md.checkShutdownRLocked()
+	if err != nil {
+		return MDServerMemoryHealth{}, err
+	}
+
+	var health MDServerMemoryHealth
+	tlfIDs := make(map[tlf.ID]bool)
+	headRevs := make(map[tlf.ID]kbfsmd.Revision)
+	for key, blockList := range md.mdDb {
+		if len(blockList.blocks) == 0 {
+			continue
+		}
+		tlfIDs[key.tlfID] = true
+		health.NumRevisions += len(blockList.blocks)
+		for _, block := range blockList.blocks {
+			health.EncodedMDBytes += int64(len(block.encodedMd))
+		}
+		if key.branchID == kbfsmd.NullBranchID {
+			headRevs[key.tlfID] = blockList.initialRevision +
+				kbfsmd.Revision(len(blockList.blocks)-1)
+		}
+	}
+	health.NumTLFs = len(tlfIDs)
+
+	// Puts update the head under `md.lock`, so the head revisions
+	// computed above are consistent with the observer state.
+	health.NumObservers, health.NumStuckObservers =
+		md.updateManager.countObservers(headRevs)
+	return health, nil
+}
+
 // RefreshAuthToken implements the MDServer interface for MDServerMemory.
 func (md *MDServerMemory) RefreshAuthToken(ctx context.Context) {}
 
@@ -866,7 +1701,7 @@ func (md *MDServerMemory) copy(config mdServerLocalConfig) mdServerLocal {
 	// purpose, so that the MD server that gets a Put will notify all
 	// observers correctly no matter where they got on the list.
 	log := config.MakeLogger("")
-	return &MDServerMemory{config, log, md.mdServerMemShared}
+	return &MDServerMemory{config, log, md.codecOverride, md.mdServerMemShared}
 }
 
 // isShutdown returns whether the logical, shared MDServer instance
@@ -901,6 +1736,7 @@ func (md *MDServerMemory) addNewAssertionForTest(uid keybase1.UID,
 
 	// Iterate through all the handles, and add handles for ones
 	// containing newAssertion to now include the uid.
+	changed := make(map[tlf.ID]tlf.Handle)
 	for hBytes, id := range md.handleDb {
 		var h tlf.Handle
 		err := md.config.Codec().Decode([]byte(hBytes), &h)
@@ -919,20 +1755,41 @@ func (md *MDServerMemory) addNewAssertionForTest(uid keybase1.UID,
 			return err
 		}
 		md.handleDb[mdHandleKey(newHBytes)] = id
+		changed[id] = newH
+	}
+
+	for id, h := range changed {
+		md.updateManager.handleChanged(id, h)
 	}
 	return nil
 }
 
 func (md *MDServerMemory) getCurrentMergedHeadRevision(
 	ctx context.Context, id tlf.ID) (rev kbfsmd.Revision, err error) {
-	head, err := md.GetForTLF(ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, nil)
+	if err := checkContext(ctx); err != nil {
+		return 0, err
+	}
+
+	md.lock.RLock()
+	defer md.lock.RUnlock()
+
+	_, err = md.checkGetParamsRLocked(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged)
 	if err != nil {
 		return 0, err
 	}
-	if head != nil {
-		rev = head.MD.RevisionNumber()
+
+	// Only the revision is needed, so skip decoding the rest of
+	// the head.
+	header, err := md.getHeadHeaderRLocked(
+		id, kbfsmd.NullBranchID, kbfsmd.Merged)
+	if err != nil {
+		return 0, kbfsmd.ServerError{Err: err}
+	}
+	if header != nil {
+		rev = header.Revision
 	}
-	return
+	return rev, nil
 }
 
 // GetLatestHandleForTLF implements the MDServer interface for MDServerMemory.
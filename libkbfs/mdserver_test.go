@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/keybase1"
 	"github.com/keybase/kbfs/kbfscodec"
 	"github.com/keybase/kbfs/kbfscrypto"
@@ -200,3 +201,1027 @@ func TestMDServerRegisterForUpdate(t *testing.T) {
 	_, err = mdServer.RegisterForUpdate(ctx, id2, kbfsmd.RevisionInitial)
 	require.NoError(t, err)
 }
+
+// Make sure that a rekey-only put to an MDServerMemory fires a
+// distinct rekey-needed notification, rather than a normal update.
+func TestMDServerMemoryRekeyNeededNotification(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+	rekeyObserver := mdServer.copy(mdServerLocalConfigAdapter{config})
+	updateObserver := mdServer.copy(mdServerLocalConfigAdapter{config})
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	brmd := makeBRMDForTest(t, config.Codec(), id, h, 1, uid, kbfsmd.ID{})
+	rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+	prevRoot, err := kbfsmd.MakeID(config.Codec(), rmds.MD)
+	require.NoError(t, err)
+
+	rekeyCh, err := rekeyObserver.registerForUpdateOrRekey(ctx, id, 1)
+	require.NoError(t, err)
+	updateCh, err := updateObserver.RegisterForUpdate(ctx, id, 1)
+	require.NoError(t, err)
+
+	// Push a rekey-only MD.
+	brmd = makeBRMDForTest(t, config.Codec(), id, h, 2, uid, prevRoot)
+	brmd.SetRekeyBit()
+	brmd.SetWriterMetadataCopiedBit()
+	rmds = signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+	prevRoot, err = kbfsmd.MakeID(config.Codec(), rmds.MD)
+	require.NoError(t, err)
+
+	select {
+	case update := <-rekeyCh:
+		require.NoError(t, update.err)
+		require.True(t, update.rekeyNeeded)
+	default:
+		t.Fatal("Rekey-needed notification didn't fire")
+	}
+	select {
+	case err := <-updateCh:
+		t.Fatalf("Unexpected update notification for a rekey: %+v", err)
+	default:
+	}
+
+	// A normal put should fire the regular update.
+	brmd = makeBRMDForTest(t, config.Codec(), id, h, 3, uid, prevRoot)
+	rmds = signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+
+	select {
+	case err := <-updateCh:
+		require.NoError(t, err)
+	default:
+		t.Fatal("Update notification didn't fire")
+	}
+}
+
+// Make sure that a burst of merged puts within the debounce window
+// results in a single update notification, delivered after the
+// window ends according to the config's clock.
+func TestMDServerMemoryUpdateDebounce(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	clock := newTestClockNow()
+	config.SetClock(clock)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+	const debounce = 100 * time.Millisecond
+	mdServer.SetUpdateDebounce(debounce)
+	observer := mdServer.copy(mdServerLocalConfigAdapter{config})
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	put := func(rev kbfsmd.Revision, prevRoot kbfsmd.ID) kbfsmd.ID {
+		brmd := makeBRMDForTest(t, config.Codec(), id, h, rev, uid, prevRoot)
+		rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+		err := mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+		require.NoError(t, err)
+		mdID, err := kbfsmd.MakeID(config.Codec(), rmds.MD)
+		require.NoError(t, err)
+		return mdID
+	}
+	requireNoUpdate := func(updateCh <-chan error) {
+		select {
+		case err := <-updateCh:
+			t.Fatalf("Unexpected update notification: %+v", err)
+		default:
+		}
+	}
+	requireUpdate := func(updateCh <-chan error) {
+		select {
+		case err := <-updateCh:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Update notification didn't fire")
+		}
+	}
+
+	prevRoot := put(1, kbfsmd.ID{})
+	updateCh, err := observer.RegisterForUpdate(ctx, id, 1)
+	require.NoError(t, err)
+	for rev := kbfsmd.Revision(2); rev <= 5; rev++ {
+		prevRoot = put(rev, prevRoot)
+	}
+	requireNoUpdate(updateCh)
+	clock.Add(debounce - 1)
+	requireNoUpdate(updateCh)
+	clock.Add(1)
+	requireUpdate(updateCh)
+
+	// The observer fetches the final head and re-registers there,
+	// and doesn't hear about the coalesced puts again.
+	head, err := observer.GetForTLF(ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+	require.Equal(t, kbfsmd.Revision(5), head.MD.RevisionNumber())
+	updateCh, err = observer.RegisterForUpdate(ctx, id, 5)
+	require.NoError(t, err)
+	clock.Add(2 * debounce)
+	requireNoUpdate(updateCh)
+
+	// The next put still notifies the observer.
+	prevRoot = put(6, prevRoot)
+	clock.Add(debounce)
+	requireUpdate(updateCh)
+
+	// Shutting down stops the timer of a pending notification.
+	updateCh, err = observer.RegisterForUpdate(ctx, id, 6)
+	require.NoError(t, err)
+	put(7, prevRoot)
+	mdServer.Shutdown()
+	clock.l.Lock()
+	numTimers := len(clock.timers)
+	clock.l.Unlock()
+	require.Equal(t, 0, numTimers)
+	clock.Add(debounce)
+	requireNoUpdate(updateCh)
+}
+
+// Make sure that MDServerMemory rejects unmerged puts past the
+// configured per-branch limit, but still allows merged puts.
+func TestMDServerMemoryMaxUnmergedRevisions(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+	mdServer.SetMaxUnmergedRevisionsPerBranch(5)
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	// Push some merged revisions.
+	prevRoot := kbfsmd.ID{}
+	for i := kbfsmd.Revision(1); i <= 2; i++ {
+		brmd := makeBRMDForTest(t, config.Codec(), id, h, i, uid, prevRoot)
+		rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+		err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+		require.NoError(t, err)
+		prevRoot, err = kbfsmd.MakeID(config.Codec(), rmds.MD)
+		require.NoError(t, err)
+	}
+	mergedRoot := prevRoot
+
+	// Fill up an unmerged branch off of the merged head.
+	bid, err := config.Crypto().MakeRandomBranchID()
+	require.NoError(t, err)
+	for i := kbfsmd.Revision(3); i <= 7; i++ {
+		brmd := makeBRMDForTest(t, config.Codec(), id, h, i, uid, prevRoot)
+		brmd.SetUnmerged()
+		brmd.SetBranchID(bid)
+		rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+		err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+		require.NoError(t, err)
+		prevRoot, err = kbfsmd.MakeID(config.Codec(), rmds.MD)
+		require.NoError(t, err)
+	}
+
+	// The next unmerged put should be rejected.
+	brmd := makeBRMDForTest(t, config.Codec(), id, h, 8, uid, prevRoot)
+	brmd.SetUnmerged()
+	brmd.SetBranchID(bid)
+	rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.Equal(t, kbfsmd.ServerErrorTooManyUnmergedRevisions{
+		Count: 5, Limit: 5}, err)
+
+	// But a merged put on the same TLF should still succeed.
+	brmd = makeBRMDForTest(t, config.Codec(), id, h, 3, uid, mergedRoot)
+	rmds = signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+}
+
+// Make sure that MDServerMemory reports whether the current device
+// has an unmerged branch for a TLF.
+func TestMDServerMemoryHasUnmergedBranch(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	// Put a merged revision.
+	brmd := makeBRMDForTest(t, config.Codec(), id, h, 1, uid, kbfsmd.ID{})
+	rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+	prevRoot, err := kbfsmd.MakeID(config.Codec(), rmds.MD)
+	require.NoError(t, err)
+
+	hasBranch, err := mdServer.HasUnmergedBranch(ctx, id)
+	require.NoError(t, err)
+	require.False(t, hasBranch)
+
+	// Start an unmerged branch off of the merged head.
+	bid, err := config.Crypto().MakeRandomBranchID()
+	require.NoError(t, err)
+	brmd = makeBRMDForTest(t, config.Codec(), id, h, 2, uid, prevRoot)
+	brmd.SetUnmerged()
+	brmd.SetBranchID(bid)
+	rmds = signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+
+	hasBranch, err = mdServer.HasUnmergedBranch(ctx, id)
+	require.NoError(t, err)
+	require.True(t, hasBranch)
+
+	// Pruning the branch removes it.
+	err = mdServer.PruneBranch(ctx, id, bid)
+	require.NoError(t, err)
+	hasBranch, err = mdServer.HasUnmergedBranch(ctx, id)
+	require.NoError(t, err)
+	require.False(t, hasBranch)
+}
+
+// Make sure that resolving a social assertion in a TLF's handle fires
+// a handle-change notification carrying the new handle.
+func TestMDServerMemoryHandleChangeNotification(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+	observer := mdServer.copy(mdServerLocalConfigAdapter{config})
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	assertion := keybase1.SocialAssertion{
+		User:    "user2",
+		Service: "twitter",
+	}
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil,
+		[]keybase1.SocialAssertion{assertion}, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	updateCh, err := observer.registerForUpdateOrRekey(
+		ctx, id, kbfsmd.RevisionInitial)
+	require.NoError(t, err)
+
+	// An assertion that isn't in the handle shouldn't notify anyone.
+	err = mdServer.addNewAssertionForTest(keybase1.MakeTestUID(3),
+		keybase1.SocialAssertion{User: "user3", Service: "twitter"})
+	require.NoError(t, err)
+	select {
+	case update := <-updateCh:
+		t.Fatalf("Unexpected notification: %+v", update)
+	default:
+	}
+
+	uid2 := keybase1.MakeTestUID(2)
+	err = mdServer.addNewAssertionForTest(uid2, assertion)
+	require.NoError(t, err)
+
+	expectedHandle, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{
+			uid.AsUserOrTeam(), uid2.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+
+	select {
+	case update := <-updateCh:
+		require.NoError(t, update.err)
+		require.False(t, update.rekeyNeeded)
+		require.NotNil(t, update.newHandle)
+		require.Equal(t, expectedHandle, *update.newHandle)
+	default:
+		t.Fatal("Handle-change notification didn't fire")
+	}
+}
+
+// Make sure that VerifyConsistency accepts a well-formed MD list, and
+// detects a wrong initial revision, a revision gap, and a broken
+// PrevRoot chain.
+func TestMDServerMemoryVerifyConsistency(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	// An empty list is trivially consistent.
+	err = mdServer.VerifyConsistency(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged)
+	require.NoError(t, err)
+
+	prevRoot := kbfsmd.ID{}
+	for i := kbfsmd.Revision(1); i <= 5; i++ {
+		brmd := makeBRMDForTest(t, config.Codec(), id, h, i, uid, prevRoot)
+		rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+		err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+		require.NoError(t, err)
+		prevRoot, err = kbfsmd.MakeID(config.Codec(), rmds.MD)
+		require.NoError(t, err)
+	}
+
+	err = mdServer.VerifyConsistency(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged)
+	require.NoError(t, err)
+
+	key := mdBlockKey{id, kbfsmd.NullBranchID}
+	orig := mdServer.mdDb[key]
+	origBlocks := append([]mdBlockMem(nil), orig.blocks...)
+
+	// Wrong initial revision.
+	mdServer.mdDb[key] = mdBlockMemList{
+		initialRevision: orig.initialRevision + 1,
+		blocks:          origBlocks,
+	}
+	err = mdServer.VerifyConsistency(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged)
+	require.Error(t, err)
+
+	// A revision gap.
+	gapBlocks := append(append([]mdBlockMem(nil), origBlocks[:2]...),
+		origBlocks[3:]...)
+	mdServer.mdDb[key] = mdBlockMemList{
+		initialRevision: orig.initialRevision,
+		blocks:          gapBlocks,
+	}
+	err = mdServer.VerifyConsistency(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged)
+	require.Error(t, err)
+
+	// A broken PrevRoot chain, with otherwise correct revisions.
+	brmd := makeBRMDForTest(
+		t, config.Codec(), id, h, 3, uid, kbfsmd.FakeID(1))
+	rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	encodedMd, err := kbfsmd.EncodeRootMetadataSigned(
+		config.Codec(), &rmds.RootMetadataSigned)
+	require.NoError(t, err)
+	badBlocks := append([]mdBlockMem(nil), origBlocks...)
+	badBlocks[2] = mdBlockMem{
+		encodedMd, config.Clock().Now(), rmds.MD.Version(),
+		kbfsmd.MakeRootMetadataHeader(rmds.MD)}
+	mdServer.mdDb[key] = mdBlockMemList{
+		initialRevision: orig.initialRevision,
+		blocks:          badBlocks,
+	}
+	err = mdServer.VerifyConsistency(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged)
+	require.Error(t, err)
+
+	// Restoring the original list makes it consistent again.
+	mdServer.mdDb[key] = orig
+	err = mdServer.VerifyConsistency(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged)
+	require.NoError(t, err)
+}
+
+// Make sure that Health reports the stored TLFs, revisions and
+// encoded MD sizes, and detects update observers that should have
+// been fired but weren't.
+func TestMDServerMemoryHealth(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+
+	health, err := mdServer.Health()
+	require.NoError(t, err)
+	require.Equal(t, MDServerMemoryHealth{}, health)
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	var expectedBytes int64
+	put := func(rmds *RootMetadataSigned) {
+		err := mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+		require.NoError(t, err)
+		encodedMd, err := kbfsmd.EncodeRootMetadataSigned(
+			config.Codec(), &rmds.RootMetadataSigned)
+		require.NoError(t, err)
+		expectedBytes += int64(len(encodedMd))
+	}
+
+	prevRoot := kbfsmd.ID{}
+	for i := kbfsmd.Revision(1); i <= 5; i++ {
+		brmd := makeBRMDForTest(t, config.Codec(), id, h, i, uid, prevRoot)
+		rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+		put(rmds)
+		prevRoot, err = kbfsmd.MakeID(config.Codec(), rmds.MD)
+		require.NoError(t, err)
+	}
+
+	// Unmerged revisions count toward the totals too.
+	bid, err := config.Crypto().MakeRandomBranchID()
+	require.NoError(t, err)
+	for i := kbfsmd.Revision(6); i <= 8; i++ {
+		brmd := makeBRMDForTest(t, config.Codec(), id, h, i, uid, prevRoot)
+		brmd.SetUnmerged()
+		brmd.SetBranchID(bid)
+		rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+		put(rmds)
+		prevRoot, err = kbfsmd.MakeID(config.Codec(), rmds.MD)
+		require.NoError(t, err)
+	}
+
+	// An observer that's up to date isn't stuck.
+	_, err = mdServer.RegisterForUpdate(ctx, id, 5)
+	require.NoError(t, err)
+
+	health, err = mdServer.Health()
+	require.NoError(t, err)
+	require.Equal(t, MDServerMemoryHealth{
+		NumTLFs:        1,
+		NumRevisions:   8,
+		EncodedMDBytes: expectedBytes,
+		NumObservers:   1,
+	}, health)
+
+	// Register an observer from another session behind the head,
+	// bypassing the immediate-fire check, as a racing registration
+	// could.
+	otherServer := mdServer.copy(mdServerLocalConfigAdapter{config})
+	mdServer.updateManager.registerForUpdate(id, 3, 3, otherServer)
+
+	health, err = mdServer.Health()
+	require.NoError(t, err)
+	require.Equal(t, 2, health.NumObservers)
+	require.Equal(t, 1, health.NumStuckObservers)
+
+	mdServer.Shutdown()
+	_, err = mdServer.Health()
+	require.Error(t, err)
+}
+
+// Make sure that a batch put to an MDServerMemory stores exactly the
+// same history as individual puts, and rejects broken batches
+// entirely.
+func TestMDServerMemoryPutRange(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+	batchServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer batchServer.Shutdown()
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	const numRevs = 1000
+	rmdses := make([]*RootMetadataSigned, 0, numRevs)
+	prevRoot := kbfsmd.ID{}
+	for i := kbfsmd.Revision(1); i <= numRevs; i++ {
+		brmd := makeBRMDForTest(t, config.Codec(), id, h, i, uid, prevRoot)
+		rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+		rmdses = append(rmdses, rmds)
+		prevRoot, err = kbfsmd.MakeID(config.Codec(), rmds.MD)
+		require.NoError(t, err)
+	}
+
+	for _, rmds := range rmdses {
+		err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+		require.NoError(t, err)
+	}
+
+	// A batch with a broken link is rejected entirely.
+	broken := append([]*RootMetadataSigned(nil), rmdses[:10]...)
+	broken = append(broken, rmdses[11])
+	err = batchServer.PutRange(ctx, broken)
+	require.IsType(t, kbfsmd.ServerErrorConflictRevision{}, err)
+	head, err := batchServer.GetForTLF(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+	require.Nil(t, head)
+
+	// Push the first revision individually, and the rest as a batch.
+	err = batchServer.Put(ctx, rmdses[0], nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+	err = batchServer.PutRange(ctx, rmdses[1:])
+	require.NoError(t, err)
+
+	// A batch that doesn't link to the current head is rejected.
+	err = batchServer.PutRange(ctx, rmdses[1:2])
+	require.IsType(t, kbfsmd.ServerErrorConflictRevision{}, err)
+
+	expected, err := mdServer.GetRange(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, 1, numRevs, nil)
+	require.NoError(t, err)
+	actual, err := batchServer.GetRange(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, 1, numRevs, nil)
+	require.NoError(t, err)
+	require.Len(t, actual, numRevs)
+	for i := range expected {
+		require.Equal(t, expected[i].RootMetadataSigned,
+			actual[i].RootMetadataSigned)
+	}
+}
+
+type mdServerRootMetadataWrapper struct {
+	kbfsmd.RootMetadataV2
+}
+
+// mdServerRootMetadataV2Future is a hypothetical future version of
+// RootMetadataV2, with some extra fields.
+type mdServerRootMetadataV2Future struct {
+	mdServerRootMetadataWrapper
+	kbfscodec.Extra
+}
+
+// Make sure that MD stored by an MDServerMemory with a future codec
+// can be loaded with the current one, keeping any unknown fields.
+func TestMDServerMemoryCodecOverride(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+
+	cFuture := kbfscodec.NewMsgpack()
+	registerOpsFuture(cFuture)
+	cCurrent := kbfscodec.NewMsgpack()
+	RegisterOps(cCurrent)
+	cCurrentKnownOnly := kbfscodec.NewMsgpackNoUnknownFields()
+	RegisterOps(cCurrentKnownOnly)
+
+	futureServer, err := NewMDServerMemoryWithCodec(
+		mdServerLocalConfigAdapter{config}, cFuture)
+	require.NoError(t, err)
+	defer futureServer.Shutdown()
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := futureServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	// Make an MD that carries some fields unknown to the current
+	// version.
+	brmd := makeBRMDForTest(t, config.Codec(), id, h, 1, uid, kbfsmd.ID{})
+	extra := kbfscodec.MakeExtraOrBust("RootMetadataV2", t)
+	buf, err := cFuture.Encode(mdServerRootMetadataV2Future{
+		mdServerRootMetadataWrapper{*brmd}, extra})
+	require.NoError(t, err)
+	var brmdFuture kbfsmd.RootMetadataV2
+	err = cCurrent.Decode(buf, &brmdFuture)
+	require.NoError(t, err)
+	rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), &brmdFuture)
+	err = futureServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+	expectedID, err := kbfsmd.MakeID(config.Codec(), rmds.MD)
+	require.NoError(t, err)
+
+	// Load it through a server sharing the same storage, but using
+	// the current codec.
+	currentServer := futureServer.copy(
+		mdServerLocalConfigAdapter{config}).(*MDServerMemory)
+	currentServer.codecOverride = cCurrent
+	head, err := currentServer.GetForTLF(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+	require.NotNil(t, head)
+	require.Equal(t, rmds.RootMetadataSigned, head.RootMetadataSigned)
+	headID, err := kbfsmd.MakeID(cCurrent, head.MD)
+	require.NoError(t, err)
+	require.Equal(t, expectedID, headID)
+
+	// The unknown fields survive the round trip.
+	buf, err = cCurrent.Encode(head.MD)
+	require.NoError(t, err)
+	var future mdServerRootMetadataV2Future
+	err = cFuture.Decode(buf, &future)
+	require.NoError(t, err)
+	require.Equal(t, extra, future.Extra)
+
+	// A server that only knows the current fields still sees the
+	// same known fields, but drops the rest.
+	knownOnlyServer := futureServer.copy(
+		mdServerLocalConfigAdapter{config}).(*MDServerMemory)
+	knownOnlyServer.codecOverride = cCurrentKnownOnly
+	head, err = knownOnlyServer.GetForTLF(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+	require.NotNil(t, head)
+	require.Equal(t, rmds.MD.RevisionNumber(), head.MD.RevisionNumber())
+	require.Equal(t, rmds.SigInfo, head.SigInfo)
+	headID, err = kbfsmd.MakeID(cCurrentKnownOnly, head.MD)
+	require.NoError(t, err)
+	require.NotEqual(t, expectedID, headID)
+
+	// The next revision still links to the stored one.
+	brmd = makeBRMDForTest(t, config.Codec(), id, h, 2, uid, expectedID)
+	rmds = signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	err = currentServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+}
+
+func TestMDServerMemoryFaultInjection(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	brmd := makeBRMDForTest(t, config.Codec(), id, h, 1, uid, kbfsmd.ID{})
+	rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+
+	// The same seed produces the same sequence of errors.
+	getErrors := func() (failed []bool) {
+		mdServer.SetFaultInjection(&MDServerMemoryFaults{
+			Seed: 1,
+			Methods: map[string]MDServerMemoryFault{
+				"GetForTLF": {ErrorProbability: 0.5},
+			},
+		})
+		for i := 0; i < 20; i++ {
+			_, err := mdServer.GetForTLF(
+				ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, nil)
+			failed = append(failed, err != nil)
+		}
+		return failed
+	}
+	failed := getErrors()
+	require.Contains(t, failed, true)
+	require.Contains(t, failed, false)
+	require.Equal(t, failed, getErrors())
+}
+
+func TestMDServerMemoryReplayedPut(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	var rmdses []*RootMetadataSigned
+	prevRoot := kbfsmd.ID{}
+	for i := kbfsmd.Revision(1); i <= 10; i++ {
+		brmd := makeBRMDForTest(t, config.Codec(), id, h, i, uid, prevRoot)
+		rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+		err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+		require.NoError(t, err)
+		prevRoot, err = kbfsmd.MakeID(config.Codec(), rmds.MD)
+		require.NoError(t, err)
+		rmdses = append(rmdses, rmds)
+	}
+
+	// Replaying an identical old revision succeeds without changing
+	// anything.
+	err = mdServer.Put(ctx, rmdses[4], nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+	head, err := mdServer.GetForTLF(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+	require.Equal(t, kbfsmd.Revision(10), head.MD.RevisionNumber())
+
+	// An old revision with different contents is a conflict.
+	brmd := makeBRMDForTest(
+		t, config.Codec(), id, h, 5, uid, rmdses[4].MD.GetPrevRoot())
+	brmd.SetSerializedPrivateMetadata([]byte{0x2})
+	rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.Equal(t, kbfsmd.ServerErrorConflictRevision{
+		Desc:     "revision 5 is already stored with different contents",
+		Expected: 11,
+		Actual:   5,
+	}, err)
+
+	rmdsList, err := mdServer.GetRange(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, 5, 5, nil)
+	require.NoError(t, err)
+	require.Len(t, rmdsList, 1)
+	expectedID, err := kbfsmd.MakeID(config.Codec(), rmdses[4].MD)
+	require.NoError(t, err)
+	storedID, err := kbfsmd.MakeID(config.Codec(), rmdsList[0].MD)
+	require.NoError(t, err)
+	require.Equal(t, expectedID, storedID)
+}
+
+func TestMDServerMemoryPutIfHead(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	brmd := makeBRMDForTest(t, config.Codec(), id, h, 1, uid, kbfsmd.ID{})
+	rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+	rev1ID, err := kbfsmd.MakeID(config.Codec(), rmds.MD)
+	require.NoError(t, err)
+
+	// Two clients both fetch revision 1 and compute a successor.
+	makeSuccessor := func(prevRoot kbfsmd.ID, rev kbfsmd.Revision,
+		data byte) *RootMetadataSigned {
+		brmd := makeBRMDForTest(t, config.Codec(), id, h, rev, uid, prevRoot)
+		brmd.SetSerializedPrivateMetadata([]byte{data})
+		return signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	}
+	rmdsA := makeSuccessor(rev1ID, 2, 0xa)
+	rmdsB := makeSuccessor(rev1ID, 2, 0xb)
+
+	// A wins the race.
+	err = mdServer.PutIfHead(ctx, rmdsA, nil, nil, rev1ID)
+	require.NoError(t, err)
+	rev2ID, err := kbfsmd.MakeID(config.Codec(), rmdsA.MD)
+	require.NoError(t, err)
+
+	// B's assumption about the head is stale now.
+	err = mdServer.PutIfHead(ctx, rmdsB, nil, nil, rev1ID)
+	require.Equal(t, kbfsmd.ServerErrorConflictPrevRoot{
+		Expected: rev1ID,
+		Actual:   rev2ID,
+	}, err)
+
+	// Even a valid successor of the real head is rejected if the
+	// client expected a different head.
+	rmdsB = makeSuccessor(rev2ID, 3, 0xb)
+	err = mdServer.PutIfHead(ctx, rmdsB, nil, nil, rev1ID)
+	require.Equal(t, kbfsmd.ServerErrorConflictPrevRoot{
+		Expected: rev1ID,
+		Actual:   rev2ID,
+	}, err)
+
+	// Replaying A's put still succeeds.
+	err = mdServer.PutIfHead(ctx, rmdsA, nil, nil, rev1ID)
+	require.NoError(t, err)
+
+	// With the right expected head, B succeeds.
+	err = mdServer.PutIfHead(ctx, rmdsB, nil, nil, rev2ID)
+	require.NoError(t, err)
+	head, err := mdServer.GetForTLF(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+	require.Equal(t, kbfsmd.Revision(3), head.MD.RevisionNumber())
+	require.Equal(t, []byte{0xb}, head.MD.GetSerializedPrivateMetadata())
+}
+
+func TestMDServerMemoryVerifyGetRange(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	prevRoot := kbfsmd.ID{}
+	for i := kbfsmd.Revision(1); i <= 2; i++ {
+		brmd := makeBRMDForTest(t, config.Codec(), id, h, i, uid, prevRoot)
+		rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+		err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+		require.NoError(t, err)
+		prevRoot, err = kbfsmd.MakeID(config.Codec(), rmds.MD)
+		require.NoError(t, err)
+	}
+
+	mdServer.SetVerifyGetRange(true)
+	rmdses, err := mdServer.GetRange(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, 1, 2, nil)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 2)
+
+	// Tamper with the stored private data of revision 2, without
+	// re-signing it.
+	key := mdBlockKey{id, kbfsmd.NullBranchID}
+	orig := mdServer.mdDb[key]
+	block := orig.blocks[1]
+	rmds, err := DecodeRootMetadataSigned(
+		config.Codec(), id, block.version, config.MetadataVersion(),
+		block.encodedMd, block.timestamp)
+	require.NoError(t, err)
+	mutableMD, ok := rmds.MD.(kbfsmd.MutableRootMetadata)
+	require.True(t, ok)
+	mutableMD.SetSerializedPrivateMetadata([]byte{0xff})
+	encodedMd, err := kbfsmd.EncodeRootMetadataSigned(
+		config.Codec(), &rmds.RootMetadataSigned)
+	require.NoError(t, err)
+	badBlocks := append([]mdBlockMem(nil), orig.blocks...)
+	badBlocks[1] = mdBlockMem{
+		encodedMd, block.timestamp, block.version, block.header}
+	mdServer.mdDb[key] = mdBlockMemList{
+		initialRevision: orig.initialRevision,
+		blocks:          badBlocks,
+	}
+
+	_, err = mdServer.GetRange(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, 1, 2, nil)
+	require.IsType(t, MDMismatchError{}, err)
+	require.Equal(t, kbfsmd.Revision(2), err.(MDMismatchError).Revision)
+
+	// The untampered revision is still fine.
+	rmdses, err = mdServer.GetRange(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, 1, 1, nil)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 1)
+
+	// Without verification, the tampered revision is returned as is.
+	mdServer.SetVerifyGetRange(false)
+	rmdses, err = mdServer.GetRange(
+		ctx, id, kbfsmd.NullBranchID, kbfsmd.Merged, 1, 2, nil)
+	require.NoError(t, err)
+	require.Len(t, rmdses, 2)
+}
+
+// Make sure that a finalized TLF is still found by its original
+// handle, and by its finalized handle, instead of a new TLF being
+// created.
+func TestMDServerMemoryGetForHandleFinalized(t *testing.T) {
+	// setup
+	ctx := context.Background()
+	config := MakeTestConfigOrBust(t, "test_user")
+	defer config.Shutdown(ctx)
+	mdServer, err := NewMDServerMemory(mdServerLocalConfigAdapter{config})
+	require.NoError(t, err)
+	defer mdServer.Shutdown()
+
+	session, err := config.KBPKI().GetCurrentSession(ctx)
+	require.NoError(t, err)
+	uid := session.UID
+
+	h, err := tlf.MakeHandle(
+		[]keybase1.UserOrTeamID{uid.AsUserOrTeam()}, nil, nil, nil, nil)
+	require.NoError(t, err)
+	id, _, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+
+	brmd := makeBRMDForTest(t, config.Codec(), id, h, 1, uid, kbfsmd.ID{})
+	rmds := signRMDSForTest(t, config.Codec(), config.Crypto(), brmd)
+	err = mdServer.Put(ctx, rmds, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+
+	now := config.Clock().Now()
+	finalizedInfo, err := tlf.NewHandleExtension(
+		tlf.HandleExtensionFinalized, 1, libkb.NormalizedUsername("<unknown>"),
+		now)
+	require.NoError(t, err)
+	finalRMDS, err := rmds.MakeFinalCopy(config.Codec(), now, finalizedInfo)
+	require.NoError(t, err)
+	err = mdServer.Put(ctx, finalRMDS, nil, nil, keybase1.MDPriorityNormal)
+	require.NoError(t, err)
+
+	latestHandle, err := mdServer.GetLatestHandleForTLF(ctx, id)
+	require.NoError(t, err)
+	require.True(t, latestHandle.IsFinal())
+
+	// The original handle gets the finalized head.
+	gotID, head, err := mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+	require.Equal(t, id, gotID)
+	require.NotNil(t, head)
+	require.True(t, head.MD.IsFinal())
+	require.Equal(t, kbfsmd.Revision(2), head.MD.RevisionNumber())
+
+	// So does the finalized handle.
+	finalH := h
+	finalH.FinalizedInfo = finalizedInfo
+	gotID, head, err = mdServer.GetForHandle(ctx, finalH, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+	require.Equal(t, id, gotID)
+	require.NotNil(t, head)
+	require.True(t, head.MD.IsFinal())
+
+	// Even if the original handle has been forgotten, the finalized
+	// TLF is found rather than recreated.
+	hBytes, err := config.Codec().Encode(h)
+	require.NoError(t, err)
+	delete(mdServer.handleDb, mdHandleKey(hBytes))
+	gotID, head, err = mdServer.GetForHandle(ctx, h, kbfsmd.Merged, nil)
+	require.NoError(t, err)
+	require.Equal(t, id, gotID)
+	require.NotNil(t, head)
+	require.True(t, head.MD.IsFinal())
+}
@@ -12,6 +12,7 @@ import (
 	kbfsblock "github.com/keybase/kbfs/kbfsblock"
 	kbfscodec "github.com/keybase/kbfs/kbfscodec"
 	kbfscrypto "github.com/keybase/kbfs/kbfscrypto"
+	kbfshash "github.com/keybase/kbfs/kbfshash"
 	kbfsmd "github.com/keybase/kbfs/kbfsmd"
 	tlf "github.com/keybase/kbfs/tlf"
 	go_metrics "github.com/rcrowley/go-metrics"
@@ -1032,6 +1033,19 @@ func (mr *MockKBFSOpsMockRecorder) Read(ctx, file, dest, off interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Read", reflect.TypeOf((*MockKBFSOps)(nil).Read), ctx, file, dest, off)
 }
 
+// ReadWithCachePolicy mocks base method
+func (m *MockKBFSOps) ReadWithCachePolicy(ctx context.Context, file Node, dest []byte, off int64, policy BlockCachePolicy) (int64, error) {
+	ret := m.ctrl.Call(m, "ReadWithCachePolicy", ctx, file, dest, off, policy)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReadWithCachePolicy indicates an expected call of ReadWithCachePolicy
+func (mr *MockKBFSOpsMockRecorder) ReadWithCachePolicy(ctx, file, dest, off, policy interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReadWithCachePolicy", reflect.TypeOf((*MockKBFSOps)(nil).ReadWithCachePolicy), ctx, file, dest, off, policy)
+}
+
 // Write mocks base method
 func (m *MockKBFSOps) Write(ctx context.Context, file Node, data []byte, off int64) error {
 	ret := m.ctrl.Call(m, "Write", ctx, file, data, off)
@@ -1056,6 +1070,18 @@ func (mr *MockKBFSOpsMockRecorder) Truncate(ctx, file, size interface{}) *gomock
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Truncate", reflect.TypeOf((*MockKBFSOps)(nil).Truncate), ctx, file, size)
 }
 
+// PunchHole mocks base method
+func (m *MockKBFSOps) PunchHole(ctx context.Context, file Node, off, length int64) error {
+	ret := m.ctrl.Call(m, "PunchHole", ctx, file, off, length)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// PunchHole indicates an expected call of PunchHole
+func (mr *MockKBFSOpsMockRecorder) PunchHole(ctx, file, off, length interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PunchHole", reflect.TypeOf((*MockKBFSOps)(nil).PunchHole), ctx, file, off, length)
+}
+
 // SetEx mocks base method
 func (m *MockKBFSOps) SetEx(ctx context.Context, file Node, ex bool) error {
 	ret := m.ctrl.Call(m, "SetEx", ctx, file, ex)
@@ -1092,6 +1118,54 @@ func (mr *MockKBFSOpsMockRecorder) SyncAll(ctx, folderBranch interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SyncAll", reflect.TypeOf((*MockKBFSOps)(nil).SyncAll), ctx, folderBranch)
 }
 
+// FinalizeFile mocks base method
+func (m *MockKBFSOps) FinalizeFile(ctx context.Context, file Node) error {
+	ret := m.ctrl.Call(m, "FinalizeFile", ctx, file)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FinalizeFile indicates an expected call of FinalizeFile
+func (mr *MockKBFSOpsMockRecorder) FinalizeFile(ctx, file interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FinalizeFile", reflect.TypeOf((*MockKBFSOps)(nil).FinalizeFile), ctx, file)
+}
+
+// RegisterBlockManagerObserver mocks base method
+func (m *MockKBFSOps) RegisterBlockManagerObserver(ctx context.Context, folderBranch FolderBranch, obs BlockManagerObserver) error {
+	ret := m.ctrl.Call(m, "RegisterBlockManagerObserver", ctx, folderBranch, obs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RegisterBlockManagerObserver indicates an expected call of RegisterBlockManagerObserver
+func (mr *MockKBFSOpsMockRecorder) RegisterBlockManagerObserver(ctx, folderBranch, obs interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RegisterBlockManagerObserver", reflect.TypeOf((*MockKBFSOps)(nil).RegisterBlockManagerObserver), ctx, folderBranch, obs)
+}
+
+// UnregisterBlockManagerObserver mocks base method
+func (m *MockKBFSOps) UnregisterBlockManagerObserver(ctx context.Context, folderBranch FolderBranch, obs BlockManagerObserver) error {
+	ret := m.ctrl.Call(m, "UnregisterBlockManagerObserver", ctx, folderBranch, obs)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UnregisterBlockManagerObserver indicates an expected call of UnregisterBlockManagerObserver
+func (mr *MockKBFSOpsMockRecorder) UnregisterBlockManagerObserver(ctx, folderBranch, obs interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UnregisterBlockManagerObserver", reflect.TypeOf((*MockKBFSOps)(nil).UnregisterBlockManagerObserver), ctx, folderBranch, obs)
+}
+
+// SetFolderMaxFileBytes mocks base method
+func (m *MockKBFSOps) SetFolderMaxFileBytes(ctx context.Context, folderBranch FolderBranch, maxBytes uint64) error {
+	ret := m.ctrl.Call(m, "SetFolderMaxFileBytes", ctx, folderBranch, maxBytes)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetFolderMaxFileBytes indicates an expected call of SetFolderMaxFileBytes
+func (mr *MockKBFSOpsMockRecorder) SetFolderMaxFileBytes(ctx, folderBranch, maxBytes interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetFolderMaxFileBytes", reflect.TypeOf((*MockKBFSOps)(nil).SetFolderMaxFileBytes), ctx, folderBranch, maxBytes)
+}
+
 // FolderStatus mocks base method
 func (m *MockKBFSOps) FolderStatus(ctx context.Context, folderBranch FolderBranch) (FolderBranchStatus, <-chan StatusUpdate, error) {
 	ret := m.ctrl.Call(m, "FolderStatus", ctx, folderBranch)
@@ -1132,6 +1206,18 @@ func (mr *MockKBFSOpsMockRecorder) UnstageForTesting(ctx, folderBranch interface
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UnstageForTesting", reflect.TypeOf((*MockKBFSOps)(nil).UnstageForTesting), ctx, folderBranch)
 }
 
+// AbandonBranch mocks base method
+func (m *MockKBFSOps) AbandonBranch(ctx context.Context, folderBranch FolderBranch) error {
+	ret := m.ctrl.Call(m, "AbandonBranch", ctx, folderBranch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AbandonBranch indicates an expected call of AbandonBranch
+func (mr *MockKBFSOpsMockRecorder) AbandonBranch(ctx, folderBranch interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AbandonBranch", reflect.TypeOf((*MockKBFSOps)(nil).AbandonBranch), ctx, folderBranch)
+}
+
 // RequestRekey mocks base method
 func (m *MockKBFSOps) RequestRekey(ctx context.Context, id tlf.ID) {
 	m.ctrl.Call(m, "RequestRekey", ctx, id)
@@ -2851,6 +2937,72 @@ func (mr *MockBlockCacheSimpleMockRecorder) Put(ptr, tlf, block, lifetime interf
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Put", reflect.TypeOf((*MockBlockCacheSimple)(nil).Put), ptr, tlf, block, lifetime)
 }
 
+// MockBlockDedupIndex is a mock of BlockDedupIndex interface
+type MockBlockDedupIndex struct {
+	ctrl     *gomock.Controller
+	recorder *MockBlockDedupIndexMockRecorder
+}
+
+// MockBlockDedupIndexMockRecorder is the mock recorder for MockBlockDedupIndex
+type MockBlockDedupIndexMockRecorder struct {
+	mock *MockBlockDedupIndex
+}
+
+// NewMockBlockDedupIndex creates a new mock instance
+func NewMockBlockDedupIndex(ctrl *gomock.Controller) *MockBlockDedupIndex {
+	mock := &MockBlockDedupIndex{ctrl: ctrl}
+	mock.recorder = &MockBlockDedupIndexMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use
+func (m *MockBlockDedupIndex) EXPECT() *MockBlockDedupIndexMockRecorder {
+	return m.recorder
+}
+
+// Lookup mocks base method
+func (m *MockBlockDedupIndex) Lookup(tlf tlf.ID, contentHash kbfshash.RawDefaultHash) (BlockPointer, bool) {
+	ret := m.ctrl.Call(m, "Lookup", tlf, contentHash)
+	ret0, _ := ret[0].(BlockPointer)
+	ret1, _ := ret[1].(bool)
+	return ret0, ret1
+}
+
+// Lookup indicates an expected call of Lookup
+func (mr *MockBlockDedupIndexMockRecorder) Lookup(tlf, contentHash interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Lookup", reflect.TypeOf((*MockBlockDedupIndex)(nil).Lookup), tlf, contentHash)
+}
+
+// Record mocks base method
+func (m *MockBlockDedupIndex) Record(tlf tlf.ID, contentHash kbfshash.RawDefaultHash, ptr BlockPointer) {
+	m.ctrl.Call(m, "Record", tlf, contentHash, ptr)
+}
+
+// Record indicates an expected call of Record
+func (mr *MockBlockDedupIndexMockRecorder) Record(tlf, contentHash, ptr interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Record", reflect.TypeOf((*MockBlockDedupIndex)(nil).Record), tlf, contentHash, ptr)
+}
+
+// Forget mocks base method
+func (m *MockBlockDedupIndex) Forget(tlf tlf.ID, contentHash kbfshash.RawDefaultHash) {
+	m.ctrl.Call(m, "Forget", tlf, contentHash)
+}
+
+// Forget indicates an expected call of Forget
+func (mr *MockBlockDedupIndexMockRecorder) Forget(tlf, contentHash interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Forget", reflect.TypeOf((*MockBlockDedupIndex)(nil).Forget), tlf, contentHash)
+}
+
+// ForgetID mocks base method
+func (m *MockBlockDedupIndex) ForgetID(tlf tlf.ID, id kbfsblock.ID) {
+	m.ctrl.Call(m, "ForgetID", tlf, id)
+}
+
+// ForgetID indicates an expected call of ForgetID
+func (mr *MockBlockDedupIndexMockRecorder) ForgetID(tlf, id interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ForgetID", reflect.TypeOf((*MockBlockDedupIndex)(nil).ForgetID), tlf, id)
+}
+
 // MockBlockCache is a mock of BlockCache interface
 type MockBlockCache struct {
 	ctrl     *gomock.Controller
@@ -2912,6 +3064,19 @@ func (mr *MockBlockCacheMockRecorder) CheckForKnownPtr(tlf, block interface{}) *
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckForKnownPtr", reflect.TypeOf((*MockBlockCache)(nil).CheckForKnownPtr), tlf, block)
 }
 
+// CheckForKnownPtrs mocks base method
+func (m *MockBlockCache) CheckForKnownPtrs(tlf tlf.ID, blocks []*FileBlock) (map[*FileBlock]BlockPointer, error) {
+	ret := m.ctrl.Call(m, "CheckForKnownPtrs", tlf, blocks)
+	ret0, _ := ret[0].(map[*FileBlock]BlockPointer)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CheckForKnownPtrs indicates an expected call of CheckForKnownPtrs
+func (mr *MockBlockCacheMockRecorder) CheckForKnownPtrs(tlf, blocks interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckForKnownPtrs", reflect.TypeOf((*MockBlockCache)(nil).CheckForKnownPtrs), tlf, blocks)
+}
+
 // DeleteTransient mocks base method
 func (m *MockBlockCache) DeleteTransient(ptr BlockPointer, tlf tlf.ID) error {
 	ret := m.ctrl.Call(m, "DeleteTransient", ptr, tlf)
@@ -2948,6 +3113,40 @@ func (mr *MockBlockCacheMockRecorder) DeleteKnownPtr(tlf, block interface{}) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteKnownPtr", reflect.TypeOf((*MockBlockCache)(nil).DeleteKnownPtr), tlf, block)
 }
 
+// HasRoomForTransient mocks base method
+func (m *MockBlockCache) HasRoomForTransient(block Block) bool {
+	ret := m.ctrl.Call(m, "HasRoomForTransient", block)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// HasRoomForTransient indicates an expected call of HasRoomForTransient
+func (mr *MockBlockCacheMockRecorder) HasRoomForTransient(block interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HasRoomForTransient", reflect.TypeOf((*MockBlockCache)(nil).HasRoomForTransient), block)
+}
+
+// Pin mocks base method
+func (m *MockBlockCache) Pin(ptr BlockPointer) bool {
+	ret := m.ctrl.Call(m, "Pin", ptr)
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// Pin indicates an expected call of Pin
+func (mr *MockBlockCacheMockRecorder) Pin(ptr interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Pin", reflect.TypeOf((*MockBlockCache)(nil).Pin), ptr)
+}
+
+// Unpin mocks base method
+func (m *MockBlockCache) Unpin(ptr BlockPointer) {
+	m.ctrl.Call(m, "Unpin", ptr)
+}
+
+// Unpin indicates an expected call of Unpin
+func (mr *MockBlockCacheMockRecorder) Unpin(ptr interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unpin", reflect.TypeOf((*MockBlockCache)(nil).Unpin), ptr)
+}
+
 // GetWithPrefetch mocks base method
 func (m *MockBlockCache) GetWithPrefetch(ptr BlockPointer) (Block, PrefetchStatus, BlockCacheLifetime, error) {
 	ret := m.ctrl.Call(m, "GetWithPrefetch", ptr)
@@ -3146,6 +3345,18 @@ func (mr *MockDirtyBlockCacheMockRecorder) ShouldForceSync(tlfID interface{}) *g
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ShouldForceSync", reflect.TypeOf((*MockDirtyBlockCache)(nil).ShouldForceSync), tlfID)
 }
 
+// MaxUnsyncedBytes mocks base method
+func (m *MockDirtyBlockCache) MaxUnsyncedBytes(tlfID tlf.ID) int64 {
+	ret := m.ctrl.Call(m, "MaxUnsyncedBytes", tlfID)
+	ret0, _ := ret[0].(int64)
+	return ret0
+}
+
+// MaxUnsyncedBytes indicates an expected call of MaxUnsyncedBytes
+func (mr *MockDirtyBlockCacheMockRecorder) MaxUnsyncedBytes(tlfID interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MaxUnsyncedBytes", reflect.TypeOf((*MockDirtyBlockCache)(nil).MaxUnsyncedBytes), tlfID)
+}
+
 // Shutdown mocks base method
 func (m *MockDirtyBlockCache) Shutdown() error {
 	ret := m.ctrl.Call(m, "Shutdown")
@@ -3425,6 +3636,33 @@ func (mr *MockcryptoPureMockRecorder) DecryptBlock(encryptedBlock, key, block in
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DecryptBlock", reflect.TypeOf((*MockcryptoPure)(nil).DecryptBlock), encryptedBlock, key, block)
 }
 
+// EncryptEncodedBlock mocks base method
+func (m *MockcryptoPure) EncryptEncodedBlock(encodedBlock []byte, key kbfscrypto.BlockCryptKey) (int, kbfscrypto.EncryptedBlock, error) {
+	ret := m.ctrl.Call(m, "EncryptEncodedBlock", encodedBlock, key)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(kbfscrypto.EncryptedBlock)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// EncryptEncodedBlock indicates an expected call of EncryptEncodedBlock
+func (mr *MockcryptoPureMockRecorder) EncryptEncodedBlock(encodedBlock, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptEncodedBlock", reflect.TypeOf((*MockcryptoPure)(nil).EncryptEncodedBlock), encodedBlock, key)
+}
+
+// DecryptEncodedBlock mocks base method
+func (m *MockcryptoPure) DecryptEncodedBlock(encryptedBlock kbfscrypto.EncryptedBlock, key kbfscrypto.BlockCryptKey) ([]byte, error) {
+	ret := m.ctrl.Call(m, "DecryptEncodedBlock", encryptedBlock, key)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DecryptEncodedBlock indicates an expected call of DecryptEncodedBlock
+func (mr *MockcryptoPureMockRecorder) DecryptEncodedBlock(encryptedBlock, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DecryptEncodedBlock", reflect.TypeOf((*MockcryptoPure)(nil).DecryptEncodedBlock), encryptedBlock, key)
+}
+
 // MockCrypto is a mock of Crypto interface
 type MockCrypto struct {
 	ctrl     *gomock.Controller
@@ -3594,6 +3832,33 @@ func (mr *MockCryptoMockRecorder) DecryptBlock(encryptedBlock, key, block interf
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DecryptBlock", reflect.TypeOf((*MockCrypto)(nil).DecryptBlock), encryptedBlock, key, block)
 }
 
+// EncryptEncodedBlock mocks base method
+func (m *MockCrypto) EncryptEncodedBlock(encodedBlock []byte, key kbfscrypto.BlockCryptKey) (int, kbfscrypto.EncryptedBlock, error) {
+	ret := m.ctrl.Call(m, "EncryptEncodedBlock", encodedBlock, key)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(kbfscrypto.EncryptedBlock)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// EncryptEncodedBlock indicates an expected call of EncryptEncodedBlock
+func (mr *MockCryptoMockRecorder) EncryptEncodedBlock(encodedBlock, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptEncodedBlock", reflect.TypeOf((*MockCrypto)(nil).EncryptEncodedBlock), encodedBlock, key)
+}
+
+// DecryptEncodedBlock mocks base method
+func (m *MockCrypto) DecryptEncodedBlock(encryptedBlock kbfscrypto.EncryptedBlock, key kbfscrypto.BlockCryptKey) ([]byte, error) {
+	ret := m.ctrl.Call(m, "DecryptEncodedBlock", encryptedBlock, key)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DecryptEncodedBlock indicates an expected call of DecryptEncodedBlock
+func (mr *MockCryptoMockRecorder) DecryptEncodedBlock(encryptedBlock, key interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DecryptEncodedBlock", reflect.TypeOf((*MockCrypto)(nil).DecryptEncodedBlock), encryptedBlock, key)
+}
+
 // Sign mocks base method
 func (m *MockCrypto) Sign(arg0 context.Context, arg1 []byte) (kbfscrypto.SignatureInfo, error) {
 	ret := m.ctrl.Call(m, "Sign", arg0, arg1)
@@ -4020,6 +4285,18 @@ func (mr *MockBlockOpsMockRecorder) Get(ctx, kmd, blockPtr, block, cacheLifetime
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockBlockOps)(nil).Get), ctx, kmd, blockPtr, block, cacheLifetime)
 }
 
+// GetWithPriority mocks base method
+func (m *MockBlockOps) GetWithPriority(ctx context.Context, kmd KeyMetadata, blockPtr BlockPointer, block Block, cacheLifetime BlockCacheLifetime, priority int) error {
+	ret := m.ctrl.Call(m, "GetWithPriority", ctx, kmd, blockPtr, block, cacheLifetime, priority)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// GetWithPriority indicates an expected call of GetWithPriority
+func (mr *MockBlockOpsMockRecorder) GetWithPriority(ctx, kmd, blockPtr, block, cacheLifetime, priority interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWithPriority", reflect.TypeOf((*MockBlockOps)(nil).GetWithPriority), ctx, kmd, blockPtr, block, cacheLifetime, priority)
+}
+
 // GetEncodedSize mocks base method
 func (m *MockBlockOps) GetEncodedSize(ctx context.Context, kmd KeyMetadata, blockPtr BlockPointer) (uint32, error) {
 	ret := m.ctrl.Call(m, "GetEncodedSize", ctx, kmd, blockPtr)
@@ -4073,6 +4350,16 @@ func (mr *MockBlockOpsMockRecorder) Archive(ctx, tlfID, ptrs interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Archive", reflect.TypeOf((*MockBlockOps)(nil).Archive), ctx, tlfID, ptrs)
 }
 
+// SetBlockCodec mocks base method
+func (m *MockBlockOps) SetBlockCodec(tlfID tlf.ID, codec BlockCodec) {
+	m.ctrl.Call(m, "SetBlockCodec", tlfID, codec)
+}
+
+// SetBlockCodec indicates an expected call of SetBlockCodec
+func (mr *MockBlockOpsMockRecorder) SetBlockCodec(tlfID, codec interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBlockCodec", reflect.TypeOf((*MockBlockOps)(nil).SetBlockCodec), tlfID, codec)
+}
+
 // TogglePrefetcher mocks base method
 func (m *MockBlockOps) TogglePrefetcher(enable bool) <-chan struct{} {
 	ret := m.ctrl.Call(m, "TogglePrefetcher", enable)
@@ -4713,6 +5000,19 @@ func (mr *MockmdServerLocalMockRecorder) getCurrentMergedHeadRevision(ctx, id in
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "getCurrentMergedHeadRevision", reflect.TypeOf((*MockmdServerLocal)(nil).getCurrentMergedHeadRevision), ctx, id)
 }
 
+// registerForUpdateOrRekey mocks base method
+func (m *MockmdServerLocal) registerForUpdateOrRekey(ctx context.Context, id tlf.ID, currHead kbfsmd.Revision) (<-chan mdServerLocalUpdate, error) {
+	ret := m.ctrl.Call(m, "registerForUpdateOrRekey", ctx, id, currHead)
+	ret0, _ := ret[0].(<-chan mdServerLocalUpdate)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// registerForUpdateOrRekey indicates an expected call of registerForUpdateOrRekey
+func (mr *MockmdServerLocalMockRecorder) registerForUpdateOrRekey(ctx, id, currHead interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "registerForUpdateOrRekey", reflect.TypeOf((*MockmdServerLocal)(nil).registerForUpdateOrRekey), ctx, id, currHead)
+}
+
 // isShutdown mocks base method
 func (m *MockmdServerLocal) isShutdown() bool {
 	ret := m.ctrl.Call(m, "isShutdown")
@@ -5111,6 +5411,18 @@ func (mr *MockBlockSplitterMockRecorder) CheckSplit(block interface{}) *gomock.C
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CheckSplit", reflect.TypeOf((*MockBlockSplitter)(nil).CheckSplit), block)
 }
 
+// MaxSize mocks base method
+func (m *MockBlockSplitter) MaxSize() int64 {
+	ret := m.ctrl.Call(m, "MaxSize")
+	ret0, _ := ret[0].(int64)
+	return ret0
+}
+
+// MaxSize indicates an expected call of MaxSize
+func (mr *MockBlockSplitterMockRecorder) MaxSize() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MaxSize", reflect.TypeOf((*MockBlockSplitter)(nil).MaxSize))
+}
+
 // MaxPtrsPerBlock mocks base method
 func (m *MockBlockSplitter) MaxPtrsPerBlock() int {
 	ret := m.ctrl.Call(m, "MaxPtrsPerBlock")
@@ -6243,6 +6555,18 @@ func (mr *MockConfigMockRecorder) MaxNameBytes() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MaxNameBytes", reflect.TypeOf((*MockConfig)(nil).MaxNameBytes))
 }
 
+// MaxFileBytes mocks base method
+func (m *MockConfig) MaxFileBytes() uint64 {
+	ret := m.ctrl.Call(m, "MaxFileBytes")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+// MaxFileBytes indicates an expected call of MaxFileBytes
+func (mr *MockConfigMockRecorder) MaxFileBytes() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MaxFileBytes", reflect.TypeOf((*MockConfig)(nil).MaxFileBytes))
+}
+
 // MaxDirBytes mocks base method
 func (m *MockConfig) MaxDirBytes() uint64 {
 	ret := m.ctrl.Call(m, "MaxDirBytes")
@@ -6467,6 +6791,28 @@ func (mr *MockConfigMockRecorder) SetBGFlushDirOpBatchSize(s interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBGFlushDirOpBatchSize", reflect.TypeOf((*MockConfig)(nil).SetBGFlushDirOpBatchSize), s)
 }
 
+// BlockDedupIndex mocks base method
+func (m *MockConfig) BlockDedupIndex() BlockDedupIndex {
+	ret := m.ctrl.Call(m, "BlockDedupIndex")
+	ret0, _ := ret[0].(BlockDedupIndex)
+	return ret0
+}
+
+// BlockDedupIndex indicates an expected call of BlockDedupIndex
+func (mr *MockConfigMockRecorder) BlockDedupIndex() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BlockDedupIndex", reflect.TypeOf((*MockConfig)(nil).BlockDedupIndex))
+}
+
+// SetBlockDedupIndex mocks base method
+func (m *MockConfig) SetBlockDedupIndex(index BlockDedupIndex) {
+	m.ctrl.Call(m, "SetBlockDedupIndex", index)
+}
+
+// SetBlockDedupIndex indicates an expected call of SetBlockDedupIndex
+func (mr *MockConfigMockRecorder) SetBlockDedupIndex(index interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBlockDedupIndex", reflect.TypeOf((*MockConfig)(nil).SetBlockDedupIndex), index)
+}
+
 // BGFlushPeriod mocks base method
 func (m *MockConfig) BGFlushPeriod() time.Duration {
 	ret := m.ctrl.Call(m, "BGFlushPeriod")
@@ -6489,6 +6835,30 @@ func (mr *MockConfigMockRecorder) SetBGFlushPeriod(p interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetBGFlushPeriod", reflect.TypeOf((*MockConfig)(nil).SetBGFlushPeriod), p)
 }
 
+// Tunables mocks base method
+func (m *MockConfig) Tunables() Tunables {
+	ret := m.ctrl.Call(m, "Tunables")
+	ret0, _ := ret[0].(Tunables)
+	return ret0
+}
+
+// Tunables indicates an expected call of Tunables
+func (mr *MockConfigMockRecorder) Tunables() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Tunables", reflect.TypeOf((*MockConfig)(nil).Tunables))
+}
+
+// SetTunables mocks base method
+func (m *MockConfig) SetTunables(t Tunables) error {
+	ret := m.ctrl.Call(m, "SetTunables", t)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetTunables indicates an expected call of SetTunables
+func (mr *MockConfigMockRecorder) SetTunables(t interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetTunables", reflect.TypeOf((*MockConfig)(nil).SetTunables), t)
+}
+
 // Shutdown mocks base method
 func (m *MockConfig) Shutdown(arg0 context.Context) error {
 	ret := m.ctrl.Call(m, "Shutdown", arg0)
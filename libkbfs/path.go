@@ -80,19 +80,35 @@ type path struct {
 }
 
 // isValid() returns true if the path has at least one node (for the
-// root).
+// root), and all of its nodes have valid block pointers.
 func (p path) isValid() bool {
+	return p.checkValid() == nil
+}
+
+// checkValid returns an InvalidPathError if the path has no nodes,
+// or if any of its nodes (not just the tail) has an invalid block
+// pointer, identifying the first such node.
+func (p path) checkValid() error {
 	if len(p.path) < 1 {
-		return false
+		return InvalidPathError{p, -1}
 	}
 
-	for _, n := range p.path {
+	for i, n := range p.path {
 		if !n.isValid() {
-			return false
+			return InvalidPathError{p, i}
 		}
 	}
 
-	return true
+	return nil
+}
+
+// assertValid panics if the path isn't valid.  Helpers whose callers
+// must have already checked the path with checkValid use it instead
+// of returning an error.
+func (p path) assertValid() {
+	if err := p.checkValid(); err != nil {
+		panic(err)
+	}
 }
 
 // isValidForNotification() returns true if the path has at least one
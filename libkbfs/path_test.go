@@ -19,3 +19,22 @@ func TestBuildCanonicalPath(t *testing.T) {
 	assert.Equal(t, "/keybase/private/u3", BuildCanonicalPath(PrivatePathType, "u3", ""))
 	assert.Equal(t, "/keybase/hi.txt", BuildCanonicalPath(KeybasePathType, "hi.txt"))
 }
+
+func TestPathCheckValid(t *testing.T) {
+	root := pathNode{makeFakeBlockPointer(t), "root"}
+	dir := pathNode{makeFakeBlockPointer(t), "dir"}
+	file := pathNode{makeFakeBlockPointer(t), "file"}
+	p := path{path: []pathNode{root, dir, file}}
+	assert.NoError(t, p.checkValid())
+	assert.True(t, p.isValid())
+
+	err := path{}.checkValid()
+	assert.Equal(t, InvalidPathError{path{}, -1}, err)
+
+	p.path[1].BlockPointer = BlockPointer{}
+	err = p.checkValid()
+	assert.Equal(t, InvalidPathError{p, 1}, err)
+	assert.Contains(t, err.Error(), `node 1 ("dir")`)
+	assert.False(t, p.isValid())
+	assert.Panics(t, p.assertValid)
+}
@@ -127,6 +127,12 @@ func newBlockPrefetcher(retriever BlockRetriever,
 	return p
 }
 
+// isPrefetchRequest returns true if `ctx` belongs to a prefetch
+// issued by a blockPrefetcher, rather than to an on-demand request.
+func isPrefetchRequest(ctx context.Context) bool {
+	return ctx.Value(ctxPrefetchIDKey) != nil
+}
+
 func (p *blockPrefetcher) newPrefetch(count int, triggered bool,
 	req *prefetchRequest) *prefetch {
 	ctx, cancel := context.WithTimeout(p.ctx, prefetchTimeout)
@@ -291,7 +297,13 @@ func (p *blockPrefetcher) prefetchIndirectFileBlock(ctx context.Context,
 			p.recordPrefetchParent(ptr.BlockPointer.ID, parentBlockID)
 		numBlocks += n
 		if needNewFetch {
-			p.request(ctx, startingPriority-i, kmd,
+			nextOff := int64(-1)
+			if i+1 < len(b.IPtrs) {
+				nextOff = b.IPtrs[i+1].Off
+			}
+			groupCtx := withBlockRetrievalGroup(
+				ctx, parentBlockID, ptr.Off, nextOff)
+			p.request(groupCtx, startingPriority-i, kmd,
 				ptr.BlockPointer, b.NewEmpty(), lifetime)
 		}
 	}
@@ -60,6 +60,11 @@ func (sc *StateChecker) findAllBlocksInPath(ctx context.Context,
 		return err
 	}
 
+	// Count the child blocks of indirect dir blocks too.
+	for _, iptr := range dblock.assembledFrom {
+		blockSizes[iptr.BlockPointer] = iptr.EncodedSize
+	}
+
 	for name, de := range dblock.Children {
 		if de.Type == Sym {
 			continue
@@ -664,10 +664,19 @@ func ForceQuotaReclamationForTesting(config Config,
 
 // TestClock returns a set time as the current time.
 type TestClock struct {
-	l sync.Mutex
-	t time.Time
+	l      sync.Mutex
+	t      time.Time
+	timers []*testClockTimer
 }
 
+// testClockTimer is a pending timer started by TestClock.newTimer.
+type testClockTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+var _ timerClock = (*TestClock)(nil)
+
 func newTestClockNow() *TestClock {
 	return &TestClock{t: time.Now()}
 }
@@ -689,6 +698,7 @@ func (tc *TestClock) Set(t time.Time) {
 	tc.l.Lock()
 	defer tc.l.Unlock()
 	tc.t = t
+	tc.fireTimersLocked()
 }
 
 // Add adds to the test clock time.
@@ -696,6 +706,44 @@ func (tc *TestClock) Add(d time.Duration) {
 	tc.l.Lock()
 	defer tc.l.Unlock()
 	tc.t = tc.t.Add(d)
+	tc.fireTimersLocked()
+}
+
+// newTimer implements the timerClock interface for TestClock.  The
+// timer only fires once the test moves the clock past its deadline.
+func (tc *TestClock) newTimer(d time.Duration) (
+	c <-chan time.Time, stop func() bool) {
+	tc.l.Lock()
+	defer tc.l.Unlock()
+	timer := &testClockTimer{
+		deadline: tc.t.Add(d),
+		c:        make(chan time.Time, 1),
+	}
+	tc.timers = append(tc.timers, timer)
+	tc.fireTimersLocked()
+	return timer.c, func() bool {
+		tc.l.Lock()
+		defer tc.l.Unlock()
+		for i, t := range tc.timers {
+			if t == timer {
+				tc.timers = append(tc.timers[:i], tc.timers[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (tc *TestClock) fireTimersLocked() {
+	pending := tc.timers[:0]
+	for _, timer := range tc.timers {
+		if timer.deadline.After(tc.t) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.c <- tc.t
+	}
+	tc.timers = pending
 }
 
 // CheckConfigAndShutdown shuts down the given config, but fails the
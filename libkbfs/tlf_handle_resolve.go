@@ -324,6 +324,38 @@ func MakeTlfHandle(
 	return h, nil
 }
 
+// MakeTlfHandleFromUIDs creates a canonical TlfHandle for a private
+// or public folder with the given writer and reader UIDs, by
+// resolving each UID to its current username via the given KBPKI.
+// Unlike ParseTlfHandle, no assertion strings are involved, and no
+// identifies are done.
+func MakeTlfHandleFromUIDs(
+	ctx context.Context, kbpki KBPKI, idGetter tlfIDGetter,
+	writers, readers []keybase1.UID, public bool) (*TlfHandle, error) {
+	if len(writers) == 0 {
+		return nil, errors.New("folder must have at least one writer")
+	}
+
+	t := tlf.Private
+	if public {
+		t = tlf.Public
+	}
+
+	resolvableWriters := make([]resolvableUser, 0, len(writers))
+	for _, w := range writers {
+		resolvableWriters = append(
+			resolvableWriters, resolvableID{kbpki, w.AsUserOrTeam()})
+	}
+	resolvableReaders := make([]resolvableUser, 0, len(readers))
+	for _, r := range readers {
+		resolvableReaders = append(
+			resolvableReaders, resolvableID{kbpki, r.AsUserOrTeam()})
+	}
+
+	return makeTlfHandleHelper(
+		ctx, t, resolvableWriters, resolvableReaders, nil, idGetter)
+}
+
 type resolvableNameUIDPair nameIDPair
 
 func (rp resolvableNameUIDPair) resolve(ctx context.Context) (
@@ -607,6 +607,60 @@ func TestParseTlfHandleUIDAssertion(t *testing.T) {
 	assert.Equal(t, TlfNameNotCanonical{a, "u1"}, err)
 }
 
+func TestMakeTlfHandleFromUIDs(t *testing.T) {
+	ctx := context.Background()
+
+	localUsers := MakeLocalUsers([]libkb.NormalizedUsername{"u1", "u2", "u3"})
+	currentUID := localUsers[0].UID
+	daemon := NewKeybaseDaemonMemory(
+		currentUID, localUsers, nil, kbfscodec.NewMsgpack())
+
+	kbpki := &identifyCountingKBPKI{
+		KBPKI: &daemonKBPKI{
+			daemon: daemon,
+		},
+	}
+
+	u1 := localUsers[0].UID
+	u2 := localUsers[1].UID
+	u3 := localUsers[2].UID
+
+	// Out-of-order and duplicate UIDs still give the canonical handle.
+	h, err := MakeTlfHandleFromUIDs(
+		ctx, kbpki, nil, []keybase1.UID{u2, u1, u2}, []keybase1.UID{u3},
+		false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, kbpki.getIdentifyCalls())
+	parsedH, err := ParseTlfHandle(ctx, kbpki, nil, "u1,u2#u3", tlf.Private)
+	require.NoError(t, err)
+	assert.Equal(t, parsedH.GetCanonicalName(), h.GetCanonicalName())
+	assert.Equal(t, parsedH.ResolvedWriters(), h.ResolvedWriters())
+	assert.Equal(t, parsedH.ResolvedReaders(), h.ResolvedReaders())
+	assert.Equal(t, tlf.Private, h.Type())
+
+	// A reader who is also a writer is just a writer.
+	h, err = MakeTlfHandleFromUIDs(
+		ctx, kbpki, nil, []keybase1.UID{u1}, []keybase1.UID{u1}, false)
+	require.NoError(t, err)
+	assert.Equal(t, tlf.CanonicalName("u1"), h.GetCanonicalName())
+
+	h, err = MakeTlfHandleFromUIDs(
+		ctx, kbpki, nil, []keybase1.UID{u3, u1}, nil, true)
+	require.NoError(t, err)
+	parsedH, err = ParseTlfHandle(ctx, kbpki, nil, "u1,u3", tlf.Public)
+	require.NoError(t, err)
+	assert.Equal(t, parsedH.GetCanonicalName(), h.GetCanonicalName())
+	assert.Equal(t, tlf.Public, h.Type())
+
+	// Public folders can't have readers.
+	_, err = MakeTlfHandleFromUIDs(
+		ctx, kbpki, nil, []keybase1.UID{u1}, []keybase1.UID{u2}, true)
+	require.Error(t, err)
+
+	_, err = MakeTlfHandleFromUIDs(ctx, kbpki, nil, nil, nil, false)
+	require.Error(t, err)
+}
+
 func TestParseTlfHandleAndAssertion(t *testing.T) {
 	ctx := context.Background()
 
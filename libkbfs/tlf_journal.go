@@ -45,6 +45,7 @@ type tlfJournalConfig interface {
 	diskLimitTimeout() time.Duration
 	teamMembershipChecker() kbfsmd.TeamMembershipChecker
 	BGFlushDirOpBatchSize() int
+	Tunables() Tunables
 	tlfIDGetter() tlfIDGetter
 }
 
@@ -1105,7 +1106,7 @@ func (j *tlfJournal) flushBlockEntries(
 		defer convertCancel()
 		return flushBlockEntries(groupCtx, j.log, j.deferLog,
 			j.delegateBlockServer, j.config.BlockCache(), j.config.Reporter(),
-			j.tlfID, tlfName, entries)
+			j.tlfID, tlfName, entries, j.config.Tunables().MaxParallelBlockPuts)
 	})
 	converted = false
 	eg.Go(func() error {
@@ -160,6 +160,10 @@ func (c testTLFJournalConfig) BGFlushDirOpBatchSize() int {
 	return 1
 }
 
+func (c testTLFJournalConfig) Tunables() Tunables {
+	return DefaultTunables()
+}
+
 func (c testTLFJournalConfig) makeBlock(data []byte) (
 	kbfsblock.ID, kbfsblock.Context, kbfscrypto.BlockCryptKeyServerHalf) {
 	id, err := kbfsblock.MakePermanentID(data)
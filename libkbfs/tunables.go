@@ -0,0 +1,171 @@
+// Copyright 2026 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Tunables holds the numeric settings that tune how KBFS uses its
+// resources, like timeouts, size limits and worker counts.  They can
+// be changed at any time with Config.SetTunables; start from
+// DefaultTunables or Config.Tunables, since the zero value isn't
+// valid.
+type Tunables struct {
+	// QuotaReclamationTruncateLockTimeout is how long a single quota
+	// reclamation run keeps trying to get a folder's truncate lock
+	// before giving up until the next reclamation period.  Zero, the
+	// default, means it only tries once, so that reclamation never
+	// blocks on another device's lock.  It must not be negative.
+	QuotaReclamationTruncateLockTimeout time.Duration
+
+	// QuotaReclamationMinForcedInterval is the minimum time between
+	// the start of one quota reclamation and the start of a forced
+	// one, for each folder.  Forced reclamations requested within
+	// that window are coalesced into a single run.  Zero, the
+	// default, means forced reclamations run right away.  It must not
+	// be negative.
+	QuotaReclamationMinForcedInterval time.Duration
+
+	// QuotaReclamationMaxClockSkew is how far in the future an MD
+	// timestamp may be before quota reclamation stops trusting it,
+	// and treats that revision as not old enough to reclaim.  It
+	// must not be negative.
+	QuotaReclamationMaxClockSkew time.Duration
+
+	// ReservedOnDemandWorkerFraction is the fraction of the
+	// on-demand block retrieval workers that never work on prefetch
+	// requests, so that on-demand requests always have capacity.  It
+	// must be between 0 and 1.
+	ReservedOnDemandWorkerFraction float64
+
+	// MaxQueuedBlockRetrievals is the number of queued block
+	// retrievals at which new prefetch requests are rejected.  Zero
+	// means there's no limit.  It must not be negative.
+	MaxQueuedBlockRetrievals int
+
+	// MaxParallelBlockPuts is the maximum number of blocks (or chunks
+	// of block pointers being downgraded) that are sent to the block
+	// server in parallel.  It must be positive.
+	MaxParallelBlockPuts int
+
+	// TruncateExtendCutoff is the number of bytes by which a truncate
+	// must extend a file before the new space is left as a hole,
+	// rather than being filled in with zeroes.  It must not be
+	// negative.
+	TruncateExtendCutoff int64
+
+	// MinDowngradeWorkers is the number of workers that each quota
+	// reclamation archive or delete tries to spread its block
+	// pointers across, even if that means sending fewer pointers per
+	// call.  It must be positive, and no more than
+	// MaxParallelBlockPuts.
+	MinDowngradeWorkers int
+
+	// MaxFolderDirtyBytes is the number of unsynced bytes any single
+	// folder may have outstanding, on top of the global limit of the
+	// dirty block cache, so that one folder can't use up the cache's
+	// whole budget.  Zero, the default, lets each folder use a
+	// fraction of the dirty block cache's limit.  It must not be
+	// negative.
+	MaxFolderDirtyBytes int64
+
+	// MaxDirBlockBytes is the encoded size past which a directory
+	// block is split into an indirect dir block when it's synced.
+	// Zero, the default, turns splitting off, and any directory that
+	// was split is stored as a single block again on its next sync.
+	// It must not be negative.
+	MaxDirBlockBytes int
+
+	// MaxBlockPlaintextSize is the largest plaintext size of any file
+	// block that writes make, which should match the largest block
+	// the block server accepts.  Writes split blocks at that size no
+	// matter what the BlockSplitter decides.  Zero, the default, means
+	// the BlockSplitter's MaxSize is used.  It must not be negative.
+	MaxBlockPlaintextSize int64
+
+	// RecentlyArchivedWindow is how long a block pointer that was
+	// archived successfully is skipped by later archives of the same
+	// folder, e.g. for the overlapping unrefs of conflict resolution.
+	// Zero means pointers are never skipped.  It must not be
+	// negative.
+	RecentlyArchivedWindow time.Duration
+}
+
+// DefaultTunables returns the Tunables that a new Config starts out
+// with.
+func DefaultTunables() Tunables {
+	return Tunables{
+		QuotaReclamationMaxClockSkew:   qrMaxClockSkewDefault,
+		ReservedOnDemandWorkerFraction: 0.25,
+		MaxQueuedBlockRetrievals:       100000,
+		MaxParallelBlockPuts:           maxParallelBlockPuts,
+		TruncateExtendCutoff:           truncateExtendCutoffPoint,
+		MinDowngradeWorkers:            1,
+		RecentlyArchivedWindow:         10 * time.Minute,
+	}
+}
+
+// Validate returns an error if any of the settings in `t` is out of
+// range.
+func (t Tunables) Validate() error {
+	if t.QuotaReclamationTruncateLockTimeout < 0 {
+		return errors.Errorf("Invalid truncate lock timeout: %s",
+			t.QuotaReclamationTruncateLockTimeout)
+	}
+	if t.QuotaReclamationMinForcedInterval < 0 {
+		return errors.Errorf("Invalid min forced QR interval: %s",
+			t.QuotaReclamationMinForcedInterval)
+	}
+	if t.QuotaReclamationMaxClockSkew < 0 {
+		return errors.Errorf("Invalid QR max clock skew: %s",
+			t.QuotaReclamationMaxClockSkew)
+	}
+	if t.ReservedOnDemandWorkerFraction < 0 ||
+		t.ReservedOnDemandWorkerFraction > 1 {
+		return errors.Errorf("Invalid reserved on-demand worker fraction: %v",
+			t.ReservedOnDemandWorkerFraction)
+	}
+	if t.MaxQueuedBlockRetrievals < 0 {
+		return errors.Errorf("Invalid max queued block retrievals: %d",
+			t.MaxQueuedBlockRetrievals)
+	}
+	if t.MaxParallelBlockPuts < 1 {
+		return errors.Errorf("Invalid number of parallel block puts: %d",
+			t.MaxParallelBlockPuts)
+	}
+	if t.TruncateExtendCutoff < 0 {
+		return errors.Errorf("Invalid truncate extend cutoff: %d",
+			t.TruncateExtendCutoff)
+	}
+	if t.MinDowngradeWorkers < 1 {
+		return errors.Errorf("Invalid min downgrade workers: %d",
+			t.MinDowngradeWorkers)
+	}
+	if t.MinDowngradeWorkers > t.MaxParallelBlockPuts {
+		return errors.Errorf("Min downgrade workers %d exceeds the "+
+			"number of parallel block puts %d",
+			t.MinDowngradeWorkers, t.MaxParallelBlockPuts)
+	}
+	if t.MaxFolderDirtyBytes < 0 {
+		return errors.Errorf("Invalid max folder dirty bytes: %d",
+			t.MaxFolderDirtyBytes)
+	}
+	if t.MaxDirBlockBytes < 0 {
+		return errors.Errorf("Invalid max dir block bytes: %d",
+			t.MaxDirBlockBytes)
+	}
+	if t.MaxBlockPlaintextSize < 0 {
+		return errors.Errorf("Invalid max block plaintext size: %d",
+			t.MaxBlockPlaintextSize)
+	}
+	if t.RecentlyArchivedWindow < 0 {
+		return errors.Errorf("Invalid recently-archived window: %s",
+			t.RecentlyArchivedWindow)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2026 Keybase Inc. All rights reserved.
+// Use of this source code is governed by a BSD
+// license that can be found in the LICENSE file.
+
+package libkbfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestTunablesValidate checks that the default tunables are valid,
+// and that each setting is checked.
+func TestTunablesValidate(t *testing.T) {
+	require.NoError(t, DefaultTunables().Validate())
+
+	invalid := map[string]func(*Tunables){
+		"negative truncate lock timeout": func(t *Tunables) {
+			t.QuotaReclamationTruncateLockTimeout = -1
+		},
+		"negative min forced QR interval": func(t *Tunables) {
+			t.QuotaReclamationMinForcedInterval = -1
+		},
+		"negative QR max clock skew": func(t *Tunables) {
+			t.QuotaReclamationMaxClockSkew = -1
+		},
+		"negative reserved worker fraction": func(t *Tunables) {
+			t.ReservedOnDemandWorkerFraction = -0.1
+		},
+		"reserved worker fraction above 1": func(t *Tunables) {
+			t.ReservedOnDemandWorkerFraction = 1.1
+		},
+		"negative max queued retrievals": func(t *Tunables) {
+			t.MaxQueuedBlockRetrievals = -1
+		},
+		"zero parallel block puts": func(t *Tunables) {
+			t.MaxParallelBlockPuts = 0
+		},
+		"negative truncate extend cutoff": func(t *Tunables) {
+			t.TruncateExtendCutoff = -1
+		},
+		"zero min downgrade workers": func(t *Tunables) {
+			t.MinDowngradeWorkers = 0
+		},
+		"min downgrade workers above parallel block puts": func(t *Tunables) {
+			t.MinDowngradeWorkers = t.MaxParallelBlockPuts + 1
+		},
+		"negative max folder dirty bytes": func(t *Tunables) {
+			t.MaxFolderDirtyBytes = -1
+		},
+		"negative max dir block bytes": func(t *Tunables) {
+			t.MaxDirBlockBytes = -1
+		},
+		"negative max block plaintext size": func(t *Tunables) {
+			t.MaxBlockPlaintextSize = -1
+		},
+		"negative recently-archived window": func(t *Tunables) {
+			t.RecentlyArchivedWindow = -1
+		},
+	}
+	for name, f := range invalid {
+		tunables := DefaultTunables()
+		f(&tunables)
+		require.Error(t, tunables.Validate(), name)
+	}
+}
+
+// TestConfigLocalSetTunables checks that a ConfigLocal rejects
+// invalid tunables without changing the current ones.
+func TestConfigLocalSetTunables(t *testing.T) {
+	config := &ConfigLocal{tunables: DefaultTunables()}
+	tunables := config.Tunables()
+	tunables.QuotaReclamationTruncateLockTimeout = -1
+	require.Error(t, config.SetTunables(tunables))
+	require.Equal(t, DefaultTunables(), config.Tunables())
+
+	tunables.QuotaReclamationTruncateLockTimeout = 1
+	require.NoError(t, config.SetTunables(tunables))
+	require.Equal(t, tunables, config.Tunables())
+}
@@ -13,3 +13,27 @@ type wallClock struct {
 func (wc wallClock) Now() time.Time {
 	return time.Now()
 }
+
+// timerClock is an optional interface that a Clock can implement to
+// run timers off of its own time, rather than the wall clock's.
+type timerClock interface {
+	// newTimer returns a channel that receives the clock's time once
+	// `d` has passed according to the clock, and a function that
+	// stops the timer.  Like time.Timer.Stop, the stop function
+	// returns false if the timer already fired or was stopped.
+	newTimer(d time.Duration) (c <-chan time.Time, stop func() bool)
+}
+
+// newClockTimer starts a timer for `d` according to `clock`.  If
+// `clock` doesn't implement timerClock, a wall clock timer is used.
+func newClockTimer(clock Clock, d time.Duration) (
+	c <-chan time.Time, stop func() bool) {
+	if c, ok := clock.(*ClockWithSkew); ok {
+		clock = c.Clock
+	}
+	if tc, ok := clock.(timerClock); ok {
+		return tc.newTimer(d)
+	}
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}